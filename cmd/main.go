@@ -17,24 +17,55 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"cri-image-service/pkg/server"
 
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 const (
-	listen = "unix:///var/run/cri-image.sock"
+	defaultListen = "unix:///var/run/cri-image.sock"
+	// listenEnv overrides the default listen endpoint
+	listenEnv = "CRI_IMAGE_SOCKET"
 )
 
-func setupSocket(socketPath string) (net.Listener, func(), error) {
+// listenEndpoint returns the endpoint to listen on when no -listen flag is
+// given
+func listenEndpoint() string {
+	if endpoint := os.Getenv(listenEnv); endpoint != "" {
+		return endpoint
+	}
+	return defaultListen
+}
+
+// setupSocket listens on a unix:// or tcp:// endpoint, treating an endpoint
+// without a scheme as a unix socket path
+func setupSocket(endpoint string) (net.Listener, func(), error) {
+	if addr, ok := strings.CutPrefix(endpoint, "tcp://"); ok {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to listen: %v", err)
+		}
+		return listener, func() { listener.Close() }, nil
+	}
+	if scheme, _, ok := strings.Cut(endpoint, "://"); ok && scheme != "unix" {
+		return nil, nil, fmt.Errorf("unsupported endpoint scheme %q", scheme)
+	}
+	socketPath := strings.TrimPrefix(endpoint, "unix://")
+	if socketPath == "" {
+		return nil, nil, fmt.Errorf("empty socket path")
+	}
+
 	// Clean up existing socket file
 	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
 		return nil, nil, fmt.Errorf("failed to remove existing socket: %v", err)
@@ -57,36 +88,49 @@ func setupSocket(socketPath string) (net.Listener, func(), error) {
 	return listener, cleanup, nil
 }
 
+// newGRPCServer creates a gRPC server serving imageServer and its health
+func newGRPCServer(imageServer *server.ImageServer) *grpc.Server {
+	s := grpc.NewServer()
+
+	// Register image service
+	runtime.RegisterImageServiceServer(s, imageServer)
+
+	// Register health checks, which fail once shutdown begins
+	healthpb.RegisterHealthServer(s, server.NewHealthServer(imageServer))
+	return s
+}
+
 func main() {
-	// Remove unix socket prefix
-	endpoint := listen[7:]
+	listen := flag.String("listen", listenEndpoint(), "endpoint to serve on, unix:///path or tcp://host:port (env "+listenEnv+")")
+	flag.Parse()
 
 	// Setup socket and get cleanup function
-	listener, cleanup, err := setupSocket(endpoint)
+	listener, cleanup, err := setupSocket(*listen)
 	if err != nil {
 		log.Fatalf("Failed to setup socket: %v", err)
 	}
 	defer cleanup()
 
-	// Create gRPC server
-	s := grpc.NewServer()
-
-	// Register image service
 	imageServer := server.NewImageServer()
-	runtime.RegisterImageServiceServer(s, imageServer)
+	s := newGRPCServer(imageServer)
 
 	// Setup signal handling
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	// Start server
-	fmt.Printf("Starting CRI image service on %s\n", listen)
+	fmt.Printf("Starting CRI image service on %s\n", *listen)
 	go s.Serve(listener)
 
 	// Wait for interrupt
 	<-stop
 	fmt.Println("\nShutting down...")
 
+	// Abort in-flight pulls and flush state before draining RPCs
+	if err := imageServer.Close(); err != nil {
+		log.Printf("Failed to close image service: %v", err)
+	}
+
 	// Stop server
 	s.GracefulStop()
 	fmt.Println("Server stopped")
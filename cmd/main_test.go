@@ -0,0 +1,131 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cri-image-service/pkg/server"
+	"cri-image-service/pkg/service"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestSetupSocket(t *testing.T) {
+	// Unix socket paths are length limited, so avoid the long t.TempDir()
+	dir, err := os.MkdirTemp("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "image.sock")
+
+	tests := []struct {
+		name     string
+		endpoint string
+		network  string
+		wantErr  bool
+	}{
+		{name: "unix scheme", endpoint: "unix://" + socketPath, network: "unix"},
+		{name: "bare path", endpoint: socketPath, network: "unix"},
+		{name: "tcp", endpoint: "tcp://127.0.0.1:0", network: "tcp"},
+		{name: "unsupported scheme", endpoint: "http://127.0.0.1:0", wantErr: true},
+		{name: "empty unix path", endpoint: "unix://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, cleanup, err := setupSocket(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupSocket(%q) error = %v, wantErr %v", tt.endpoint, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			addr := listener.Addr()
+			if addr.Network() != tt.network {
+				t.Errorf("listener network = %s, want %s", addr.Network(), tt.network)
+			}
+			conn, err := net.Dial(addr.Network(), addr.String())
+			if err != nil {
+				t.Fatalf("failed to dial %s: %v", addr, err)
+			}
+			conn.Close()
+
+			cleanup()
+			if tt.network == "unix" {
+				if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+					t.Errorf("socket file left behind after cleanup: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestListenEndpoint(t *testing.T) {
+	t.Setenv(listenEnv, "")
+	if got := listenEndpoint(); got != defaultListen {
+		t.Errorf("listenEndpoint() = %q, want default %q", got, defaultListen)
+	}
+	t.Setenv(listenEnv, "tcp://127.0.0.1:9000")
+	if got := listenEndpoint(); got != "tcp://127.0.0.1:9000" {
+		t.Errorf("listenEndpoint() = %q, want the %s value", got, listenEnv)
+	}
+}
+
+func TestServeTCP(t *testing.T) {
+	config := service.DefaultConfig()
+	config.ImageRoot = t.TempDir()
+	imageServer := server.NewImageServerWithConfig(config)
+	defer imageServer.Close()
+
+	listener, cleanup, err := setupSocket("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("setupSocket() error = %v", err)
+	}
+	defer cleanup()
+
+	s := newGRPCServer(imageServer)
+	go s.Serve(listener)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", listener.Addr(), err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := runtime.NewImageServiceClient(conn)
+	_, err = client.ImageStatus(ctx, &runtime.ImageStatusRequest{
+		Image: &runtime.ImageSpec{Image: "docker.io/library/missing:latest"},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("ImageStatus() over tcp error = %v, want NotFound", err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"cri-image-service/pkg/service"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	status "google.golang.org/grpc/status"
+)
+
+const (
+	// imageServiceName is the name health checks use for the CRI image
+	// service
+	imageServiceName = "runtime.v1.ImageService"
+	// healthWatchInterval is how often Watch re-checks the serving status
+	healthWatchInterval = 5 * time.Second
+)
+
+// HealthServer implements the standard gRPC health service, reporting the
+// image service as SERVING while it is ready to handle requests
+type HealthServer struct {
+	healthpb.UnimplementedHealthServer
+	imageService *service.ImageService
+}
+
+// NewHealthServer returns a health server for the image service behind
+// imageServer
+func NewHealthServer(imageServer *ImageServer) *HealthServer {
+	return &HealthServer{imageService: imageServer.imageService}
+}
+
+// servingStatus returns the status of the named service, where an empty
+// name stands for the server as a whole
+func (s *HealthServer) servingStatus(name string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	if name != "" && name != imageServiceName {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, status.Errorf(codes.NotFound, "unknown service %q", name)
+	}
+	if s.imageService.Ready() != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING, nil
+	}
+	return healthpb.HealthCheckResponse_SERVING, nil
+}
+
+// Check implements the health check of a single service
+func (s *HealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	serving, err := s.servingStatus(req.GetService())
+	if err != nil {
+		return nil, err
+	}
+	return &healthpb.HealthCheckResponse{Status: serving}, nil
+}
+
+// Watch streams the status of a service, sending it once and then again
+// whenever it changes
+func (s *HealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		// Unknown services are reported rather than failing the stream
+		serving, _ := s.servingStatus(req.GetService())
+		if serving != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: serving}); err != nil {
+				return err
+			}
+			last = serving
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return status.Error(codes.Canceled, "stream has ended")
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	status "google.golang.org/grpc/status"
+)
+
+func TestHealthServer_Check(t *testing.T) {
+	s := newTestServer(t)
+	health := NewHealthServer(s)
+	ctx := context.Background()
+
+	for _, name := range []string{"", imageServiceName} {
+		resp, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: name})
+		if err != nil {
+			t.Fatalf("Check(%q) error = %v", name, err)
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Check(%q) = %v after startup, want SERVING", name, resp.GetStatus())
+		}
+	}
+
+	if _, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Check(unknown) error = %v, want code %v", err, codes.NotFound)
+	}
+
+	// Shutting down stops serving
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	resp, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Check() = %v after Close, want NOT_SERVING", resp.GetStatus())
+	}
+}
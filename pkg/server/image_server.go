@@ -18,10 +18,14 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"cri-image-service/pkg/service"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
@@ -38,6 +42,19 @@ func NewImageServer() *ImageServer {
 	}
 }
 
+// NewImageServerWithConfig creates an ImageServer backed by an image
+// service using config
+func NewImageServerWithConfig(config service.Config) *ImageServer {
+	return &ImageServer{
+		imageService: service.NewImageServiceWithConfig(config),
+	}
+}
+
+// Close shuts down the underlying image service
+func (s *ImageServer) Close() error {
+	return s.imageService.Close()
+}
+
 // PullImage implements image pulling
 func (s *ImageServer) PullImage(ctx context.Context, req *runtime.PullImageRequest) (*runtime.PullImageResponse, error) {
 	if req.GetImage() == nil {
@@ -51,7 +68,7 @@ func (s *ImageServer) PullImage(ctx context.Context, req *runtime.PullImageReque
 
 	imageID, err := s.imageService.PullImage(ctx, imageRef, req.GetAuth())
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to pull image: %v", err)
+		return nil, statusError(err, "failed to pull image")
 	}
 
 	return &runtime.PullImageResponse{
@@ -67,7 +84,7 @@ func (s *ImageServer) RemoveImage(ctx context.Context, req *runtime.RemoveImageR
 
 	err := s.imageService.RemoveImage(ctx, req.GetImage().GetImage())
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to remove image: %v", err)
+		return nil, statusError(err, "failed to remove image")
 	}
 
 	return &runtime.RemoveImageResponse{}, nil
@@ -81,12 +98,21 @@ func (s *ImageServer) ImageStatus(ctx context.Context, req *runtime.ImageStatusR
 
 	imgStatus, err := s.imageService.ImageStatus(ctx, req.GetImage().GetImage())
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get image status: %v", err)
+		return nil, statusError(err, "failed to get image status")
 	}
 
-	return &runtime.ImageStatusResponse{
+	resp := &runtime.ImageStatusResponse{
 		Image: imgStatus,
-	}, nil
+	}
+	if req.GetVerbose() {
+		info, err := s.imageService.ImageInfo(ctx, req.GetImage().GetImage())
+		if err != nil {
+			return nil, statusError(err, "failed to get image info")
+		}
+		resp.Info = info
+	}
+
+	return resp, nil
 }
 
 // ListImages implements listing all images
@@ -101,19 +127,81 @@ func (s *ImageServer) ListImages(ctx context.Context, req *runtime.ListImagesReq
 	}, nil
 }
 
-// ImageFsInfo implements retrieving filesystem information
+// ImageFsInfo implements retrieving filesystem information. Images and
+// container writable layers share the image root, so both report the same
+// usage.
 func (s *ImageServer) ImageFsInfo(ctx context.Context, req *runtime.ImageFsInfoRequest) (*runtime.ImageFsInfoResponse, error) {
-	// Return basic information about image storage
-	return &runtime.ImageFsInfoResponse{
-		ImageFilesystems: []*runtime.FilesystemUsage{
-			{
-				Timestamp: time.Now().UnixNano(),
-				FsId: &runtime.FilesystemIdentifier{
-					Mountpoint: s.imageService.GetImageRoot(),
-				},
-				UsedBytes:  &runtime.UInt64Value{Value: 0},
-				InodesUsed: &runtime.UInt64Value{Value: 0},
+	usedBytes, inodesUsed, err := s.imageService.FilesystemUsage()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get filesystem usage: %v", err)
+	}
+
+	timestamp := time.Now().UnixNano()
+	usage := func() *runtime.FilesystemUsage {
+		return &runtime.FilesystemUsage{
+			Timestamp: timestamp,
+			FsId: &runtime.FilesystemIdentifier{
+				Mountpoint: s.imageService.GetImageRoot(),
 			},
-		},
+			UsedBytes:  &runtime.UInt64Value{Value: usedBytes},
+			InodesUsed: &runtime.UInt64Value{Value: inodesUsed},
+		}
+	}
+
+	return &runtime.ImageFsInfoResponse{
+		ImageFilesystems:     []*runtime.FilesystemUsage{usage()},
+		ContainerFilesystems: []*runtime.FilesystemUsage{usage()},
 	}, nil
 }
+
+const (
+	// errorDomain is the domain of the ErrorInfo details of errors
+	errorDomain = "cri-image-service"
+	// layerFailureReason is the reason of the ErrorInfo detail attached to
+	// pulls that failed on a layer
+	layerFailureReason = "LAYER_PULL_FAILED"
+)
+
+// statusError converts a service error into a gRPC status error whose code
+// reflects the cause, prefixing its message with msg. Errors of a layer
+// carry an ErrorInfo detail naming the layer.
+func statusError(err error, msg string) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, service.ErrImageNotFound):
+		code = codes.NotFound
+	case errors.Is(err, service.ErrInvalidReference),
+		errors.Is(err, service.ErrManifestUnsupported):
+		code = codes.InvalidArgument
+	case errors.Is(err, service.ErrAuthRequired):
+		code = codes.Unauthenticated
+	case errors.Is(err, service.ErrAuthFailed):
+		code = codes.PermissionDenied
+	case errors.Is(err, service.ErrDigestMismatch):
+		code = codes.DataLoss
+	case errors.Is(err, service.ErrImageTooLarge):
+		code = codes.ResourceExhausted
+	case errors.Is(err, service.ErrReadOnly):
+		code = codes.FailedPrecondition
+	}
+	st := status.New(code, fmt.Sprintf("%s: %v", msg, err))
+
+	// Tell callers how far a pull got before a layer failed
+	var layerErr *service.LayerError
+	if errors.As(err, &layerErr) {
+		detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+			Reason: layerFailureReason,
+			Domain: errorDomain,
+			Metadata: map[string]string{
+				"layer_index":  strconv.Itoa(layerErr.Index),
+				"layer_count":  strconv.Itoa(layerErr.Count),
+				"layer_digest": layerErr.Digest,
+				"cause":        layerErr.Err.Error(),
+			},
+		})
+		if detailErr == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
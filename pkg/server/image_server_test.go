@@ -0,0 +1,201 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"cri-image-service/pkg/service"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// newTestServer creates an ImageServer storing images in a temporary
+// directory
+func newTestServer(t *testing.T) *ImageServer {
+	t.Helper()
+
+	config := service.DefaultConfig()
+	config.ImageRoot = t.TempDir()
+	s := NewImageServerWithConfig(config)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestImageServer_ImageFsInfo(t *testing.T) {
+	s := newTestServer(t)
+
+	resp, err := s.ImageFsInfo(context.Background(), &runtime.ImageFsInfoRequest{})
+	if err != nil {
+		t.Fatalf("ImageFsInfo() error = %v", err)
+	}
+
+	for name, filesystems := range map[string][]*runtime.FilesystemUsage{
+		"ImageFilesystems":     resp.GetImageFilesystems(),
+		"ContainerFilesystems": resp.GetContainerFilesystems(),
+	} {
+		if len(filesystems) != 1 {
+			t.Fatalf("%s has %d entries, want 1", name, len(filesystems))
+		}
+		fs := filesystems[0]
+		if fs.GetFsId().GetMountpoint() != s.imageService.GetImageRoot() {
+			t.Errorf("%s mountpoint = %q, want %q", name, fs.GetFsId().GetMountpoint(), s.imageService.GetImageRoot())
+		}
+		if fs.GetUsedBytes() == nil || fs.GetInodesUsed() == nil {
+			t.Errorf("%s is missing usage values", name)
+		}
+	}
+}
+
+func TestImageServer_ErrorCodes(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{
+			name: "pull with nil image",
+			call: func() error {
+				_, err := s.PullImage(ctx, &runtime.PullImageRequest{})
+				return err
+			},
+			want: codes.InvalidArgument,
+		},
+		{
+			name: "pull with invalid reference",
+			call: func() error {
+				_, err := s.PullImage(ctx, &runtime.PullImageRequest{
+					Image: &runtime.ImageSpec{Image: "Invalid::Reference"},
+				})
+				return err
+			},
+			want: codes.InvalidArgument,
+		},
+		{
+			name: "remove with nil image",
+			call: func() error {
+				_, err := s.RemoveImage(ctx, &runtime.RemoveImageRequest{})
+				return err
+			},
+			want: codes.InvalidArgument,
+		},
+		{
+			name: "status of missing image",
+			call: func() error {
+				_, err := s.ImageStatus(ctx, &runtime.ImageStatusRequest{
+					Image: &runtime.ImageSpec{Image: "missing:latest"},
+				})
+				return err
+			},
+			want: codes.NotFound,
+		},
+		{
+			name: "status with nil image",
+			call: func() error {
+				_, err := s.ImageStatus(ctx, &runtime.ImageStatusRequest{})
+				return err
+			},
+			want: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("status code = %v, want %v (error: %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{fmt.Errorf("pull: %w", service.ErrImageNotFound), codes.NotFound},
+		{fmt.Errorf("pull: %w", service.ErrInvalidReference), codes.InvalidArgument},
+		{fmt.Errorf("pull: %w", service.ErrManifestUnsupported), codes.InvalidArgument},
+		{fmt.Errorf("pull: %w", service.ErrAuthRequired), codes.Unauthenticated},
+		{fmt.Errorf("pull: %w", service.ErrAuthFailed), codes.PermissionDenied},
+		{fmt.Errorf("pull: %w", service.ErrDigestMismatch), codes.DataLoss},
+		{fmt.Errorf("pull: %w", service.ErrImageTooLarge), codes.ResourceExhausted},
+		{fmt.Errorf("pull: %w", service.ErrReadOnly), codes.FailedPrecondition},
+		{fmt.Errorf("pull: connection refused"), codes.Internal},
+	}
+
+	for _, tt := range tests {
+		if got := status.Code(statusError(tt.err, "failed")); got != tt.want {
+			t.Errorf("statusError(%v) code = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStatusError_LayerDetail(t *testing.T) {
+	layerErr := &service.LayerError{
+		Index:  2,
+		Count:  5,
+		Digest: "sha256:0123",
+		Err:    fmt.Errorf("blob %w", service.ErrDigestMismatch),
+	}
+	st := status.Convert(statusError(fmt.Errorf("pull: %w", layerErr), "failed to pull image"))
+
+	// The code still reflects the cause of the layer failure
+	if st.Code() != codes.DataLoss {
+		t.Errorf("status code = %v, want %v", st.Code(), codes.DataLoss)
+	}
+
+	var info *errdetails.ErrorInfo
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*errdetails.ErrorInfo); ok {
+			info = d
+		}
+	}
+	if info == nil {
+		t.Fatalf("status details = %v, want an ErrorInfo", st.Details())
+	}
+	if info.GetReason() != layerFailureReason || info.GetDomain() != errorDomain {
+		t.Errorf("ErrorInfo reason = %s in %s, want %s in %s", info.GetReason(), info.GetDomain(), layerFailureReason, errorDomain)
+	}
+	want := map[string]string{
+		"layer_index":  "2",
+		"layer_count":  "5",
+		"layer_digest": "sha256:0123",
+		"cause":        layerErr.Err.Error(),
+	}
+	if !reflect.DeepEqual(info.GetMetadata(), want) {
+		t.Errorf("ErrorInfo metadata = %v, want %v", info.GetMetadata(), want)
+	}
+
+	// Other errors carry no details
+	if details := status.Convert(statusError(service.ErrImageNotFound, "failed")).Details(); len(details) != 0 {
+		t.Errorf("details of a plain error = %v, want none", details)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// defaultBlobChunkConcurrency bounds the Range requests in flight per blob
+// when BlobChunkConcurrency is unset
+const defaultBlobChunkConcurrency = 4
+
+// parseContentRange parses a "bytes start-end/total" Content-Range header
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	span, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q: %v", header, err)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q: %v", header, err)
+	}
+	if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q: %v", header, err)
+	}
+	if start < 0 || end < start || end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	return start, end, total, nil
+}
+
+// readBlobChunks writes a blob whose first chunk is held by first to dst,
+// fetching the remaining chunks with concurrent Range requests and writing
+// each at its offset. The size the registry reports must match
+// expectedSize when known. It returns the size of the blob; the caller
+// verifies its digest.
+func (s *ImageService) readBlobChunks(ctx context.Context, url string, auth *runtime.AuthConfig, first *Blob, dst io.WriterAt, expectedSize int64) (int64, error) {
+	start, end, total, err := parseContentRange(first.ContentRange)
+	if err != nil {
+		return 0, err
+	}
+	if start != 0 {
+		return 0, fmt.Errorf("first chunk starts at byte %d", start)
+	}
+	if expectedSize > 0 && total != expectedSize {
+		return 0, fmt.Errorf("registry reported a size of %d bytes, expected %d", total, expectedSize)
+	}
+	if s.config.MaxImageSize > 0 && total > s.config.MaxImageSize {
+		return 0, fmt.Errorf("registry reported a size of %d bytes, exceeding the image size limit of %d bytes", total, s.config.MaxImageSize)
+	}
+
+	if err := copyChunk(dst, first.Body, 0, end+1); err != nil {
+		return 0, err
+	}
+
+	concurrency := s.config.BlobChunkConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultBlobChunkConcurrency
+	}
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	for offset := end + 1; offset < total; offset += s.config.BlobChunkSize {
+		last := min(offset+s.config.BlobChunkSize, total) - 1
+		group.Go(func() error {
+			return s.readBlobChunk(ctx, url, auth, dst, offset, last)
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// readBlobChunk writes the bytes offset to last of the blob at url to dst
+// at offset
+func (s *ImageService) readBlobChunk(ctx context.Context, url string, auth *runtime.AuthConfig, dst io.WriterAt, offset, last int64) error {
+	if err := s.waitForRegistry(ctx, url); err != nil {
+		return fmt.Errorf("failed to download chunk at byte %d: %v", offset, err)
+	}
+	blob, err := s.registryClient().GetBlob(ctx, url, auth, fmt.Sprintf("bytes=%d-%d", offset, last))
+	if err != nil {
+		return fmt.Errorf("failed to download chunk at byte %d: %v", offset, err)
+	}
+	defer blob.Body.Close()
+
+	if blob.ContentRange == "" {
+		return fmt.Errorf("failed to download chunk at byte %d: registry ignored the range", offset)
+	}
+	start, end, _, err := parseContentRange(blob.ContentRange)
+	if err != nil {
+		return err
+	}
+	if start != offset || end != last {
+		return fmt.Errorf("registry returned bytes %d-%d for chunk %d-%d", start, end, offset, last)
+	}
+	return copyChunk(dst, blob.Body, offset, last-offset+1)
+}
+
+// copyChunk writes exactly n bytes of body to dst at offset
+func copyChunk(dst io.WriterAt, body io.Reader, offset, n int64) error {
+	written, err := io.Copy(io.NewOffsetWriter(dst, offset), io.LimitReader(body, n))
+	if err == nil && written < n {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read chunk at byte %d: %v", offset, err)
+	}
+	return nil
+}
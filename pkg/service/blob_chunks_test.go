@@ -0,0 +1,205 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header            string
+		start, end, total int64
+		wantErr           bool
+	}{
+		{header: "bytes 0-99/1000", start: 0, end: 99, total: 1000},
+		{header: "bytes 900-999/1000", start: 900, end: 999, total: 1000},
+		{header: "bytes 0-99/*", wantErr: true},
+		{header: "bytes 100-99/1000", wantErr: true},
+		{header: "bytes 0-1000/1000", wantErr: true},
+		{header: "items 0-99/1000", wantErr: true},
+		{header: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		start, end, total, err := parseContentRange(tt.header)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseContentRange(%q) error = %v, wantErr %v", tt.header, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (start != tt.start || end != tt.end || total != tt.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, want %d, %d, %d",
+				tt.header, start, end, total, tt.start, tt.end, tt.total)
+		}
+	}
+}
+
+func TestImageService_ChunkedLayerDownload(t *testing.T) {
+	const chunkSize = 64 * 1024
+
+	// A large layer whose size is not a multiple of the chunk size
+	blob := make([]byte, 16*chunkSize+123)
+	rand.New(rand.NewSource(1)).Read(blob)
+
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/huge", "latest", "application/vnd.oci.image.layer.v1.tar", blob)
+	blobPath := "/v2/library/huge/blobs/" + digest.FromBytes(blob).String()
+
+	// Serve the layer with Range support
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != blobPath {
+			registry.serveHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	service.config.BlobChunkSize = chunkSize
+	service.config.BlobChunkConcurrency = 3
+	service.config.StagingDir = t.TempDir()
+
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/huge:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	layers, err := service.ImageLayers(imageRef)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	data, err := os.ReadFile(layers[0].Path)
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Error("assembled layer differs from the served blob")
+	}
+	if layers[0].UncompressedSize != int64(len(blob)) || layers[0].DiffID != digest.FromBytes(blob).String() {
+		t.Errorf("layer = %+v, want uncompressed size %d and diffID %s", layers[0], len(blob), digest.FromBytes(blob))
+	}
+
+	// The staged chunks were moved into the store
+	if entries, err := os.ReadDir(service.config.StagingDir); err != nil || len(entries) != 0 {
+		t.Errorf("staging directory holds %v (err %v), want it empty", entries, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := 17; len(ranges) != want {
+		t.Errorf("layer fetched in %d requests, want %d", len(ranges), want)
+	}
+	for _, r := range ranges {
+		if !strings.HasPrefix(r, "bytes=") {
+			t.Errorf("layer request without a range: %q", r)
+		}
+	}
+}
+
+func TestImageService_ChunkedLayerDownloadFallback(t *testing.T) {
+	layer := []byte("layer from a registry without range support")
+
+	// The test registry ignores Range headers and always sends whole blobs
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", layer)
+
+	service := newTestService(t, registry)
+	service.config.BlobChunkSize = 8
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if n := registry.hitCount("/v2/library/app/blobs/" + digest.FromBytes(layer).String()); n != 1 {
+		t.Errorf("layer fetched in %d requests, want a single stream", n)
+	}
+}
+
+func TestImageService_ChunkedLayerDownloadRejectsSize(t *testing.T) {
+	layer := []byte("layer served with a forged total size")
+
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", layer)
+	blobPath := "/v2/library/app/blobs/" + digest.FromBytes(layer).String()
+
+	tests := []struct {
+		name  string
+		total int64
+	}{
+		{"huge", 1 << 40},
+		{"short", int64(len(layer)) - 1},
+		{"long", int64(len(layer)) + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != blobPath {
+					registry.serveHTTP(w, r)
+					return
+				}
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-7/%d", tt.total))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(layer[:8])
+			}))
+			defer server.Close()
+
+			service := newTestService(t, nil)
+			service.client = server.Client()
+			service.config.BlobChunkSize = 8
+
+			imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+			if _, err := service.PullImage(context.Background(), imageRef, nil); err == nil {
+				t.Fatal("PullImage() succeeded with a forged blob size")
+			}
+			// The size is checked before any further chunk is requested
+			if n := requests.Load(); n != 1 {
+				t.Errorf("layer fetched in %d requests, want 1", n)
+			}
+
+			// Nothing is left behind in the blob store
+			blobs, _ := filepath.Glob(filepath.Join(service.imageRoot, "blobs", "sha256", "*"))
+			if len(blobs) != 0 {
+				t.Errorf("files left in the blob store: %v", blobs)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Version is the version of the service, set at build time with
+// -ldflags "-X cri-image-service/pkg/service.Version=<version>"
+var Version = "dev"
+
+// defaultUserAgent identifies the service to registries
+func defaultUserAgent() string {
+	return "cri-image-service/" + Version
+}
+
+// LayerOrder controls the order in which the layers of an image are fetched
+type LayerOrder int
+
+const (
+	// LayerOrderManifest fetches layers in manifest order
+	LayerOrderManifest LayerOrder = iota
+	// LayerOrderSmallestFirst fetches small layers first for quick wins
+	LayerOrderSmallestFirst
+	// LayerOrderLargestFirst starts the longest download as early as possible
+	LayerOrderLargestFirst
+)
+
+// Config holds the tunable settings of the image service
+type Config struct {
+	// ImageRoot is where images, layers and metadata are stored
+	ImageRoot string
+	// ReadOnly serves the images already in ImageRoot without modifying
+	// it: pulls, removals and imports fail with ErrReadOnly, the garbage
+	// collector does not run and metadata is never written
+	ReadOnly bool
+	// StagingDir holds downloads and imports until they are verified and
+	// moved into ImageRoot. It may be on another filesystem, in which case
+	// verified files are copied into place. When empty, files are staged
+	// next to their destination.
+	StagingDir string
+	// MaxCacheSize bounds the total size of cached layers in bytes
+	MaxCacheSize int64
+	// EvictionPolicy selects which cached layers are evicted first
+	EvictionPolicy EvictionPolicy
+	// CacheAdmissionFraction keeps layers larger than this fraction of
+	// MaxCacheSize, such as 0.25, out of the layer cache. Their blobs are
+	// still stored and reused. Zero admits every layer that fits.
+	CacheAdmissionFraction float64
+	// DiskPressureThreshold is the free space in bytes below which the
+	// layer cache shrinks until space is available again. Zero disables
+	// the check.
+	DiskPressureThreshold uint64
+	// DiskPressureInterval is how often free space is checked
+	DiskPressureInterval time.Duration
+	// MaxImageSize bounds the size of the layers of a single image.
+	// Pulls of larger images are aborted. Zero disables the limit.
+	MaxImageSize int64
+	// MaxLayers bounds the number of layers a single image may declare, so
+	// that a crafted manifest cannot exhaust inodes and file handles. Zero
+	// disables the limit.
+	MaxLayers int
+	// MetadataFlushInterval batches metadata writes, which are otherwise
+	// made on every change, flushing changed metadata at this interval,
+	// on SyncMetadata and on Close. Zero writes on every change.
+	MetadataFlushInterval time.Duration
+	// GCInterval is how often unreferenced layers are collected
+	GCInterval time.Duration
+	// LayerOrder is the order in which layer downloads are dispatched
+	LayerOrder LayerOrder
+	// AllowSchema1 pulls images that registries only serve as deprecated
+	// Docker schema 1 manifests. Their layers are pulled like those of
+	// schema 2 images and their config is taken from the v1 compatibility
+	// history of the top layer.
+	AllowSchema1 bool
+	// LazyExtract keeps pulled layers compressed and extracts an image
+	// only on its first UnpackImage, caching the root filesystem by the
+	// chain of layer diffIDs so that later unpacks copy it instead of
+	// decompressing every layer again. GC reclaims cached root
+	// filesystems once no image uses them.
+	LazyExtract bool
+	// VerifyReusedLayers re-checks the digest of a stored layer before
+	// another image reuses it, downloading the layer again on mismatch
+	VerifyReusedLayers bool
+	// MaxConcurrentPulls bounds the pulls downloading at once across all
+	// callers. Further pulls wait for a slot until their context ends;
+	// pulls of images already present never wait. Zero disables the limit.
+	MaxConcurrentPulls int
+	// PrefetchConcurrency bounds the background pulls started by
+	// PrefetchImages that run at once. Values below one allow a single pull.
+	PrefetchConcurrency int
+	// MaxManifestSize bounds the manifests and image configs read from
+	// registries in bytes, so that a misbehaving registry cannot exhaust
+	// memory. Zero applies a 4 MiB limit.
+	MaxManifestSize int64
+	// RequestTimeout bounds each individual registry request, independent
+	// of the overall pull deadline. Layer downloads, which may take longer,
+	// are aborted once no data arrives for this long instead. Zero disables
+	// the per-request timeout.
+	RequestTimeout time.Duration
+	// MaxImageAge is how long an image that is not pinned may go unused
+	// before GC removes it. Zero disables age-based removal.
+	MaxImageAge time.Duration
+	// AbandonedPullTimeout is how long a partially pulled image may stay
+	// in the store before GC reclaims it. Zero disables the cleanup.
+	AbandonedPullTimeout time.Duration
+	// DefaultRegistry is the registry (host[:port]) that references without
+	// one, such as "myapp:latest", are pulled from. When empty they resolve
+	// to docker.io.
+	DefaultRegistry string
+	// UserAgent is sent with every registry request. When empty it is
+	// cri-image-service/<version>.
+	UserAgent string
+	// InsecureRegistries lists registries (host[:port]) reached over plain
+	// HTTP instead of HTTPS
+	InsecureRegistries []string
+	// Mirrors maps a registry host to mirror endpoints (host[:port] or
+	// base URL) tried in order before falling back to the registry itself
+	Mirrors map[string][]string
+	// TLSCAFile is a PEM bundle of CA certificates trusted for registries
+	// in addition to the system roots
+	TLSCAFile string
+	// TLSCAData is like TLSCAFile with the PEM bundle given inline
+	TLSCAData []byte
+	// TLSClientCertFile and TLSClientKeyFile hold the PEM certificate and
+	// key presented to registries that require client certificates
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+	// InsecureSkipVerify disables verification of registry certificates.
+	// It should only be used for testing.
+	InsecureSkipVerify bool
+	// ProxyURL is the HTTP proxy used to reach registries, overriding the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	ProxyURL string
+	// BlobChunkSize splits layer downloads into Range requests of this many
+	// bytes fetched concurrently, falling back to a single stream when the
+	// registry does not support ranges. Zero disables chunking.
+	BlobChunkSize int64
+	// BlobChunkConcurrency bounds the chunk requests in flight per layer
+	BlobChunkConcurrency int
+	// RegistryClient performs the registry requests of the service. When
+	// nil, registries are reached over HTTP with the proxy and DNS cache
+	// settings.
+	RegistryClient RegistryClient
+	// DNSCacheTTL enables an in-process cache of registry host resolutions
+	// kept for the given duration. Zero disables the cache.
+	DNSCacheTTL time.Duration
+	// RegistryRateLimit caps manifest and blob requests per registry host
+	// in requests per second. Zero disables rate limiting.
+	RegistryRateLimit float64
+	// RegistryRateBurst is the number of requests a registry host may
+	// receive at once before RegistryRateLimit applies
+	RegistryRateBurst int
+	// NegativeCacheTTL is how long a reference the registry reported as
+	// missing fails to pull without asking the registry again. Zero
+	// disables the cache.
+	NegativeCacheTTL time.Duration
+	// SignaturePublicKey is a PEM encoded ECDSA public key. When set, a
+	// cosign signature published for a pulled image must verify against it.
+	SignaturePublicKey []byte
+	// RequireSignature additionally fails pulls of images that have no
+	// cosign signature
+	RequireSignature bool
+	// Logger receives the structured logs of the service. When nil, JSON
+	// logs are written to stderr.
+	Logger *slog.Logger
+}
+
+// DefaultConfig returns the configuration used by NewImageService
+func DefaultConfig() Config {
+	return Config{
+		ImageRoot:            "/var/lib/image-service",
+		MaxCacheSize:         10 * 1024 * 1024 * 1024,
+		EvictionPolicy:       EvictionLRU,
+		DiskPressureInterval: 1 * time.Minute,
+		GCInterval:           1 * time.Hour,
+		LayerOrder:           LayerOrderManifest,
+		PrefetchConcurrency:  2,
+		MaxManifestSize:      defaultMaxManifestSize,
+		MaxLayers:            512,
+		RequestTimeout:       30 * time.Second,
+		AbandonedPullTimeout: 1 * time.Hour,
+		RegistryRateLimit:    5,
+		RegistryRateBurst:    10,
+		NegativeCacheTTL:     30 * time.Second,
+		UserAgent:            defaultUserAgent(),
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// RuntimeConfig holds the settings that can be changed on a running service
+type RuntimeConfig struct {
+	// MaxCacheSize is the new layer cache limit in bytes. Zero disables
+	// the limit.
+	MaxCacheSize int64
+	// GCInterval is the new interval between garbage collections
+	GCInterval time.Duration
+}
+
+// UpdateConfig applies update to the running service without a restart.
+// Shrinking the layer cache evicts layers immediately and a new garbage
+// collection interval takes effect from now on, keeping the collected
+// statistics.
+func (s *ImageService) UpdateConfig(update RuntimeConfig) error {
+	if update.MaxCacheSize < 0 {
+		return fmt.Errorf("invalid cache size %d", update.MaxCacheSize)
+	}
+	if update.GCInterval <= 0 {
+		return fmt.Errorf("invalid garbage collection interval %v", update.GCInterval)
+	}
+
+	if s.gc != nil {
+		if err := s.gc.SetInterval(update.GCInterval); err != nil {
+			return err
+		}
+	}
+	s.layerCache.SetMaxSize(update.MaxCacheSize)
+
+	s.log().Info("configuration updated",
+		"max_cache_size", update.MaxCacheSize,
+		"gc_interval", update.GCInterval)
+	return nil
+}
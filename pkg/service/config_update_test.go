@@ -0,0 +1,113 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImageService_UpdateConfigShrinksCache(t *testing.T) {
+	service := newTestService(t, nil)
+	service.layerCache = NewLayerCache(300)
+	service.layerCache.releaseEvicted = service.removeEvictedBlobs
+
+	// Three 100 byte layers, the first one least recently used
+	var paths []string
+	for i := 0; i < 3; i++ {
+		digest := fmt.Sprintf("layer%d", i)
+		path := filepath.Join(service.imageRoot, digest)
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatalf("Failed to write layer: %v", err)
+		}
+		service.layerCache.Add(digest, LayerMetadata{Digest: digest, Path: path, Size: 100})
+		paths = append(paths, path)
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := service.UpdateConfig(RuntimeConfig{MaxCacheSize: 150, GCInterval: time.Hour}); err != nil {
+		t.Fatalf("UpdateConfig() error = %v", err)
+	}
+
+	// Eviction happens within UpdateConfig, without waiting for an Add
+	if _, size := service.layerCache.snapshot(); size != 100 {
+		t.Errorf("cache size = %d after shrinking, want 100", size)
+	}
+	for i, path := range paths {
+		_, err := os.Stat(path)
+		if evicted := os.IsNotExist(err); evicted != (i < 2) {
+			t.Errorf("layer%d evicted = %v, want %v", i, evicted, i < 2)
+		}
+	}
+
+	// Layers beyond the new limit are not cached any more
+	service.layerCache.Add("large", LayerMetadata{Digest: "large", Size: 200})
+	if _, ok := service.layerCache.Get("large"); ok {
+		t.Error("layer larger than the new limit was cached")
+	}
+}
+
+func TestImageService_UpdateConfigGCInterval(t *testing.T) {
+	service := newTestService(t, nil)
+	service.gc = NewGarbageCollector(service, time.Hour)
+	service.gc.Start()
+	defer service.gc.Stop()
+
+	if err := service.gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+
+	if err := service.UpdateConfig(RuntimeConfig{MaxCacheSize: 1024, GCInterval: 20 * time.Millisecond}); err != nil {
+		t.Fatalf("UpdateConfig() error = %v", err)
+	}
+
+	// Collections run at the new interval, adding to the earlier stats
+	waitForCollections(t, service.gc, 3)
+}
+
+func TestImageService_UpdateConfigInvalid(t *testing.T) {
+	service := newTestService(t, nil)
+	service.layerCache = NewLayerCache(300)
+
+	tests := []struct {
+		name   string
+		update RuntimeConfig
+	}{
+		{
+			name:   "negative cache size",
+			update: RuntimeConfig{MaxCacheSize: -1, GCInterval: time.Hour},
+		},
+		{
+			name:   "zero interval",
+			update: RuntimeConfig{MaxCacheSize: 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := service.UpdateConfig(tt.update); err == nil {
+				t.Error("UpdateConfig() should fail")
+			}
+			if service.layerCache.maxSize != 300 {
+				t.Errorf("cache limit = %d after a rejected update, want 300", service.layerCache.maxSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"syscall"
+	"time"
+)
+
+// diskFreeFunc reports the bytes available on the filesystem holding path
+type diskFreeFunc func(path string) (uint64, error)
+
+// statfsFree is the diskFreeFunc backed by statfs
+func statfsFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// checkDiskPressure compares the free space on the filesystem holding path
+// with minFree. Under pressure the effective cache size is halved and layers
+// are evicted to fit, releasing their blobs unless images still use them;
+// once pressure clears it doubles back up to the
+// configured size on each check.
+func (c *LayerCache) checkDiskPressure(path string, minFree uint64) {
+	diskFree := c.diskFree
+	if diskFree == nil {
+		diskFree = statfsFree
+	}
+	free, err := diskFree(path)
+	if err != nil {
+		c.log().Warn("failed to check free disk space", "path", path, "error", err)
+		return
+	}
+
+	var evicted []LayerMetadata
+	defer func() { c.handleEvicted(evicted) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if free < minFree {
+		limit := c.maxSize
+		if limit == 0 || limit > c.totalSize {
+			limit = c.totalSize
+		}
+		limit /= 2
+		if limit == 0 {
+			// Nothing left to shrink
+			return
+		}
+		c.maxSize = limit
+		evicted = c.evictLayers(c.totalSize - c.maxSize)
+		c.log().Warn("disk pressure, shrinking layer cache",
+			"free_bytes", free,
+			"max_size", c.maxSize)
+		return
+	}
+
+	if c.maxSize == c.configuredSize {
+		return
+	}
+	limit := c.maxSize * 2
+	if c.configuredSize == 0 || limit >= c.configuredSize {
+		limit = c.configuredSize
+	}
+	c.maxSize = limit
+	c.log().Info("disk pressure cleared, growing layer cache", "max_size", c.maxSize)
+}
+
+// StartDiskPressureMonitor checks the free space on the filesystem holding
+// path every interval and shrinks the cache while it is below minFree. The
+// returned function stops the monitor.
+func (c *LayerCache) StartDiskPressureMonitor(path string, minFree uint64, interval time.Duration) func() {
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				c.checkDiskPressure(path, minFree)
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-done
+	}
+}
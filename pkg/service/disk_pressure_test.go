@@ -0,0 +1,104 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayerCache_DiskPressure(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewLayerCache(1000)
+
+	var free uint64
+	cache.diskFree = func(string) (uint64, error) { return free, nil }
+
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("layer%d", i))
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatalf("Failed to create layer file: %v", err)
+		}
+		cache.Add(fmt.Sprintf("sha256:%d", i), LayerMetadata{Path: path, Size: 100})
+	}
+
+	const minFree = 1 << 20
+	tests := []struct {
+		name      string
+		free      uint64
+		wantMax   int64
+		wantTotal int64
+	}{
+		{"no pressure", minFree, 1000, 400},
+		{"pressure halves the used size", minFree - 1, 200, 200},
+		{"sustained pressure keeps halving", minFree - 1, 100, 100},
+		{"cleared pressure doubles", minFree, 200, 100},
+		{"doubling continues", minFree, 400, 100},
+		{"doubling continues again", minFree, 800, 100},
+		{"restored to the configured size", minFree, 1000, 100},
+	}
+
+	for _, tt := range tests {
+		free = tt.free
+		cache.checkDiskPressure(dir, minFree)
+
+		cache.mu.RLock()
+		maxSize, totalSize := cache.maxSize, cache.totalSize
+		cache.mu.RUnlock()
+		if maxSize != tt.wantMax {
+			t.Errorf("%s: maxSize = %d, want %d", tt.name, maxSize, tt.wantMax)
+		}
+		if totalSize != tt.wantTotal {
+			t.Errorf("%s: totalSize = %d, want %d", tt.name, totalSize, tt.wantTotal)
+		}
+	}
+
+	// Evicted layers are the least recently used. Their files are left to
+	// the owner of the cache, as images may share them.
+	for i := 0; i < 3; i++ {
+		if _, ok := cache.Get(fmt.Sprintf("sha256:%d", i)); ok {
+			t.Errorf("layer %d was not evicted", i)
+		}
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("layer%d", i))); err != nil {
+			t.Errorf("file of evicted layer %d removed by the cache: %v", i, err)
+		}
+	}
+	if _, ok := cache.Get("sha256:3"); !ok {
+		t.Error("most recently used layer was evicted")
+	}
+}
+
+func TestLayerCache_DiskPressureUnlimited(t *testing.T) {
+	cache := NewLayerCache(0)
+	cache.diskFree = func(string) (uint64, error) { return 0, nil }
+	cache.Add("sha256:a", LayerMetadata{Size: 100})
+	cache.Add("sha256:b", LayerMetadata{Size: 100})
+
+	cache.checkDiskPressure(t.TempDir(), 1)
+	if cache.maxSize != 100 || cache.totalSize != 100 {
+		t.Errorf("under pressure maxSize = %d, totalSize = %d, want 100, 100", cache.maxSize, cache.totalSize)
+	}
+
+	// An unlimited cache becomes unlimited again as soon as pressure clears
+	cache.diskFree = func(string) (uint64, error) { return 1, nil }
+	cache.checkDiskPressure(t.TempDir(), 1)
+	if cache.maxSize != 0 {
+		t.Errorf("after pressure maxSize = %d, want 0", cache.maxSize)
+	}
+}
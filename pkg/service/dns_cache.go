@@ -0,0 +1,119 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache resolves registry hosts once per TTL and dials the cached
+// addresses. The Go resolver does not expose record TTLs, so entries live
+// for the configured TTL and are refreshed early when a dial fails.
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsEntry
+
+	// Hooks overridable in tests
+	lookup func(ctx context.Context, host string) ([]string, error)
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	now    func() time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &dnsCache{
+		ttl:     ttl,
+		entries: make(map[string]dnsEntry),
+		lookup:  net.DefaultResolver.LookupHost,
+		dial:    dialer.DialContext,
+		now:     time.Now,
+	}
+}
+
+// DialContext dials addr using cached resolutions of its host
+func (c *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return c.dial(ctx, network, addr)
+	}
+
+	addrs, cached, err := c.resolve(ctx, host, false)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dialAny(ctx, network, addrs, port)
+	if err == nil || !cached {
+		return conn, err
+	}
+
+	// The cached addresses may be stale, resolve again and retry once
+	addrs, _, err = c.resolve(ctx, host, true)
+	if err != nil {
+		return nil, err
+	}
+	return c.dialAny(ctx, network, addrs, port)
+}
+
+// resolve returns the addresses of host and whether they came from cache
+func (c *dnsCache) resolve(ctx context.Context, host string, refresh bool) ([]string, bool, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+
+	if ok && !refresh && c.now().Before(entry.expires) {
+		return entry.addrs, true, nil
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(addrs) == 0 {
+		return nil, false, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, false, nil
+}
+
+// dialAny dials each address in turn and returns the first connection
+func (c *dnsCache) dialAny(ctx context.Context, network string, addrs []string, port string) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range addrs {
+		conn, err := c.dial(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
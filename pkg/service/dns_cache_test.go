@@ -0,0 +1,108 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCache_ReusesResolution(t *testing.T) {
+	cache := newDNSCache(time.Minute)
+
+	lookups := 0
+	cache.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"10.0.0.1"}, nil
+	}
+	var dialed []string
+	cache.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := cache.DialContext(context.Background(), "tcp", "registry.example.com:443")
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		conn.Close()
+	}
+
+	if lookups != 1 {
+		t.Errorf("host resolved %d times, want 1", lookups)
+	}
+	for _, addr := range dialed {
+		if addr != "10.0.0.1:443" {
+			t.Errorf("dialed %s, want cached address 10.0.0.1:443", addr)
+		}
+	}
+
+	// Expired entries are resolved again
+	now := time.Now().Add(2 * time.Minute)
+	cache.now = func() time.Time { return now }
+	conn, err := cache.DialContext(context.Background(), "tcp", "registry.example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	conn.Close()
+	if lookups != 2 {
+		t.Errorf("host resolved %d times after expiry, want 2", lookups)
+	}
+}
+
+func TestDNSCache_RefreshOnDialFailure(t *testing.T) {
+	cache := newDNSCache(time.Hour)
+
+	current := "10.0.0.1"
+	lookups := 0
+	cache.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{current}, nil
+	}
+	cache.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != current+":443" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	conn, err := cache.DialContext(context.Background(), "tcp", "registry.example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	conn.Close()
+
+	// The registry moves, the cached address now fails to dial
+	current = "10.0.0.2"
+	conn, err = cache.DialContext(context.Background(), "tcp", "registry.example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext() after move error = %v", err)
+	}
+	conn.Close()
+
+	if lookups != 2 {
+		t.Errorf("host resolved %d times, want re-resolution after failed dial", lookups)
+	}
+}
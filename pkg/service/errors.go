@@ -0,0 +1,68 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrImageNotFound is returned when an image is not in the store
+	ErrImageNotFound = errors.New("image not found")
+	// ErrInvalidReference is returned when an image reference cannot be
+	// parsed
+	ErrInvalidReference = errors.New("invalid image reference")
+	// ErrManifestUnsupported is returned for manifests, such as manifest
+	// lists or schema 1 manifests, and layer media types that cannot be
+	// pulled
+	ErrManifestUnsupported = errors.New("unsupported manifest")
+	// ErrDigestMismatch is returned when downloaded content does not match
+	// its expected digest
+	ErrDigestMismatch = errors.New("digest mismatch")
+	// ErrAuthRequired is returned when a registry requires credentials that
+	// were not provided
+	ErrAuthRequired = errors.New("authentication required")
+	// ErrAuthFailed is returned when a registry rejects the provided
+	// credentials
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrImageTooLarge is returned when an image exceeds the configured
+	// maximum image size
+	ErrImageTooLarge = errors.New("image too large")
+	// ErrReadOnly is returned for operations that would modify a read-only
+	// image store
+	ErrReadOnly = errors.New("image store is read-only")
+)
+
+// LayerError reports a pull that failed while downloading one of the layers
+// of an image
+type LayerError struct {
+	// Index is the position of the layer in the manifest, out of Count
+	// layers
+	Index  int
+	Count  int
+	Digest string
+	Err    error
+}
+
+func (e *LayerError) Error() string {
+	return fmt.Sprintf("failed to download layer %d: %v", e.Index, e.Err)
+}
+
+func (e *LayerError) Unwrap() error {
+	return e.Err
+}
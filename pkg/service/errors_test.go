@@ -0,0 +1,176 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageService_SentinelErrors(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/bzip", "latest", "application/vnd.oci.image.layer.v1.tar+bzip2", []byte("bzip2 layer"))
+	registry.manifests["library/list:latest"] = []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","manifests":[]}`)
+	registry.manifests["library/v1:latest"] = []byte(`{"schemaVersion":1,"name":"library/v1","tag":"latest"}`)
+
+	// Serve other content than advertised for the layer of this image
+	layer := []byte("genuine layer content")
+	registry.addImage(t, "library/corrupt", "latest", layer)
+	registry.blobs[digest.FromBytes(layer).String()] = []byte("tampered layer content")
+
+	// A registry answering every request with the given status
+	statusRegistry := func(code int) string {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		t.Cleanup(server.Close)
+		return server.Listener.Addr().String()
+	}
+	unauthorized := statusRegistry(http.StatusUnauthorized)
+	forbidden := statusRegistry(http.StatusForbidden)
+
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		call func(s *ImageService) error
+		want error
+	}{
+		{
+			name: "status of missing image",
+			call: func(s *ImageService) error {
+				_, err := s.ImageStatus(ctx, "missing:latest")
+				return err
+			},
+			want: ErrImageNotFound,
+		},
+		{
+			name: "dry run removal of missing image",
+			call: func(s *ImageService) error {
+				_, err := s.RemoveImageDryRun(ctx, "missing:latest")
+				return err
+			},
+			want: ErrImageNotFound,
+		},
+		{
+			name: "invalid reference",
+			call: func(s *ImageService) error {
+				_, err := s.PullImage(ctx, "Invalid::Reference", nil)
+				return err
+			},
+			want: ErrInvalidReference,
+		},
+		{
+			name: "manifest list",
+			call: func(s *ImageService) error {
+				_, err := s.PullImage(ctx, registry.host()+"/library/list:latest", nil)
+				return err
+			},
+			want: ErrManifestUnsupported,
+		},
+		{
+			name: "schema 1 manifest",
+			call: func(s *ImageService) error {
+				_, err := s.PullImage(ctx, registry.host()+"/library/v1:latest", nil)
+				return err
+			},
+			want: ErrManifestUnsupported,
+		},
+		{
+			name: "unsupported layer media type",
+			call: func(s *ImageService) error {
+				_, err := s.PullImage(ctx, registry.host()+"/library/bzip:latest", nil)
+				return err
+			},
+			want: ErrManifestUnsupported,
+		},
+		{
+			name: "layer digest mismatch",
+			call: func(s *ImageService) error {
+				_, err := s.PullImage(ctx, registry.host()+"/library/corrupt:latest", nil)
+				return err
+			},
+			want: ErrDigestMismatch,
+		},
+		{
+			name: "registry requires authentication",
+			call: func(s *ImageService) error {
+				_, err := s.PullImage(ctx, unauthorized+"/library/app:latest", nil)
+				return err
+			},
+			want: ErrAuthRequired,
+		},
+		{
+			name: "registry rejects credentials",
+			call: func(s *ImageService) error {
+				_, err := s.PullImage(ctx, forbidden+"/library/app:latest", nil)
+				return err
+			},
+			want: ErrAuthFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, registry)
+			// The test servers share the same certificate authority
+			service.client = registry.server.Client()
+
+			err := tt.call(service)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetJSONBlob_DigestMismatch(t *testing.T) {
+	registry := newTestRegistry(t)
+	config := []byte(`{"architecture":"amd64"}`)
+	registry.blobs[digest.FromBytes(config).String()] = []byte(`{"architecture":"arm64"}`)
+
+	service := newTestService(t, registry)
+	url := registry.server.URL + "/v2/library/app/blobs/" + digest.FromBytes(config).String()
+	if _, err := service.getJSONBlob(context.Background(), url, digest.FromBytes(config).String(), nil); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("getJSONBlob() error = %v, want %v", err, ErrDigestMismatch)
+	}
+}
+
+func TestImageService_LayerError(t *testing.T) {
+	const mediaType = "application/vnd.oci.image.layer.v1.tar"
+	missing := []byte("layer missing from the registry")
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", mediaType, []byte("first layer"), missing, []byte("last layer"))
+	delete(registry.blobs, digest.FromBytes(missing).String())
+	service := newTestService(t, registry)
+
+	_, err := service.PullImage(context.Background(), registry.host()+"/library/app:latest", nil)
+	var layerErr *LayerError
+	if !errors.As(err, &layerErr) {
+		t.Fatalf("PullImage() error = %v, want a LayerError", err)
+	}
+	if layerErr.Index != 1 || layerErr.Count != 3 || layerErr.Digest != digest.FromBytes(missing).String() {
+		t.Errorf("LayerError = layer %d of %d (%s), want layer 1 of 3 (%s)", layerErr.Index, layerErr.Count, layerErr.Digest, digest.FromBytes(missing))
+	}
+	if registryStatus(err) != http.StatusNotFound {
+		t.Errorf("LayerError does not wrap the registry error: %v", err)
+	}
+}
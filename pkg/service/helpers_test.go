@@ -0,0 +1,273 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// testRegistry is a minimal in-memory registry served over TLS
+type testRegistry struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string][]byte // "<repo>:<tag>" -> manifest
+	blobs     map[string][]byte // digest -> content
+	hits      map[string]int    // request path -> count
+	requests  []string          // request paths in arrival order
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+
+	r := &testRegistry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[string][]byte),
+		hits:      make(map[string]int),
+	}
+	r.server = httptest.NewTLSServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// newPlainTestRegistry is like newTestRegistry but serves plain HTTP
+func newPlainTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+
+	r := &testRegistry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[string][]byte),
+		hits:      make(map[string]int),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.hits[req.URL.Path]++
+	r.requests = append(r.requests, req.URL.Path)
+	r.mu.Unlock()
+
+	path := req.URL.Path
+	if path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if i := strings.Index(path, "/manifests/"); i > 0 {
+		key := strings.TrimPrefix(path[:i], "/v2/") + ":" + path[i+len("/manifests/"):]
+		r.mu.Lock()
+		manifest, ok := r.manifests[key]
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+		w.Write(manifest)
+		return
+	}
+
+	if i := strings.Index(path, "/blobs/"); i > 0 {
+		r.mu.Lock()
+		blob, ok := r.blobs[path[i+len("/blobs/"):]]
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(blob)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// host returns the host:port of the registry
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.server.URL, "https://"), "http://")
+}
+
+// addImage registers an image made of the given layer blobs and returns the
+// digest of its manifest
+func (r *testRegistry) addImage(t *testing.T, repo, tag string, layers ...[]byte) digest.Digest {
+	t.Helper()
+	return r.addImageWithMediaType(t, repo, tag, "application/vnd.docker.image.rootfs.diff.tar.gzip", layers...)
+}
+
+// addImageWithMediaType is like addImage but declares every layer with the
+// given media type. As in real images, the config lists the layers, so
+// images with different layers have different IDs.
+func (r *testRegistry) addImageWithMediaType(t *testing.T, repo, tag, mediaType string, layers ...[]byte) digest.Digest {
+	t.Helper()
+
+	var config struct {
+		RootFS struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{}
+	for _, layer := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(layer).String())
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	return r.addImageWithConfig(t, repo, tag, mediaType, data, layers...)
+}
+
+// addImageWithConfig is like addImageWithMediaType but serves the given
+// image config blob
+func (r *testRegistry) addImageWithConfig(t *testing.T, repo, tag, mediaType string, config []byte, layers ...[]byte) digest.Digest {
+	t.Helper()
+
+	manifest := DockerManifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+	}
+	manifest.Config.MediaType = "application/vnd.docker.container.image.v1+json"
+	manifest.Config.Size = int64(len(config))
+	manifest.Config.Digest = digest.FromBytes(config).String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.blobs[manifest.Config.Digest] = config
+	for _, layer := range layers {
+		dgst := digest.FromBytes(layer).String()
+		r.blobs[dgst] = layer
+		manifest.Layers = append(manifest.Layers, struct {
+			MediaType string   `json:"mediaType"`
+			Size      int64    `json:"size"`
+			Digest    string   `json:"digest"`
+			URLs      []string `json:"urls,omitempty"`
+		}{
+			MediaType: mediaType,
+			Size:      int64(len(layer)),
+			Digest:    dgst,
+		})
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	r.manifests[repo+":"+tag] = data
+	return digest.FromBytes(data)
+}
+
+// hitCount returns how many times path was requested
+func (r *testRegistry) hitCount(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hits[path]
+}
+
+// blobRequests returns the blob paths requested so far, in arrival order
+func (r *testRegistry) blobRequests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var blobs []string
+	for _, path := range r.requests {
+		if strings.Contains(path, "/blobs/") {
+			blobs = append(blobs, path)
+		}
+	}
+	return blobs
+}
+
+// newTestService creates an ImageService rooted in a temporary directory
+// that talks to the given registry
+func newTestService(t *testing.T, registry *testRegistry) *ImageService {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+	service := &ImageService{
+		client:       http.DefaultClient,
+		imageRoot:    tmpDir,
+		images:       make(map[string]*imageMetadata),
+		metadataFile: filepath.Join(tmpDir, "metadata.json"),
+		layerCache:   NewLayerCache(100 * 1024 * 1024),
+		labels:       make(map[string]map[string]string),
+		labelsFile:   filepath.Join(tmpDir, "labels.json"),
+	}
+	service.layerCache.releaseEvicted = service.removeEvictedBlobs
+	if registry != nil {
+		service.client = registry.server.Client()
+	}
+	return service
+}
+
+// buildTar returns a tar archive holding the given regular files
+func buildTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write tar content: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// gzipBytes compresses data with gzip
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatalf("Failed to gzip data: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
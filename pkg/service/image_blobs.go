@@ -0,0 +1,217 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// blobsDir is the directory under the image root holding layer blobs by
+// content digest, shared by every image that references them
+const blobsDir = "blobs"
+
+// blobPath returns where the blob with the given digest is stored
+func (s *ImageService) blobPath(blobDigest string) (string, error) {
+	dgst, err := normalizeDigest(blobDigest)
+	if err != nil {
+		return "", fmt.Errorf("invalid blob digest %q: %v", blobDigest, err)
+	}
+	return filepath.Join(s.imageRoot, blobsDir, dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+// migrateLayerPaths moves the layers older versions stored per image, under
+// <image>/layer-N/layer.tar, into the blob store and points their metadata
+// at the shared blob. Per-image copies of blobs already in the store are
+// removed. It returns the number of layers migrated.
+func (s *ImageService) migrateLayerPaths() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var migrated int
+	var duplicates []string
+	for ref, img := range s.images {
+		for i := range img.Layers {
+			layer := &img.Layers[i]
+			if layer.Path == "" {
+				continue
+			}
+			target, err := s.blobPath(layer.Digest)
+			if err != nil {
+				s.log().Warn("cannot migrate layer", "image", ref, "path", layer.Path, "error", err)
+				continue
+			}
+			if layer.Path == target {
+				continue
+			}
+
+			legacy := layer.Path
+			if _, err := os.Stat(target); err == nil {
+				duplicates = append(duplicates, legacy)
+			} else if !os.IsNotExist(err) {
+				return migrated, fmt.Errorf("failed to stat blob: %v", err)
+			} else if _, err := os.Stat(legacy); err != nil {
+				// Reconcile drops images whose layers are gone
+				continue
+			} else {
+				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+					return migrated, fmt.Errorf("failed to create blob directory: %v", err)
+				}
+				if err := os.Rename(legacy, target); err != nil {
+					return migrated, fmt.Errorf("failed to move layer %s: %v", legacy, err)
+				}
+				s.removeEmptyParents(legacy)
+			}
+			layer.Path = target
+			migrated++
+		}
+	}
+	if migrated == 0 {
+		return 0, nil
+	}
+
+	if err := s.saveMetadata(); err != nil {
+		return migrated, fmt.Errorf("failed to save metadata: %v", err)
+	}
+	// Duplicates are only dropped once no saved image points at them
+	for _, path := range duplicates {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			s.log().Warn("failed to remove migrated layer", "path", path, "error", err)
+			continue
+		}
+		s.removeEmptyParents(path)
+	}
+	s.log().Info("migrated layers into the blob store", "layers", migrated)
+	return migrated, nil
+}
+
+// reusableLayer reports whether the stored blob of a layer may be reused.
+// With VerifyReusedLayers, a blob whose content no longer matches its digest
+// is dropped from the cache so that the layer is downloaded again.
+func (s *ImageService) reusableLayer(layerDigest, path string) bool {
+	if !s.config.VerifyReusedLayers {
+		return true
+	}
+	if err := verifyBlobFile(path, layerDigest); err != nil {
+		s.log().Warn("stored layer is corrupted, downloading it again", "digest", layerDigest, "path", path, "error", err)
+		s.layerCache.Remove(layerDigest)
+		return false
+	}
+	return true
+}
+
+// verifyBlobFile checks the content of the blob stored at path against its
+// expected digest
+func verifyBlobFile(path, expectedDigest string) error {
+	expected, err := normalizeDigest(expectedDigest)
+	if err != nil {
+		return fmt.Errorf("invalid blob digest %q: %v", expectedDigest, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open blob: %v", err)
+	}
+	defer f.Close()
+
+	actual, err := expected.Algorithm().FromReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read blob: %v", err)
+	}
+	if actual != expected {
+		return fmt.Errorf("blob %w: expected %s, got %s", ErrDigestMismatch, expected, actual)
+	}
+	return nil
+}
+
+// layerStored reports whether the blob of a layer is already stored at path
+func (s *ImageService) layerStored(layerDigest, path string) bool {
+	if s.layerCache.Contains(layerDigest) {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// storedLayer describes a blob already present at path, preferring the
+// layer cache and falling back to inspecting the file
+func (s *ImageService) storedLayer(layerDigest, path, mediaType string) (LayerMetadata, error) {
+	if metadata, ok := s.layerCache.Get(layerDigest); ok && metadata.Path == path {
+		return metadata, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return LayerMetadata{}, fmt.Errorf("failed to get layer size: %v", err)
+	}
+	diffID, uncompressedSize, err := computeDiffID(path, mediaType)
+	if err != nil {
+		return LayerMetadata{}, fmt.Errorf("failed to compute diffID: %v", err)
+	}
+
+	metadata := LayerMetadata{
+		Digest:           layerDigest,
+		Path:             path,
+		Size:             fi.Size(),
+		UncompressedSize: uncompressedSize,
+		DiffID:           diffID.String(),
+	}
+	s.layerCache.Add(layerDigest, metadata)
+	return metadata, nil
+}
+
+// PurgeLayerCache empties the layer cache and deletes the blobs of purged
+// layers that no image references, so that later pulls start cold. Blobs
+// still used by images are kept, as are all blobs of a read-only service.
+func (s *ImageService) PurgeLayerCache() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, layer := range s.layerCache.Purge(false) {
+		if s.config.ReadOnly || s.layerInUse(layer.Digest) || layer.Path == "" {
+			continue
+		}
+		if err := os.Remove(layer.Path); err != nil && !os.IsNotExist(err) {
+			s.log().Error("failed to remove layer file", "path", layer.Path, "error", err)
+		}
+	}
+}
+
+// removeEvictedBlobs deletes the blobs of layers evicted from the layer
+// cache unless an image references them or a pull has claimed them
+func (s *ImageService) removeEvictedBlobs(layers []LayerMetadata) {
+	if s.config.ReadOnly {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, layer := range layers {
+		if s.layerInUse(layer.Digest) || layer.Path == "" {
+			continue
+		}
+		if err := os.Remove(layer.Path); err != nil && !os.IsNotExist(err) {
+			s.log().Error("failed to remove evicted layer file", "path", layer.Path, "error", err)
+		}
+	}
+}
+
+// LayerCacheStats returns a snapshot of the usage of the layer cache
+func (s *ImageService) LayerCacheStats() LayerCacheStats {
+	return s.layerCache.Stats()
+}
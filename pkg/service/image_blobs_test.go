@@ -0,0 +1,449 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageService_SharedBlobStore(t *testing.T) {
+	shared := []byte("shared base layer")
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/a", "latest", shared, []byte("layer only in a"))
+	registry.addImage(t, "library/b", "latest", shared, []byte("layer only in b"))
+	service := newTestService(t, registry)
+
+	refA := registry.host() + "/library/a:latest"
+	refB := registry.host() + "/library/b:latest"
+	for _, ref := range []string{refA, refB} {
+		if _, err := service.PullImage(context.Background(), ref, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+	}
+
+	// The shared layer is stored exactly once, under its digest
+	sharedDigest := digest.FromBytes(shared)
+	sharedPath := filepath.Join(service.imageRoot, "blobs", "sha256", sharedDigest.Encoded())
+	var copies int
+	err := filepath.Walk(service.imageRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if string(content) == string(shared) {
+				copies++
+				if path != sharedPath {
+					t.Errorf("shared layer stored at %s, want %s", path, sharedPath)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk image root: %v", err)
+	}
+	if copies != 1 {
+		t.Errorf("shared layer stored %d times, want 1", copies)
+	}
+
+	// Both images reference the same blob
+	for _, ref := range []string{refA, refB} {
+		layers, err := service.ImageLayers(ref)
+		if err != nil {
+			t.Fatalf("ImageLayers(%s) error = %v", ref, err)
+		}
+		if layers[0].Path != sharedPath {
+			t.Errorf("%s layer 0 path = %s, want %s", ref, layers[0].Path, sharedPath)
+		}
+	}
+
+	// Removing one image keeps the blob the other still references
+	if err := service.RemoveImage(context.Background(), refA); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+	if _, err := os.Stat(sharedPath); err != nil {
+		t.Errorf("shared blob removed while still referenced: %v", err)
+	}
+}
+
+func TestGarbageCollector_ReclaimsUnreferencedBlobs(t *testing.T) {
+	service := newTestService(t, nil)
+
+	referencedDigest := digest.FromString("referenced").String()
+	referenced, err := service.blobPath(referencedDigest)
+	if err != nil {
+		t.Fatalf("blobPath() error = %v", err)
+	}
+	orphan, err := service.blobPath(digest.FromString("orphan").String())
+	if err != nil {
+		t.Fatalf("blobPath() error = %v", err)
+	}
+	inProgress := orphan + ".123.tmp"
+	for _, path := range []string{referenced, orphan, inProgress} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create blob directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("blob"), 0644); err != nil {
+			t.Fatalf("Failed to write blob: %v", err)
+		}
+	}
+	service.images["app"] = &imageMetadata{
+		Layers: []LayerMetadata{{Digest: referencedDigest, Path: referenced}},
+	}
+
+	gc := NewGarbageCollector(service, 0)
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+
+	if _, err := os.Stat(referenced); err != nil {
+		t.Errorf("referenced blob removed: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("unreferenced blob was not reclaimed")
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Errorf("in-progress download removed: %v", err)
+	}
+}
+
+func TestImageService_LayerRefCount(t *testing.T) {
+	shared := []byte("shared base layer")
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/a", "latest", shared)
+	registry.addImage(t, "library/b", "latest", shared, []byte("layer only in b"))
+	service := newTestService(t, registry)
+	service.layerRefsFile = filepath.Join(service.imageRoot, "layer_refs.json")
+
+	refA := registry.host() + "/library/a:latest"
+	refB := registry.host() + "/library/b:latest"
+	for _, ref := range []string{refA, refB} {
+		if _, err := service.PullImage(context.Background(), ref, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+	}
+
+	sharedDigest := digest.FromBytes(shared).String()
+	if got := service.layerRefCount(sharedDigest); got != 2 {
+		t.Fatalf("ref count after two pulls = %d, want 2", got)
+	}
+
+	if err := service.RemoveImage(context.Background(), refA); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+	if got := service.layerRefCount(sharedDigest); got != 1 {
+		t.Errorf("ref count after removing one image = %d, want 1", got)
+	}
+	blob, _ := service.blobPath(sharedDigest)
+	if _, err := os.Stat(blob); err != nil {
+		t.Errorf("shared blob removed while still referenced: %v", err)
+	}
+
+	// The counts are persisted next to the metadata
+	reloaded := newTestService(t, nil)
+	reloaded.metadataFile = service.metadataFile
+	reloaded.layerRefsFile = service.layerRefsFile
+	if err := reloaded.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	if err := reloaded.loadLayerRefs(); err != nil {
+		t.Fatalf("loadLayerRefs() error = %v", err)
+	}
+	if got := reloaded.layerRefCount(sharedDigest); got != 1 {
+		t.Errorf("reloaded ref count = %d, want 1", got)
+	}
+
+	// Dropping the last reference removes the blob
+	if err := service.RemoveImage(context.Background(), refB); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+	if got := service.layerRefCount(sharedDigest); got != 0 {
+		t.Errorf("ref count after removing both images = %d, want 0", got)
+	}
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Error("unreferenced blob was not removed")
+	}
+}
+
+func TestImageService_StaleLayerRefs(t *testing.T) {
+	shared := []byte("shared base layer")
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/a", "latest", shared)
+	registry.addImage(t, "library/b", "latest", shared, []byte("layer only in b"))
+	service := newTestService(t, registry)
+	service.layerRefsFile = filepath.Join(service.imageRoot, "layer_refs.json")
+
+	refA := registry.host() + "/library/a:latest"
+	refB := registry.host() + "/library/b:latest"
+	if _, err := service.PullImage(context.Background(), refA, nil); err != nil {
+		t.Fatalf("PullImage(%s) error = %v", refA, err)
+	}
+	stale, err := os.ReadFile(service.layerRefsFile)
+	if err != nil {
+		t.Fatalf("Failed to read layer references: %v", err)
+	}
+	if _, err := service.PullImage(context.Background(), refB, nil); err != nil {
+		t.Fatalf("PullImage(%s) error = %v", refB, err)
+	}
+
+	// A crash after writing the metadata leaves the counts of before the pull
+	if err := os.WriteFile(service.layerRefsFile, stale, 0644); err != nil {
+		t.Fatalf("Failed to write layer references: %v", err)
+	}
+	restarted := newTestService(t, nil)
+	restarted.imageRoot = service.imageRoot
+	restarted.metadataFile = service.metadataFile
+	restarted.layerRefsFile = service.layerRefsFile
+	if err := restarted.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	if err := restarted.loadLayerRefs(); err != nil {
+		t.Fatalf("loadLayerRefs() error = %v", err)
+	}
+
+	sharedDigest := digest.FromBytes(shared).String()
+	if got := restarted.layerRefCount(sharedDigest); got != 2 {
+		t.Errorf("ref count after restart = %d, want 2", got)
+	}
+	if err := restarted.RemoveImage(context.Background(), refA); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+	blob, _ := restarted.blobPath(sharedDigest)
+	if _, err := os.Stat(blob); err != nil {
+		t.Errorf("blob of %s removed along with %s: %v", refB, refA, err)
+	}
+}
+
+func TestImageService_PurgeLayerCache(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("layer kept by the image"))
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	orphanDigest := digest.FromString("orphan").String()
+	orphan, _ := service.blobPath(orphanDigest)
+	if err := os.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+	service.layerCache.Add(orphanDigest, LayerMetadata{Digest: orphanDigest, Path: orphan, Size: 6})
+
+	service.PurgeLayerCache()
+
+	if layers, totalSize := service.layerCache.snapshot(); len(layers) != 0 || totalSize != 0 {
+		t.Errorf("layer cache not empty after purge: %d layers, %d bytes", len(layers), totalSize)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("unreferenced blob survived the purge")
+	}
+	layers, err := service.ImageLayers(imageRef)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	if _, err := os.Stat(layers[0].Path); err != nil {
+		t.Errorf("blob of a pulled image removed by the purge: %v", err)
+	}
+}
+
+func TestImageService_EvictionKeepsReferencedBlobs(t *testing.T) {
+	tests := []struct {
+		name  string
+		evict func(service *ImageService)
+	}{
+		{"add over the limit", func(service *ImageService) {
+			service.layerCache.SetMaxSize(1 << 20)
+			service.layerCache.Add("sha256:large", LayerMetadata{Digest: "sha256:large", Size: 1 << 20})
+		}},
+		{"shrinking the limit", func(service *ImageService) {
+			service.layerCache.SetMaxSize(1)
+		}},
+		{"disk pressure", func(service *ImageService) {
+			service.layerCache.diskFree = func(string) (uint64, error) { return 0, nil }
+			for i := 0; i < 8; i++ {
+				service.layerCache.checkDiskPressure(service.imageRoot, 1)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+			registry.addImage(t, "library/app", "latest", []byte("layer kept by the image"))
+			service := newTestService(t, registry)
+
+			imageRef := registry.host() + "/library/app:latest"
+			if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+			orphanDigest := digest.FromString("orphan").String()
+			orphan, _ := service.blobPath(orphanDigest)
+			if err := os.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+				t.Fatalf("Failed to write blob: %v", err)
+			}
+			service.layerCache.Add(orphanDigest, LayerMetadata{Digest: orphanDigest, Path: orphan, Size: 6})
+
+			tt.evict(service)
+
+			layers, err := service.ImageLayers(imageRef)
+			if err != nil {
+				t.Fatalf("ImageLayers() error = %v", err)
+			}
+			if service.layerCache.Contains(layers[0].Digest) {
+				t.Fatal("layer of the image was not evicted")
+			}
+			if _, err := os.Stat(layers[0].Path); err != nil {
+				t.Errorf("blob of a pulled image removed by eviction: %v", err)
+			}
+			if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+				t.Error("unreferenced blob survived eviction")
+			}
+		})
+	}
+}
+
+func TestImageService_VerifyReusedLayers(t *testing.T) {
+	shared := []byte("shared base layer that gets corrupted on disk")
+	sharedDigest := digest.FromBytes(shared)
+
+	tests := []struct {
+		name        string
+		verify      bool
+		wantFetches int
+	}{
+		{name: "corruption detected", verify: true, wantFetches: 2},
+		{name: "verification disabled", verify: false, wantFetches: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+			registry.addImageWithMediaType(t, "library/a", "latest", "application/vnd.oci.image.layer.v1.tar", shared)
+			registry.addImageWithMediaType(t, "library/b", "latest", "application/vnd.oci.image.layer.v1.tar", shared, []byte("layer only in b"))
+			service := newTestService(t, registry)
+			service.config.VerifyReusedLayers = tt.verify
+
+			if _, err := service.PullImage(context.Background(), registry.host()+"/library/a:latest", nil); err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+
+			// Corrupt the stored blob in place, keeping its size
+			blobPath, _ := service.blobPath(sharedDigest.String())
+			corrupted := append([]byte(nil), shared...)
+			corrupted[0] ^= 0xff
+			if err := os.WriteFile(blobPath, corrupted, 0644); err != nil {
+				t.Fatalf("Failed to corrupt blob: %v", err)
+			}
+
+			if _, err := service.PullImage(context.Background(), registry.host()+"/library/b:latest", nil); err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+
+			fetches := registry.hitCount("/v2/library/a/blobs/"+sharedDigest.String()) +
+				registry.hitCount("/v2/library/b/blobs/"+sharedDigest.String())
+			if fetches != tt.wantFetches {
+				t.Errorf("shared layer fetched %d times, want %d", fetches, tt.wantFetches)
+			}
+			if err := verifyBlobFile(blobPath, sharedDigest.String()); (err == nil) != tt.verify {
+				t.Errorf("verifyBlobFile() after second pull error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewImageService_MigratesLegacyLayerPaths(t *testing.T) {
+	config := DefaultConfig()
+	config.ImageRoot = t.TempDir()
+
+	// Two images stored the same layer under their own directories, as
+	// older versions did
+	content := []byte("layer stored once per image")
+	layerDigest := digest.FromBytes(content).String()
+	images := make(map[string]*imageMetadata)
+	var legacyPaths []string
+	for _, ref := range []string{"example.com/library/a:latest", "example.com/library/b:latest"} {
+		path := filepath.Join(config.ImageRoot, digest.FromString(ref).Hex(), "layer-0", "layer.tar")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create layer directory: %v", err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("Failed to write layer: %v", err)
+		}
+		legacyPaths = append(legacyPaths, path)
+		images[ref] = &imageMetadata{
+			ID:       "sha256:" + digest.FromString(ref).Hex(),
+			RepoTags: []string{ref},
+			Size:     int64(len(content)),
+			Layers:   []LayerMetadata{{Digest: layerDigest, Path: path, Size: int64(len(content))}},
+			State:    imageStateReady,
+		}
+	}
+	writer := newTestService(t, nil)
+	writer.metadataFile = filepath.Join(config.ImageRoot, "metadata.json")
+	writer.images = images
+	if err := writer.saveMetadata(); err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+
+	service := NewImageServiceWithConfig(config)
+	defer service.Close()
+
+	want, err := service.blobPath(layerDigest)
+	if err != nil {
+		t.Fatalf("blobPath() error = %v", err)
+	}
+	for ref := range images {
+		layers, err := service.ImageLayers(ref)
+		if err != nil {
+			t.Fatalf("ImageLayers(%s) error = %v", ref, err)
+		}
+		if len(layers) != 1 || layers[0].Path != want {
+			t.Errorf("%s layers = %+v, want the shared blob %s", ref, layers, want)
+		}
+	}
+	if data, err := os.ReadFile(want); err != nil || string(data) != string(content) {
+		t.Errorf("shared blob content = %q, %v, want %q", data, err, content)
+	}
+	for _, path := range legacyPaths {
+		if _, err := os.Stat(filepath.Dir(filepath.Dir(path))); !os.IsNotExist(err) {
+			t.Errorf("legacy image directory of %s left behind: %v", path, err)
+		}
+	}
+
+	// The migrated paths are persisted
+	reloaded := newTestService(t, nil)
+	reloaded.metadataFile = service.metadataFile
+	if err := reloaded.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	for ref, img := range reloaded.images {
+		if img.Layers[0].Path != want {
+			t.Errorf("saved path of %s = %s, want %s", ref, img.Layers[0].Path, want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// layerCompression identifies how a layer blob is compressed
+type layerCompression int
+
+const (
+	compressionNone layerCompression = iota
+	compressionGzip
+	compressionZstd
+)
+
+// layerCompressionFor derives the compression of a layer from its media type
+func layerCompressionFor(mediaType string) (layerCompression, error) {
+	switch {
+	case strings.HasSuffix(mediaType, ".tar.gzip"), strings.HasSuffix(mediaType, "+gzip"):
+		return compressionGzip, nil
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return compressionZstd, nil
+	case strings.Contains(mediaType, "+"):
+		return compressionNone, fmt.Errorf("%w: unsupported layer compression in media type %q", ErrManifestUnsupported, mediaType)
+	case strings.HasSuffix(mediaType, ".tar"):
+		return compressionNone, nil
+	default:
+		return compressionNone, fmt.Errorf("%w: unsupported layer media type %q", ErrManifestUnsupported, mediaType)
+	}
+}
+
+// computeDiffID returns the digest and size of the uncompressed content of
+// the layer stored at path, reading it once. For uncompressed layers the
+// diffID equals the blob digest.
+func computeDiffID(path, mediaType string) (digest.Digest, int64, error) {
+	compression, err := layerCompressionFor(mediaType)
+	if err != nil {
+		return "", 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open layer: %v", err)
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	switch compression {
+	case compressionGzip:
+		gzReader, err := gzip.NewReader(f)
+		switch {
+		case err == nil:
+			defer gzReader.Close()
+			reader = gzReader
+		case err == gzip.ErrHeader || err == io.EOF:
+			// Some registries mislabel plain tar blobs as gzip, treat
+			// them as uncompressed
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return "", 0, fmt.Errorf("failed to rewind layer: %v", err)
+			}
+		default:
+			return "", 0, fmt.Errorf("failed to open gzip stream: %v", err)
+		}
+	case compressionZstd:
+		zstdReader, err := zstd.NewReader(f)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to open zstd stream: %v", err)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(digester.Hash(), reader)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to compute diffID: %v", err)
+	}
+	return digester.Digest(), size, nil
+}
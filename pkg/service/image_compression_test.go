@@ -0,0 +1,152 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestComputeDiffID(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tarData := buildTar(t, map[string]string{"etc/hostname": "node-1\n"})
+	gzData := gzipBytes(t, tarData)
+
+	gzPath := filepath.Join(tmpDir, "layer.tar.gz")
+	if err := os.WriteFile(gzPath, gzData, 0644); err != nil {
+		t.Fatalf("Failed to write layer: %v", err)
+	}
+	tarPath := filepath.Join(tmpDir, "layer.tar")
+	if err := os.WriteFile(tarPath, tarData, 0644); err != nil {
+		t.Fatalf("Failed to write layer: %v", err)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to create zstd encoder: %v", err)
+	}
+	zstdPath := filepath.Join(tmpDir, "layer.tar.zst")
+	if err := os.WriteFile(zstdPath, encoder.EncodeAll(tarData, nil), 0644); err != nil {
+		t.Fatalf("Failed to write layer: %v", err)
+	}
+	encoder.Close()
+
+	want := digest.FromBytes(tarData)
+	tests := []struct {
+		name      string
+		path      string
+		mediaType string
+	}{
+		{"docker gzip layer", gzPath, "application/vnd.docker.image.rootfs.diff.tar.gzip"},
+		{"oci gzip layer", gzPath, "application/vnd.oci.image.layer.v1.tar+gzip"},
+		{"uncompressed layer", tarPath, "application/vnd.oci.image.layer.v1.tar"},
+		{"mislabelled plain layer", tarPath, "application/vnd.oci.image.layer.v1.tar+gzip"},
+		{"zstd layer", zstdPath, "application/vnd.oci.image.layer.v1.tar+zstd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, size, err := computeDiffID(tt.path, tt.mediaType)
+			if err != nil {
+				t.Fatalf("computeDiffID() error = %v", err)
+			}
+			if got != want {
+				t.Errorf("computeDiffID() = %v, want %v", got, want)
+			}
+			if size != int64(len(tarData)) {
+				t.Errorf("computeDiffID() size = %d, want %d", size, len(tarData))
+			}
+		})
+	}
+}
+
+func TestImageService_PullRecordsDiffID(t *testing.T) {
+	tarData := buildTar(t, map[string]string{"bin/app": "#!/bin/sh\necho hello\n"})
+	gzData := gzipBytes(t, tarData)
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", gzData)
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	layers := service.images[imageRef].Layers
+	if len(layers) != 1 {
+		t.Fatalf("Expected 1 layer, got %d", len(layers))
+	}
+	if want := digest.FromBytes(gzData).String(); layers[0].Digest != want {
+		t.Errorf("layer Digest = %v, want compressed digest %v", layers[0].Digest, want)
+	}
+	if want := digest.FromBytes(tarData).String(); layers[0].DiffID != want {
+		t.Errorf("layer DiffID = %v, want %v", layers[0].DiffID, want)
+	}
+}
+
+func TestImageService_PullZstdLayer(t *testing.T) {
+	tarData := buildTar(t, map[string]string{"bin/app": "zstd content"})
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to create zstd encoder: %v", err)
+	}
+	zstdData := encoder.EncodeAll(tarData, nil)
+	encoder.Close()
+
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar+zstd", zstdData)
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	layers := service.images[imageRef].Layers
+	if len(layers) != 1 {
+		t.Fatalf("Expected 1 layer, got %d", len(layers))
+	}
+	if want := digest.FromBytes(tarData).String(); layers[0].DiffID != want {
+		t.Errorf("layer DiffID = %v, want %v", layers[0].DiffID, want)
+	}
+}
+
+func TestImageService_RejectUnknownCompression(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar+lz4", []byte("lz4 data"))
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	_, err := service.PullImage(context.Background(), imageRef, nil)
+	if err == nil {
+		t.Fatal("PullImage() should reject unknown layer compression")
+	}
+	if !strings.Contains(err.Error(), "unsupported layer compression") {
+		t.Errorf("PullImage() error = %v, want unsupported layer compression", err)
+	}
+	if hits := registry.hitCount("/v2/library/app/blobs/" + digest.FromBytes([]byte("lz4 data")).String()); hits != 0 {
+		t.Errorf("layer blob fetched %d times, want 0", hits)
+	}
+}
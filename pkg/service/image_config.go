@@ -0,0 +1,144 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// ImageConfig is the subset of the OCI image configuration exposed in
+// verbose image status
+type ImageConfig struct {
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+	Config       struct {
+		User       string            `json:"User,omitempty"`
+		Env        []string          `json:"Env,omitempty"`
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		WorkingDir string            `json:"WorkingDir,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+}
+
+// ImageInfo returns the verbose information of imageRef, keyed as in
+// ImageStatusResponse.Info. The "info" entry holds the image config as JSON,
+// "size" and "uncompressedSize" the compressed and extracted sizes of its
+// layers in bytes.
+func (s *ImageService) ImageInfo(ctx context.Context, imageRef string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	if !ok || !img.ready() {
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+
+	info := map[string]string{
+		"size":             strconv.FormatInt(img.Size, 10),
+		"uncompressedSize": strconv.FormatInt(img.uncompressedSize(), 10),
+	}
+	if len(img.Config) == 0 {
+		// Images pulled before configs were stored have nothing to report
+		return info, nil
+	}
+
+	var config ImageConfig
+	if err := json.Unmarshal(img.Config, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %v", err)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal image config: %v", err)
+	}
+	info["info"] = string(data)
+	return info, nil
+}
+
+// configLabels returns the labels declared in a raw image config
+func configLabels(data []byte) map[string]string {
+	if len(data) == 0 {
+		return nil
+	}
+	var config ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil
+	}
+	return config.Config.Labels
+}
+
+// configPlatform returns the platform declared in a raw image config as
+// os/architecture[/variant], or an empty string if it declares none
+func configPlatform(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var config ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil || config.OS == "" || config.Architecture == "" {
+		return ""
+	}
+	platform := config.OS + "/" + config.Architecture
+	if config.Variant != "" {
+		platform += "/" + config.Variant
+	}
+	return platform
+}
+
+// getJSONBlob downloads a small JSON blob, such as the image config, and
+// verifies its digest
+func (s *ImageService) getJSONBlob(ctx context.Context, url, expectedDigest string, auth *runtime.AuthConfig) ([]byte, error) {
+	expected, err := normalizeDigest(expectedDigest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob digest %q: %v", expectedDigest, err)
+	}
+
+	ctx, cancel := s.withRequestTimeout(ctx)
+	defer cancel()
+
+	if err := s.waitForRegistry(ctx, url); err != nil {
+		return nil, fmt.Errorf("failed to get blob: %v", err)
+	}
+	blob, err := s.registryClient().GetBlob(ctx, url, auth, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %v", err)
+	}
+	defer blob.Body.Close()
+
+	// JSON blobs are held in memory, so they get the manifest size limit
+	limit := s.config.MaxManifestSize
+	if limit <= 0 {
+		limit = defaultMaxManifestSize
+	}
+	data, err := readLimited(blob.Body, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %v", err)
+	}
+
+	if actual := expected.Algorithm().FromBytes(data); actual != expected {
+		return nil, fmt.Errorf("blob %w: expected %s, got %s", ErrDigestMismatch, expected, actual)
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("blob %s is not valid JSON", expected)
+	}
+	return data, nil
+}
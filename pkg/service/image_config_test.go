@@ -0,0 +1,269 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestImageService_ImageInfo(t *testing.T) {
+	config := []byte(`{
+		"architecture": "amd64",
+		"os": "linux",
+		"config": {
+			"Env": ["PATH=/usr/bin"],
+			"Entrypoint": ["/bin/app"],
+			"Labels": {"maintainer": "team@example.com"}
+		}
+	}`)
+
+	registry := newTestRegistry(t)
+	registry.addImageWithConfig(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", config, []byte("layer"))
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	info, err := service.ImageInfo(context.Background(), imageRef)
+	if err != nil {
+		t.Fatalf("ImageInfo() error = %v", err)
+	}
+
+	var got ImageConfig
+	if err := json.Unmarshal([]byte(info["info"]), &got); err != nil {
+		t.Fatalf("Failed to decode info %q: %v", info["info"], err)
+	}
+	if got.Architecture != "amd64" || got.OS != "linux" {
+		t.Errorf("platform = %s/%s, want linux/amd64", got.OS, got.Architecture)
+	}
+	if !reflect.DeepEqual(got.Config.Env, []string{"PATH=/usr/bin"}) {
+		t.Errorf("Env = %v", got.Config.Env)
+	}
+	if !reflect.DeepEqual(got.Config.Entrypoint, []string{"/bin/app"}) {
+		t.Errorf("Entrypoint = %v", got.Config.Entrypoint)
+	}
+	if got.Config.Labels["maintainer"] != "team@example.com" {
+		t.Errorf("Labels = %v", got.Config.Labels)
+	}
+
+	// Non-verbose status carries none of the config
+	status, err := service.ImageStatus(context.Background(), imageRef)
+	if err != nil {
+		t.Fatalf("ImageStatus() error = %v", err)
+	}
+	if status.Spec != nil && len(status.Spec.Annotations) != 0 {
+		t.Errorf("non-verbose status exposes config: %v", status.Spec.Annotations)
+	}
+
+	// The config survives a restart
+	reloaded := newTestService(t, registry)
+	reloaded.metadataFile = service.metadataFile
+	if err := reloaded.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	info, err = reloaded.ImageInfo(context.Background(), imageRef)
+	if err != nil {
+		t.Fatalf("ImageInfo() after reload error = %v", err)
+	}
+	if info["info"] == "" {
+		t.Error("image config lost after reload")
+	}
+}
+
+func TestImageService_UncompressedSize(t *testing.T) {
+	// A highly compressible layer extracts to far more than it downloads
+	tarData := buildTar(t, map[string]string{"data": strings.Repeat("compressible ", 8192)})
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to create zstd encoder: %v", err)
+	}
+	zstdData := encoder.EncodeAll(tarData, nil)
+	encoder.Close()
+
+	tests := []struct {
+		name      string
+		mediaType string
+		layer     []byte
+	}{
+		{"gzip layer", "application/vnd.oci.image.layer.v1.tar+gzip", gzipBytes(t, tarData)},
+		{"zstd layer", "application/vnd.oci.image.layer.v1.tar+zstd", zstdData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+			registry.addImageWithMediaType(t, "library/app", "latest", tt.mediaType, tt.layer)
+			service := newTestService(t, registry)
+
+			imageRef := registry.host() + "/library/app:latest"
+			if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+
+			service.mu.RLock()
+			img := service.images[imageRef]
+			size, uncompressed := img.Size, img.UncompressedSize
+			service.mu.RUnlock()
+			if uncompressed != int64(len(tarData)) {
+				t.Errorf("UncompressedSize = %d, want %d", uncompressed, len(tarData))
+			}
+			if uncompressed <= size {
+				t.Errorf("UncompressedSize = %d, want more than the compressed Size %d", uncompressed, size)
+			}
+
+			info, err := service.ImageInfo(context.Background(), imageRef)
+			if err != nil {
+				t.Fatalf("ImageInfo() error = %v", err)
+			}
+			if got, want := info["size"], strconv.FormatInt(size, 10); got != want {
+				t.Errorf("info size = %q, want %q", got, want)
+			}
+			if got, want := info["uncompressedSize"], strconv.FormatInt(uncompressed, 10); got != want {
+				t.Errorf("info uncompressedSize = %q, want %q", got, want)
+			}
+
+			// Images recorded before the size was stored report their layers' sum
+			service.mu.Lock()
+			img.UncompressedSize = 0
+			service.mu.Unlock()
+			info, err = service.ImageInfo(context.Background(), imageRef)
+			if err != nil {
+				t.Fatalf("ImageInfo() error = %v", err)
+			}
+			if got, want := info["uncompressedSize"], strconv.FormatInt(uncompressed, 10); got != want {
+				t.Errorf("info uncompressedSize without a stored size = %q, want %q", got, want)
+			}
+
+			// Imports record the same size
+			var archive bytes.Buffer
+			if err := service.ExportImage(context.Background(), imageRef, &archive); err != nil {
+				t.Fatalf("ExportImage() error = %v", err)
+			}
+			target := newTestService(t, nil)
+			if _, err := target.LoadImageFromTar(context.Background(), &archive); err != nil {
+				t.Fatalf("LoadImageFromTar() error = %v", err)
+			}
+			if got := target.images[imageRef].UncompressedSize; got != int64(len(tarData)) {
+				t.Errorf("imported UncompressedSize = %d, want %d", got, len(tarData))
+			}
+		})
+	}
+}
+
+func TestImageService_PullRejectsCorruptConfig(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImageWithConfig(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", []byte(`{}`), []byte("layer"))
+	for dgst := range registry.blobs {
+		if string(registry.blobs[dgst]) == `{}` {
+			registry.blobs[dgst] = []byte(`{"tampered": true}`)
+		}
+	}
+	service := newTestService(t, registry)
+
+	// A config that does not match the manifest fails the pull
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("PullImage() error = %v, want %v", err, ErrDigestMismatch)
+	}
+	if service.HasImage(imageRef) {
+		t.Error("image with a tampered config was recorded")
+	}
+	if blobs := registry.blobRequests(); len(blobs) != 1 {
+		t.Errorf("blob requests = %v, want only the config before failing", blobs)
+	}
+}
+
+func TestImageService_PullWithoutConfig(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImageWithConfig(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", []byte(`{}`), []byte("layer"))
+	delete(registry.blobs, digest.FromBytes([]byte(`{}`)).String())
+	service := newTestService(t, registry)
+
+	// An image whose config cannot be fetched is still pulled
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	info, err := service.ImageInfo(context.Background(), imageRef)
+	if err != nil {
+		t.Fatalf("ImageInfo() error = %v", err)
+	}
+	if _, ok := info["info"]; ok {
+		t.Errorf("ImageInfo() exposed a config that was never fetched: %s", info["info"])
+	}
+}
+
+func TestImageService_ListImagesLabelFilter(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImageWithConfig(t, "library/web", "latest", "application/vnd.oci.image.layer.v1.tar",
+		[]byte(`{"config": {"Labels": {"maintainer": "web-team", "tier": "frontend"}}}`), []byte("web layer"))
+	registry.addImageWithConfig(t, "library/db", "latest", "application/vnd.oci.image.layer.v1.tar",
+		[]byte(`{"config": {"Labels": {"maintainer": "db-team"}}}`), []byte("db layer"))
+	service := newTestService(t, registry)
+
+	webRef := registry.host() + "/library/web:latest"
+	dbRef := registry.host() + "/library/db:latest"
+	for _, ref := range []string{webRef, dbRef} {
+		if _, err := service.PullImage(context.Background(), ref, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		selector map[string]string
+		want     []string
+	}{
+		{"no selector", nil, []string{dbRef, webRef}},
+		{"single label", map[string]string{"maintainer": "web-team"}, []string{webRef}},
+		{"all labels must match", map[string]string{"maintainer": "db-team", "tier": "frontend"}, nil},
+		{"unknown label", map[string]string{"owner": "nobody"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := &runtime.ImageFilter{Image: &runtime.ImageSpec{Annotations: tt.selector}}
+			images, err := service.ListImages(context.Background(), filter)
+			if err != nil {
+				t.Fatalf("ListImages() error = %v", err)
+			}
+
+			var got []string
+			for _, img := range images {
+				got = append(got, img.RepoTags...)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ociLayoutFile and ociIndexFile are the entry points of an OCI image
+	// layout
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+	// ociLayoutVersion is the image layout version written and accepted
+	ociLayoutVersion = "1.0.0"
+
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+
+	// ociImageNameAnnotation carries the full reference of an image in the
+	// index, ociRefNameAnnotation its tag
+	ociImageNameAnnotation = "io.containerd.image.name"
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name"
+)
+
+// ociLayout is the content of the oci-layout file
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// ociDescriptor references a blob of an image layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociIndex is the content of the index.json file
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ExportImage writes imageRef to w as a tar archive in the OCI image layout,
+// holding its config, its layers and a manifest referencing them
+func (s *ImageService) ExportImage(ctx context.Context, imageRef string, w io.Writer) error {
+	s.mu.RLock()
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	if !ok || !img.ready() {
+		s.mu.RUnlock()
+		return fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	layers := append([]LayerMetadata(nil), img.Layers...)
+	config := append([]byte(nil), img.Config...)
+	s.mu.RUnlock()
+
+	// Images pulled before configs were stored get a config describing
+	// just their layers
+	if len(config) == 0 {
+		var err error
+		if config, err = layersConfig(layers); err != nil {
+			return err
+		}
+	}
+
+	manifest := DockerManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+	}
+	manifest.Config.MediaType = ociConfigMediaType
+	manifest.Config.Size = int64(len(config))
+	manifest.Config.Digest = digest.FromBytes(config).String()
+	for i, layer := range layers {
+		layerDigest, err := normalizeDigest(layer.Digest)
+		if err != nil {
+			return fmt.Errorf("layer %d: invalid digest %q: %v", i, layer.Digest, err)
+		}
+		fi, err := os.Stat(layer.Path)
+		if err != nil {
+			return fmt.Errorf("failed to get size of layer %d: %v", i, err)
+		}
+		mediaType, err := sniffLayerMediaType(layer.Path)
+		if err != nil {
+			return fmt.Errorf("layer %d: %v", i, err)
+		}
+		manifest.Layers = append(manifest.Layers, struct {
+			MediaType string   `json:"mediaType"`
+			Size      int64    `json:"size"`
+			Digest    string   `json:"digest"`
+			URLs      []string `json:"urls,omitempty"`
+		}{
+			MediaType: mediaType,
+			Size:      fi.Size(),
+			Digest:    layerDigest.String(),
+		})
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+
+	layoutData, err := json.Marshal(ociLayout{ImageLayoutVersion: ociLayoutVersion})
+	if err != nil {
+		return fmt.Errorf("failed to marshal image layout: %v", err)
+	}
+	indexData, err := json.Marshal(ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests: []ociDescriptor{{
+			MediaType: ociManifestMediaType,
+			Digest:    digest.FromBytes(manifestData).String(),
+			Size:      int64(len(manifestData)),
+			Annotations: map[string]string{
+				ociImageNameAnnotation: imageRef,
+				ociRefNameAnnotation:   refName(imageRef),
+			},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %v", err)
+	}
+
+	tw := tar.NewWriter(w)
+	written := make(map[string]bool)
+	writeBlob := func(blobDigest string, size int64, r io.Reader) error {
+		if written[blobDigest] {
+			return nil
+		}
+		written[blobDigest] = true
+		dgst := digest.Digest(blobDigest)
+		name := path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+		return writeTarFile(tw, name, size, r)
+	}
+
+	if err := writeTarFile(tw, ociLayoutFile, int64(len(layoutData)), bytes.NewReader(layoutData)); err != nil {
+		return err
+	}
+	if err := writeBlob(manifest.Config.Digest, int64(len(config)), bytes.NewReader(config)); err != nil {
+		return err
+	}
+	for i, layer := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := os.Open(layers[i].Path)
+		if err != nil {
+			return fmt.Errorf("failed to open layer %d: %v", i, err)
+		}
+		err = writeBlob(layer.Digest, layer.Size, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeBlob(digest.FromBytes(manifestData).String(), int64(len(manifestData)), bytes.NewReader(manifestData)); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ociIndexFile, int64(len(indexData)), bytes.NewReader(indexData)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %v", err)
+	}
+	return nil
+}
+
+// writeTarFile writes a regular file of size bytes read from r to tw
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// refName returns the tag of imageRef for the ref name annotation, or the
+// reference itself when it has no tag
+func refName(imageRef string) string {
+	named, err := parseImageReference(imageRef)
+	if err != nil {
+		return imageRef
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return imageRef
+}
+
+// layersConfig returns a minimal image config declaring the diffIDs of
+// layers
+func layersConfig(layers []LayerMetadata) ([]byte, error) {
+	var config struct {
+		RootFS struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{}
+	for _, layer := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.DiffID)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal image config: %v", err)
+	}
+	return data, nil
+}
+
+// sniffLayerMediaType derives the media type of the layer stored at path
+// from the magic number of its compression, as the media type the layer was
+// pulled with is not recorded
+func sniffLayerMediaType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open layer: %v", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read layer: %v", err)
+	}
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "application/vnd.oci.image.layer.v1.tar+gzip", nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "application/vnd.oci.image.layer.v1.tar+zstd", nil
+	default:
+		return "application/vnd.oci.image.layer.v1.tar", nil
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestImageService_ExportImageRoundTrip(t *testing.T) {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(buildTar(t, map[string]string{"etc/hostname": "exported"}))
+	zw.Close()
+	plain := buildTar(t, map[string]string{"usr/bin/app": "binary"})
+
+	registry := newTestRegistry(t)
+	config := []byte(`{"architecture":"amd64","os":"linux","config":{"Labels":{"stage":"export"}}}`)
+	registry.addImageWithConfig(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar+gzip", config, gzipped.Bytes())
+	registry.addImageWithConfig(t, "library/plain", "latest", "application/vnd.oci.image.layer.v1.tar", config, plain)
+
+	source := newTestService(t, registry)
+	for _, repo := range []string{"library/app", "library/plain"} {
+		imageRef := registry.host() + "/" + repo + ":latest"
+		if _, err := source.PullImage(context.Background(), imageRef, nil); err != nil {
+			t.Fatalf("PullImage() error = %v", err)
+		}
+
+		var archive bytes.Buffer
+		if err := source.ExportImage(context.Background(), imageRef, &archive); err != nil {
+			t.Fatalf("ExportImage() error = %v", err)
+		}
+
+		// The archive is an OCI image layout
+		entries := make(map[string]bool)
+		tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read archive: %v", err)
+			}
+			entries[hdr.Name] = true
+		}
+		for _, name := range []string{ociLayoutFile, ociIndexFile} {
+			if !entries[name] {
+				t.Errorf("archive of %s has no %s", repo, name)
+			}
+		}
+
+		target := newTestService(t, nil)
+		loaded, err := target.LoadImageFromTar(context.Background(), &archive)
+		if err != nil {
+			t.Fatalf("LoadImageFromTar() error = %v", err)
+		}
+		if !reflect.DeepEqual(loaded, []string{imageRef}) {
+			t.Errorf("LoadImageFromTar() = %v, want [%s]", loaded, imageRef)
+		}
+
+		want, err := source.ImageStatus(context.Background(), imageRef)
+		if err != nil {
+			t.Fatalf("ImageStatus() error = %v", err)
+		}
+		got, err := target.ImageStatus(context.Background(), imageRef)
+		if err != nil {
+			t.Fatalf("ImageStatus() of imported image error = %v", err)
+		}
+		if got.Id != want.Id || got.Size_ != want.Size_ {
+			t.Errorf("imported image = %s (%d bytes), want %s (%d bytes)", got.Id, got.Size_, want.Id, want.Size_)
+		}
+
+		wantLayers, _ := source.ImageLayers(imageRef)
+		gotLayers, _ := target.ImageLayers(imageRef)
+		if len(gotLayers) != len(wantLayers) || gotLayers[0].DiffID != wantLayers[0].DiffID {
+			t.Errorf("imported layers = %+v, want %+v", gotLayers, wantLayers)
+		}
+		if labels := target.images[imageRef].Labels; labels["stage"] != "export" {
+			t.Errorf("imported labels = %v, want the config labels", labels)
+		}
+	}
+}
+
+// renameArchive rewrites the image names in the index of an exported
+// archive to name
+func renameArchive(t *testing.T, archive []byte, name string) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", hdr.Name, err)
+		}
+		if hdr.Name == ociIndexFile {
+			var index ociIndex
+			if err := json.Unmarshal(data, &index); err != nil {
+				t.Fatalf("Failed to decode index: %v", err)
+			}
+			for _, desc := range index.Manifests {
+				desc.Annotations[ociImageNameAnnotation] = name
+				delete(desc.Annotations, ociRefNameAnnotation)
+			}
+			if data, err = json.Marshal(index); err != nil {
+				t.Fatalf("Failed to encode index: %v", err)
+			}
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write %s: %v", hdr.Name, err)
+		}
+		tw.Write(data)
+	}
+	tw.Close()
+	return out.Bytes()
+}
+
+func TestImageService_LoadImageFromTarNormalizesNames(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", gzipBytes(t, []byte("imported layer")))
+	source := newTestService(t, registry)
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := source.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	var archive bytes.Buffer
+	if err := source.ExportImage(context.Background(), imageRef, &archive); err != nil {
+		t.Fatalf("ExportImage() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{registry.host() + "/library/app", imageRef},
+		{"app:v1", "docker.io/library/app:v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newTestService(t, nil)
+			loaded, err := target.LoadImageFromTar(context.Background(), bytes.NewReader(renameArchive(t, archive.Bytes(), tt.name)))
+			if err != nil {
+				t.Fatalf("LoadImageFromTar() error = %v", err)
+			}
+			if !reflect.DeepEqual(loaded, []string{tt.want}) {
+				t.Errorf("LoadImageFromTar() = %v, want [%s]", loaded, tt.want)
+			}
+			img, ok := target.images[tt.want]
+			if !ok || len(target.images) != 1 {
+				t.Fatalf("imported image not stored under %s: %v", tt.want, target.images)
+			}
+			if !reflect.DeepEqual(img.RepoTags, []string{tt.want}) {
+				t.Errorf("RepoTags = %v, want [%s]", img.RepoTags, tt.want)
+			}
+			if !target.HasImage(tt.name) {
+				t.Errorf("imported image not found by %s", tt.name)
+			}
+		})
+	}
+
+	// A pull of the imported image finds it instead of downloading it again
+	target := newTestService(t, nil)
+	target.client = source.client
+	if _, err := target.LoadImageFromTar(context.Background(), bytes.NewReader(renameArchive(t, archive.Bytes(), registry.host()+"/library/app"))); err != nil {
+		t.Fatalf("LoadImageFromTar() error = %v", err)
+	}
+	before := registry.hitCount("/v2/library/app/manifests/latest")
+	if _, err := target.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if registry.hitCount("/v2/library/app/manifests/latest") != before {
+		t.Error("PullImage() downloaded an imported image again")
+	}
+	images, err := target.ListImages(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("ListImages() error = %v", err)
+	}
+	if len(images) != 1 || !reflect.DeepEqual(images[0].RepoTags, []string{imageRef}) {
+		t.Errorf("ListImages() = %v, want one image tagged %s", images, imageRef)
+	}
+}
+
+func TestImageService_ExportMissingImage(t *testing.T) {
+	service := newTestService(t, nil)
+	if err := service.ExportImage(context.Background(), "missing:latest", io.Discard); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("ExportImage() error = %v, want %v", err, ErrImageNotFound)
+	}
+}
+
+func TestImageService_LoadImageFromTarInvalid(t *testing.T) {
+	blob := []byte("blob content")
+
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			name:  "no layout",
+			files: map[string]string{ociIndexFile: `{"schemaVersion":2,"manifests":[]}`},
+		},
+		{
+			name: "no images",
+			files: map[string]string{
+				ociLayoutFile: `{"imageLayoutVersion":"1.0.0"}`,
+				ociIndexFile:  `{"schemaVersion":2,"manifests":[]}`,
+			},
+		},
+		{
+			name: "blob digest mismatch",
+			files: map[string]string{
+				ociLayoutFile: `{"imageLayoutVersion":"1.0.0"}`,
+				"blobs/sha256/" + "0000000000000000000000000000000000000000000000000000000000000000": string(blob),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, nil)
+			if _, err := service.LoadImageFromTar(context.Background(), bytes.NewReader(buildTar(t, tt.files))); err == nil {
+				t.Error("LoadImageFromTar() should fail")
+			}
+			if len(service.images) != 0 {
+				t.Errorf("failed import recorded %d images", len(service.images))
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// isForeignLayer reports whether mediaType marks a layer that registries
+// may not distribute, such as a Windows base layer
+func isForeignLayer(mediaType string) bool {
+	return strings.Contains(mediaType, ".foreign.") || strings.Contains(mediaType, ".nondistributable.")
+}
+
+// downloadForeignLayer downloads a layer from the first of urls that serves
+// it. The URLs point outside the registry, so no credentials are sent, and
+// the content is verified against the layer digest as for registry blobs.
+func (s *ImageService) downloadForeignLayer(ctx context.Context, urls []string, layerPath, expectedDigest string, expectedSize int64, progress func(PullStatus, int64)) error {
+	err := fmt.Errorf("no usable URL for foreign layer %s", expectedDigest)
+	for _, rawURL := range urls {
+		u, parseErr := url.Parse(rawURL)
+		if parseErr != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			s.log().Warn("skipping invalid foreign layer URL", "digest", expectedDigest, "url", rawURL)
+			continue
+		}
+
+		err = s.downloadLayer(ctx, u.String(), layerPath, expectedDigest, expectedSize, nil, progress)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		s.log().Warn("failed to download foreign layer", "digest", expectedDigest, "url", rawURL, "error", err)
+	}
+	return err
+}
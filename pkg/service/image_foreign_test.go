@@ -0,0 +1,139 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// addForeignImage registers an image whose single layer is declared with
+// urls but not stored in the registry
+func addForeignImage(t *testing.T, registry *testRegistry, repo, mediaType string, layer []byte, urls ...string) {
+	t.Helper()
+
+	var manifest DockerManifest
+	manifest.SchemaVersion = 2
+	manifest.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	manifest.Config.MediaType = "application/vnd.docker.container.image.v1+json"
+	manifest.Config.Size = 2
+	manifest.Config.Digest = digest.FromBytes([]byte(`{}`)).String()
+	manifest.Layers = append(manifest.Layers, struct {
+		MediaType string   `json:"mediaType"`
+		Size      int64    `json:"size"`
+		Digest    string   `json:"digest"`
+		URLs      []string `json:"urls,omitempty"`
+	}{
+		MediaType: mediaType,
+		Size:      int64(len(layer)),
+		Digest:    digest.FromBytes(layer).String(),
+		URLs:      urls,
+	})
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.blobs[manifest.Config.Digest] = []byte(`{}`)
+	registry.manifests[repo+":latest"] = data
+}
+
+func TestImageService_PullForeignLayers(t *testing.T) {
+	layer := gzipBytes(t, []byte("windows base layer served outside the registry"))
+
+	// The external server records whether it was handed credentials
+	var mu sync.Mutex
+	var authorizations []string
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/layer":
+			w.Write(layer)
+		case "/corrupt":
+			w.Write(gzipBytes(t, []byte("not the declared layer")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer external.Close()
+
+	registry := newTestRegistry(t)
+	addForeignImage(t, registry, "library/foreign", "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", layer,
+		"ftp://example.com/layer", external.URL+"/missing", external.URL+"/layer")
+	addForeignImage(t, registry, "library/urls", "application/vnd.docker.image.rootfs.diff.tar.gzip", layer,
+		external.URL+"/layer")
+	addForeignImage(t, registry, "library/corrupt", "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip", layer,
+		external.URL+"/corrupt")
+	auth := &runtime.AuthConfig{Username: "user", Password: "secret"}
+
+	tests := []struct {
+		name    string
+		repo    string
+		wantErr error
+	}{
+		{name: "foreign layer from the first working URL", repo: "library/foreign"},
+		{name: "registry missing a layer with URLs", repo: "library/urls"},
+		{name: "URL serving other content", repo: "library/corrupt", wantErr: ErrDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, registry)
+			imageRef := registry.host() + "/" + tt.repo + ":latest"
+
+			_, err := service.PullImage(context.Background(), imageRef, auth)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("PullImage() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+			layers, err := service.ImageLayers(imageRef)
+			if err != nil {
+				t.Fatalf("ImageLayers() error = %v", err)
+			}
+			if len(layers) != 1 || layers[0].Digest != digest.FromBytes(layer).String() {
+				t.Errorf("layers = %+v, want the foreign layer", layers)
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(authorizations) == 0 {
+		t.Fatal("the external server was never asked for a layer")
+	}
+	for _, authorization := range authorizations {
+		if authorization != "" {
+			t.Errorf("registry credentials sent to a foreign layer URL: %q", authorization)
+		}
+	}
+}
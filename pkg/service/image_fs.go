@@ -0,0 +1,45 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FilesystemUsage returns the bytes and inodes used under the image root
+func (s *ImageService) FilesystemUsage() (usedBytes, inodesUsed uint64, err error) {
+	err = filepath.Walk(s.imageRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may be removed by GC or pulls while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		inodesUsed++
+		if info.Mode().IsRegular() {
+			usedBytes += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to walk image root: %v", err)
+	}
+	return usedBytes, inodesUsed, nil
+}
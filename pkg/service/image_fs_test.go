@@ -0,0 +1,49 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageService_FilesystemUsage(t *testing.T) {
+	service := newTestService(t, nil)
+
+	layerDir := filepath.Join(service.imageRoot, "blobs", "sha256")
+	if err := os.MkdirAll(layerDir, 0755); err != nil {
+		t.Fatalf("Failed to create layer directory: %v", err)
+	}
+	for name, size := range map[string]int{"a": 100, "b": 28} {
+		if err := os.WriteFile(filepath.Join(layerDir, name), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to create layer file: %v", err)
+		}
+	}
+
+	usedBytes, inodesUsed, err := service.FilesystemUsage()
+	if err != nil {
+		t.Fatalf("FilesystemUsage() error = %v", err)
+	}
+	if usedBytes != 128 {
+		t.Errorf("FilesystemUsage() used bytes = %d, want 128", usedBytes)
+	}
+	// The root, blobs, sha256 and the two files
+	if inodesUsed != 5 {
+		t.Errorf("FilesystemUsage() inodes = %d, want 5", inodesUsed)
+	}
+}
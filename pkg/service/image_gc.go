@@ -1,19 +1,32 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type GarbageCollector struct {
 	imageService *ImageService
-	interval     time.Duration
 	stopCh       chan struct{}
 	wg           sync.WaitGroup
-	stats        GCStats
+	// intervalMu guards interval, which SetInterval changes while run
+	// ticks; resetCh wakes run to pick up the new interval
+	intervalMu sync.Mutex
+	interval   time.Duration
+	resetCh    chan struct{}
+	// now returns the current time, time.Now unless replaced by tests
+	now func() time.Time
+
+	// statsMu guards stats, which run updates while callers read them
+	statsMu sync.Mutex
+	stats   GCStats
 }
 
 type GCStats struct {
@@ -21,10 +34,15 @@ type GCStats struct {
 	TotalCollections   int
 	TotalLayersRemoved int
 	LastCollectionSize int64
+	// CumulativeBytesReclaimed is the total size of the layers removed
+	// across all collections
+	CumulativeBytesReclaimed int64
 }
 
-// GetStats returns current garbage collection statistics
+// GetStats returns a snapshot of the garbage collection statistics
 func (gc *GarbageCollector) GetStats() GCStats {
+	gc.statsMu.Lock()
+	defer gc.statsMu.Unlock()
 	return gc.stats
 }
 
@@ -33,9 +51,37 @@ func NewGarbageCollector(imageService *ImageService, interval time.Duration) *Ga
 		imageService: imageService,
 		interval:     interval,
 		stopCh:       make(chan struct{}),
+		resetCh:      make(chan struct{}, 1),
+		now:          time.Now,
 	}
 }
 
+// SetInterval changes how often garbage is collected, restarting the wait
+// for the next collection from now
+func (gc *GarbageCollector) SetInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid garbage collection interval %v", interval)
+	}
+
+	gc.intervalMu.Lock()
+	gc.interval = interval
+	gc.intervalMu.Unlock()
+
+	// A pending reset already makes run read the new interval
+	select {
+	case gc.resetCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// getInterval returns the current collection interval
+func (gc *GarbageCollector) getInterval() time.Duration {
+	gc.intervalMu.Lock()
+	defer gc.intervalMu.Unlock()
+	return gc.interval
+}
+
 func (gc *GarbageCollector) Start() {
 	gc.wg.Add(1)
 	go gc.run()
@@ -48,33 +94,61 @@ func (gc *GarbageCollector) Stop() {
 
 func (gc *GarbageCollector) run() {
 	defer gc.wg.Done()
-	ticker := time.NewTicker(gc.interval)
+	ticker := time.NewTicker(gc.getInterval())
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-gc.stopCh:
 			return
+		case <-gc.resetCh:
+			ticker.Reset(gc.getInterval())
 		case <-ticker.C:
 			if err := gc.collectGarbage(); err != nil {
-				fmt.Printf("Garbage collection failed: %v\n", err)
+				gc.imageService.log().Error("garbage collection failed", "error", err)
 			}
 		}
 	}
 }
 
 func (gc *GarbageCollector) collectGarbage() error {
-	fmt.Println("Starting garbage collection...")
+	gc.imageService.log().Debug("starting garbage collection")
 	start := time.Now()
+	now := start
+	if gc.now != nil {
+		now = gc.now()
+	}
+
+	// Drop images whose pull was interrupted long ago
+	gc.collectAbandonedPulls(now)
+
+	// Drop images that have not been used for too long
+	gc.collectOldImages(now)
 
-	// Get all layer files in the image root
-	layerFiles := make(map[string]bool)
+	// Get all layer files in the image root: blobs in the shared store,
+	// keyed by their digest, and per-image layer.tar files left by older
+	// versions
+	blobRoot := filepath.Join(gc.imageService.imageRoot, blobsDir)
+	rootfsRoot := filepath.Join(gc.imageService.imageRoot, rootfsDir)
+	blobFiles := make(map[string]string)
+	var legacyFiles []string
 	err := filepath.Walk(gc.imageService.imageRoot, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && filepath.Base(path) == "layer.tar" {
-			layerFiles[path] = true
+		if info.IsDir() {
+			// Extracted root filesystems are collected separately
+			if path == rootfsRoot {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel, err := filepath.Rel(blobRoot, path); err == nil && !strings.HasPrefix(rel, "..") {
+			if !strings.HasSuffix(path, ".tmp") {
+				blobFiles[path] = strings.Replace(filepath.ToSlash(rel), "/", ":", 1)
+			}
+		} else if filepath.Base(path) == "layer.tar" {
+			legacyFiles = append(legacyFiles, path)
 		}
 		return nil
 	})
@@ -82,41 +156,174 @@ func (gc *GarbageCollector) collectGarbage() error {
 		return fmt.Errorf("failed to walk image directory: %v", err)
 	}
 
-	// Get all layers referenced by images
-	gc.imageService.mu.RLock()
-	referencedLayers := make(map[string]bool)
-	for _, img := range gc.imageService.images {
-		for _, layer := range img.Layers {
-			referencedLayers[layer.Path] = true
+	// Blobs are reclaimed once no image references their digest and no
+	// pull claims it, legacy files once no image references their path
+	gc.imageService.mu.Lock()
+	var unreferenced []string
+	for path, blobDigest := range blobFiles {
+		if !gc.imageService.layerInUse(blobDigest) {
+			unreferenced = append(unreferenced, path)
 		}
 	}
-	gc.imageService.mu.RUnlock()
+	if len(legacyFiles) > 0 {
+		referencedLayers := make(map[string]bool)
+		for _, img := range gc.imageService.images {
+			for _, layer := range img.Layers {
+				referencedLayers[layer.Path] = true
+			}
+		}
+		for _, path := range legacyFiles {
+			if !referencedLayers[path] {
+				unreferenced = append(unreferenced, path)
+			}
+		}
+	}
+	gc.imageService.mu.Unlock()
 
-	// Remove unreferenced layer files
+	// Remove unreferenced layer files, along with the legacy layer and
+	// image directories they leave empty
 	var removed int
 	var totalSize int64
-	for path := range layerFiles {
-		if !referencedLayers[path] {
-			info, err := os.Stat(path)
-			if err != nil {
+	for _, path := range unreferenced {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		blobDigest, isBlob := blobFiles[path]
+		if isBlob {
+			// A pull may have claimed the blob since it was found
+			// unreferenced, so that is checked again under the lock
+			// pulls claim layers under
+			gc.imageService.mu.Lock()
+			if gc.imageService.layerInUse(blobDigest) {
+				gc.imageService.mu.Unlock()
 				continue
 			}
-			totalSize += info.Size()
-			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-				fmt.Printf("Failed to remove unreferenced layer %s: %v\n", path, err)
-				continue
+			err = os.Remove(path)
+			if err == nil {
+				gc.imageService.layerCache.Remove(blobDigest)
 			}
-			removed++
+			gc.imageService.mu.Unlock()
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			gc.imageService.log().Error("failed to remove unreferenced layer", "path", path, "error", err)
+			continue
+		}
+		totalSize += info.Size()
+		removed++
+		if !isBlob {
+			gc.imageService.removeEmptyParents(path)
 		}
 	}
 
+	// Remove the extracted root filesystems of removed images
+	rootfsRemoved := gc.collectExtractedRootfs()
+
 	// Update stats
-	gc.stats.LastRun = start
+	gc.statsMu.Lock()
+	gc.stats.LastRun = now
 	gc.stats.TotalCollections++
 	gc.stats.TotalLayersRemoved += removed
 	gc.stats.LastCollectionSize = totalSize
+	gc.stats.CumulativeBytesReclaimed += totalSize
+	gc.statsMu.Unlock()
 
-	fmt.Printf("Garbage collection completed: removed %d unreferenced layers (%.2f MB)\n",
-		removed, float64(totalSize)/1024/1024)
+	gc.imageService.log().Info("garbage collection completed",
+		"layers_removed", removed,
+		"rootfs_removed", rootfsRemoved,
+		"bytes", totalSize,
+		"duration", time.Since(start))
 	return nil
 }
+
+// collectOldImages removes images that are not pinned and have not been
+// used within the configured maximum image age
+func (gc *GarbageCollector) collectOldImages(now time.Time) {
+	maxAge := gc.imageService.config.MaxImageAge
+	if maxAge <= 0 {
+		return
+	}
+
+	gc.imageService.mu.RLock()
+	var expired []string
+	for ref, img := range gc.imageService.images {
+		// Images recorded before use was tracked have no known age
+		if !img.ready() || img.Pinned || img.LastUsedAt.IsZero() {
+			continue
+		}
+		if _, inFlight := gc.imageService.pulls[ref]; inFlight {
+			continue
+		}
+		if now.Sub(img.LastUsedAt) > maxAge {
+			expired = append(expired, ref)
+		}
+	}
+	gc.imageService.mu.RUnlock()
+
+	for _, ref := range expired {
+		if err := gc.imageService.removeImage(context.Background(), ref); err != nil {
+			gc.imageService.log().Error("failed to remove unused image", "image", ref, "error", err)
+			continue
+		}
+		gc.imageService.log().Info("removed unused image", "image", ref, "max_age", maxAge)
+	}
+}
+
+// removeEmptyParents removes the directories above path that are left empty,
+// stopping at the image root or at the first directory that still has
+// entries, such as a referenced layer
+func (s *ImageService) removeEmptyParents(path string) {
+	root := filepath.Clean(s.imageRoot)
+	for dir := filepath.Dir(path); dir != root; dir = filepath.Dir(dir) {
+		if rel, err := filepath.Rel(root, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return
+		}
+		// Remove fails on a directory that is not empty
+		if err := os.Remove(dir); err != nil {
+			if !os.IsNotExist(err) && !isDirNotEmpty(err) {
+				s.log().Warn("failed to remove empty directory", "path", dir, "error", err)
+			}
+			return
+		}
+	}
+}
+
+// isDirNotEmpty reports whether err is caused by removing a directory that
+// still has entries
+func isDirNotEmpty(err error) bool {
+	return errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST)
+}
+
+// collectAbandonedPulls removes images that never became ready and are not
+// being pulled by this process anymore
+func (gc *GarbageCollector) collectAbandonedPulls(now time.Time) {
+	timeout := gc.imageService.config.AbandonedPullTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	gc.imageService.mu.RLock()
+	var abandoned []string
+	for ref, img := range gc.imageService.images {
+		if img.ready() {
+			continue
+		}
+		if _, inFlight := gc.imageService.pulls[ref]; inFlight {
+			continue
+		}
+		if now.Sub(img.PullStartedAt) > timeout {
+			abandoned = append(abandoned, ref)
+		}
+	}
+	gc.imageService.mu.RUnlock()
+
+	for _, ref := range abandoned {
+		if err := gc.imageService.removeImage(context.Background(), ref); err != nil {
+			gc.imageService.log().Error("failed to remove abandoned image", "image", ref, "error", err)
+			continue
+		}
+		gc.imageService.log().Info("removed abandoned partially pulled image", "image", ref)
+	}
+}
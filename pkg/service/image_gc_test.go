@@ -1,10 +1,17 @@
 package service
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/opencontainers/go-digest"
 )
 
 func TestGarbageCollector(t *testing.T) {
@@ -54,7 +61,7 @@ func TestGarbageCollector(t *testing.T) {
 	defer gc.Stop()
 
 	// Wait for garbage collection to run
-	time.Sleep(200 * time.Millisecond)
+	waitForCollections(t, gc, 1)
 
 	// Verify referenced layer still exists
 	if _, err := os.Stat(layers[0].path); err != nil {
@@ -121,16 +128,17 @@ func TestGarbageCollectorInAction(t *testing.T) {
 	defer gc.Stop()
 
 	// Wait for garbage collection to run
-	time.Sleep(200 * time.Millisecond)
+	waitForCollections(t, gc, 1)
 
 	// Check GC stats
 	stats := gc.GetStats()
 	if stats.TotalLayersRemoved != 2 {
 		t.Errorf("Expected 2 layers to be removed, got %d", stats.TotalLayersRemoved)
 	}
-	if stats.LastCollectionSize != 20*1024*1024 { // 2 layers * 10MB
+	// Later collections find nothing left to remove, so check the total
+	if stats.CumulativeBytesReclaimed != 20*1024*1024 { // 2 layers * 10MB
 		t.Errorf("Expected 20MB to be removed, got %.2f MB",
-			float64(stats.LastCollectionSize)/1024/1024)
+			float64(stats.CumulativeBytesReclaimed)/1024/1024)
 	}
 
 	// Verify disk space was actually freed
@@ -154,3 +162,238 @@ func TestGarbageCollectorInAction(t *testing.T) {
 		t.Errorf("Expected %d bytes remaining, got %d", expectedSize, totalSize)
 	}
 }
+
+func TestGarbageCollector_RemovesEmptyDirectories(t *testing.T) {
+	service := newTestService(t, nil)
+	root := service.imageRoot
+
+	// An orphaned image whose only layer is unreferenced, and a referenced
+	// image sharing the same parent directory
+	orphan := filepath.Join(root, "images", "sha256-orphan", "layer-0", "layer.tar")
+	kept := filepath.Join(root, "images", "sha256-kept", "layer-0", "layer.tar")
+	for _, path := range []string{orphan, kept} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create layer directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("layer"), 0644); err != nil {
+			t.Fatalf("Failed to create layer file: %v", err)
+		}
+	}
+	service.images["kept:latest"] = &imageMetadata{
+		Layers: []LayerMetadata{{Path: kept}},
+	}
+
+	gc := NewGarbageCollector(service, time.Hour)
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "images", "sha256-orphan")); !os.IsNotExist(err) {
+		t.Errorf("empty image directory was not removed: %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("referenced layer was removed: %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("image root was removed: %v", err)
+	}
+}
+
+func TestGarbageCollector_ConcurrentGetStats(t *testing.T) {
+	service := newTestService(t, nil)
+	gc := NewGarbageCollector(service, time.Millisecond)
+	gc.Start()
+	defer gc.Stop()
+
+	// Run under -race: reads must not race with the collections updating
+	// the stats
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				stats := gc.GetStats()
+				if stats.CumulativeBytesReclaimed < stats.LastCollectionSize {
+					t.Errorf("cumulative bytes %d below last collection size %d",
+						stats.CumulativeBytesReclaimed, stats.LastCollectionSize)
+					return
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitForCollections(t, gc, 2)
+}
+
+// waitForCollections waits until gc has completed at least n collections
+func waitForCollections(t *testing.T, gc *GarbageCollector, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gc.GetStats().TotalCollections < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("garbage collector did not complete %d collections", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGarbageCollector_AbandonedPulls(t *testing.T) {
+	service := newTestService(t, nil)
+	service.config.AbandonedPullTimeout = time.Minute
+
+	now := time.Now()
+	service.images["stale:latest"] = &imageMetadata{
+		ID:            "sha256:stale",
+		RepoTags:      []string{"stale:latest"},
+		State:         imageStatePulling,
+		PullStartedAt: now.Add(-time.Hour),
+	}
+	service.images["fresh:latest"] = &imageMetadata{
+		ID:            "sha256:fresh",
+		RepoTags:      []string{"fresh:latest"},
+		State:         imageStatePulling,
+		PullStartedAt: now.Add(-time.Second),
+	}
+	service.images["ready:latest"] = &imageMetadata{
+		ID:       "sha256:ready",
+		RepoTags: []string{"ready:latest"},
+		State:    imageStateReady,
+	}
+
+	// A not-ready image must not be reported as present
+	if service.HasImage("stale:latest") {
+		t.Error("HasImage() reported a partially pulled image")
+	}
+	if _, err := service.ImageStatus(context.Background(), "stale:latest"); err == nil {
+		t.Error("ImageStatus() returned a partially pulled image")
+	}
+	images, _ := service.ListImages(context.Background(), nil)
+	if len(images) != 1 || images[0].Id != "sha256:ready" {
+		t.Errorf("ListImages() = %v, want only the ready image", images)
+	}
+
+	gc := NewGarbageCollector(service, time.Hour)
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+
+	if _, ok := service.images["stale:latest"]; ok {
+		t.Error("abandoned image was not cleaned up")
+	}
+	if _, ok := service.images["fresh:latest"]; !ok {
+		t.Error("recently started pull was cleaned up too early")
+	}
+	if !service.HasImage("ready:latest") {
+		t.Error("ready image was removed")
+	}
+}
+
+func TestGarbageCollector_MaxImageAge(t *testing.T) {
+	service := newTestService(t, nil)
+	service.config.MaxImageAge = 7 * 24 * time.Hour
+
+	now := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	service.images["old:latest"] = &imageMetadata{
+		ID:         "sha256:old",
+		RepoTags:   []string{"old:latest"},
+		LastUsedAt: now.Add(-8 * 24 * time.Hour),
+	}
+	service.images["recent:latest"] = &imageMetadata{
+		ID:         "sha256:recent",
+		RepoTags:   []string{"recent:latest"},
+		LastUsedAt: now.Add(-24 * time.Hour),
+	}
+	service.images["pinned:latest"] = &imageMetadata{
+		ID:         "sha256:pinned",
+		RepoTags:   []string{"pinned:latest"},
+		LastUsedAt: now.Add(-30 * 24 * time.Hour),
+		Pinned:     true,
+	}
+	service.images["untracked:latest"] = &imageMetadata{
+		ID:       "sha256:untracked",
+		RepoTags: []string{"untracked:latest"},
+	}
+
+	gc := NewGarbageCollector(service, time.Hour)
+	gc.now = func() time.Time { return now }
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+
+	if service.HasImage("old:latest") {
+		t.Error("image unused for longer than the maximum age was kept")
+	}
+	for _, ref := range []string{"recent:latest", "pinned:latest", "untracked:latest"} {
+		if !service.HasImage(ref) {
+			t.Errorf("%s was removed", ref)
+		}
+	}
+
+	// Time passes until the recent image expires as well
+	now = now.Add(7 * 24 * time.Hour)
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+	if service.HasImage("recent:latest") {
+		t.Error("image was kept after exceeding the maximum age")
+	}
+	if !service.HasImage("pinned:latest") {
+		t.Error("pinned image was removed")
+	}
+}
+
+func TestGarbageCollector_KeepsLayersOfInFlightPulls(t *testing.T) {
+	layers := [][]byte{gzipBytes(t, []byte("first layer")), gzipBytes(t, []byte("second layer"))}
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", layers...)
+
+	var service *ImageService
+	var gc *GarbageCollector
+	// Collect garbage and purge the cache while the pull is between its
+	// layers, after the first one is stored and before the image commits
+	secondBlob := "/v2/library/app/blobs/" + digest.FromBytes(layers[1]).String()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == secondBlob {
+			if err := gc.collectGarbage(); err != nil {
+				t.Errorf("collectGarbage() error = %v", err)
+			}
+			service.PurgeLayerCache()
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service = newTestService(t, registry)
+	gc = NewGarbageCollector(service, time.Hour)
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	pulled, err := service.ImageLayers(imageRef)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	for i, layer := range pulled {
+		if _, err := os.Stat(layer.Path); err != nil {
+			t.Errorf("layer %d of the committed image is missing: %v", i, err)
+		}
+	}
+
+	// Once committed, the image's references keep its layers
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+	for i, layer := range pulled {
+		if _, err := os.Stat(layer.Path); err != nil {
+			t.Errorf("layer %d removed after the pull committed: %v", i, err)
+		}
+	}
+	if len(service.layerClaims) != 0 {
+		t.Errorf("claims left after the pull: %v", service.layerClaims)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxArchiveMetadataSize bounds the index, layout file, manifests and
+// configs read from an image archive into memory
+const maxArchiveMetadataSize = 4 * 1024 * 1024
+
+// LoadImageFromTar imports the images of a tar archive in the OCI image
+// layout, such as one written by ExportImage, and returns the normalized
+// references they are stored under. Images are named by the
+// io.containerd.image.name annotation of the index, falling back to
+// org.opencontainers.image.ref.name.
+func (s *ImageService) LoadImageFromTar(ctx context.Context, r io.Reader) ([]string, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(s.stagingDir(s.imageRoot), "import-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+
+	index, err := extractArchive(ctx, r, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded []string
+	for i, desc := range index.Manifests {
+		imageRef := desc.Annotations[ociImageNameAnnotation]
+		if imageRef == "" {
+			imageRef = desc.Annotations[ociRefNameAnnotation]
+		}
+		if imageRef == "" {
+			return loaded, fmt.Errorf("manifest %d of the archive has no image name", i)
+		}
+		key, err := s.importImage(ctx, staging, imageRef, desc)
+		if err != nil {
+			return loaded, fmt.Errorf("failed to import %s: %w", imageRef, err)
+		}
+		loaded = append(loaded, key)
+	}
+	return loaded, nil
+}
+
+// extractArchive stores the blobs of an OCI layout archive in dir, named by
+// their digest after verifying it, and returns the index of the archive
+func extractArchive(ctx context.Context, r io.Reader, dir string) (*ociIndex, error) {
+	var index *ociIndex
+	var layout *ociLayout
+
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		switch {
+		case name == ociLayoutFile:
+			layout = &ociLayout{}
+			if err := decodeArchiveJSON(tr, layout); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", ociLayoutFile, err)
+			}
+		case name == ociIndexFile:
+			index = &ociIndex{}
+			if err := decodeArchiveJSON(tr, index); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", ociIndexFile, err)
+			}
+		case strings.HasPrefix(name, "blobs/"):
+			if err := extractBlob(tr, name, dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if layout == nil || layout.ImageLayoutVersion != ociLayoutVersion {
+		return nil, fmt.Errorf("archive is not an OCI image layout %s", ociLayoutVersion)
+	}
+	if index == nil || len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("archive has no images")
+	}
+	return index, nil
+}
+
+// decodeArchiveJSON decodes a small JSON file of an archive into v
+func decodeArchiveJSON(r io.Reader, v interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxArchiveMetadataSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxArchiveMetadataSize {
+		return fmt.Errorf("exceeds %d bytes", maxArchiveMetadataSize)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// extractBlob writes the blob at name, blobs/<algorithm>/<encoded>, to dir
+// and verifies its content against the digest of its name
+func extractBlob(r io.Reader, name, dir string) error {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid blob path %q in archive", name)
+	}
+	dgst, err := digest.Parse(parts[1] + ":" + parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid blob path %q in archive: %v", name, err)
+	}
+
+	f, err := os.CreateTemp(dir, "blob-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %v", err)
+	}
+	defer f.Close()
+
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(io.MultiWriter(f, verifier), r); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to extract blob %s: %v", dgst, err)
+	}
+	if !verifier.Verified() {
+		os.Remove(f.Name())
+		return fmt.Errorf("blob %w: %s", ErrDigestMismatch, dgst)
+	}
+	if err := os.Rename(f.Name(), stagedBlobPath(dir, dgst)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to store blob %s: %v", dgst, err)
+	}
+	return nil
+}
+
+// stagedBlobPath returns where extractArchive stores the blob dgst in dir
+func stagedBlobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, dgst.Algorithm().String()+"-"+dgst.Encoded())
+}
+
+// readStagedBlob reads a small blob extracted to dir
+func readStagedBlob(dir, blobDigest string) ([]byte, error) {
+	dgst, err := digest.Parse(blobDigest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %v", blobDigest, err)
+	}
+	f, err := os.Open(stagedBlobPath(dir, dgst))
+	if err != nil {
+		return nil, fmt.Errorf("blob %s missing from archive", dgst)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxArchiveMetadataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %v", dgst, err)
+	}
+	if len(data) > maxArchiveMetadataSize {
+		return nil, fmt.Errorf("blob %s exceeds %d bytes", dgst, maxArchiveMetadataSize)
+	}
+	return data, nil
+}
+
+// importImage records the image of the manifest desc, whose blobs were
+// extracted to staging, under the normalized form of imageRef, moving its
+// layers to the blob store. It returns the reference the image is stored
+// under.
+func (s *ImageService) importImage(ctx context.Context, staging, imageRef string, desc ociDescriptor) (string, error) {
+	named, err := s.parseReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+	key := pullKey(named)
+
+	manifestData, err := readStagedBlob(staging, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	var manifest DockerManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return "", fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	if err := checkManifestSupported(&manifest); err != nil {
+		return "", err
+	}
+	if err := s.checkLayerCount(&manifest); err != nil {
+		return "", err
+	}
+	config, err := readStagedBlob(staging, manifest.Config.Digest)
+	if err != nil {
+		return "", err
+	}
+	if !json.Valid(config) {
+		return "", fmt.Errorf("config %s is not valid JSON", manifest.Config.Digest)
+	}
+
+	// Keep the blobs moved into the store until the image references them
+	layerDigests := make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layerDigests[i] = layer.Digest
+	}
+	releaseLayers := s.claimLayers(layerDigests)
+	defer releaseLayers()
+
+	layers := make([]LayerMetadata, len(manifest.Layers))
+	var totalSize int64
+	for i, layer := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if _, err := layerCompressionFor(layer.MediaType); err != nil {
+			return "", fmt.Errorf("layer %d: %w", i, err)
+		}
+		dgst, err := digest.Parse(layer.Digest)
+		if err != nil {
+			return "", fmt.Errorf("layer %d: invalid digest %q: %v", i, layer.Digest, err)
+		}
+		layerPath, err := s.blobPath(layer.Digest)
+		if err != nil {
+			return "", fmt.Errorf("layer %d: %v", i, err)
+		}
+
+		// Move the blob into the store unless an image already has it
+		reused := true
+		if _, err := os.Stat(layerPath); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(layerPath), 0755); err != nil {
+				return "", fmt.Errorf("failed to create layer directory: %v", err)
+			}
+			if err := moveFile(stagedBlobPath(staging, dgst), layerPath); err != nil {
+				return "", fmt.Errorf("layer %d missing from archive: %v", i, err)
+			}
+			reused = false
+		}
+
+		metadata, err := s.storedLayer(layer.Digest, layerPath, layer.MediaType)
+		if err != nil {
+			return "", fmt.Errorf("failed to import layer %d: %v", i, err)
+		}
+		metadata.Reused = reused
+		layers[i] = metadata
+		totalSize += metadata.Size
+	}
+
+	// Images are identified by their content, as for pulls
+	manifestDigest := digest.FromBytes(manifestData)
+	now := time.Now()
+	s.mu.Lock()
+	s.setImage(key, &imageMetadata{
+		ID:               imageIDFor(&manifest, manifestDigest),
+		RepoTags:         []string{key},
+		RepoDigests:      []string{fmt.Sprintf("%s@%s", reference.TrimNamed(named), manifestDigest)},
+		Size:             totalSize,
+		Layers:           layers,
+		UncompressedSize: layersUncompressedSize(layers),
+		Digest:           manifestDigest.String(),
+		State:            imageStateReady,
+		Config:           config,
+		Labels:           configLabels(config),
+		PulledAt:         now,
+		LastUsedAt:       now,
+	})
+	err = s.saveMetadata()
+	s.mu.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to save metadata: %v", err)
+	}
+	s.forgetMissing(key)
+	return key, nil
+}
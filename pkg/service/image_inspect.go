@@ -0,0 +1,75 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/distribution/reference"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// InspectImage returns the config of imageRef as published by its registry,
+// fetching only the manifest and config blob. Nothing is stored, so the
+// image is neither pulled nor recorded.
+func (s *ImageService) InspectImage(ctx context.Context, imageRef string, auth *runtime.AuthConfig) (*ImageConfig, error) {
+	named, err := s.parseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err = s.getRegistryClient(ctx, named, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	repository := reference.Path(named)
+	endpoints := s.registryEndpoints(reference.Domain(named))
+	var manifest *DockerManifest
+	for _, endpoint := range endpoints {
+		manifestURL := s.endpointURL(endpoint, fmt.Sprintf("/v2/%s/manifests/%s", repository, manifestReference(named)))
+		manifest, _, err = s.getManifest(ctx, manifestURL, auth)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := manifest.schema1Config
+	if data == nil {
+		for _, endpoint := range endpoints {
+			configURL := s.endpointURL(endpoint, fmt.Sprintf("/v2/%s/blobs/%s", repository, manifest.Config.Digest))
+			data, err = s.getJSONBlob(ctx, configURL, manifest.Config.Digest, auth)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image config: %w", err)
+		}
+	}
+
+	var config ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %v", err)
+	}
+	return &config, nil
+}
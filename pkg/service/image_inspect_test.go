@@ -0,0 +1,74 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageService_InspectImage(t *testing.T) {
+	config := []byte(`{
+		"architecture": "arm64",
+		"os": "linux",
+		"config": {
+			"Env": ["MODE=batch"],
+			"Entrypoint": ["/bin/worker"],
+			"Cmd": ["--once"],
+			"Labels": {"gpu": "required"}
+		}
+	}`)
+	registry := newTestRegistry(t)
+	registry.addImageWithConfig(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", config, []byte("layer never fetched"))
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	got, err := service.InspectImage(context.Background(), imageRef, nil)
+	if err != nil {
+		t.Fatalf("InspectImage() error = %v", err)
+	}
+	if got.Architecture != "arm64" || got.OS != "linux" {
+		t.Errorf("platform = %s/%s, want linux/arm64", got.OS, got.Architecture)
+	}
+	if !reflect.DeepEqual(got.Config.Env, []string{"MODE=batch"}) {
+		t.Errorf("Env = %v", got.Config.Env)
+	}
+	if !reflect.DeepEqual(got.Config.Entrypoint, []string{"/bin/worker"}) || !reflect.DeepEqual(got.Config.Cmd, []string{"--once"}) {
+		t.Errorf("Entrypoint = %v, Cmd = %v", got.Config.Entrypoint, got.Config.Cmd)
+	}
+	if got.Config.Labels["gpu"] != "required" {
+		t.Errorf("Labels = %v", got.Config.Labels)
+	}
+
+	// Only the config blob is fetched and nothing is stored
+	blobs := registry.blobRequests()
+	if len(blobs) != 1 || !strings.HasSuffix(blobs[0], digest.FromBytes(config).String()) {
+		t.Errorf("blob requests = %v, want only the config", blobs)
+	}
+	if service.HasImage(imageRef) {
+		t.Error("InspectImage() recorded the image")
+	}
+
+	if _, err := service.InspectImage(context.Background(), registry.host()+"/library/missing:latest", nil); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("InspectImage() of a missing image error = %v, want %v", err, ErrImageNotFound)
+	}
+}
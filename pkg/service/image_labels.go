@@ -0,0 +1,118 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// GetImageLabels returns the labels attached to the content of imageRef
+func (s *ImageService) GetImageLabels(imageRef string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+
+	labels := make(map[string]string, len(s.labels[img.Digest]))
+	for k, v := range s.labels[img.Digest] {
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// SetImageLabels replaces the labels attached to the content of imageRef.
+// Labels are stored by manifest digest, so they reattach whenever the same
+// content is pulled again, even after the image has been removed.
+func (s *ImageService) SetImageLabels(imageRef string, labels map[string]string) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	if img.Digest == "" {
+		return fmt.Errorf("image %s has no content digest", imageRef)
+	}
+
+	if s.labels == nil {
+		s.labels = make(map[string]map[string]string)
+	}
+	if len(labels) == 0 {
+		delete(s.labels, img.Digest)
+	} else {
+		stored := make(map[string]string, len(labels))
+		for k, v := range labels {
+			stored[k] = v
+		}
+		s.labels[img.Digest] = stored
+	}
+
+	return s.saveLabels()
+}
+
+// saveLabels persists the label store. Caller must hold the lock.
+func (s *ImageService) saveLabels() error {
+	data, err := json.MarshalIndent(s.labels, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal labels: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.labelsFile), 0755); err != nil {
+		return fmt.Errorf("failed to create labels directory: %v", err)
+	}
+
+	tempFile := s.labelsFile + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write labels: %v", err)
+	}
+
+	if err := os.Rename(tempFile, s.labelsFile); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to save labels: %v", err)
+	}
+
+	return nil
+}
+
+func (s *ImageService) loadLabels() error {
+	data, err := os.ReadFile(s.labelsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read labels: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := json.Unmarshal(data, &s.labels); err != nil {
+		return fmt.Errorf("failed to unmarshal labels: %v", err)
+	}
+
+	return nil
+}
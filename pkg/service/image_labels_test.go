@@ -0,0 +1,100 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestImageService_LabelsSurviveRepull(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("app layer content"))
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	want := map[string]string{"team": "storage", "cost-center": "42"}
+	if err := service.SetImageLabels(imageRef, want); err != nil {
+		t.Fatalf("SetImageLabels() error = %v", err)
+	}
+
+	if err := service.RemoveImage(context.Background(), imageRef); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+	if _, err := service.GetImageLabels(imageRef); err == nil {
+		t.Error("GetImageLabels() should fail for a removed image")
+	}
+
+	// Re-pull the same content and expect the labels to reattach
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	got, err := service.GetImageLabels(imageRef)
+	if err != nil {
+		t.Fatalf("GetImageLabels() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetImageLabels() = %v, want %v", got, want)
+	}
+
+	// Labels must also survive a restart
+	restarted := newTestService(t, registry)
+	restarted.labelsFile = service.labelsFile
+	if err := restarted.loadLabels(); err != nil {
+		t.Fatalf("loadLabels() error = %v", err)
+	}
+	img := service.images[imageRef]
+	if !reflect.DeepEqual(restarted.labels[img.Digest], want) {
+		t.Errorf("loaded labels = %v, want %v", restarted.labels[img.Digest], want)
+	}
+}
+
+func TestImageService_LabelsFollowContent(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("version one"))
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if err := service.SetImageLabels(imageRef, map[string]string{"team": "a"}); err != nil {
+		t.Fatalf("SetImageLabels() error = %v", err)
+	}
+	if err := service.RemoveImage(context.Background(), imageRef); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+
+	// Move the tag to different content
+	registry.addImage(t, "library/app", "latest", []byte("version two"))
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	got, err := service.GetImageLabels(imageRef)
+	if err != nil {
+		t.Fatalf("GetImageLabels() error = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("GetImageLabels() = %v, want no labels for new content", got)
+	}
+}
@@ -1,8 +1,10 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
@@ -16,24 +18,182 @@ type LayerMetadata struct {
 	Path             string `json:"path"`
 	Size             int64  `json:"size"`
 	UncompressedSize int64  `json:"uncompressed_size"`
+	// DiffID is the digest of the uncompressed layer content
+	DiffID string `json:"diff_id,omitempty"`
+	// Reused records whether the pull that created the image took this
+	// layer from the cache instead of downloading it
+	Reused bool `json:"reused,omitempty"`
 }
 
+// EvictionPolicy selects which layers LayerCache evicts first
+type EvictionPolicy int
+
+const (
+	// EvictionLRU evicts the least recently used layers first
+	EvictionLRU EvictionPolicy = iota
+	// EvictionLFU evicts the least frequently used layers first, breaking
+	// ties by least recent use
+	EvictionLFU
+)
+
 // LayerCache manages image layer caching
 type LayerCache struct {
-	mu        sync.RWMutex
-	layers    map[string]LayerMetadata
-	maxSize   int64                // Maximum total size of cached layers
-	totalSize int64                // Current total size of cached layers
-	lastUsed  map[string]time.Time // Track when each layer was last used
+	mu          sync.RWMutex
+	layers      map[string]LayerMetadata
+	maxSize     int64                // Maximum total size of cached layers
+	totalSize   int64                // Current total size of cached layers
+	lastUsed    map[string]time.Time // Track when each layer was last used
+	accessCount map[string]int       // Track how often each layer was used
+	policy      EvictionPolicy
+	logger      *slog.Logger
+	// admitFraction is the largest share of maxSize a single layer may
+	// take to be admitted, zero admitting every layer that fits
+	admitFraction float64
+
+	// configuredSize is the maxSize the cache was created with, which
+	// maxSize returns to once disk pressure clears
+	configuredSize int64
+	// diskFree reports free disk space, statfs when nil
+	diskFree diskFreeFunc
+
+	// hits, misses and evictions count lookups and evicted layers
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	// onEvict is called with each layer evicted or removed from the cache
+	onEvict func(LayerMetadata)
+	// releaseEvicted is handed the layers evicted to make room, without the
+	// lock held. The cache does not own layer files, which images may share,
+	// so deleting them is left to this hook.
+	releaseEvicted func([]LayerMetadata)
+}
+
+// LayerCacheStats describes the usage of a LayerCache
+type LayerCacheStats struct {
+	Entries   int
+	TotalSize int64
+	MaxSize   int64
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// Stats returns a snapshot of the cache usage
+func (c *LayerCache) Stats() LayerCacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return LayerCacheStats{
+		Entries:   len(c.layers),
+		TotalSize: c.totalSize,
+		MaxSize:   c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
 }
 
-// NewLayerCache creates a new layer cache with size limit
+// NewLayerCache creates a new LRU layer cache with size limit
 func NewLayerCache(maxSize int64) *LayerCache {
+	return NewLayerCacheWithPolicy(maxSize, EvictionLRU)
+}
+
+// NewLayerCacheWithPolicy creates a new layer cache with size limit that
+// evicts layers according to policy
+func NewLayerCacheWithPolicy(maxSize int64, policy EvictionPolicy) *LayerCache {
 	return &LayerCache{
-		layers:   make(map[string]LayerMetadata),
-		lastUsed: make(map[string]time.Time),
-		maxSize:  maxSize,
+		layers:         make(map[string]LayerMetadata),
+		lastUsed:       make(map[string]time.Time),
+		accessCount:    make(map[string]int),
+		maxSize:        maxSize,
+		configuredSize: maxSize,
+		policy:         policy,
+	}
+}
+
+// SetMaxSize changes the size limit of the cache like Resize, discarding
+// the evicted layers
+func (c *LayerCache) SetMaxSize(maxSize int64) {
+	c.Resize(maxSize)
+}
+
+// Resize changes the size limit of the cache, evicting layers right away if
+// the cache holds more than the new limit, and returns the evicted layers.
+// Zero disables the limit.
+func (c *LayerCache) Resize(maxSize int64) []LayerMetadata {
+	var evicted []LayerMetadata
+	defer func() { c.handleEvicted(evicted) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxSize = maxSize
+	c.configuredSize = maxSize
+	if maxSize > 0 && c.totalSize > maxSize {
+		evicted = c.evictLayers(c.totalSize - maxSize)
+	}
+	return evicted
+}
+
+// SetAdmissionFraction keeps layers larger than fraction of the size limit
+// out of the cache, so that a single huge layer cannot evict many smaller
+// ones. Zero, or a fraction of one or more, admits every layer that fits.
+func (c *LayerCache) SetAdmissionFraction(fraction float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.admitFraction = fraction
+}
+
+// admits reports whether a layer of size may enter the cache. Caller must
+// hold the lock.
+func (c *LayerCache) admits(size int64) bool {
+	if c.admitFraction <= 0 || c.admitFraction >= 1 || c.maxSize == 0 {
+		return true
+	}
+	return float64(size) <= c.admitFraction*float64(c.maxSize)
+}
+
+// SetOnEvict registers fn to be called with each layer evicted or removed
+// from the cache, replacing any previous callback. fn is called without the
+// cache lock held, so it may use the cache. A nil fn disables the callback.
+func (c *LayerCache) SetOnEvict(fn func(LayerMetadata)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvict = fn
+}
+
+// notifyEvicted passes layers to the eviction callback. Caller must not
+// hold the lock.
+func (c *LayerCache) notifyEvicted(layers []LayerMetadata) {
+	if len(layers) == 0 {
+		return
+	}
+	c.mu.RLock()
+	onEvict := c.onEvict
+	c.mu.RUnlock()
+	if onEvict == nil {
+		return
+	}
+	for _, metadata := range layers {
+		onEvict(metadata)
+	}
+}
+
+// handleEvicted notifies the eviction callback of layers evicted to make
+// room and releases them. Caller must not hold the lock.
+func (c *LayerCache) handleEvicted(layers []LayerMetadata) {
+	c.notifyEvicted(layers)
+	if len(layers) > 0 && c.releaseEvicted != nil {
+		c.releaseEvicted(layers)
+	}
+}
+
+// log returns the logger of the cache, falling back to the default logger
+func (c *LayerCache) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
 	}
+	return c.logger
 }
 
 // Get retrieves a layer from the cache
@@ -43,16 +203,30 @@ func (c *LayerCache) Get(digest string) (LayerMetadata, bool) {
 
 	metadata, exists := c.layers[digest]
 	if !exists {
+		c.misses++
 		return LayerMetadata{}, false
 	}
+	c.hits++
 
-	// Update last used time
+	// Update last used time and access count
 	c.lastUsed[digest] = time.Now()
+	c.accessCount[digest]++
 	return metadata, true
 }
 
+// Contains reports whether a layer is cached without counting it as used
+func (c *LayerCache) Contains(digest string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, exists := c.layers[digest]
+	return exists
+}
+
 // Add adds a layer to the cache
 func (c *LayerCache) Add(digest string, metadata LayerMetadata) {
+	var evicted []LayerMetadata
+	defer func() { c.handleEvicted(evicted) }()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -68,6 +242,7 @@ func (c *LayerCache) Add(digest string, metadata LayerMetadata) {
 		}
 		c.layers[digest] = metadata
 		c.lastUsed[digest] = time.Now()
+		c.accessCount[digest]++
 		c.totalSize += metadata.Size
 		return
 	}
@@ -76,6 +251,11 @@ func (c *LayerCache) Add(digest string, metadata LayerMetadata) {
 	if metadata.Size > c.maxSize {
 		return
 	}
+	// Layers too large to be worth evicting others for stay on disk only
+	if !c.admits(metadata.Size) {
+		c.log().Debug("layer not admitted to the cache", "digest", digest, "size", metadata.Size, "max_size", c.maxSize)
+		return
+	}
 
 	// First remove existing layer if it exists
 	if existing, exists := c.layers[digest]; exists {
@@ -85,26 +265,29 @@ func (c *LayerCache) Add(digest string, metadata LayerMetadata) {
 	// Check if adding this layer would exceed maxSize
 	if c.totalSize+metadata.Size > c.maxSize {
 		// Need to evict layers before adding new one
-		c.evictLayers(c.totalSize + metadata.Size - c.maxSize)
+		evicted = c.evictLayers(c.totalSize + metadata.Size - c.maxSize)
 	}
 
 	// Now add the layer
 	c.layers[digest] = metadata
 	c.lastUsed[digest] = time.Now()
+	c.accessCount[digest]++
 	c.totalSize += metadata.Size
 }
 
-// evictLayers removes least recently used layers until enough space is freed
-// Caller must hold the lock
-func (c *LayerCache) evictLayers(spaceNeeded int64) {
+// evictLayers removes layers in eviction policy order until enough space is
+// freed and returns them, leaving their files in place. Caller must hold the
+// lock
+func (c *LayerCache) evictLayers(spaceNeeded int64) []LayerMetadata {
 	if spaceNeeded <= 0 {
-		return
+		return nil
 	}
 
-	// Create sorted slice of layers by last used time
+	// Create sorted slice of layers by eviction priority
 	type layerInfo struct {
 		digest string
 		used   time.Time
+		count  int
 		size   int64
 	}
 
@@ -119,54 +302,146 @@ func (c *LayerCache) evictLayers(spaceNeeded int64) {
 			layers = append(layers, layerInfo{
 				digest: digest,
 				used:   lastUsed,
+				count:  c.accessCount[digest],
 				size:   metadata.Size,
 			})
 		}
 	}
 
-	// Sort by last used time (oldest first)
+	// Sort by access count under LFU, then by last used time (oldest first)
 	sort.Slice(layers, func(i, j int) bool {
+		if c.policy == EvictionLFU && layers[i].count != layers[j].count {
+			return layers[i].count < layers[j].count
+		}
 		return layers[i].used.Before(layers[j].used)
 	})
 
 	// Remove oldest layers until we have enough space
 	spaceFreed := int64(0)
+	var evicted []LayerMetadata
 	for _, layer := range layers {
 		if spaceFreed >= spaceNeeded {
 			break
 		}
 		if metadata, exists := c.layers[layer.digest]; exists {
-			// Remove the layer file first
-			if metadata.Path != "" {
-				if err := os.Remove(metadata.Path); err != nil && !os.IsNotExist(err) {
-					// Log error but continue with cache cleanup
-					fmt.Printf("Failed to remove layer file %s: %v\n", metadata.Path, err)
-				}
-			}
-			// Then update cache state
 			spaceFreed += metadata.Size
 			c.totalSize -= metadata.Size
+			c.evictions++
 			delete(c.layers, layer.digest)
 			delete(c.lastUsed, layer.digest)
+			delete(c.accessCount, layer.digest)
+			evicted = append(evicted, metadata)
 		}
 	}
+	return evicted
 }
 
-// Remove removes a layer from the cache and its file
+// Remove removes a layer from the cache, leaving its file in place
 func (c *LayerCache) Remove(digest string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if metadata, exists := c.layers[digest]; exists {
+	metadata, exists := c.layers[digest]
+	if exists {
 		// Update total size
 		c.totalSize -= metadata.Size
 
 		// Remove from maps
 		delete(c.layers, digest)
 		delete(c.lastUsed, digest)
+		delete(c.accessCount, digest)
+	}
+	c.mu.Unlock()
+
+	if exists {
+		c.notifyEvicted([]LayerMetadata{metadata})
 	}
 }
 
+// Purge removes every layer from the cache and, if deleteFiles is set,
+// their backing files. It returns the purged layers.
+func (c *LayerCache) Purge(deleteFiles bool) []LayerMetadata {
+	var purged []LayerMetadata
+	defer func() { c.notifyEvicted(purged) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged = make([]LayerMetadata, 0, len(c.layers))
+	for _, metadata := range c.layers {
+		if deleteFiles && metadata.Path != "" {
+			if err := os.Remove(metadata.Path); err != nil && !os.IsNotExist(err) {
+				c.log().Error("failed to remove layer file", "path", metadata.Path, "error", err)
+			}
+		}
+		purged = append(purged, metadata)
+	}
+
+	c.layers = make(map[string]LayerMetadata)
+	c.lastUsed = make(map[string]time.Time)
+	c.accessCount = make(map[string]int)
+	c.totalSize = 0
+	return purged
+}
+
+// snapshot returns a copy of the cached layers sorted by digest together
+// with their total size
+func (c *LayerCache) snapshot() ([]LayerMetadata, int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	layers := make([]LayerMetadata, 0, len(c.layers))
+	for _, metadata := range c.layers {
+		layers = append(layers, metadata)
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].Digest < layers[j].Digest
+	})
+	return layers, c.totalSize
+}
+
+// Save writes the cache index to path
+func (c *LayerCache) Save(path string) error {
+	c.mu.RLock()
+	data, err := json.MarshalIndent(c.layers, "", "  ")
+	c.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal layer cache: %v", err)
+	}
+
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write layer cache: %v", err)
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to save layer cache: %v", err)
+	}
+	return nil
+}
+
+// Load restores a cache index written by Save, skipping layers whose files
+// no longer exist
+func (c *LayerCache) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read layer cache: %v", err)
+	}
+
+	var layers map[string]LayerMetadata
+	if err := json.Unmarshal(data, &layers); err != nil {
+		return fmt.Errorf("failed to unmarshal layer cache: %v", err)
+	}
+
+	for digest, metadata := range layers {
+		if _, err := os.Stat(metadata.Path); err != nil {
+			continue
+		}
+		c.Add(digest, metadata)
+	}
+	return nil
+}
+
 // reuseLayer reuses an existing layer
 func reuseLayer(srcPath, destPath string) error {
 	// Ensure source file exists and is accessible
@@ -1,7 +1,11 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -228,6 +232,37 @@ func TestLayerCache_UpdateLastUsed(t *testing.T) {
 	}
 }
 
+func TestLayerCache_Contains(t *testing.T) {
+	cache := NewLayerCache(int64(100))
+	cache.Add("layer1", LayerMetadata{Size: 40})
+	added := cache.lastUsed["layer1"]
+
+	time.Sleep(time.Millisecond)
+
+	// Probing membership leaves the eviction state untouched
+	if !cache.Contains("layer1") {
+		t.Error("Contains() = false for a cached layer")
+	}
+	if cache.Contains("missing") {
+		t.Error("Contains() = true for an uncached layer")
+	}
+	if got := cache.lastUsed["layer1"]; !got.Equal(added) {
+		t.Error("Contains() should not update lastUsed")
+	}
+	if got := cache.accessCount["layer1"]; got != 1 {
+		t.Errorf("accessCount after Contains() = %d, want 1", got)
+	}
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("Contains() counted a lookup: %+v", stats)
+	}
+
+	// Get counts as a use
+	cache.Get("layer1")
+	if got := cache.lastUsed["layer1"]; !got.After(added) {
+		t.Error("Get() should update lastUsed")
+	}
+}
+
 func TestLayerCache_EvictionOrder(t *testing.T) {
 	cache := NewLayerCache(int64(100))
 
@@ -482,15 +517,49 @@ func TestLayerCache_MaxSizeUpdate(t *testing.T) {
 	cache.Add("layer1", LayerMetadata{Size: 60})
 	cache.Add("layer2", LayerMetadata{Size: 30})
 
-	// Update maxSize to smaller value
-	cache.maxSize = 50
+	// Shrinking the cache evicts right away, without waiting for an Add
+	cache.SetMaxSize(50)
+	if stats := cache.Stats(); stats.TotalSize > 50 {
+		t.Errorf("Cache size %d exceeds new limit 50 right after SetMaxSize", stats.TotalSize)
+	}
+	if cache.Contains("layer1") || !cache.Contains("layer2") {
+		t.Error("SetMaxSize() should evict the least recently used layer only")
+	}
 
-	// Add new layer to trigger eviction
-	cache.Add("layer3", LayerMetadata{Size: 20})
+	// Later additions respect the new limit
+	cache.Add("layer3", LayerMetadata{Size: 30})
+	if stats := cache.Stats(); stats.TotalSize > 50 {
+		t.Errorf("Cache size %d exceeds new limit 50", stats.TotalSize)
+	}
+}
 
-	// Verify cache adjusted to new limit
-	if cache.totalSize > cache.maxSize {
-		t.Errorf("Cache size %d exceeds new limit %d", cache.totalSize, cache.maxSize)
+func TestLayerCache_Resize(t *testing.T) {
+	cache := NewLayerCache(int64(100))
+
+	// Fill the cache, layer1 least recently used
+	cache.Add("layer1", LayerMetadata{Digest: "layer1", Size: 40})
+	cache.Add("layer2", LayerMetadata{Digest: "layer2", Size: 30})
+	cache.Add("layer3", LayerMetadata{Digest: "layer3", Size: 30})
+
+	// Shrinking evicts down to the new limit before returning
+	evicted := cache.Resize(50)
+	if stats := cache.Stats(); stats.TotalSize > 50 || stats.MaxSize != 50 {
+		t.Errorf("after Resize(50) size = %d, limit = %d, want at most 50, 50", stats.TotalSize, stats.MaxSize)
+	}
+	if len(evicted) != 2 || evicted[0].Digest != "layer1" || evicted[1].Digest != "layer2" {
+		t.Errorf("Resize(50) evicted %v, want layer1 and layer2", evicted)
+	}
+	if !cache.Contains("layer3") {
+		t.Error("Resize(50) evicted the most recently used layer")
+	}
+
+	// Growing evicts nothing
+	if evicted := cache.Resize(200); len(evicted) != 0 {
+		t.Errorf("Resize(200) evicted %v", evicted)
+	}
+	cache.Add("layer4", LayerMetadata{Digest: "layer4", Size: 150})
+	if stats := cache.Stats(); stats.TotalSize != 180 {
+		t.Errorf("after growing size = %d, want 180", stats.TotalSize)
 	}
 }
 
@@ -522,6 +591,108 @@ func TestLayerCache_EvictionPriority(t *testing.T) {
 	}
 }
 
+func TestLayerCache_LFUAccessCounts(t *testing.T) {
+	cache := NewLayerCacheWithPolicy(int64(100), EvictionLFU)
+	cache.Add("frequent", LayerMetadata{Size: 30})
+	cache.Add("rare", LayerMetadata{Size: 30})
+	cache.Add("medium", LayerMetadata{Size: 30})
+
+	// Accesses recorded concurrently are all counted
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache.Get("frequent")
+			if i%5 == 0 {
+				cache.Get("medium")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	want := map[string]int{"frequent": 11, "medium": 3, "rare": 1}
+	cache.mu.Lock()
+	for digest, count := range want {
+		if got := cache.accessCount[digest]; got != count {
+			t.Errorf("accessCount[%s] = %d, want %d", digest, got, count)
+		}
+	}
+	// Order recency against frequency, the rare layer used last
+	base := time.Now()
+	cache.lastUsed["frequent"] = base.Add(-2 * time.Hour)
+	cache.lastUsed["medium"] = base.Add(-time.Hour)
+	cache.lastUsed["rare"] = base
+	cache.mu.Unlock()
+
+	// Add layer to trigger eviction of exactly one layer
+	cache.Add("new", LayerMetadata{Size: 30})
+
+	if cache.Contains("rare") {
+		t.Error("least frequently used layer should be evicted first")
+	}
+	for _, digest := range []string{"frequent", "medium", "new"} {
+		if !cache.Contains(digest) {
+			t.Errorf("%s should have been retained", digest)
+		}
+	}
+}
+
+func TestLayerCache_EvictionPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  EvictionPolicy
+		evicted string
+		kept    string
+	}{
+		// LRU evicts the layer untouched the longest, however popular
+		{"lru", EvictionLRU, "frequent", "rare"},
+		// LFU evicts the rarely used layer even though it was used last
+		{"lfu", EvictionLFU, "rare", "frequent"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewLayerCacheWithPolicy(int64(100), tt.policy)
+
+			cache.Add("frequent", LayerMetadata{Size: 40})
+			cache.Add("rare", LayerMetadata{Size: 40})
+			for i := 0; i < 10; i++ {
+				cache.Get("frequent")
+			}
+			time.Sleep(time.Millisecond)
+			cache.Get("rare")
+
+			// Add layer to trigger eviction of exactly one layer
+			cache.Add("new", LayerMetadata{Size: 40})
+
+			if _, exists := cache.Get(tt.evicted); exists {
+				t.Errorf("%s should have been evicted", tt.evicted)
+			}
+			if _, exists := cache.Get(tt.kept); !exists {
+				t.Errorf("%s should have been retained", tt.kept)
+			}
+		})
+	}
+}
+
+func TestLayerCache_LFUTieBreak(t *testing.T) {
+	cache := NewLayerCacheWithPolicy(int64(100), EvictionLFU)
+
+	// Equal access counts fall back to least recent use
+	cache.Add("older", LayerMetadata{Size: 40})
+	time.Sleep(time.Millisecond)
+	cache.Add("newer", LayerMetadata{Size: 40})
+	cache.Add("incoming", LayerMetadata{Size: 40})
+
+	if _, exists := cache.Get("older"); exists {
+		t.Error("older layer should be evicted on an access count tie")
+	}
+	if _, exists := cache.Get("newer"); !exists {
+		t.Error("newer layer should be retained on an access count tie")
+	}
+}
+
 func TestLayerCache_ConcurrentReadDuringEviction(t *testing.T) {
 	cache := NewLayerCache(int64(100))
 	const readers = 5
@@ -657,3 +828,210 @@ func TestLayerCache_ConcurrentAddAndGet(t *testing.T) {
 		}
 	}
 }
+
+func TestLayerCache_Purge(t *testing.T) {
+	tmpDir := t.TempDir()
+	cache := NewLayerCache(int64(1000))
+
+	var digests []string
+	for i := 0; i < 5; i++ {
+		digest := fmt.Sprintf("layer%d", i)
+		path := filepath.Join(tmpDir, digest)
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create layer file: %v", err)
+		}
+		cache.Add(digest, LayerMetadata{Digest: digest, Path: path, Size: 40})
+		digests = append(digests, digest)
+	}
+
+	if purged := cache.Purge(false); len(purged) != len(digests) {
+		t.Errorf("Purge() returned %d layers, want %d", len(purged), len(digests))
+	}
+	for _, digest := range digests {
+		if _, exists := cache.Get(digest); exists {
+			t.Errorf("%s should have been purged", digest)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, digest)); err != nil {
+			t.Errorf("%s file removed without deleteFiles: %v", digest, err)
+		}
+	}
+	if cache.totalSize != 0 {
+		t.Errorf("Expected total size 0, got %d", cache.totalSize)
+	}
+
+	// Purging with deleteFiles also removes the backing files
+	cache.Add("layer0", LayerMetadata{Digest: "layer0", Path: filepath.Join(tmpDir, "layer0"), Size: 40})
+	cache.Purge(true)
+	if _, err := os.Stat(filepath.Join(tmpDir, "layer0")); !os.IsNotExist(err) {
+		t.Error("layer0 file should have been deleted")
+	}
+
+	// The cache keeps working after a purge
+	cache.Add("layer5", LayerMetadata{Digest: "layer5", Size: 40})
+	if _, exists := cache.Get("layer5"); !exists || cache.totalSize != 40 {
+		t.Errorf("cache unusable after purge: total size %d", cache.totalSize)
+	}
+}
+
+func TestLayerCache_PurgeConcurrent(t *testing.T) {
+	cache := NewLayerCache(int64(10000))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				digest := fmt.Sprintf("layer-%d-%d", i, j)
+				cache.Add(digest, LayerMetadata{Digest: digest, Size: 1})
+				cache.Get(digest)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			cache.Purge(false)
+		}()
+	}
+	wg.Wait()
+
+	cache.Purge(false)
+	if cache.totalSize != 0 || len(cache.layers) != 0 {
+		t.Errorf("cache not empty after purge: %d layers, total size %d", len(cache.layers), cache.totalSize)
+	}
+}
+
+func TestLayerCache_Stats(t *testing.T) {
+	cache := NewLayerCache(int64(100))
+
+	cache.Add("layer1", LayerMetadata{Digest: "layer1", Size: 40})
+	cache.Add("layer2", LayerMetadata{Digest: "layer2", Size: 40})
+	cache.Get("layer1")
+	cache.Get("layer1")
+	cache.Get("missing")
+
+	// layer2 is least recently used and makes room for layer3
+	cache.Add("layer3", LayerMetadata{Digest: "layer3", Size: 50})
+	cache.Get("layer2")
+
+	want := LayerCacheStats{
+		Entries:   2,
+		TotalSize: 90,
+		MaxSize:   100,
+		Hits:      2,
+		Misses:    2,
+		Evictions: 1,
+	}
+	if got := cache.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	service := &ImageService{layerCache: cache}
+	if got := service.LayerCacheStats(); got != want {
+		t.Errorf("LayerCacheStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLayerCache_OnEvict(t *testing.T) {
+	cache := NewLayerCache(int64(100))
+
+	var evicted []LayerMetadata
+	cache.SetOnEvict(func(metadata LayerMetadata) {
+		// The cache is usable from the callback
+		if _, ok := cache.Get(metadata.Digest); ok {
+			t.Errorf("evicted layer %s still cached", metadata.Digest)
+		}
+		evicted = append(evicted, metadata)
+	})
+
+	cache.Add("layer1", LayerMetadata{Digest: "layer1", Path: "/layers/1", Size: 40})
+	cache.Add("layer2", LayerMetadata{Digest: "layer2", Path: "/layers/2", Size: 40})
+	cache.Get("layer2")
+	if len(evicted) != 0 {
+		t.Fatalf("callback fired before any eviction: %+v", evicted)
+	}
+
+	// layer1 is least recently used and makes room for layer3
+	cache.Add("layer3", LayerMetadata{Digest: "layer3", Path: "/layers/3", Size: 50})
+	if len(evicted) != 1 || evicted[0] != (LayerMetadata{Digest: "layer1", Path: "/layers/1", Size: 40}) {
+		t.Fatalf("evicted = %+v, want layer1", evicted)
+	}
+
+	cache.Remove("layer2")
+	cache.Remove("missing")
+	if len(evicted) != 2 || evicted[1].Digest != "layer2" {
+		t.Fatalf("evicted = %+v, want layer1 and layer2", evicted)
+	}
+
+	cache.SetMaxSize(10)
+	if len(evicted) != 3 || evicted[2].Digest != "layer3" {
+		t.Fatalf("evicted = %+v, want layer3 evicted by the new limit", evicted)
+	}
+
+	// Without a callback evictions go unreported
+	cache.SetOnEvict(nil)
+	cache.SetMaxSize(100)
+	cache.Add("layer4", LayerMetadata{Digest: "layer4", Size: 10})
+	cache.Remove("layer4")
+	if len(evicted) != 3 {
+		t.Errorf("evicted = %+v after removing the callback", evicted)
+	}
+}
+
+func TestLayerCache_AdmissionFraction(t *testing.T) {
+	tests := []struct {
+		name     string
+		fraction float64
+		size     int64
+		want     bool
+	}{
+		{name: "disabled", fraction: 0, size: 90, want: true},
+		{name: "within fraction", fraction: 0.25, size: 25, want: true},
+		{name: "above fraction", fraction: 0.25, size: 26, want: false},
+		{name: "whole cache", fraction: 1, size: 100, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewLayerCache(100)
+			cache.SetAdmissionFraction(tt.fraction)
+			cache.Add("small", LayerMetadata{Size: 10})
+			cache.Add("layer", LayerMetadata{Size: tt.size})
+
+			if _, got := cache.Get("layer"); got != tt.want {
+				t.Errorf("layer of %d bytes admitted = %v, want %v", tt.size, got, tt.want)
+			}
+			// A rejected layer evicts nothing
+			if !tt.want && !cache.Contains("small") {
+				t.Error("rejected layer evicted a cached one")
+			}
+		})
+	}
+}
+
+func TestImageService_CacheAdmission(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar",
+		[]byte("small"), bytes.Repeat([]byte("huge"), 1024))
+	service := newTestService(t, registry)
+	service.layerCache = NewLayerCache(8 * 1024)
+	service.layerCache.SetAdmissionFraction(0.25)
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	layers, err := service.ImageLayers(imageRef)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	small, huge := layers[0], layers[1]
+	if !service.layerCache.Contains(small.Digest) {
+		t.Error("small layer was not cached")
+	}
+	if service.layerCache.Contains(huge.Digest) {
+		t.Error("layer above the admission fraction was cached")
+	}
+	if _, err := os.Stat(huge.Path); err != nil {
+		t.Errorf("layer kept out of the cache is not on disk: %v", err)
+	}
+}
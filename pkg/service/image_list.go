@@ -0,0 +1,113 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// ListImagesPage lists the images matching filter ordered by ID, returning
+// at most pageSize images after the position encoded in pageToken together
+// with the token of the next page. The first page is requested with an
+// empty token and the last page returns an empty token. A pageSize of zero
+// or less returns all remaining images.
+func (s *ImageService) ListImagesPage(ctx context.Context, filter *runtime.ImageFilter, pageToken string, pageSize int) ([]*runtime.Image, string, error) {
+	var after string
+	if pageToken != "" {
+		id, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil || len(id) == 0 {
+			return nil, "", fmt.Errorf("invalid page token %q", pageToken)
+		}
+		after = string(id)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// References sharing an ID are listed as a single image
+	byID := make(map[string][]*imageMetadata)
+	for _, img := range s.images {
+		if !img.ready() || !matchesFilter(img, filter) || (after != "" && img.ID <= after) {
+			continue
+		}
+		byID[img.ID] = append(byID[img.ID], img)
+	}
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var nextToken string
+	if pageSize > 0 && len(ids) > pageSize {
+		ids = ids[:pageSize]
+		nextToken = base64.RawURLEncoding.EncodeToString([]byte(ids[pageSize-1]))
+	}
+
+	images := make([]*runtime.Image, 0, len(ids))
+	for _, id := range ids {
+		images = append(images, runtimeImage(byID[id]))
+	}
+	return images, nextToken, nil
+}
+
+// runtimeImage describes the image stored under the references of imgs,
+// which share its ID, with the tags and digests of all of them
+func runtimeImage(imgs []*imageMetadata) *runtime.Image {
+	image := &runtime.Image{
+		Id:    imgs[0].ID,
+		Size_: uint64(imgs[0].Size),
+	}
+	// Copy the slices so that callers never share them with the store
+	tags := make(map[string]bool)
+	digests := make(map[string]bool)
+	for _, img := range imgs {
+		for _, tag := range img.RepoTags {
+			if !tags[tag] {
+				tags[tag] = true
+				image.RepoTags = append(image.RepoTags, tag)
+			}
+		}
+		for _, dgst := range img.RepoDigests {
+			if !digests[dgst] {
+				digests[dgst] = true
+				image.RepoDigests = append(image.RepoDigests, dgst)
+			}
+		}
+		image.Pinned = image.Pinned || img.Pinned
+	}
+	sort.Strings(image.RepoTags)
+	sort.Strings(image.RepoDigests)
+	return image
+}
+
+// sameImageLocked returns the ready images sharing the ID of img, img
+// included. Caller must hold the lock.
+func (s *ImageService) sameImageLocked(img *imageMetadata) []*imageMetadata {
+	imgs := []*imageMetadata{img}
+	for _, other := range s.images {
+		if other != img && other.ID == img.ID && other.ready() {
+			imgs = append(imgs, other)
+		}
+	}
+	return imgs
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestImageService_ListImagesPage(t *testing.T) {
+	service := newTestService(t, nil)
+	var want []string
+	for i := 0; i < 25; i++ {
+		ref := fmt.Sprintf("app%02d:latest", i)
+		id := fmt.Sprintf("sha256:%064x", (i*7)%25)
+		service.images[ref] = &imageMetadata{ID: id, RepoTags: []string{ref}}
+		want = append(want, id)
+	}
+	// Images still being pulled are never listed
+	service.images["pulling:latest"] = &imageMetadata{ID: "sha256:pulling", State: imageStatePulling}
+	sort.Strings(want)
+
+	var got []string
+	var sizes []int
+	token := ""
+	for page := 0; ; page++ {
+		if page > 3 {
+			t.Fatal("paging did not terminate")
+		}
+		images, next, err := service.ListImagesPage(context.Background(), nil, token, 10)
+		if err != nil {
+			t.Fatalf("ListImagesPage() error = %v", err)
+		}
+		sizes = append(sizes, len(images))
+		for _, img := range images {
+			got = append(got, img.Id)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if fmt.Sprint(sizes) != "[10 10 5]" {
+		t.Errorf("page sizes = %v, want [10 10 5]", sizes)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("paged IDs = %v, want %v", got, want)
+	}
+
+	// The convenience wrapper returns everything in the same order
+	all, err := service.ListImages(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("ListImages() error = %v", err)
+	}
+	if len(all) != 25 || all[0].Id != want[0] || all[24].Id != want[24] {
+		t.Errorf("ListImages() returned %d images out of order", len(all))
+	}
+
+	if _, _, err := service.ListImagesPage(context.Background(), nil, "not a token!", 10); err == nil {
+		t.Error("ListImagesPage() with invalid token should fail")
+	}
+}
+
+func TestImageService_ListImagesMergesTags(t *testing.T) {
+	layer := []byte("layer tagged twice")
+	registry := newTestRegistry(t)
+	// The tags have different manifests declaring the same config and
+	// layers, so they are one image with two manifest digests
+	manifests := []digest.Digest{
+		registry.addImageWithMediaType(t, "library/app", "1.0", "application/vnd.oci.image.layer.v1.tar+gzip", layer),
+		registry.addImage(t, "library/app", "latest", layer),
+	}
+	if manifests[0] == manifests[1] {
+		t.Fatal("tags serve the same manifest")
+	}
+	registry.addImage(t, "library/other", "latest", []byte("layer of another image"))
+
+	service := newTestService(t, registry)
+	ctx := context.Background()
+	tags := []string{
+		registry.host() + "/library/app:1.0",
+		registry.host() + "/library/app:latest",
+	}
+	var ids []string
+	for _, ref := range append(tags, registry.host()+"/library/other:latest") {
+		id, err := service.PullImage(ctx, ref, nil)
+		if err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("tags of one config have IDs %s and %s, want the same", ids[0], ids[1])
+	}
+
+	// Each tag is pulled from its own manifest
+	for i, tag := range []string{"1.0", "latest"} {
+		if hits := registry.hitCount("/v2/library/app/manifests/" + tag); hits != 1 {
+			t.Errorf("manifest of %s fetched %d times, want 1", tag, hits)
+		}
+		info, err := service.GetImageInfo(tags[i])
+		if err != nil {
+			t.Fatalf("GetImageInfo(%s) error = %v", tags[i], err)
+		}
+		if info.Digest != manifests[i].String() {
+			t.Errorf("%s recorded manifest %s, want %s", tags[i], info.Digest, manifests[i])
+		}
+	}
+
+	images, err := service.ListImages(ctx, nil)
+	if err != nil {
+		t.Fatalf("ListImages() error = %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("ListImages() returned %d images, want 2", len(images))
+	}
+	var app *runtime.Image
+	for _, img := range images {
+		if img.Id == ids[0] {
+			app = img
+		}
+	}
+	if app == nil {
+		t.Fatalf("ListImages() has no image %s", ids[0])
+	}
+	if !reflect.DeepEqual(app.RepoTags, tags) {
+		t.Errorf("RepoTags = %v, want %v", app.RepoTags, tags)
+	}
+
+	// The status of either tag describes the whole image
+	status, err := service.ImageStatus(ctx, tags[1])
+	if err != nil {
+		t.Fatalf("ImageStatus() error = %v", err)
+	}
+	if !reflect.DeepEqual(status.RepoTags, tags) {
+		t.Errorf("ImageStatus() RepoTags = %v, want %v", status.RepoTags, tags)
+	}
+}
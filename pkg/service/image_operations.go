@@ -3,16 +3,20 @@ package service
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
+	// Registers sha512 with go-digest for manifests that use it
+	_ "crypto/sha512"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
-
-	"archive/tar"
-	"compress/gzip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
@@ -32,7 +36,14 @@ type DockerManifest struct {
 		MediaType string `json:"mediaType"`
 		Size      int64  `json:"size"`
 		Digest    string `json:"digest"`
+		// URLs are where foreign layers, which registries may not
+		// distribute, are downloaded from
+		URLs []string `json:"urls,omitempty"`
 	} `json:"layers"`
+
+	// schema1Config is the config carried inline by a converted schema 1
+	// manifest, which has no config blob to fetch
+	schema1Config []byte
 }
 
 // LayerInfo stores layer download information
@@ -43,111 +54,476 @@ type LayerInfo struct {
 	Path      string
 }
 
-// getRegistryClient returns a client for interacting with the registry
-func (s *ImageService) getRegistryClient(ref reference.Named, auth *runtime.AuthConfig) error {
-	// Check registry API version
-	registry := reference.Domain(ref)
-	checkURL := fmt.Sprintf("https://%s/v2/", registry)
-	return s.checkRegistry(context.Background(), checkURL, auth)
+// getRegistryClient checks that the registry of ref is reachable and returns
+// the credentials to use for it, which hold the token obtained for an
+// identity token or, for unauthenticated pulls, an anonymous token when the
+// registry requires one
+func (s *ImageService) getRegistryClient(ctx context.Context, ref reference.Named, auth *runtime.AuthConfig) (*runtime.AuthConfig, error) {
+	// Check registry API version on the first endpoint that answers
+	var err error
+	for _, endpoint := range s.registryEndpoints(reference.Domain(ref)) {
+		var registryAuth *runtime.AuthConfig
+		if registryAuth, err = s.checkRegistry(ctx, s.endpointURL(endpoint, "/v2/"), reference.Path(ref), auth); err == nil {
+			return registryAuth, nil
+		}
+	}
+	return nil, err
 }
 
-func (s *ImageService) pullImage(ctx context.Context, imageRef string, auth *runtime.AuthConfig) (string, error) {
+// registryEndpoints returns the endpoints to try for registry: configured
+// mirrors in order, then the registry itself
+func (s *ImageService) registryEndpoints(registry string) []string {
+	endpoints := append([]string(nil), s.config.Mirrors[registry]...)
+	return append(endpoints, registry)
+}
+
+// endpointURL builds the URL of path on an endpoint given either as a full
+// base URL or as a registry host
+func (s *ImageService) endpointURL(endpoint, path string) string {
+	if strings.Contains(endpoint, "://") {
+		return strings.TrimSuffix(endpoint, "/") + path
+	}
+	return s.registryURL(endpoint, path)
+}
+
+// registryURL builds the URL of path on registry, using plain HTTP for
+// registries configured as insecure
+func (s *ImageService) registryURL(registry, path string) string {
+	scheme := "https"
+	for _, insecure := range s.config.InsecureRegistries {
+		if insecure == registry {
+			scheme = "http"
+			break
+		}
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, registry, path)
+}
+
+// parseImageReference parses imageRef, rejecting references that cannot
+// name a pullable image before any registry is contacted
+func parseImageReference(imageRef string) (reference.Named, error) {
+	// A bare digest would otherwise be read as a tag of library/sha256
+	if _, err := digest.Parse(imageRef); err == nil {
+		return nil, fmt.Errorf("%w: bare digest %q", ErrInvalidReference, imageRef)
+	}
+
 	named, err := reference.ParseNormalizedNamed(imageRef)
 	if err != nil {
-		return "", fmt.Errorf("invalid image reference: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReference, err)
+	}
+
+	domain, path := reference.Domain(named), reference.Path(named)
+	if domain == "" || path == "" {
+		return nil, fmt.Errorf("%w: %q has no registry or repository", ErrInvalidReference, imageRef)
+	}
+	for _, component := range strings.Split(path, "/") {
+		if component == "" {
+			return nil, fmt.Errorf("%w: %q has an empty path component", ErrInvalidReference, imageRef)
+		}
+	}
+	// scratch is reserved for images built from nothing
+	if path == "library/scratch" {
+		return nil, fmt.Errorf("%w: %q is reserved", ErrInvalidReference, imageRef)
+	}
+	return named, nil
+}
+
+// parseReference parses imageRef like parseImageReference, resolving
+// references without a registry against the configured default registry
+func (s *ImageService) parseReference(imageRef string) (reference.Named, error) {
+	// References are validated as written first, so that bare digests and
+	// reserved names are rejected whatever the default registry
+	named, err := parseImageReference(imageRef)
+	if err != nil || s.config.DefaultRegistry == "" || hasRegistry(imageRef) {
+		return named, err
+	}
+	return parseImageReference(s.config.DefaultRegistry + "/" + imageRef)
+}
+
+// hasRegistry reports whether imageRef names its registry, following the
+// rule of ParseNormalizedNamed: the first path component is a registry if it
+// contains a dot, a port or upper-case letters, or is localhost
+func hasRegistry(imageRef string) bool {
+	first, _, found := strings.Cut(imageRef, "/")
+	if !found {
+		return false
+	}
+	return strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first
+}
+
+func (s *ImageService) pullImage(ctx context.Context, imageRef string, auth *runtime.AuthConfig) (string, error) {
+	named, err := s.parseReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	// Fail fast on references the registry recently reported as missing
+	key := pullKey(named)
+	if s.knownMissing(key) {
+		return "", fmt.Errorf("%w: %s (cached)", ErrImageNotFound, imageRef)
 	}
 
+	// Share a single download between concurrent pulls of the same image,
+	// waiting for it only as long as ctx allows
+	f, err := s.joinPull(ctx, named, key, auth)
+	if err != nil {
+		return "", fmt.Errorf("failed to pull %s: %w", imageRef, err)
+	}
+	select {
+	case <-f.done:
+		s.leavePull(f)
+	case <-ctx.Done():
+		// The last waiter to give up sees the download stop
+		if s.leavePull(f) {
+			<-f.done
+		}
+		return "", fmt.Errorf("failed to pull %s: %w", imageRef, ctx.Err())
+	}
+
+	if f.err != nil {
+		if errors.Is(f.err, ErrImageNotFound) {
+			s.recordMissing(key)
+		}
+		return "", f.err
+	}
+	s.forgetMissing(key)
+	return f.imageID, nil
+}
+
+// pullKey identifies the pulls of named, which share their download and
+// progress events, and is the key the pulled image is stored under
+func pullKey(named reference.Named) string {
+	return reference.TagNameOnly(named).String()
+}
+
+// NormalizeReference returns the canonical form of imageRef: the
+// registry and library/ repository prefix of Docker Hub are filled in and
+// the latest tag is added unless a tag or digest is given, so that
+// "nginx", "nginx:latest" and "docker.io/library/nginx:latest" are equal
+func NormalizeReference(imageRef string) (string, error) {
+	named, err := parseImageReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+	return pullKey(named), nil
+}
+
+// normalizeImageKeysLocked moves images recorded by older versions under
+// the reference they were pulled by to their normalized reference, unless
+// an image is already stored there. Caller must hold the lock.
+func (s *ImageService) normalizeImageKeysLocked() {
+	for ref, img := range s.images {
+		named, err := s.parseReference(ref)
+		if err != nil {
+			continue
+		}
+		key := pullKey(named)
+		if _, taken := s.images[key]; taken {
+			continue
+		}
+		s.images[key] = img
+		delete(s.images, ref)
+	}
+}
+
+// imageKeyLocked returns the key under which the image named by imageRef is
+// stored: imageRef itself when recorded under it, such as an image stored
+// before references were normalized, otherwise its normalized form
+// resolved against the default registry. Caller must hold the lock.
+func (s *ImageService) imageKeyLocked(imageRef string) string {
+	if _, ok := s.images[imageRef]; ok {
+		return imageRef
+	}
+	named, err := s.parseReference(imageRef)
+	if err != nil {
+		return imageRef
+	}
+	return pullKey(named)
+}
+
+// fetchImage pulls imageRef unless it is already present
+func (s *ImageService) fetchImage(ctx context.Context, named reference.Named, imageRef string, auth *runtime.AuthConfig) (string, error) {
 	// Check if image already exists
 	s.mu.RLock()
-	if img, ok := s.images[imageRef]; ok {
+	if img, ok := s.images[imageRef]; ok && img.ready() {
 		defer s.mu.RUnlock()
 		return img.ID, nil
 	}
 	s.mu.RUnlock()
 
+	// Wait for a pull slot before touching the registry
+	release, err := s.acquirePullSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	// Track the pull until it either commits or fails
+	start := time.Now()
+	s.startPull(imageRef)
+	defer s.finishPull(imageRef)
+
 	// Get registry client
-	if err := s.getRegistryClient(named, auth); err != nil {
+	auth, err = s.getRegistryClient(ctx, named, auth)
+	if err != nil {
 		return "", err
 	}
 
 	// Get manifest and download layers
-	dgst, totalSize, err := s.downloadImage(ctx, reference.Domain(named), reference.Path(named), "latest", imageRef, auth)
+	key := pullKey(named)
+	progress := func(p PullProgress) { s.publishProgress(key, p) }
+	imageID, totalSize, err := s.downloadImage(ctx, reference.Domain(named), reference.Path(named), manifestReference(named), imageRef, auth, progress)
 	if err != nil {
-		return "", fmt.Errorf("failed to download image: %v", err)
+		return "", fmt.Errorf("failed to download image: %w", err)
 	}
 
-	// Create image ID and save metadata
-	imageID := fmt.Sprintf("sha256:%x", dgst.Hex())
+	// Image metadata has already been recorded by downloadImage
+	var manifestDigest string
+	s.mu.RLock()
+	if img, ok := s.images[imageRef]; ok {
+		manifestDigest = img.Digest
+	}
+	s.mu.RUnlock()
+	s.log().Info("image pulled",
+		"image", imageRef,
+		"id", imageID,
+		"digest", manifestDigest,
+		"bytes", totalSize,
+		"duration", time.Since(start))
+	return imageID, nil
+}
+
+// acquirePullSlot waits until fewer than MaxConcurrentPulls pulls are
+// downloading and returns a func releasing the slot taken
+func (s *ImageService) acquirePullSlot(ctx context.Context) (func(), error) {
+	s.pullSemOnce.Do(func() {
+		if s.config.MaxConcurrentPulls > 0 {
+			s.pullSem = make(chan struct{}, s.config.MaxConcurrentPulls)
+		}
+	})
+	if s.pullSem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.pullSem <- struct{}{}:
+		return func() { <-s.pullSem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for a pull slot: %w", ctx.Err())
+	}
+}
+
+// startPull records imageRef as being pulled
+func (s *ImageService) startPull(imageRef string) {
 	s.mu.Lock()
-	s.images[imageRef] = &imageMetadata{
-		ID:          imageID,
-		RepoTags:    []string{imageRef},
-		RepoDigests: []string{fmt.Sprintf("%s@%s", imageRef, dgst)},
-		Size:        totalSize,
+	defer s.mu.Unlock()
+
+	if s.pulls == nil {
+		s.pulls = make(map[string]time.Time)
 	}
+	s.pulls[imageRef] = time.Now()
+}
+
+// finishPull forgets an in-flight pull of imageRef and discards whatever a
+// failed pull left behind
+func (s *ImageService) finishPull(imageRef string) {
+	s.mu.Lock()
+	delete(s.pulls, imageRef)
+	img, ok := s.images[imageRef]
+	abandoned := ok && !img.ready()
 	s.mu.Unlock()
 
-	if err := s.saveMetadata(); err != nil {
-		return "", fmt.Errorf("failed to save metadata: %v", err)
+	if abandoned {
+		if err := s.removeImage(context.Background(), imageRef); err != nil {
+			s.log().Error("failed to clean up partially pulled image", "image", imageRef, "error", err)
+		}
 	}
+}
 
-	fmt.Printf("Successfully pulled image: %s\n", imageRef)
-	return imageID, nil
+// layerDownloadOrder returns the manifest indices of the layers in the order
+// their downloads should be dispatched
+func layerDownloadOrder(manifest *DockerManifest, order LayerOrder) []int {
+	indices := make([]int, len(manifest.Layers))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	switch order {
+	case LayerOrderSmallestFirst:
+		sort.SliceStable(indices, func(a, b int) bool {
+			return manifest.Layers[indices[a]].Size < manifest.Layers[indices[b]].Size
+		})
+	case LayerOrderLargestFirst:
+		sort.SliceStable(indices, func(a, b int) bool {
+			return manifest.Layers[indices[a]].Size > manifest.Layers[indices[b]].Size
+		})
+	}
+	return indices
 }
 
-func (s *ImageService) downloadImage(ctx context.Context, registry, repository, tag, imageRef string, auth *runtime.AuthConfig) (digest.Digest, int64, error) {
-	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, repository, tag)
-	manifest, err := s.getManifest(ctx, manifestURL, auth)
+// downloadImage fetches the manifest, config and layers of imageRef and
+// records the image, returning its ID and size
+func (s *ImageService) downloadImage(ctx context.Context, registry, repository, tag, imageRef string, auth *runtime.AuthConfig, progress func(PullProgress)) (string, int64, error) {
+	// Fetch the manifest from the first endpoint that serves it
+	endpoints := s.registryEndpoints(registry)
+	var manifest *DockerManifest
+	var manifestDigest digest.Digest
+	var err error
+	for _, endpoint := range endpoints {
+		manifestURL := s.endpointURL(endpoint, fmt.Sprintf("/v2/%s/manifests/%s", repository, tag))
+		manifest, manifestDigest, err = s.getManifest(ctx, manifestURL, auth)
+		if err == nil {
+			break
+		}
+		if len(endpoints) > 1 {
+			s.log().Warn("failed to get manifest", "image", imageRef, "endpoint", endpoint, "error", err)
+		}
+	}
 	if err != nil {
 		return "", 0, err
 	}
 
-	// Create image directory
-	dgst := digest.FromString(imageRef)
-	imageID := fmt.Sprintf("sha256:%x", dgst.Hex())
-	imageDir := filepath.Join(s.imageRoot, dgst.Hex())
-	if err := os.MkdirAll(imageDir, 0755); err != nil {
-		return "", 0, fmt.Errorf("failed to create image directory: %v", err)
+	// Check the signature of the resolved manifest before fetching content
+	if err := s.verifySignature(ctx, endpoints, repository, manifestDigest, auth); err != nil {
+		return "", 0, fmt.Errorf("signature verification failed: %v", err)
 	}
 
-	// Download layers
-	var layers []LayerMetadata
-	var totalSize int64
+	imageID := imageIDFor(manifest, manifestDigest)
+
+	// Reject layers we cannot decompress before downloading anything
 	for i, layer := range manifest.Layers {
-		layerDir := filepath.Join(imageDir, fmt.Sprintf("layer-%d", i))
-		layerPath := filepath.Join(layerDir, "layer.tar")
-
-		// Check if layer already exists
-		if metadata, exists := s.layerCache.Get(layer.Digest); exists {
-			// Add additional check to ensure file exists
-			if _, err := os.Stat(metadata.Path); err == nil {
-				if err := reuseLayer(metadata.Path, layerPath); err != nil {
-					// If reuse fails, remove from cache and continue downloading
-					s.layerCache.Remove(layer.Digest)
-					goto downloadLayer
-				}
-				layers = append(layers, metadata)
-				totalSize += metadata.Size
-				continue
+		if _, err := layerCompressionFor(layer.MediaType); err != nil {
+			return "", 0, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+
+	// Reject images whose manifest already declares too much content
+	if err := s.checkLayerCount(manifest); err != nil {
+		return "", 0, err
+	}
+	if err := s.checkImageSize(declaredImageSize(manifest)); err != nil {
+		return "", 0, err
+	}
+
+	// Fetch the image config. It only backs verbose status, so an image
+	// whose config cannot be fetched is still pulled, but a config that does
+	// not match the manifest means the registry cannot be trusted. Schema 1
+	// manifests carry their config inline.
+	config := manifest.schema1Config
+	if config == nil {
+		for _, endpoint := range endpoints {
+			configURL := s.endpointURL(endpoint, fmt.Sprintf("/v2/%s/blobs/%s", repository, manifest.Config.Digest))
+			config, err = s.getJSONBlob(ctx, configURL, manifest.Config.Digest, auth)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrDigestMismatch) {
+				return "", 0, fmt.Errorf("failed to get image config: %w", err)
 			}
+			s.log().Warn("failed to get image config", "image", imageRef, "error", err)
 		}
+	}
+
+	// Keep the blobs of the layers from being collected until the image
+	// that references them is recorded
+	layerDigests := make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layerDigests[i] = layer.Digest
+	}
+	releaseLayers := s.claimLayers(layerDigests)
+	defer releaseLayers()
+
+	// Record the image as pulling so that an interrupted pull leaves a
+	// trace the garbage collector can reclaim
+	s.mu.Lock()
+	s.setImage(imageRef, &imageMetadata{
+		ID:            imageID,
+		RepoTags:      []string{imageRef},
+		State:         imageStatePulling,
+		PullStartedAt: time.Now(),
+	})
+	err = s.saveMetadata()
+	s.mu.Unlock()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to save metadata: %v", err)
+	}
 
-	downloadLayer:
-		if err := os.MkdirAll(layerDir, 0755); err != nil {
-			return "", 0, fmt.Errorf("failed to create layer directory: %v", err)
+	// Download layers in the configured order, recording them in manifest order
+	layers := make([]LayerMetadata, len(manifest.Layers))
+	var totalSize int64
+	// downloaded lists the layers fetched by this pull, discarded if the
+	// image turns out to exceed MaxImageSize
+	var downloaded []string
+	for _, i := range layerDownloadOrder(manifest, s.config.LayerOrder) {
+		// Stop at the next layer once the pull is cancelled
+		if err := ctx.Err(); err != nil {
+			return "", 0, fmt.Errorf("pull cancelled before layer %d: %w", i, err)
+		}
+		layer := manifest.Layers[i]
+		layerPath, err := s.blobPath(layer.Digest)
+		if err != nil {
+			return "", 0, fmt.Errorf("layer %d: %v", i, err)
 		}
 
-		layerURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", registry, repository, layer.Digest)
-		uncompressedSize, err := s.downloadLayer(ctx, layerURL, layerDir, layer.Digest, auth)
+		// Reuse the blob if another image already stored it. Probing the
+		// cache must not count as a use, storedLayer records the reuse.
+		if s.layerStored(layer.Digest, layerPath) && s.reusableLayer(layer.Digest, layerPath) {
+			metadata, err := s.storedLayer(layer.Digest, layerPath, layer.MediaType)
+			if err != nil {
+				return "", 0, fmt.Errorf("failed to reuse layer %d: %v", i, err)
+			}
+			s.warnLayerSizeMismatch(layer.Digest, layer.Size, metadata.Size)
+			metadata.Reused = true
+			layers[i] = metadata
+			totalSize += metadata.Size
+			progress(PullProgress{Image: imageRef, Layer: layer.Digest, Downloaded: metadata.Size, Total: metadata.Size, Status: PullStatusComplete})
+			if err := s.checkImageSize(totalSize); err != nil {
+				releaseLayers()
+				s.discardLayers(downloaded)
+				return "", 0, err
+			}
+			continue
+		}
+
+		layerProgress := func(status PullStatus, downloaded int64) {
+			progress(PullProgress{Image: imageRef, Layer: layer.Digest, Downloaded: downloaded, Total: layer.Size, Status: status})
+		}
+		layerProgress(PullStatusPulling, 0)
+		if isForeignLayer(layer.MediaType) && len(layer.URLs) > 0 {
+			// Foreign layers come from their own URLs, unless the
+			// registry is configured to distribute them
+			err = s.downloadForeignLayer(ctx, layer.URLs, layerPath, layer.Digest, layer.Size, layerProgress)
+			if err != nil && ctx.Err() == nil {
+				if registryErr := s.downloadRegistryLayer(ctx, endpoints, repository, imageRef, layer.Digest, layer.Size, layerPath, auth, layerProgress); registryErr == nil {
+					err = nil
+				}
+			}
+		} else {
+			err = s.downloadRegistryLayer(ctx, endpoints, repository, imageRef, layer.Digest, layer.Size, layerPath, auth, layerProgress)
+			// Layers missing from the registry may be listed elsewhere
+			if err != nil && len(layer.URLs) > 0 && registryStatus(err) == http.StatusNotFound {
+				err = s.downloadForeignLayer(ctx, layer.URLs, layerPath, layer.Digest, layer.Size, layerProgress)
+			}
+		}
 		if err != nil {
-			return "", 0, fmt.Errorf("failed to download layer %d: %v", i, err)
+			return "", 0, &LayerError{Index: i, Count: len(manifest.Layers), Digest: layer.Digest, Err: err}
 		}
+		downloaded = append(downloaded, layer.Digest)
 
 		// Get layer size
 		fi, err := os.Stat(layerPath)
 		if err != nil {
 			return "", 0, fmt.Errorf("failed to get layer size: %v", err)
 		}
+		s.warnLayerSizeMismatch(layer.Digest, layer.Size, fi.Size())
+
+		// Compute the digest and size of the uncompressed content
+		diffID, uncompressedSize, err := computeDiffID(layerPath, layer.MediaType)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to compute diffID of layer %d: %v", i, err)
+		}
 
 		// Create and cache layer metadata
 		metadata := LayerMetadata{
@@ -155,212 +531,479 @@ func (s *ImageService) downloadImage(ctx context.Context, registry, repository,
 			Path:             layerPath,
 			Size:             fi.Size(),
 			UncompressedSize: uncompressedSize,
+			DiffID:           diffID.String(),
 		}
 		s.layerCache.Add(layer.Digest, metadata)
-		layers = append(layers, metadata)
-		totalSize += uncompressedSize
+		layers[i] = metadata
+		totalSize += fi.Size()
+		progress(PullProgress{Image: imageRef, Layer: layer.Digest, Downloaded: fi.Size(), Total: fi.Size(), Status: PullStatusComplete})
+		if err := s.checkImageSize(totalSize); err != nil {
+			releaseLayers()
+			s.discardLayers(downloaded)
+			return "", 0, err
+		}
 	}
 
 	// Save image metadata
+	pulledAt := time.Now()
 	s.mu.Lock()
-	s.images[imageRef] = &imageMetadata{
-		ID:          imageID,
-		RepoTags:    []string{imageRef},
-		RepoDigests: []string{fmt.Sprintf("%s@%s", imageRef, dgst)},
-		Size:        totalSize,
-		Layers:      layers,
-	}
+	s.setImage(imageRef, &imageMetadata{
+		ID:               imageID,
+		RepoTags:         []string{imageRef},
+		RepoDigests:      []string{fmt.Sprintf("%s/%s@%s", registry, repository, manifestDigest)},
+		Size:             totalSize,
+		Layers:           layers,
+		UncompressedSize: layersUncompressedSize(layers),
+		Digest:           manifestDigest.String(),
+		State:            imageStateReady,
+		Config:           config,
+		Labels:           configLabels(config),
+		PulledAt:         pulledAt,
+		LastUsedAt:       pulledAt,
+	})
+	delete(s.pulls, imageRef)
+	err = s.saveMetadata()
 	s.mu.Unlock()
-
-	if err := s.saveMetadata(); err != nil {
+	if err != nil {
 		return "", 0, fmt.Errorf("failed to save metadata: %v", err)
 	}
 
-	return dgst, totalSize, nil
+	return imageID, totalSize, nil
 }
 
-func (s *ImageService) getManifest(ctx context.Context, url string, auth *runtime.AuthConfig) (*DockerManifest, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+// imageIDFor returns the ID of the image described by manifest: the digest
+// of its config, so that every reference resolving to the same content
+// names the same image, or the manifest digest if the config digest is
+// invalid
+func imageIDFor(manifest *DockerManifest, manifestDigest digest.Digest) string {
+	if configDigest, err := digest.Parse(manifest.Config.Digest); err == nil {
+		return configDigest.String()
 	}
+	return manifestDigest.String()
+}
 
-	if auth != nil {
-		req.SetBasicAuth(auth.Username, auth.Password)
+// describeSize formats a response size for progress messages, which is
+// unknown when the registry omits Content-Length
+func describeSize(size int64) string {
+	if size < 0 {
+		return "unknown size"
 	}
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	return fmt.Sprintf("%d bytes", size)
+}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get manifest: %v", err)
+// warnLayerSizeMismatch reports a layer whose size on disk differs from the
+// size declared in the manifest
+func (s *ImageService) warnLayerSizeMismatch(layerDigest string, declared, actual int64) {
+	if declared != actual {
+		s.log().Warn("layer size differs from manifest", "digest", layerDigest, "bytes", actual, "declared_bytes", declared)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get manifest: %s", resp.Status)
+// withRequestTimeout derives a context bounding a single registry request
+func (s *ImageService) withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.config.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, s.config.RequestTimeout)
+}
 
-	var manifest DockerManifest
-	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
-		return nil, fmt.Errorf("failed to decode manifest: %v", err)
+// withIdleTimeout derives a context bounding a blob download, which may
+// take longer than RequestTimeout as a whole. It is cancelled once
+// RequestTimeout passes without the returned touch func being called, with
+// a cause wrapping context.DeadlineExceeded.
+func (s *ImageService) withIdleTimeout(ctx context.Context) (context.Context, func(), context.CancelFunc) {
+	timeout := s.config.RequestTimeout
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, func() {}, cancel
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() {
+		cancel(fmt.Errorf("no data received for %v: %w", timeout, context.DeadlineExceeded))
+	})
+	touch := func() { timer.Reset(timeout) }
+	return ctx, touch, func() {
+		timer.Stop()
+		cancel(context.Canceled)
 	}
-
-	return &manifest, nil
 }
 
-func getUncompressedSize(reader io.Reader) (int64, error) {
-	// Read all data into buffer to avoid consuming the reader
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return 0, fmt.Errorf("failed to read data: %v", err)
+// downloadErr returns the cause of a cancelled download context in place
+// of err, so that idle timeouts are reported as such
+func downloadErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
 	}
+	return err
+}
+
+// touchWriterAt calls touch on every write to w
+type touchWriterAt struct {
+	w     io.WriterAt
+	touch func()
+}
 
-	// Create new reader from buffer
-	bufReader := bytes.NewReader(data)
+func (tw touchWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	tw.touch()
+	return tw.w.WriteAt(p, off)
+}
 
-	gzReader, err := gzip.NewReader(bufReader)
-	if err != nil {
-		// If not gzipped, return original size
-		return int64(len(data)), nil
+// getManifest fetches and decodes the manifest at url, returning it together
+// with the digest of the raw manifest bytes. When the registry rejects the
+// accepted media types or answers with a manifest that cannot be pulled,
+// each of manifestFallbackMediaTypes is requested in turn.
+func (s *ImageService) getManifest(ctx context.Context, url string, auth *runtime.AuthConfig) (*DockerManifest, digest.Digest, error) {
+	manifest, dgst, err := s.getManifestAs(ctx, url, auth, s.manifestAcceptTypes())
+	if err == nil || !acceptRejected(err) {
+		return manifest, dgst, err
 	}
-	defer gzReader.Close()
+	for _, mediaType := range manifestFallbackMediaTypes {
+		if ctx.Err() != nil {
+			break
+		}
+		var fallbackErr error
+		manifest, dgst, fallbackErr = s.getManifestAs(ctx, url, auth, []string{mediaType})
+		if fallbackErr == nil {
+			return manifest, dgst, nil
+		}
+		if !acceptRejected(fallbackErr) {
+			return nil, "", fallbackErr
+		}
+		s.log().Debug("manifest media type not usable", "url", url, "media_type", mediaType, "error", fallbackErr)
+	}
+	return nil, "", fmt.Errorf("no usable manifest for any accepted media type: %w", err)
+}
 
-	tarReader := tar.NewReader(gzReader)
-	var totalSize int64
+// getManifestAs fetches and decodes the manifest at url, accepting the given
+// media types
+func (s *ImageService) getManifestAs(ctx context.Context, url string, auth *runtime.AuthConfig, mediaTypes []string) (*DockerManifest, digest.Digest, error) {
+	ctx, cancel := s.withRequestTimeout(ctx)
+	defer cancel()
 
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
+	if err := s.waitForRegistry(ctx, url); err != nil {
+		return nil, "", fmt.Errorf("failed to get manifest: %v", err)
+	}
+	body, err := s.registryClient().GetManifest(ctx, url, auth, mediaTypes)
+	if err != nil {
+		if acceptStatus(registryStatus(err)) {
+			return nil, "", fmt.Errorf("failed to get manifest: %w", err)
 		}
+		return nil, "", registryRequestError("failed to get manifest", err, auth)
+	}
+
+	var manifest DockerManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	if manifest.SchemaVersion == 1 && s.config.AllowSchema1 {
+		converted, err := convertSchema1(body)
 		if err != nil {
-			// If not a valid tar, return gzipped size
-			return int64(len(data)), nil
+			return nil, "", err
 		}
+		return converted, digest.FromBytes(body), nil
+	}
+	if err := checkManifestSupported(&manifest); err != nil {
+		return nil, "", err
+	}
 
-		if header.Typeflag == tar.TypeReg {
-			totalSize += header.Size
-		}
+	return &manifest, digest.FromBytes(body), nil
+}
+
+// acceptStatus reports whether a registry answering a manifest request with
+// status may serve the manifest for other accepted media types. Missing
+// manifests and authorization failures are final.
+func acceptStatus(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusNotAcceptable, http.StatusUnsupportedMediaType:
+		return true
 	}
+	return false
+}
 
-	return totalSize, nil
+// acceptRejected reports whether a manifest request failed because of the
+// media types it accepted, rather than because the manifest is unavailable
+func acceptRejected(err error) bool {
+	return errors.Is(err, ErrManifestUnsupported) || acceptStatus(registryStatus(err))
 }
 
-func (s *ImageService) downloadLayer(ctx context.Context, url, destDir, expectedDigest string, auth *runtime.AuthConfig) (int64, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create request: %v", err)
+// registryRequestError describes a failed registry request, classifying
+// missing content as ErrImageNotFound and authorization failures as
+// ErrAuthRequired or ErrAuthFailed
+func registryRequestError(msg string, err error, auth *runtime.AuthConfig) error {
+	switch status := registryStatus(err); {
+	case status == http.StatusNotFound:
+		return fmt.Errorf("%s: %w: %v", msg, ErrImageNotFound, err)
+	case status == http.StatusUnauthorized && !hasCredentials(auth):
+		return fmt.Errorf("%s: %w: %v", msg, ErrAuthRequired, err)
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return fmt.Errorf("%s: %w: %v", msg, ErrAuthFailed, err)
+	default:
+		return fmt.Errorf("%s: %v", msg, err)
 	}
+}
 
-	if auth != nil {
-		req.SetBasicAuth(auth.Username, auth.Password)
+// checkManifestSupported rejects manifests that do not describe a single
+// image, which the service cannot pull
+func checkManifestSupported(manifest *DockerManifest) error {
+	switch {
+	case manifest.SchemaVersion == 1:
+		return fmt.Errorf("%w: schema version 1", ErrManifestUnsupported)
+	case manifest.MediaType == "application/vnd.docker.distribution.manifest.list.v2+json",
+		manifest.MediaType == "application/vnd.oci.image.index.v1+json":
+		return fmt.Errorf("%w: media type %q", ErrManifestUnsupported, manifest.MediaType)
 	}
+	return nil
+}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("failed to download layer: %v", err)
+// downloadRegistryLayer downloads a layer blob from the first registry
+// endpoint that serves it
+func (s *ImageService) downloadRegistryLayer(ctx context.Context, endpoints []string, repository, imageRef, layerDigest string, layerSize int64, layerPath string, auth *runtime.AuthConfig, progress func(PullStatus, int64)) error {
+	var err error
+	for _, endpoint := range endpoints {
+		layerURL := s.endpointURL(endpoint, fmt.Sprintf("/v2/%s/blobs/%s", repository, layerDigest))
+		err = s.downloadLayer(ctx, layerURL, layerPath, layerDigest, layerSize, auth, progress)
+		if err == nil {
+			return nil
+		}
+		if len(endpoints) > 1 {
+			s.log().Warn("failed to download layer", "image", imageRef, "digest", layerDigest, "endpoint", endpoint, "error", err)
+		}
 	}
-	defer resp.Body.Close()
+	return err
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("failed to download layer: %s", resp.Status)
+// downloadLayer fetches a layer blob, verifies it against its digest and,
+// when known, its size and stores it at layerPath, reporting its progress
+// to progress unless nil
+func (s *ImageService) downloadLayer(ctx context.Context, url, layerPath, expectedDigest string, expectedSize int64, auth *runtime.AuthConfig, progress func(PullStatus, int64)) error {
+	if progress == nil {
+		progress = func(PullStatus, int64) {}
 	}
 
-	// Create a buffer to store response body
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return 0, fmt.Errorf("failed to read response body: %v", err)
+	ctx, touch, cancel := s.withIdleTimeout(ctx)
+	defer cancel()
+
+	var byteRange string
+	if s.config.BlobChunkSize > 0 {
+		// Registries ignoring the range answer with the whole blob
+		byteRange = fmt.Sprintf("bytes=0-%d", s.config.BlobChunkSize-1)
 	}
 
-	// Get uncompressed size
-	uncompressedSize, err := getUncompressedSize(bytes.NewReader(bodyBytes))
+	if err := s.waitForRegistry(ctx, url); err != nil {
+		return fmt.Errorf("failed to download layer: %v", err)
+	}
+	blob, err := s.registryClient().GetBlob(ctx, url, auth, byteRange)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get uncompressed size: %v", err)
+		return fmt.Errorf("failed to download layer: %w", err)
 	}
+	defer blob.Body.Close()
 
-	// Save layer using the buffered data
-	if _, err := s.saveLayer(destDir, bytes.NewReader(bodyBytes), expectedDigest); err != nil {
-		return 0, err
+	// Catch error pages served with a success status before reading them
+	if err := checkLayerContentType(blob.ContentType); err != nil {
+		return fmt.Errorf("failed to download layer: %v", err)
 	}
 
-	// Update layer metadata with uncompressed size
-	layerPath := filepath.Join(destDir, "layer.tar")
-	fi, err := os.Stat(layerPath)
+	if blob.ContentRange != "" {
+		s.log().Debug("downloading layer in chunks", "digest", expectedDigest, "chunk_size", s.config.BlobChunkSize)
+
+		// Chunks are written at their offsets in a staged file rather than
+		// assembled in memory
+		if err := os.MkdirAll(filepath.Dir(layerPath), 0755); err != nil {
+			return fmt.Errorf("failed to create layer directory: %v", err)
+		}
+		f, err := os.CreateTemp(s.stagingDir(filepath.Dir(layerPath)), filepath.Base(layerPath)+".*.tmp")
+		if err != nil {
+			return fmt.Errorf("failed to create layer file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		size, err := s.readBlobChunks(ctx, url, auth, blob, touchWriterAt{w: f, touch: touch}, expectedSize)
+		if err != nil {
+			return fmt.Errorf("failed to download layer: %v", downloadErr(ctx, err))
+		}
+		progress(PullStatusVerifying, size)
+		return commitStagedLayer(f, layerPath, expectedDigest, expectedSize)
+	}
+
+	s.log().Debug("downloading layer", "digest", expectedDigest, "size", describeSize(blob.Size))
+
+	// Create a buffer to store response body. Registries may stream the
+	// blob with chunked encoding, so the body is read to EOF rather than
+	// trusting Content-Length.
+	body := &progressReader{r: blob.Body, report: func(n int64) {
+		touch()
+		progress(PullStatusPulling, n)
+	}}
+	bodyBytes, err := io.ReadAll(body)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get layer size: %v", err)
+		return fmt.Errorf("failed to read response body: %v", downloadErr(ctx, err))
 	}
+	progress(PullStatusVerifying, int64(len(bodyBytes)))
+
+	// Save layer using the downloaded data
+	_, err = s.saveLayer(layerPath, bytes.NewReader(bodyBytes), expectedDigest, expectedSize)
+	return err
+}
 
-	metadata := LayerMetadata{
-		Digest:           expectedDigest,
-		Path:             layerPath,
-		Size:             fi.Size(),
-		UncompressedSize: uncompressedSize,
+// layerContentTypes are the media types, besides layer media types,
+// registries and the storage behind them serve layer blobs as
+var layerContentTypes = []string{
+	"application/octet-stream",
+	"binary/octet-stream",
+	"application/gzip",
+	"application/x-gzip",
+	"application/tar",
+	"application/x-tar",
+	"application/zstd",
+}
+
+// checkLayerContentType rejects a layer blob response whose Content-Type
+// shows it is not a layer, such as an HTML error page. A missing
+// Content-Type is accepted.
+func checkLayerContentType(contentType string) error {
+	if contentType == "" {
+		return nil
 	}
-	s.layerCache.Add(expectedDigest, metadata)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("registry returned invalid content type %q for layer blob: %v", contentType, err)
+	}
+	if slices.Contains(layerContentTypes, mediaType) ||
+		strings.HasPrefix(mediaType, "application/vnd.oci.image.layer.") ||
+		strings.HasPrefix(mediaType, "application/vnd.docker.image.rootfs.") {
+		return nil
+	}
+	return fmt.Errorf("registry returned %s content instead of a layer blob", mediaType)
+}
 
-	return uncompressedSize, nil
+// normalizeDigest parses a digest string tolerating a missing algorithm
+// prefix (assumed canonical) and upper-case hex
+func normalizeDigest(value string) (digest.Digest, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if !strings.Contains(value, ":") {
+		value = string(digest.Canonical) + ":" + value
+	}
+	return digest.Parse(value)
 }
 
-func (s *ImageService) saveLayer(destDir string, reader io.Reader, expectedDigest string) (int64, error) {
-	layerPath := filepath.Join(destDir, "layer.tar")
-	tempPath := layerPath + ".tmp"
-	f, err := os.Create(tempPath)
+// saveLayer writes a layer to layerPath once its content matches
+// expectedDigest and, if positive, expectedSize, returning the number of
+// bytes written. Concurrent writers of the same blob each use their own
+// temporary file in the staging directory, so the blob only ever appears
+// complete.
+func (s *ImageService) saveLayer(layerPath string, reader io.Reader, expectedDigest string, expectedSize int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(layerPath), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create layer directory: %v", err)
+	}
+	f, err := os.CreateTemp(s.stagingDir(filepath.Dir(layerPath)), filepath.Base(layerPath)+".*.tmp")
 	if err != nil {
 		return 0, fmt.Errorf("failed to create layer file: %v", err)
 	}
 	defer f.Close()
+	tempPath := f.Name()
 
-	digester := digest.Canonical.Digester()
+	// Verify with the algorithm the expected digest was computed with
+	expected, err := normalizeDigest(expectedDigest)
+	if err != nil {
+		os.Remove(tempPath)
+		return 0, fmt.Errorf("invalid expected layer digest: %v", err)
+	}
+	digester := expected.Algorithm().Digester()
 	writer := io.MultiWriter(f, digester.Hash())
 
-	if _, err := io.Copy(writer, reader); err != nil {
+	written, err := io.Copy(writer, reader)
+	if err != nil {
 		os.Remove(tempPath)
 		return 0, fmt.Errorf("failed to save layer: %v", err)
 	}
 
-	actualDigest := digester.Digest().String()
-	if actualDigest != expectedDigest {
+	if err := checkLayerContent(digester.Digest(), expected, written, expectedSize); err != nil {
 		os.Remove(tempPath)
-		return 0, fmt.Errorf("layer digest mismatch: expected %s, got %s", expectedDigest, actualDigest)
+		return 0, err
 	}
 
-	if err := os.Rename(tempPath, layerPath); err != nil {
+	if err := moveFile(tempPath, layerPath); err != nil {
 		os.Remove(tempPath)
 		return 0, fmt.Errorf("failed to move verified layer: %v", err)
 	}
 
-	return 0, nil
+	return written, nil
 }
 
-func (s *ImageService) checkRegistry(ctx context.Context, url string, auth *runtime.AuthConfig) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+// commitStagedLayer verifies the layer staged in f as saveLayer does,
+// streaming it from disk, and moves it to layerPath
+func commitStagedLayer(f *os.File, layerPath, expectedDigest string, expectedSize int64) error {
+	expected, err := normalizeDigest(expectedDigest)
+	if err != nil {
+		return fmt.Errorf("invalid expected layer digest: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read layer: %v", err)
+	}
+	digester := expected.Algorithm().Digester()
+	size, err := io.Copy(digester.Hash(), f)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return fmt.Errorf("failed to read layer: %v", err)
+	}
+	if err := checkLayerContent(digester.Digest(), expected, size, expectedSize); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close layer file: %v", err)
 	}
+	if err := moveFile(f.Name(), layerPath); err != nil {
+		return fmt.Errorf("failed to move verified layer: %v", err)
+	}
+	return nil
+}
 
-	if auth != nil && auth.Username != "" && auth.Password != "" {
-		// Add proper authentication header
-		req.Header.Set("Authorization", fmt.Sprintf("Basic %s",
-			base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password))))
+// checkLayerContent verifies that a layer of size bytes with digest actual
+// matches expected and, if positive, expectedSize
+func checkLayerContent(actual, expected digest.Digest, size, expectedSize int64) error {
+	if actual != expected {
+		return fmt.Errorf("layer %w: expected %s, got %s", ErrDigestMismatch, expected, actual)
+	}
+	if expectedSize > 0 && size != expectedSize {
+		return fmt.Errorf("layer size mismatch: expected %d bytes, got %d", expectedSize, size)
 	}
+	return nil
+}
 
-	resp, err := s.client.Do(req)
+func (s *ImageService) checkRegistry(ctx context.Context, url, repository string, auth *runtime.AuthConfig) (*runtime.AuthConfig, error) {
+	ctx, cancel := s.withRequestTimeout(ctx)
+	defer cancel()
+
+	statusCode, authenticate, err := s.registryClient().CheckV2(ctx, url, auth)
 	if err != nil {
-		return fmt.Errorf("failed to check registry: %v", err)
+		return nil, fmt.Errorf("failed to check registry: %v", err)
 	}
-	defer resp.Body.Close()
+	status := fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
 
-	switch resp.StatusCode {
+	switch statusCode {
 	case http.StatusOK, http.StatusUnauthorized:
 		// Handle WWW-Authenticate challenge if present
-		if auth == nil && resp.StatusCode == http.StatusUnauthorized {
-			return fmt.Errorf("authentication required")
+		if !hasCredentials(auth) && statusCode == http.StatusUnauthorized {
+			challenge, ok := parseBearerChallenge(authenticate)
+			if !ok {
+				return nil, ErrAuthRequired
+			}
+			// An identity token is exchanged for an access token, and
+			// public images may still be pulled with an anonymous token
+			token, err := s.fetchToken(ctx, challenge, repository, auth)
+			if err != nil {
+				if auth.GetIdentityToken() != "" {
+					return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+				}
+				return nil, fmt.Errorf("%w: %v", ErrAuthRequired, err)
+			}
+			return &runtime.AuthConfig{RegistryToken: token}, nil
 		}
-		return nil
+		return auth, nil
 	case http.StatusForbidden:
-		return fmt.Errorf("authentication failed: %s", resp.Status)
+		return nil, fmt.Errorf("%w: %s", ErrAuthFailed, status)
 	default:
-		return fmt.Errorf("registry check failed: %s", resp.Status)
+		return nil, fmt.Errorf("registry check failed: %s", status)
 	}
 }
 
@@ -368,58 +1011,80 @@ func (s *ImageService) removeImage(ctx context.Context, imageRef string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	img, exists := s.images[imageRef]
-	if !exists {
-		return fmt.Errorf("image not found: %s", imageRef)
+	_, err := s.removeImageLocked(imageRef)
+	return err
+}
+
+// removeImageLocked removes imageRef and the layers only it referenced,
+// returning the bytes freed on disk. Caller must hold the lock.
+func (s *ImageService) removeImageLocked(imageRef string) (int64, error) {
+	if _, exists := s.images[imageRef]; !exists {
+		return 0, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
 	}
 
 	// Remove image directory
 	dgst := digest.FromString(imageRef)
 	imageDir := filepath.Join(s.imageRoot, dgst.Hex())
 
-	// Check which layers are used by other images
-	layersInUse := make(map[string]bool)
-	for ref, otherImg := range s.images {
-		if ref == imageRef {
+	// Only remove layers that are not used by other images
+	var freed int64
+	var leftover []LayerMetadata
+	for _, layer := range s.deleteImage(imageRef) {
+		// A pull in flight reuses the blob
+		if s.layerInUse(layer.Digest) {
 			continue
 		}
-		for _, layer := range otherImg.Layers {
-			layersInUse[layer.Digest] = true
-		}
-	}
-
-	// Only remove layers that are not used by other images
-	if img.Layers != nil {
-		for _, layer := range img.Layers {
-			if !layersInUse[layer.Digest] {
-				// Remove from cache first
-				s.layerCache.Remove(layer.Digest)
-
-				// Then remove the actual file if it's not used by other images
-				if layer.Path != "" {
-					if err := os.Remove(layer.Path); err != nil && !os.IsNotExist(err) {
-						fmt.Printf("Failed to remove layer file %s: %v\n", layer.Path, err)
-					}
-				}
+		// Remove from cache first
+		s.layerCache.Remove(layer.Digest)
+
+		// Then remove the actual file
+		if layer.Path != "" {
+			fi, statErr := os.Stat(layer.Path)
+			if err := os.Remove(layer.Path); err != nil && !os.IsNotExist(err) {
+				s.log().Error("failed to remove layer file", "path", layer.Path, "error", err)
+				leftover = append(leftover, layer)
+			} else if err == nil && statErr == nil {
+				freed += fi.Size()
 			}
 		}
 	}
 
-	// Remove the image directory
+	// Whatever is left is retried when the removal is repeated
 	if err := os.RemoveAll(imageDir); err != nil {
-		return fmt.Errorf("failed to remove image directory: %v", err)
+		s.recordPartialRemoval(imageRef, leftover)
+		return freed, fmt.Errorf("failed to remove image directory: %v", err)
 	}
-
-	// Update metadata
-	delete(s.images, imageRef)
 	if err := s.saveMetadata(); err != nil {
-		return fmt.Errorf("failed to save metadata: %v", err)
+		s.recordPartialRemoval(imageRef, leftover)
+		return freed, fmt.Errorf("failed to save metadata: %v", err)
+	}
+	if len(leftover) > 0 {
+		s.recordPartialRemoval(imageRef, leftover)
 	}
 
-	return nil
+	return freed, nil
 }
 
+// saveMetadata persists the image store and layer reference counts,
+// writing them right away unless the metadata flusher batches writes.
+// Caller must hold the lock.
 func (s *ImageService) saveMetadata() error {
+	if s.stopFlusher != nil {
+		s.metadataDirty = true
+		return nil
+	}
+	return s.writeMetadata()
+}
+
+// writeMetadata writes the image store and layer reference counts to disk.
+// Caller must hold the lock, which also keeps concurrent saves from
+// sharing the temporary file.
+func (s *ImageService) writeMetadata() error {
+	// Changes to a read-only service, such as images dropped by
+	// Reconcile, are kept in memory only
+	if s.config.ReadOnly {
+		return nil
+	}
 	if s.images == nil {
 		s.images = make(map[string]*imageMetadata)
 	}
@@ -433,17 +1098,11 @@ func (s *ImageService) saveMetadata() error {
 		return fmt.Errorf("failed to create metadata directory: %v", err)
 	}
 
-	tempFile := filepath.Join(filepath.Dir(s.metadataFile), filepath.Base(s.metadataFile)+".tmp")
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write metadata: %v", err)
-	}
-
-	if err := os.Rename(tempFile, s.metadataFile); err != nil {
-		os.Remove(tempFile)
+	if err := s.writeFileAtomic(s.metadataFile, data); err != nil {
 		return fmt.Errorf("failed to save metadata: %v", err)
 	}
 
-	return nil
+	return s.saveLayerRefs()
 }
 
 func (s *ImageService) loadMetadata() error {
@@ -461,6 +1120,9 @@ func (s *ImageService) loadMetadata() error {
 	if err := json.Unmarshal(data, &s.images); err != nil {
 		return fmt.Errorf("failed to unmarshal metadata: %v", err)
 	}
+	s.normalizeImageKeysLocked()
+	// Reference counts are rebuilt from the loaded images on first use
+	s.layerRefs = nil
 
 	return nil
 }
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"sync"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// PrefetchState is the progress of a background pull
+type PrefetchState string
+
+const (
+	// PrefetchPending marks a pull waiting for a free worker
+	PrefetchPending PrefetchState = "pending"
+	// PrefetchPulling marks a pull in progress
+	PrefetchPulling PrefetchState = "pulling"
+	// PrefetchComplete marks a pull that succeeded
+	PrefetchComplete PrefetchState = "complete"
+	// PrefetchFailed marks a pull that failed
+	PrefetchFailed PrefetchState = "failed"
+)
+
+// PrefetchStatus is the status of the background pull of one image
+type PrefetchStatus struct {
+	Ref     string
+	State   PrefetchState
+	ImageID string
+	Err     error
+}
+
+// PrefetchHandle tracks the background pulls started by PrefetchImages
+type PrefetchHandle struct {
+	mu       sync.Mutex
+	statuses []PrefetchStatus
+	wg       sync.WaitGroup
+	cancel   context.CancelFunc
+}
+
+// Status returns the status of every image of the prefetch, in the order
+// they were requested
+func (h *PrefetchHandle) Status() []PrefetchStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]PrefetchStatus(nil), h.statuses...)
+}
+
+// Done reports whether every pull of the prefetch has finished
+func (h *PrefetchHandle) Done() bool {
+	for _, status := range h.Status() {
+		if status.State == PrefetchPending || status.State == PrefetchPulling {
+			return false
+		}
+	}
+	return true
+}
+
+// Wait blocks until every pull of the prefetch has finished
+func (h *PrefetchHandle) Wait() {
+	h.wg.Wait()
+}
+
+// Cancel aborts the pulls of the prefetch that have not finished
+func (h *PrefetchHandle) Cancel() {
+	h.cancel()
+}
+
+// update records the status of the i-th image
+func (h *PrefetchHandle) update(i int, state PrefetchState, imageID string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.statuses[i].State = state
+	h.statuses[i].ImageID = imageID
+	h.statuses[i].Err = err
+}
+
+// PrefetchImages pulls refs in the background and returns immediately with
+// a handle reporting their progress. At most PrefetchConcurrency pulls run
+// at once across all prefetches, and pulls of images that are already
+// being pulled share the same download. The pulls outlive ctx, but stop
+// when the handle is cancelled or the service is closed.
+func (s *ImageService) PrefetchImages(ctx context.Context, refs []string, auth *runtime.AuthConfig) *PrefetchHandle {
+	s.prefetchOnce.Do(func() {
+		concurrency := s.config.PrefetchConcurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		s.prefetchSem = make(chan struct{}, concurrency)
+	})
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	handle := &PrefetchHandle{
+		statuses: make([]PrefetchStatus, len(refs)),
+		cancel:   cancel,
+	}
+	for i, ref := range refs {
+		handle.statuses[i] = PrefetchStatus{Ref: ref, State: PrefetchPending}
+	}
+
+	handle.wg.Add(len(refs))
+	for i, ref := range refs {
+		go func(i int, ref string) {
+			defer handle.wg.Done()
+
+			select {
+			case s.prefetchSem <- struct{}{}:
+				defer func() { <-s.prefetchSem }()
+			case <-ctx.Done():
+				handle.update(i, PrefetchFailed, "", ctx.Err())
+				return
+			}
+
+			handle.update(i, PrefetchPulling, "", nil)
+			imageID, err := s.PullImage(ctx, ref, auth)
+			if err != nil {
+				s.log().Warn("prefetch failed", "image", ref, "error", err)
+				handle.update(i, PrefetchFailed, "", err)
+				return
+			}
+			handle.update(i, PrefetchComplete, imageID, nil)
+		}(i, ref)
+	}
+
+	// Release the context once every pull has finished
+	go func() {
+		handle.wg.Wait()
+		cancel()
+	}()
+	return handle
+}
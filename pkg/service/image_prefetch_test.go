@@ -0,0 +1,90 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestImageService_PrefetchImages(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/one", "latest", []byte("first prefetched layer"))
+	registry.addImage(t, "library/two", "latest", []byte("second prefetched layer"))
+	service := newTestService(t, registry)
+
+	refs := []string{
+		registry.host() + "/library/one:latest",
+		registry.host() + "/library/two:latest",
+		registry.host() + "/library/missing:latest",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	handle := service.PrefetchImages(ctx, refs, nil)
+	// The pulls outlive the context they were requested with
+	cancel()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !handle.Done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetch did not finish: %+v", handle.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	statuses := handle.Status()
+	if len(statuses) != len(refs) {
+		t.Fatalf("Status() returned %d entries, want %d", len(statuses), len(refs))
+	}
+	for i, status := range statuses[:2] {
+		if status.Ref != refs[i] {
+			t.Errorf("status %d is for %s, want %s", i, status.Ref, refs[i])
+		}
+		if status.State != PrefetchComplete || status.Err != nil {
+			t.Errorf("%s: state = %s, error = %v, want %s", status.Ref, status.State, status.Err, PrefetchComplete)
+		}
+		if status.ImageID == "" {
+			t.Errorf("%s: no image ID reported", status.Ref)
+		}
+		if !service.HasImage(status.Ref) {
+			t.Errorf("%s was not pulled", status.Ref)
+		}
+	}
+	if missing := statuses[2]; missing.State != PrefetchFailed || missing.Err == nil {
+		t.Errorf("%s: state = %s, error = %v, want %s with an error", missing.Ref, missing.State, missing.Err, PrefetchFailed)
+	}
+}
+
+func TestImageService_PrefetchCancel(t *testing.T) {
+	service := newTestService(t, nil)
+	service.config.PrefetchConcurrency = 1
+	// Occupy the only worker so the prefetch stays pending
+	service.PrefetchImages(context.Background(), nil, nil)
+	service.prefetchSem <- struct{}{}
+	defer func() { <-service.prefetchSem }()
+
+	handle := service.PrefetchImages(context.Background(), []string{"example.com/library/app:latest"}, nil)
+	if status := handle.Status()[0]; status.State != PrefetchPending {
+		t.Fatalf("state = %s, want %s", status.State, PrefetchPending)
+	}
+
+	handle.Cancel()
+	handle.Wait()
+	if status := handle.Status()[0]; status.State != PrefetchFailed || status.Err == nil {
+		t.Errorf("state = %s, error = %v, want %s with an error", status.State, status.Err, PrefetchFailed)
+	}
+}
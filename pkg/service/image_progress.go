@@ -0,0 +1,168 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"io"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// PullStatus is the stage a layer, or a whole pull, has reached
+type PullStatus string
+
+const (
+	// PullStatusPulling marks a layer being downloaded
+	PullStatusPulling PullStatus = "pulling"
+	// PullStatusVerifying marks a downloaded layer being checked against
+	// its digest
+	PullStatusVerifying PullStatus = "verifying"
+	// PullStatusComplete marks a layer stored, or the whole pull done when
+	// Layer is empty
+	PullStatusComplete PullStatus = "complete"
+	// PullStatusFailed marks a pull that failed
+	PullStatusFailed PullStatus = "failed"
+)
+
+// PullProgress is a progress event of a pull. Layer events carry the layer
+// digest; the final event of PullImageEvents has no layer and carries the
+// image ID or the error.
+type PullProgress struct {
+	Image      string
+	Layer      string
+	Downloaded int64
+	Total      int64
+	Status     PullStatus
+	ImageID    string
+	Err        error
+}
+
+// progressWatcher receives the progress events of a pull
+type progressWatcher struct {
+	fn func(PullProgress)
+}
+
+// PullImageWithProgress pulls imageRef like PullImage, calling progress
+// with the events of each layer as it is downloaded. Callers joining a pull
+// that is already in flight only see the events that follow. progress is
+// called from the downloading goroutine and should not block.
+func (s *ImageService) PullImageWithProgress(ctx context.Context, imageRef string, auth *runtime.AuthConfig, progress func(PullProgress)) (string, error) {
+	named, err := s.parseReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+	stop := s.watchProgress(pullKey(named), progress)
+	defer stop()
+
+	return s.PullImage(ctx, imageRef, auth)
+}
+
+// PullImageEvents pulls imageRef in the background and streams its
+// progress. The last event reports the outcome of the pull, after which the
+// channel is closed. Intermediate download counts are dropped while the
+// reader falls behind; other events are delivered unless ctx is cancelled.
+func (s *ImageService) PullImageEvents(ctx context.Context, imageRef string, auth *runtime.AuthConfig) <-chan PullProgress {
+	events := make(chan PullProgress, 64)
+	go func() {
+		defer close(events)
+
+		imageID, err := s.PullImageWithProgress(ctx, imageRef, auth, func(p PullProgress) {
+			if p.Status == PullStatusPulling {
+				select {
+				case events <- p:
+				default:
+				}
+				return
+			}
+			select {
+			case events <- p:
+			case <-ctx.Done():
+			}
+		})
+
+		final := PullProgress{Image: imageRef, Status: PullStatusComplete, ImageID: imageID}
+		if err != nil {
+			final = PullProgress{Image: imageRef, Status: PullStatusFailed, Err: err}
+		}
+		select {
+		case events <- final:
+		case <-ctx.Done():
+		}
+	}()
+	return events
+}
+
+// watchProgress registers fn for the progress events of the pull of key
+// and returns a function unregistering it
+func (s *ImageService) watchProgress(key string, fn func(PullProgress)) func() {
+	if fn == nil {
+		return func() {}
+	}
+	watcher := &progressWatcher{fn: fn}
+
+	s.progressMu.Lock()
+	defer s.progressMu.Unlock()
+	if s.progressWatchers == nil {
+		s.progressWatchers = make(map[string][]*progressWatcher)
+	}
+	s.progressWatchers[key] = append(s.progressWatchers[key], watcher)
+
+	return func() {
+		s.progressMu.Lock()
+		defer s.progressMu.Unlock()
+		watchers := s.progressWatchers[key]
+		for i, w := range watchers {
+			if w == watcher {
+				watchers = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(watchers) == 0 {
+			delete(s.progressWatchers, key)
+		} else {
+			s.progressWatchers[key] = watchers
+		}
+	}
+}
+
+// publishProgress sends p to the watchers of the pull of key
+func (s *ImageService) publishProgress(key string, p PullProgress) {
+	s.progressMu.Lock()
+	watchers := append([]*progressWatcher(nil), s.progressWatchers[key]...)
+	s.progressMu.Unlock()
+
+	for _, w := range watchers {
+		w.fn(p)
+	}
+}
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	r      io.Reader
+	n      int64
+	report func(int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.n += int64(n)
+		pr.report(pr.n)
+	}
+	return n, err
+}
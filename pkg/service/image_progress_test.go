@@ -0,0 +1,110 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// drainEvents collects the events of a pull until the channel is closed
+func drainEvents(t *testing.T, events <-chan PullProgress) []PullProgress {
+	t.Helper()
+
+	var got []PullProgress
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return got
+			}
+			got = append(got, event)
+		case <-timeout:
+			t.Fatalf("pull events not closed, got %+v", got)
+		}
+	}
+}
+
+func TestImageService_PullImageEvents(t *testing.T) {
+	registry := newTestRegistry(t)
+	content := []byte("layer reported while it downloads")
+	registry.addImage(t, "library/app", "latest", content)
+	service := newTestService(t, registry)
+	imageRef := registry.host() + "/library/app:latest"
+
+	events := drainEvents(t, service.PullImageEvents(context.Background(), imageRef, nil))
+	if len(events) == 0 {
+		t.Fatal("no events received")
+	}
+
+	final := events[len(events)-1]
+	if final.Status != PullStatusComplete || final.Layer != "" || final.Err != nil {
+		t.Fatalf("final event = %+v, want the pull complete", final)
+	}
+	if final.ImageID == "" || !service.HasImage(imageRef) {
+		t.Errorf("final event reports image %q, want the pulled image", final.ImageID)
+	}
+
+	// Each layer goes through verification before completing
+	var statuses []PullStatus
+	for _, event := range events[:len(events)-1] {
+		if event.Image != imageRef || event.Layer == "" {
+			t.Errorf("unexpected event %+v", event)
+			continue
+		}
+		if len(statuses) == 0 || statuses[len(statuses)-1] != event.Status {
+			statuses = append(statuses, event.Status)
+		}
+		if event.Status == PullStatusComplete && event.Downloaded != int64(len(content)) {
+			t.Errorf("layer completed with %d bytes, want %d", event.Downloaded, len(content))
+		}
+	}
+	want := []PullStatus{PullStatusPulling, PullStatusVerifying, PullStatusComplete}
+	if len(statuses) != len(want) {
+		t.Fatalf("layer statuses = %v, want %v", statuses, want)
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Errorf("layer statuses = %v, want %v", statuses, want)
+			break
+		}
+	}
+
+	// Pulling the same image again completes without layer events
+	events = drainEvents(t, service.PullImageEvents(context.Background(), imageRef, nil))
+	if len(events) != 1 || events[0].Status != PullStatusComplete {
+		t.Errorf("events of a present image = %+v, want a single completion", events)
+	}
+}
+
+func TestImageService_PullImageEventsFailure(t *testing.T) {
+	registry := newTestRegistry(t)
+	service := newTestService(t, registry)
+
+	events := drainEvents(t, service.PullImageEvents(context.Background(), registry.host()+"/library/missing:latest", nil))
+	if len(events) != 1 {
+		t.Fatalf("events = %+v, want a single failure", events)
+	}
+	if events[0].Status != PullStatusFailed || events[0].Err == nil {
+		t.Errorf("final event = %+v, want a failure with an error", events[0])
+	}
+	if len(service.progressWatchers) != 0 {
+		t.Errorf("progress watchers left registered: %v", service.progressWatchers)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"sort"
+)
+
+// PruneDanglingImages removes images left without any tag, unless they are
+// pinned or still being pulled, along with the layers only they used. It
+// returns the IDs of the removed images and the bytes reclaimed on disk.
+func (s *ImageService) PruneDanglingImages(ctx context.Context) ([]string, int64, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dangling []string
+	for ref, img := range s.images {
+		if len(img.RepoTags) > 0 || img.Pinned {
+			continue
+		}
+		if _, inFlight := s.pulls[ref]; inFlight {
+			continue
+		}
+		dangling = append(dangling, ref)
+	}
+	sort.Strings(dangling)
+
+	var removed []string
+	var reclaimed int64
+	for _, ref := range dangling {
+		if err := ctx.Err(); err != nil {
+			return removed, reclaimed, err
+		}
+		id := s.images[ref].ID
+		freed, err := s.removeImageLocked(ref)
+		reclaimed += freed
+		if err != nil {
+			return removed, reclaimed, err
+		}
+		removed = append(removed, id)
+	}
+
+	if len(removed) > 0 {
+		s.log().Info("pruned dangling images", "images", len(removed), "bytes", reclaimed)
+	}
+	return removed, reclaimed, nil
+}
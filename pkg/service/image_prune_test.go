@@ -0,0 +1,98 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageService_PruneDanglingImages(t *testing.T) {
+	service := newTestService(t, nil)
+
+	// writeLayer stores a blob of the given size and describes it
+	writeLayer := func(name string, size int) LayerMetadata {
+		layerDigest := digest.FromString(name).String()
+		path, err := service.blobPath(layerDigest)
+		if err != nil {
+			t.Fatalf("blobPath() error = %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create blob directory: %v", err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to write blob: %v", err)
+		}
+		return LayerMetadata{Digest: layerDigest, Path: path, Size: int64(size)}
+	}
+
+	shared := writeLayer("shared", 100)
+	danglingOnly := writeLayer("dangling", 40)
+	pinnedOnly := writeLayer("pinned", 30)
+
+	service.AddImage("tagged", &imageMetadata{
+		ID:       "sha256:tagged",
+		RepoTags: []string{"example.com/app:latest"},
+		Layers:   []LayerMetadata{shared},
+	})
+	service.AddImage("dangling", &imageMetadata{
+		ID:     "sha256:dangling",
+		Layers: []LayerMetadata{shared, danglingOnly},
+	})
+	service.AddImage("pinned", &imageMetadata{
+		ID:     "sha256:pinned",
+		Layers: []LayerMetadata{pinnedOnly},
+		Pinned: true,
+	})
+
+	removed, reclaimed, err := service.PruneDanglingImages(context.Background())
+	if err != nil {
+		t.Fatalf("PruneDanglingImages() error = %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"sha256:dangling"}) {
+		t.Errorf("removed = %v, want [sha256:dangling]", removed)
+	}
+	if reclaimed != danglingOnly.Size {
+		t.Errorf("reclaimed = %d bytes, want %d", reclaimed, danglingOnly.Size)
+	}
+
+	for _, ref := range []string{"tagged", "pinned"} {
+		if _, ok := service.images[ref]; !ok {
+			t.Errorf("%s image was pruned", ref)
+		}
+	}
+	if _, ok := service.images["dangling"]; ok {
+		t.Error("dangling image survived the prune")
+	}
+	if _, err := os.Stat(shared.Path); err != nil {
+		t.Errorf("layer shared with a tagged image removed: %v", err)
+	}
+	if _, err := os.Stat(danglingOnly.Path); !os.IsNotExist(err) {
+		t.Error("layer of the dangling image was not removed")
+	}
+
+	// A second prune has nothing left to do
+	removed, reclaimed, err = service.PruneDanglingImages(context.Background())
+	if err != nil || len(removed) != 0 || reclaimed != 0 {
+		t.Errorf("second PruneDanglingImages() = %v, %d, %v; want nothing removed", removed, reclaimed, err)
+	}
+}
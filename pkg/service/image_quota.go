@@ -0,0 +1,74 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"os"
+)
+
+// declaredImageSize sums the layer sizes declared by manifest, ignoring
+// layers that declare none
+func declaredImageSize(manifest *DockerManifest) int64 {
+	var size int64
+	for _, layer := range manifest.Layers {
+		if layer.Size > 0 {
+			size += layer.Size
+		}
+	}
+	return size
+}
+
+// checkImageSize fails with ErrImageTooLarge when size exceeds the
+// configured maximum image size
+func (s *ImageService) checkImageSize(size int64) error {
+	if s.config.MaxImageSize > 0 && size > s.config.MaxImageSize {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrImageTooLarge, size, s.config.MaxImageSize)
+	}
+	return nil
+}
+
+// checkLayerCount fails with ErrImageTooLarge when manifest declares more
+// layers than the configured maximum
+func (s *ImageService) checkLayerCount(manifest *DockerManifest) error {
+	if s.config.MaxLayers > 0 && len(manifest.Layers) > s.config.MaxLayers {
+		return fmt.Errorf("%w: %d layers exceeds the limit of %d layers", ErrImageTooLarge, len(manifest.Layers), s.config.MaxLayers)
+	}
+	return nil
+}
+
+// discardLayers removes the blobs of layers downloaded by an aborted pull,
+// keeping those that a committed image references or another pull claims
+// meanwhile. The aborted pull must have dropped its own claims.
+func (s *ImageService) discardLayers(layerDigests []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, layerDigest := range layerDigests {
+		if s.layerInUse(layerDigest) {
+			continue
+		}
+		s.layerCache.Remove(layerDigest)
+		path, err := s.blobPath(layerDigest)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			s.log().Error("failed to remove discarded layer", "path", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// regularFiles returns the regular files below root other than the
+// metadata files of the service
+func regularFiles(t *testing.T, root string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && filepath.Ext(path) != ".json" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %s: %v", root, err)
+	}
+	return files
+}
+
+func TestImageService_MaxImageSize(t *testing.T) {
+	layers := [][]byte{
+		[]byte("first layer of the image within quota"),
+		[]byte("second layer of the image pushing it over the quota"),
+	}
+
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/large", "latest", "application/vnd.oci.image.layer.v1.tar", layers...)
+	registry.addImageWithMediaType(t, "library/understated", "latest", "application/vnd.oci.image.layer.v1.tar", layers...)
+	registry.addImageWithMediaType(t, "library/small", "latest", "application/vnd.oci.image.layer.v1.tar", layers[0])
+
+	// The understated image declares no layer sizes, so it can only be
+	// caught while downloading
+	var manifest DockerManifest
+	if err := json.Unmarshal(registry.manifests["library/understated:latest"], &manifest); err != nil {
+		t.Fatalf("Failed to decode manifest: %v", err)
+	}
+	for i := range manifest.Layers {
+		manifest.Layers[i].Size = 0
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	registry.manifests["library/understated:latest"] = data
+
+	quota := int64(len(layers[0]) + len(layers[1]) - 1)
+	tests := []struct {
+		name      string
+		repo      string
+		wantErr   bool
+		wantBlobs bool
+	}{
+		{
+			name:    "manifest exceeds quota",
+			repo:    "library/large",
+			wantErr: true,
+		},
+		{
+			name:      "download exceeds quota",
+			repo:      "library/understated",
+			wantErr:   true,
+			wantBlobs: true,
+		},
+		{
+			name: "within quota",
+			repo: "library/small",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, registry)
+			service.config.MaxImageSize = quota
+			imageRef := registry.host() + "/" + tt.repo + ":latest"
+			before := len(registry.blobRequests())
+
+			_, err := service.PullImage(context.Background(), imageRef, nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("PullImage() error = %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrImageTooLarge) {
+				t.Fatalf("PullImage() error = %v, want %v", err, ErrImageTooLarge)
+			}
+			if service.HasImage(imageRef) {
+				t.Error("rejected image recorded")
+			}
+			if files := regularFiles(t, service.imageRoot); len(files) != 0 {
+				t.Errorf("rejected pull left %v on disk", files)
+			}
+			// The config blob is fetched before the layers
+			if fetched := len(registry.blobRequests()) - before; (fetched > 1) != tt.wantBlobs {
+				t.Errorf("rejected pull fetched %d blobs", fetched)
+			}
+		})
+	}
+}
+
+func TestImageService_MaxLayers(t *testing.T) {
+	registry := newTestRegistry(t)
+	const mediaType = "application/vnd.oci.image.layer.v1.tar"
+	registry.addImageWithMediaType(t, "library/flat", "latest", mediaType, []byte("layer 1"), []byte("layer 2"))
+	registry.addImageWithMediaType(t, "library/deep", "latest", mediaType, []byte("layer 1"), []byte("layer 2"), []byte("layer 3"))
+
+	tests := []struct {
+		name    string
+		repo    string
+		wantErr bool
+	}{
+		{name: "at the limit", repo: "library/flat"},
+		{name: "over the limit", repo: "library/deep", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, registry)
+			service.config.MaxLayers = 2
+			imageRef := registry.host() + "/" + tt.repo + ":latest"
+			before := len(registry.blobRequests())
+
+			_, err := service.PullImage(context.Background(), imageRef, nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("PullImage() error = %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrImageTooLarge) {
+				t.Fatalf("PullImage() error = %v, want %v", err, ErrImageTooLarge)
+			}
+			if service.HasImage(imageRef) {
+				t.Error("rejected image recorded")
+			}
+			if fetched := registry.blobRequests()[before:]; len(fetched) != 0 {
+				t.Errorf("rejected pull fetched blobs %v", fetched)
+			}
+		})
+	}
+}
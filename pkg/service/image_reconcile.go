@@ -0,0 +1,75 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Reconcile drops the images whose layer files no longer exist on disk,
+// such as layers deleted out of band, and returns their references. Layers
+// only the dropped images used are left for the garbage collector.
+func (s *ImageService) Reconcile() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dropped []string
+	for ref, img := range s.images {
+		// Interrupted pulls are reclaimed by the garbage collector
+		if !img.ready() {
+			continue
+		}
+		missing := missingLayers(img.Layers)
+		if len(missing) == 0 {
+			continue
+		}
+		for _, layer := range missing {
+			s.layerCache.Remove(layer.Digest)
+		}
+		s.deleteImage(ref)
+		dropped = append(dropped, ref)
+		s.log().Warn("dropped image with missing layers",
+			"image", ref,
+			"id", img.ID,
+			"missing_layers", len(missing))
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	sort.Strings(dropped)
+
+	if err := s.saveMetadata(); err != nil {
+		return dropped, fmt.Errorf("failed to save metadata: %v", err)
+	}
+	return dropped, nil
+}
+
+// missingLayers returns the layers whose file cannot be found
+func missingLayers(layers []LayerMetadata) []LayerMetadata {
+	var missing []LayerMetadata
+	for _, layer := range layers {
+		if layer.Path == "" {
+			continue
+		}
+		if _, err := os.Stat(layer.Path); os.IsNotExist(err) {
+			missing = append(missing, layer)
+		}
+	}
+	return missing
+}
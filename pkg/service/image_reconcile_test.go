@@ -0,0 +1,72 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestNewImageService_ReconcilesMissingLayers(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/intact", "latest", []byte("layer of the intact image"))
+	registry.addImage(t, "library/orphaned", "latest", []byte("layer deleted out of band"))
+	intact := registry.host() + "/library/intact:latest"
+	orphaned := registry.host() + "/library/orphaned:latest"
+
+	config := DefaultConfig()
+	config.ImageRoot = t.TempDir()
+
+	service := NewImageServiceWithConfig(config)
+	service.client = registry.server.Client()
+	for _, ref := range []string{intact, orphaned} {
+		if _, err := service.PullImage(context.Background(), ref, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+	}
+	service.mu.RLock()
+	layerPath := service.images[orphaned].Layers[0].Path
+	service.mu.RUnlock()
+	if err := service.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Delete the layer behind the back of the service
+	if err := os.Remove(layerPath); err != nil {
+		t.Fatalf("Failed to remove layer: %v", err)
+	}
+
+	restarted := NewImageServiceWithConfig(config)
+	defer restarted.Close()
+	if restarted.HasImage(orphaned) {
+		t.Error("image with a missing layer still listed after restart")
+	}
+	if !restarted.HasImage(intact) {
+		t.Error("intact image dropped after restart")
+	}
+
+	// The repaired index is persisted
+	reloaded := newTestService(t, nil)
+	reloaded.metadataFile = restarted.metadataFile
+	if err := reloaded.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	if _, ok := reloaded.images[orphaned]; ok {
+		t.Error("orphaned image still in the saved metadata")
+	}
+}
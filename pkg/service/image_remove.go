@@ -0,0 +1,142 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// RemovalReport describes what removing an image would delete
+type RemovalReport struct {
+	ImageID string
+	// Layers are the layers no other image references, which would be
+	// deleted along with the image
+	Layers []LayerMetadata
+	// ReclaimableBytes is the size on disk of Layers
+	ReclaimableBytes int64
+}
+
+// RemoveImageDryRun reports the layers and bytes that RemoveImage of
+// imageRef would reclaim, without touching disk or metadata
+func (s *ImageService) RemoveImageDryRun(ctx context.Context, imageRef string) (*RemovalReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// RemoveImage removes every reference imageRef resolves to, so their
+	// layers are released together
+	refs := s.resolveImageRefsLocked(imageRef)
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	var layers []LayerMetadata
+	for _, ref := range refs {
+		layers = append(layers, s.images[ref].Layers...)
+	}
+
+	report := &RemovalReport{
+		ImageID: s.images[refs[0]].ID,
+		Layers:  s.unreferencedLayers(layers),
+	}
+	for _, layer := range report.Layers {
+		if layer.Path == "" {
+			continue
+		}
+		if fi, err := os.Stat(layer.Path); err == nil {
+			report.ReclaimableBytes += fi.Size()
+		}
+	}
+	return report, nil
+}
+
+// resolveImageRefsLocked returns the references under which the image
+// named by imageRef is stored, in order. imageRef may be one of them, in
+// any spelling that normalizes to it, a repo tag or digest of the image,
+// or its ID, and every reference sharing
+// the ID of the image it names is returned. Caller must hold the lock.
+func (s *ImageService) resolveImageRefsLocked(imageRef string) []string {
+	key := s.imageKeyLocked(imageRef)
+	ids := make(map[string]bool)
+	for ref, img := range s.images {
+		if ref == key || img.ID == imageRef ||
+			slices.Contains(img.RepoTags, imageRef) || slices.Contains(img.RepoDigests, imageRef) {
+			ids[img.ID] = true
+		}
+	}
+
+	var refs []string
+	for ref, img := range s.images {
+		if ids[img.ID] {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// recordPartialRemoval remembers that removing imageRef left the layer
+// files leftover, and possibly its directory and metadata, behind. Caller
+// must hold the lock.
+func (s *ImageService) recordPartialRemoval(imageRef string, leftover []LayerMetadata) {
+	if s.partialRemovals == nil {
+		s.partialRemovals = make(map[string][]LayerMetadata)
+	}
+	s.partialRemovals[imageRef] = append(s.partialRemovals[imageRef], leftover...)
+}
+
+// finishRemovalLocked cleans up after an earlier removal of imageRef that
+// failed part way: its image directory, the layer files no image has
+// referenced since, and the metadata that may not have been saved. Caller
+// must hold the lock.
+func (s *ImageService) finishRemovalLocked(imageRef string) error {
+	imageDir := filepath.Join(s.imageRoot, digest.FromString(imageRef).Hex())
+	if err := os.RemoveAll(imageDir); err != nil {
+		return fmt.Errorf("failed to remove image directory: %v", err)
+	}
+
+	leftover, partial := s.partialRemovals[imageRef]
+	if !partial {
+		return nil
+	}
+	var remaining []LayerMetadata
+	for _, layer := range leftover {
+		// The layer may have been pulled again since
+		if s.layerInUse(layer.Digest) {
+			continue
+		}
+		if err := os.Remove(layer.Path); err != nil && !os.IsNotExist(err) {
+			s.log().Error("failed to remove layer file", "path", layer.Path, "error", err)
+			remaining = append(remaining, layer)
+		}
+	}
+	if err := s.saveMetadata(); err != nil {
+		s.partialRemovals[imageRef] = remaining
+		return fmt.Errorf("failed to save metadata: %v", err)
+	}
+	if len(remaining) > 0 {
+		s.partialRemovals[imageRef] = remaining
+		return fmt.Errorf("failed to remove %d layer files of %s", len(remaining), imageRef)
+	}
+	delete(s.partialRemovals, imageRef)
+	return nil
+}
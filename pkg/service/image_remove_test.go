@@ -0,0 +1,253 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestImageService_RemoveImageDryRun(t *testing.T) {
+	shared := []byte("layer shared by both images")
+	unique := []byte("layer only used by the first image")
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/first", "latest", shared, unique)
+	registry.addImage(t, "library/second", "latest", shared)
+
+	service := newTestService(t, registry)
+	ctx := context.Background()
+	first := registry.host() + "/library/first:latest"
+	second := registry.host() + "/library/second:latest"
+	for _, ref := range []string{first, second} {
+		if _, err := service.PullImage(ctx, ref, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+	}
+
+	layers, err := service.ImageLayers(first)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+
+	report, err := service.RemoveImageDryRun(ctx, first)
+	if err != nil {
+		t.Fatalf("RemoveImageDryRun() error = %v", err)
+	}
+	if len(report.Layers) != 1 || report.Layers[0].Digest != layers[1].Digest {
+		t.Errorf("RemoveImageDryRun() layers = %v, want only the unique layer", report.Layers)
+	}
+	if report.ReclaimableBytes != int64(len(unique)) {
+		t.Errorf("RemoveImageDryRun() reclaimable bytes = %d, want %d", report.ReclaimableBytes, len(unique))
+	}
+
+	// Nothing was removed
+	if !service.HasImage(first) {
+		t.Error("dry run removed the image")
+	}
+	for _, layer := range layers {
+		if _, err := os.Stat(layer.Path); err != nil {
+			t.Errorf("dry run removed layer %s: %v", layer.Digest, err)
+		}
+	}
+	service.mu.Lock()
+	refs := service.layerRefCount(layers[0].Digest)
+	service.mu.Unlock()
+	if refs != 2 {
+		t.Errorf("dry run changed the shared layer references to %d, want 2", refs)
+	}
+
+	// The actual removal frees what the dry run reported
+	service.mu.Lock()
+	freed, err := service.removeImageLocked(first)
+	service.mu.Unlock()
+	if err != nil {
+		t.Fatalf("removeImageLocked() error = %v", err)
+	}
+	if freed != report.ReclaimableBytes {
+		t.Errorf("removal freed %d bytes, dry run reported %d", freed, report.ReclaimableBytes)
+	}
+
+	if _, err := service.RemoveImageDryRun(ctx, first); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("RemoveImageDryRun() of removed image error = %v, want %v", err, ErrImageNotFound)
+	}
+}
+
+func TestImageService_RemoveImageDryRunSharedID(t *testing.T) {
+	shared := []byte("layer shared with another image")
+	unique := []byte("layer only used by the tagged image")
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "v1", shared, unique)
+	registry.addImage(t, "library/app", "latest", shared, unique)
+	registry.addImage(t, "library/other", "latest", shared)
+
+	tagged := registry.host() + "/library/app:v1"
+	refs := []string{tagged, registry.host() + "/library/app:latest", registry.host() + "/library/other:latest"}
+
+	tests := []struct {
+		name     string
+		argument func(s *ImageService) string
+	}{
+		{name: "by tag", argument: func(*ImageService) string { return tagged }},
+		{name: "by ID", argument: func(s *ImageService) string { return s.images[tagged].ID }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, registry)
+			ctx := context.Background()
+			for _, ref := range refs {
+				if _, err := service.PullImage(ctx, ref, nil); err != nil {
+					t.Fatalf("PullImage(%s) error = %v", ref, err)
+				}
+			}
+			if service.images[refs[0]].ID != service.images[refs[1]].ID {
+				t.Fatal("tags of the same content have different IDs")
+			}
+			layers, err := service.ImageLayers(tagged)
+			if err != nil {
+				t.Fatalf("ImageLayers() error = %v", err)
+			}
+
+			argument := tt.argument(service)
+			report, err := service.RemoveImageDryRun(ctx, argument)
+			if err != nil {
+				t.Fatalf("RemoveImageDryRun(%s) error = %v", argument, err)
+			}
+			if report.ImageID != service.images[tagged].ID {
+				t.Errorf("RemoveImageDryRun() image ID = %s, want %s", report.ImageID, service.images[tagged].ID)
+			}
+			if len(report.Layers) != 1 || report.Layers[0].Digest != layers[1].Digest {
+				t.Errorf("RemoveImageDryRun() layers = %v, want only the unique layer", report.Layers)
+			}
+
+			// RemoveImage removes both tags and frees what the dry run reported
+			if err := service.RemoveImage(ctx, argument); err != nil {
+				t.Fatalf("RemoveImage(%s) error = %v", argument, err)
+			}
+			for _, layer := range report.Layers {
+				if _, err := os.Stat(layer.Path); !os.IsNotExist(err) {
+					t.Errorf("reported layer %s was not removed: %v", layer.Digest, err)
+				}
+			}
+			if _, err := os.Stat(layers[0].Path); err != nil {
+				t.Errorf("shared layer removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestImageService_RemoveImageIdempotent(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/test", "latest", []byte("layer of the removed image"))
+
+	service := newTestService(t, registry)
+	ctx := context.Background()
+	ref := registry.host() + "/library/test:latest"
+	if _, err := service.PullImage(ctx, ref, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	// The first removal fails to save the metadata, which still lists the
+	// image on disk
+	service.wrapMetadataWriter = func(w io.Writer) io.Writer {
+		return &shortWriter{w: w, err: errors.New("no space left on device")}
+	}
+	if err := service.RemoveImage(ctx, ref); err == nil {
+		t.Fatal("RemoveImage() succeeded despite a failed metadata write")
+	}
+	service.wrapMetadataWriter = nil
+
+	// Retrying succeeds and finishes the removal, as does any later call
+	for i := 0; i < 2; i++ {
+		if err := service.RemoveImage(ctx, ref); err != nil {
+			t.Fatalf("RemoveImage() retry %d error = %v", i+1, err)
+		}
+	}
+
+	data, err := os.ReadFile(service.metadataFile)
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	var images map[string]*imageMetadata
+	if err := json.Unmarshal(data, &images); err != nil {
+		t.Fatalf("Failed to decode metadata: %v", err)
+	}
+	if _, ok := images[ref]; ok {
+		t.Error("metadata still lists the removed image")
+	}
+	if len(service.partialRemovals) != 0 {
+		t.Errorf("partial removals = %v, want none", service.partialRemovals)
+	}
+}
+
+func TestImageService_RemoveImageByID(t *testing.T) {
+	tests := []struct {
+		name     string
+		argument string
+	}{
+		{name: "by ID", argument: "sha256:shared"},
+		{name: "by repo digest", argument: "registry.example.com/app@sha256:manifest"},
+		{name: "by tag", argument: "registry.example.com/app:v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, nil)
+			images := map[string]*imageMetadata{
+				"registry.example.com/app:v1": {
+					ID:          "sha256:shared",
+					RepoTags:    []string{"registry.example.com/app:v1"},
+					RepoDigests: []string{"registry.example.com/app@sha256:manifest"},
+				},
+				"registry.example.com/app:latest": {
+					ID:       "sha256:shared",
+					RepoTags: []string{"registry.example.com/app:latest"},
+				},
+				"registry.example.com/other:v1": {
+					ID:       "sha256:other",
+					RepoTags: []string{"registry.example.com/other:v1"},
+				},
+			}
+			for ref, img := range images {
+				img.State = imageStateReady
+				if err := service.AddImage(ref, img); err != nil {
+					t.Fatalf("AddImage(%s) error = %v", ref, err)
+				}
+			}
+
+			if err := service.RemoveImage(context.Background(), tt.argument); err != nil {
+				t.Fatalf("RemoveImage(%s) error = %v", tt.argument, err)
+			}
+
+			// Every tag of the image is gone, other images are kept
+			for _, ref := range []string{"registry.example.com/app:v1", "registry.example.com/app:latest"} {
+				if service.HasImage(ref) {
+					t.Errorf("%s still present", ref)
+				}
+			}
+			if !service.HasImage("registry.example.com/other:v1") {
+				t.Error("unrelated image removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// ResolveDigest returns the digest of the manifest imageRef currently points
+// to, asking the registry without downloading the manifest or its layers
+func (s *ImageService) ResolveDigest(ctx context.Context, imageRef string, auth *runtime.AuthConfig) (string, error) {
+	named, err := s.parseReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	auth, err = s.getRegistryClient(ctx, named, auth)
+	if err != nil {
+		return "", err
+	}
+
+	path := fmt.Sprintf("/v2/%s/manifests/%s", reference.Path(named), manifestReference(named))
+	for _, endpoint := range s.registryEndpoints(reference.Domain(named)) {
+		var dgst string
+		dgst, err = s.headManifest(ctx, s.endpointURL(endpoint, path), auth)
+		if err == nil {
+			return dgst, nil
+		}
+	}
+	return "", err
+}
+
+// manifestReference returns the tag or digest addressing the manifest of
+// named, defaulting to the latest tag
+func manifestReference(named reference.Named) string {
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest().String()
+	}
+	return reference.TagNameOnly(named).(reference.Tagged).Tag()
+}
+
+// headManifest resolves the manifest at url to its digest
+func (s *ImageService) headManifest(ctx context.Context, url string, auth *runtime.AuthConfig) (string, error) {
+	ctx, cancel := s.withRequestTimeout(ctx)
+	defer cancel()
+
+	if err := s.waitForRegistry(ctx, url); err != nil {
+		return "", fmt.Errorf("failed to resolve manifest: %v", err)
+	}
+	dgst, err := s.registryClient().HeadManifest(ctx, url, auth)
+	if err != nil {
+		return "", registryRequestError("failed to resolve manifest", err, auth)
+	}
+	if _, err := digest.Parse(dgst); err != nil {
+		return "", fmt.Errorf("registry returned invalid digest %q: %v", dgst, err)
+	}
+	return dgst, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestImageService_ResolveDigest(t *testing.T) {
+	registry := newTestRegistry(t)
+	want := registry.addImage(t, "library/app", "v1", []byte("resolved layer content"))
+
+	// Record how the manifest endpoint is asked for
+	var mu sync.Mutex
+	var methods, accepts []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			mu.Lock()
+			methods = append(methods, r.Method)
+			accepts = append(accepts, r.Header.Get("Accept"))
+			mu.Unlock()
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	got, err := service.ResolveDigest(context.Background(), host+"/library/app:v1", nil)
+	if err != nil {
+		t.Fatalf("ResolveDigest() error = %v", err)
+	}
+	if got != want.String() {
+		t.Errorf("ResolveDigest() = %s, want %s", got, want)
+	}
+
+	if len(methods) != 1 || methods[0] != "HEAD" {
+		t.Errorf("manifest requested with %v, want a single HEAD", methods)
+	}
+	if len(accepts) == 1 && !strings.Contains(accepts[0], "application/vnd.docker.distribution.manifest.v2+json") {
+		t.Errorf("Accept header = %q, want manifest media types", accepts[0])
+	}
+	if blobs := registry.blobRequests(); len(blobs) != 0 {
+		t.Errorf("ResolveDigest() fetched blobs %v", blobs)
+	}
+	if service.HasImage(host + "/library/app:v1") {
+		t.Error("ResolveDigest() recorded the image")
+	}
+
+	if _, err := service.ResolveDigest(context.Background(), host+"/library/app:missing", nil); err == nil {
+		t.Error("ResolveDigest() of missing tag succeeded")
+	}
+	if _, err := service.ResolveDigest(context.Background(), "", nil); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("ResolveDigest() of empty reference error = %v, want %v", err, ErrInvalidReference)
+	}
+}
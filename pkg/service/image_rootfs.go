@@ -0,0 +1,265 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// rootfsDir is the directory under the image root holding root filesystems
+// extracted under LazyExtract, keyed by the chain ID of their layers
+const rootfsDir = "rootfs"
+
+// chainID returns the OCI chain ID of layers, identifying the root
+// filesystem they produce, or "" when a layer has no recorded diffID
+func chainID(layers []LayerMetadata) string {
+	var chain digest.Digest
+	for i, layer := range layers {
+		if layer.DiffID == "" {
+			return ""
+		}
+		if i == 0 {
+			chain = digest.Digest(layer.DiffID)
+			continue
+		}
+		chain = digest.FromString(chain.String() + " " + layer.DiffID)
+	}
+	return chain.String()
+}
+
+// rootfsPath returns where the root filesystem with the given chain ID is
+// cached
+func (s *ImageService) rootfsPath(chain string) string {
+	return filepath.Join(s.imageRoot, rootfsDir, digest.Digest(chain).Encoded())
+}
+
+// extractedRootfs returns the cached root filesystem of layers, extracting
+// it first if no earlier unpack did
+func (s *ImageService) extractedRootfs(chain string, layers []LayerMetadata) (string, error) {
+	path := s.rootfsPath(chain)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create rootfs cache directory: %v", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create rootfs staging directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for i, layer := range layers {
+		if err := applyLayerFile(layer.Path, tmp, s.log()); err != nil {
+			return "", fmt.Errorf("failed to apply layer %d (%s): %v", i, layer.Digest, err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		// A concurrent unpack of the same layers got there first
+		if _, statErr := os.Stat(path); statErr == nil {
+			return path, nil
+		}
+		return "", fmt.Errorf("failed to store extracted rootfs: %v", err)
+	}
+	return path, nil
+}
+
+// copyTree copies the tree below src into dst, preserving the permissions,
+// ownership, modification times and hardlinks of its entries as applyLayer
+// does. Device nodes are skipped when unprivileged, as are sockets.
+func copyTree(src, dst string, logger *slog.Logger) error {
+	// Hardlinked files are linked to the first copy of their inode
+	links := make(map[uint64]string)
+	// Copying into a directory updates its times, so they are set last
+	var dirs []string
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		// dst keeps its own permissions, as when layers are applied to it
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to stat %s", rel)
+		}
+
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return fmt.Errorf("failed to create directory %s: %v", rel, err)
+			}
+			if err := os.Chmod(target, mode.Perm()); err != nil {
+				return fmt.Errorf("failed to chmod %s: %v", rel, err)
+			}
+			dirs = append(dirs, rel)
+		case mode.IsRegular():
+			if first, ok := links[st.Ino]; ok && st.Nlink > 1 {
+				if err := os.RemoveAll(target); err != nil {
+					return fmt.Errorf("failed to replace %s: %v", rel, err)
+				}
+				if err := os.Link(first, target); err != nil {
+					return fmt.Errorf("failed to create hardlink %s: %v", rel, err)
+				}
+				return nil
+			}
+			if err := copyRootfsFile(path, target, mode.Perm()); err != nil {
+				return err
+			}
+			if st.Nlink > 1 {
+				links[st.Ino] = target
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %v", rel, err)
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", rel, err)
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %v", rel, err)
+			}
+		case mode&(os.ModeDevice|os.ModeNamedPipe) != 0:
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", rel, err)
+			}
+			if err := syscall.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				if errors.Is(err, syscall.EPERM) {
+					// Device nodes need privileges, skip them when unprivileged
+					logger.Warn("skipping device node in cached rootfs", "path", rel, "error", err)
+					return nil
+				}
+				return fmt.Errorf("failed to create device node %s: %v", rel, err)
+			}
+		default:
+			logger.Warn("skipping special file in cached rootfs", "path", rel, "mode", mode.String())
+			return nil
+		}
+
+		if !mode.IsDir() && mode&os.ModeSymlink == 0 {
+			if err := os.Chtimes(target, time.Unix(st.Atim.Unix()), info.ModTime()); err != nil {
+				return fmt.Errorf("failed to set times on %s: %v", rel, err)
+			}
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+				return fmt.Errorf("failed to chown %s: %v", rel, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Children come after their parent, so the deepest directories go first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if err := os.Chtimes(filepath.Join(dst, dirs[i]), time.Unix(st.Atim.Unix()), info.ModTime()); err != nil {
+			return fmt.Errorf("failed to set times on %s: %v", dirs[i], err)
+		}
+	}
+	return nil
+}
+
+// copyRootfsFile copies the regular file src to dst with the given
+// permissions, leaving src in place
+func copyRootfsFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", dst, err)
+	}
+	return os.Chmod(dst, perm)
+}
+
+// collectExtractedRootfs removes cached root filesystems that no image
+// produces anymore and returns how many were removed
+func (gc *GarbageCollector) collectExtractedRootfs() int {
+	s := gc.imageService
+	root := filepath.Join(s.imageRoot, rootfsDir)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.log().Error("failed to read rootfs cache", "error", err)
+		}
+		return 0
+	}
+
+	s.mu.RLock()
+	inUse := make(map[string]bool)
+	for _, img := range s.images {
+		if chain := chainID(img.Layers); chain != "" {
+			inUse[filepath.Base(s.rootfsPath(chain))] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	removed := 0
+	for _, entry := range entries {
+		// Extractions in progress are staged in .tmp directories
+		if inUse[entry.Name()] || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			s.log().Error("failed to remove cached rootfs", "name", entry.Name(), "error", err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageService_LazyExtract(t *testing.T) {
+	lower := buildTar(t, map[string]string{
+		"etc/config":   "lower config",
+		"etc/obsolete": "to be deleted",
+	})
+	upper := buildTar(t, map[string]string{
+		"etc/.wh.obsolete": "",
+		"usr/bin/app":      "upper binary",
+	})
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", gzipBytes(t, lower), gzipBytes(t, upper))
+	service := newTestService(t, registry)
+	service.config.LazyExtract = true
+
+	ref := registry.host() + "/library/app:latest"
+	imageID, err := service.PullImage(context.Background(), ref, nil)
+	if err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	// Pulling leaves the layers compressed
+	cacheRoot := filepath.Join(service.imageRoot, rootfsDir)
+	if _, err := os.Stat(cacheRoot); !os.IsNotExist(err) {
+		t.Fatalf("rootfs extracted at pull time: %v", err)
+	}
+
+	layers, err := service.ImageLayers(ref)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	cached := service.rootfsPath(chainID(layers))
+
+	checkRootfs := func(t *testing.T, root string) {
+		t.Helper()
+		for name, want := range map[string]string{
+			"etc/config":  "lower config",
+			"usr/bin/app": "upper binary",
+		} {
+			got, err := os.ReadFile(filepath.Join(root, name))
+			if err != nil {
+				t.Errorf("Failed to read %s: %v", name, err)
+				continue
+			}
+			if string(got) != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(root, "etc/obsolete")); !os.IsNotExist(err) {
+			t.Error("etc/obsolete should not exist in the rootfs")
+		}
+	}
+
+	// The first unpack populates the cached rootfs
+	first := filepath.Join(t.TempDir(), "first")
+	if err := service.UnpackImage(imageID, first); err != nil {
+		t.Fatalf("UnpackImage() error = %v", err)
+	}
+	checkRootfs(t, first)
+	checkRootfs(t, cached)
+
+	// Later unpacks copy the cached rootfs without reading the layers
+	for _, layer := range layers {
+		if err := os.Remove(layer.Path); err != nil {
+			t.Fatalf("Failed to remove layer: %v", err)
+		}
+	}
+	second := filepath.Join(t.TempDir(), "second")
+	if err := service.UnpackImage(imageID, second); err != nil {
+		t.Fatalf("UnpackImage() from cache error = %v", err)
+	}
+	checkRootfs(t, second)
+
+	// GC keeps the rootfs while the image exists and reclaims it after
+	gc := NewGarbageCollector(service, 0)
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+	if _, err := os.Stat(cached); err != nil {
+		t.Fatalf("rootfs of a present image removed: %v", err)
+	}
+	if err := service.RemoveImage(context.Background(), ref); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Errorf("rootfs of a removed image kept: %v", err)
+	}
+}
+
+func TestImageService_LazyExtractPreservesMetadata(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []*tar.Header{
+		{Name: "home/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime},
+		{Name: "home/user/", Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000, Gid: 1000, ModTime: modTime},
+		{Name: "home/user/data", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1001, Size: 4, ModTime: modTime},
+		{Name: "home/user/link", Typeflag: tar.TypeLink, Linkname: "home/user/data", Uid: 1000, Gid: 1001, ModTime: modTime},
+		{Name: "home/user/sh", Typeflag: tar.TypeSymlink, Linkname: "data", Uid: 1000, Gid: 1000, ModTime: modTime},
+		{Name: "home/user/pipe", Typeflag: tar.TypeFifo, Mode: 0600, Uid: 1000, Gid: 1000, ModTime: modTime},
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("data"))
+		}
+	}
+	tw.Close()
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", gzipBytes(t, buf.Bytes()))
+	ref := registry.host() + "/library/app:latest"
+
+	unpack := func(lazy bool) string {
+		service := newTestService(t, registry)
+		service.config.LazyExtract = lazy
+		imageID, err := service.PullImage(context.Background(), ref, nil)
+		if err != nil {
+			t.Fatalf("PullImage() error = %v", err)
+		}
+		root := filepath.Join(t.TempDir(), "rootfs")
+		if err := service.UnpackImage(imageID, root); err != nil {
+			t.Fatalf("UnpackImage() error = %v", err)
+		}
+		return root
+	}
+	eager, lazy := unpack(false), unpack(true)
+
+	for _, name := range []string{"home/user", "home/user/data", "home/user/link", "home/user/sh", "home/user/pipe"} {
+		want, err := os.Lstat(filepath.Join(eager, name))
+		if err != nil {
+			t.Fatalf("Failed to stat eager %s: %v", name, err)
+		}
+		got, err := os.Lstat(filepath.Join(lazy, name))
+		if err != nil {
+			t.Errorf("lazy unpack lost %s: %v", name, err)
+			continue
+		}
+		if got.Mode() != want.Mode() {
+			t.Errorf("%s mode = %v, want %v", name, got.Mode(), want.Mode())
+		}
+		gotStat, wantStat := got.Sys().(*syscall.Stat_t), want.Sys().(*syscall.Stat_t)
+		if gotStat.Uid != wantStat.Uid || gotStat.Gid != wantStat.Gid {
+			t.Errorf("%s owner = %d:%d, want %d:%d", name, gotStat.Uid, gotStat.Gid, wantStat.Uid, wantStat.Gid)
+		}
+		if want.Mode().IsRegular() && !got.ModTime().Equal(want.ModTime()) {
+			t.Errorf("%s mtime = %v, want %v", name, got.ModTime(), want.ModTime())
+		}
+	}
+	if os.Geteuid() == 0 {
+		fi, _ := os.Lstat(filepath.Join(lazy, "home/user/data"))
+		if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1001 {
+			t.Errorf("home/user/data owner = %d:%d, want 1000:1001", st.Uid, st.Gid)
+		}
+	}
+	data, _ := os.Stat(filepath.Join(lazy, "home/user/data"))
+	link, _ := os.Stat(filepath.Join(lazy, "home/user/link"))
+	if data == nil || link == nil || !os.SameFile(data, link) {
+		t.Error("lazy unpack did not keep home/user/link hardlinked to home/user/data")
+	}
+}
+
+func TestChainID(t *testing.T) {
+	a := digest.FromString("a").String()
+	b := digest.FromString("b").String()
+
+	tests := []struct {
+		name   string
+		layers []LayerMetadata
+		want   string
+	}{
+		{"single layer", []LayerMetadata{{DiffID: a}}, a},
+		{"two layers", []LayerMetadata{{DiffID: a}, {DiffID: b}}, digest.FromString(a + " " + b).String()},
+		{"missing diffID", []LayerMetadata{{DiffID: a}, {}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chainID(tt.layers); got != tt.want {
+				t.Errorf("chainID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
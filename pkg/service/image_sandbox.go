@@ -0,0 +1,71 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// SetSandboxImage pulls imageRef, the pause image pod sandboxes are created
+// from, and pins it so that neither garbage collection nor pruning ever
+// removes it. The previous sandbox image, if any, is unpinned.
+func (s *ImageService) SetSandboxImage(ctx context.Context, imageRef string, auth *runtime.AuthConfig) error {
+	if _, err := s.PullImage(ctx, imageRef, auth); err != nil {
+		return fmt.Errorf("failed to pull sandbox image: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.imageKeyLocked(imageRef)
+	img, ok := s.images[key]
+	if !ok || !img.ready() {
+		// Removed again before it could be pinned
+		return fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	for ref, other := range s.images {
+		if other.Sandbox && ref != key {
+			other.Sandbox = false
+			other.Pinned = false
+		}
+	}
+	img.Sandbox = true
+	img.Pinned = true
+
+	if err := s.saveMetadata(); err != nil {
+		return fmt.Errorf("failed to save metadata: %v", err)
+	}
+	s.log().Info("sandbox image set", "image", imageRef, "id", img.ID)
+	return nil
+}
+
+// SandboxImage returns the reference of the sandbox image, or an empty
+// string if none is set
+func (s *ImageService) SandboxImage() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for ref, img := range s.images {
+		if img.Sandbox {
+			return ref
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestImageService_SetSandboxImage(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/pause", "latest", []byte("pause image layer"))
+	registry.addImage(t, "library/app", "latest", []byte("application image layer"))
+	service := newTestService(t, registry)
+	service.config.MaxImageAge = time.Hour
+	pause := registry.host() + "/library/pause:latest"
+	app := registry.host() + "/library/app:latest"
+
+	if err := service.SetSandboxImage(context.Background(), pause, nil); err != nil {
+		t.Fatalf("SetSandboxImage() error = %v", err)
+	}
+	if _, err := service.PullImage(context.Background(), app, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if got := service.SandboxImage(); got != pause {
+		t.Errorf("SandboxImage() = %q, want %q", got, pause)
+	}
+
+	// Only the sandbox image is listed as pinned
+	images, err := service.ListImages(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("ListImages() error = %v", err)
+	}
+	for _, img := range images {
+		if want := img.RepoTags[0] == pause; img.Pinned != want {
+			t.Errorf("%v pinned = %v, want %v", img.RepoTags, img.Pinned, want)
+		}
+	}
+	status, err := service.ImageStatus(context.Background(), pause)
+	if err != nil {
+		t.Fatalf("ImageStatus() error = %v", err)
+	}
+	if !status.Pinned {
+		t.Error("ImageStatus() does not report the sandbox image as pinned")
+	}
+
+	// Neither garbage collection nor pruning removes it, even once it is
+	// unused and untagged
+	service.mu.Lock()
+	for _, img := range service.images {
+		img.LastUsedAt = time.Now().Add(-24 * time.Hour)
+		img.RepoTags = nil
+	}
+	service.mu.Unlock()
+	gc := NewGarbageCollector(service, time.Hour)
+	if err := gc.collectGarbage(); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+	if _, _, err := service.PruneDanglingImages(context.Background()); err != nil {
+		t.Fatalf("PruneDanglingImages() error = %v", err)
+	}
+	if !service.HasImage(pause) {
+		t.Error("sandbox image was removed")
+	}
+	if service.HasImage(app) {
+		t.Error("unpinned image was kept")
+	}
+
+	// Setting another sandbox image releases the previous one
+	registry.addImage(t, "library/pause2", "latest", []byte("newer pause image layer"))
+	pause2 := registry.host() + "/library/pause2:latest"
+	if err := service.SetSandboxImage(context.Background(), pause2, nil); err != nil {
+		t.Fatalf("SetSandboxImage() error = %v", err)
+	}
+	if got := service.SandboxImage(); got != pause2 {
+		t.Errorf("SandboxImage() = %q, want %q", got, pause2)
+	}
+	service.mu.RLock()
+	previous := service.images[pause]
+	service.mu.RUnlock()
+	if previous.Pinned || previous.Sandbox {
+		t.Error("previous sandbox image is still pinned")
+	}
+
+	if err := service.SetSandboxImage(context.Background(), registry.host()+"/library/missing:latest", nil); err == nil {
+		t.Error("SetSandboxImage() of a missing image succeeded")
+	}
+	if got := service.SandboxImage(); got != pause2 {
+		t.Errorf("SandboxImage() = %q after a failed change, want %q", got, pause2)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// schema1LayerMediaType is the media type of the gzipped tar layers of
+	// schema 1 images, which their manifests do not declare
+	schema1LayerMediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	// schema1ConfigMediaType describes the config synthesized for schema 1
+	// images
+	schema1ConfigMediaType = "application/vnd.docker.container.image.v1+json"
+)
+
+// schema1MediaTypes are the media types of signed and unsigned schema 1
+// manifests
+var schema1MediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v1+prettyjws",
+	"application/vnd.docker.distribution.manifest.v1+json",
+}
+
+// schema1Manifest is a Docker schema 1 manifest. Its layers and history
+// are listed from the top layer down.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// manifestAcceptTypes returns the media types the first manifest request
+// accepts, nil for manifestMediaTypes
+func (s *ImageService) manifestAcceptTypes() []string {
+	if !s.config.AllowSchema1 {
+		return nil
+	}
+	return append(append([]string(nil), manifestMediaTypes...), schema1MediaTypes...)
+}
+
+// convertSchema1 describes the schema 1 manifest in data as a schema 2
+// manifest. The v1 compatibility config of the top layer becomes the image
+// config, so that the image is identified by its digest.
+func convertSchema1(data []byte) (*DockerManifest, error) {
+	var legacy schema1Manifest
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("failed to decode schema 1 manifest: %v", err)
+	}
+	if len(legacy.FSLayers) == 0 {
+		return nil, fmt.Errorf("schema 1 manifest has no layers")
+	}
+	if len(legacy.History) != len(legacy.FSLayers) {
+		return nil, fmt.Errorf("schema 1 manifest has %d history entries for %d layers", len(legacy.History), len(legacy.FSLayers))
+	}
+	config := []byte(legacy.History[0].V1Compatibility)
+	if !json.Valid(config) {
+		return nil, fmt.Errorf("schema 1 manifest has an invalid v1 compatibility config")
+	}
+
+	manifest := &DockerManifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		schema1Config: config,
+	}
+	manifest.Config.MediaType = schema1ConfigMediaType
+	manifest.Config.Size = int64(len(config))
+	manifest.Config.Digest = digest.FromBytes(config).String()
+	// Layers are listed base first in schema 2, and their sizes are only
+	// known once downloaded
+	for i := len(legacy.FSLayers) - 1; i >= 0; i-- {
+		blobSum := legacy.FSLayers[i].BlobSum
+		if _, err := digest.Parse(blobSum); err != nil {
+			return nil, fmt.Errorf("schema 1 layer %d: invalid digest %q: %v", i, blobSum, err)
+		}
+		manifest.Layers = append(manifest.Layers, struct {
+			MediaType string   `json:"mediaType"`
+			Size      int64    `json:"size"`
+			Digest    string   `json:"digest"`
+			URLs      []string `json:"urls,omitempty"`
+		}{
+			MediaType: schema1LayerMediaType,
+			Digest:    blobSum,
+		})
+	}
+	return manifest, nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// addSchema1Image registers a schema 1 image made of the given layers,
+// listed base first, and returns its v1 compatibility config
+func addSchema1Image(t *testing.T, registry *testRegistry, repo, tag string, layers ...[]byte) string {
+	t.Helper()
+
+	config := `{"id":"top","architecture":"amd64","os":"linux","config":{"Cmd":["/bin/legacy"]}}`
+	var manifest struct {
+		SchemaVersion int                 `json:"schemaVersion"`
+		Name          string              `json:"name"`
+		Tag           string              `json:"tag"`
+		FSLayers      []map[string]string `json:"fsLayers"`
+		History       []map[string]string `json:"history"`
+	}
+	manifest.SchemaVersion, manifest.Name, manifest.Tag = 1, repo, tag
+	for i := len(layers) - 1; i >= 0; i-- {
+		dgst := digest.FromBytes(layers[i]).String()
+		registry.blobs[dgst] = layers[i]
+		manifest.FSLayers = append(manifest.FSLayers, map[string]string{"blobSum": dgst})
+		v1 := `{"id":"parent"}`
+		if i == len(layers)-1 {
+			v1 = config
+		}
+		manifest.History = append(manifest.History, map[string]string{"v1Compatibility": v1})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	registry.manifests[repo+":"+tag] = data
+	return config
+}
+
+func TestImageService_PullSchema1(t *testing.T) {
+	base := gzipBytes(t, buildTar(t, map[string]string{"base": "base layer"}))
+	top := gzipBytes(t, buildTar(t, map[string]string{"top": "top layer"}))
+	registry := newTestRegistry(t)
+	config := addSchema1Image(t, registry, "library/legacy", "latest", base, top)
+
+	var mu sync.Mutex
+	var accepts []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			mu.Lock()
+			accepts = append(accepts, r.Header.Get("Accept"))
+			mu.Unlock()
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/legacy:latest"
+
+	t.Run("disabled", func(t *testing.T) {
+		service := newTestService(t, nil)
+		service.client = server.Client()
+		if _, err := service.PullImage(context.Background(), imageRef, nil); !errors.Is(err, ErrManifestUnsupported) {
+			t.Errorf("PullImage() error = %v, want %v", err, ErrManifestUnsupported)
+		}
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		mu.Lock()
+		accepts = nil
+		mu.Unlock()
+
+		service := newTestService(t, nil)
+		service.client = server.Client()
+		service.config.AllowSchema1 = true
+		id, err := service.PullImage(context.Background(), imageRef, nil)
+		if err != nil {
+			t.Fatalf("PullImage() error = %v", err)
+		}
+		if want := digest.FromString(config).String(); id != want {
+			t.Errorf("image ID = %s, want the digest of the v1 config %s", id, want)
+		}
+
+		// Layers are recorded base first with the size they have on disk
+		layers, err := service.ImageLayers(imageRef)
+		if err != nil {
+			t.Fatalf("ImageLayers() error = %v", err)
+		}
+		if len(layers) != 2 {
+			t.Fatalf("got %d layers, want 2", len(layers))
+		}
+		for i, want := range [][]byte{base, top} {
+			if layers[i].Digest != digest.FromBytes(want).String() {
+				t.Errorf("layer %d = %s, want %s", i, layers[i].Digest, digest.FromBytes(want))
+			}
+			if layers[i].Size != int64(len(want)) {
+				t.Errorf("layer %d size = %d, want %d", i, layers[i].Size, len(want))
+			}
+		}
+
+		info, err := service.InspectImage(context.Background(), imageRef, nil)
+		if err != nil {
+			t.Fatalf("InspectImage() error = %v", err)
+		}
+		if info.Architecture != "amd64" || len(info.Config.Cmd) != 1 || info.Config.Cmd[0] != "/bin/legacy" {
+			t.Errorf("InspectImage() = %+v, want the v1 config", info)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(accepts) == 0 || !strings.Contains(accepts[0], schema1MediaTypes[0]) {
+			t.Errorf("manifest Accept headers = %q, want schema 1 accepted", accepts)
+		}
+	})
+}
@@ -18,115 +18,523 @@ package service
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"golang.org/x/time/rate"
 	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
+// imageState tracks whether an image has been fully pulled
+type imageState string
+
+const (
+	// imageStatePulling marks an image whose layers are still being fetched
+	imageStatePulling imageState = "pulling"
+	// imageStateReady marks an image whose layers and metadata are committed
+	imageStateReady imageState = "ready"
+)
+
 type imageMetadata struct {
 	ID          string          `json:"id"`
 	RepoTags    []string        `json:"repo_tags"`
 	RepoDigests []string        `json:"repo_digests"`
 	Size        int64           `json:"size"`
 	Layers      []LayerMetadata `json:"layers"`
+	// UncompressedSize is the size of the layers once extracted, where
+	// Size is their compressed size
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+	// Digest is the content digest of the image manifest
+	Digest string `json:"digest,omitempty"`
+	// State is empty for images recorded before states were tracked,
+	// which are considered ready
+	State         imageState `json:"state,omitempty"`
+	PullStartedAt time.Time  `json:"pull_started_at,omitempty"`
+	// Config is the raw image config blob
+	Config json.RawMessage `json:"config,omitempty"`
+	// Labels are the labels declared in the image config
+	Labels map[string]string `json:"labels,omitempty"`
+	// Pinned images are never pruned
+	Pinned bool `json:"pinned,omitempty"`
+	// Sandbox marks the pinned pause image set by SetSandboxImage
+	Sandbox bool `json:"sandbox,omitempty"`
+	// PulledAt is when the image finished pulling
+	PulledAt time.Time `json:"pulled_at,omitempty"`
+	// LastUsedAt is when the image was last pulled or had its status
+	// queried, to within lastUsedResolution
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// lastUsedResolution is how stale LastUsedAt may get before a status query
+// records a new use, so that frequent queries do not each save metadata
+const lastUsedResolution = time.Minute
+
+// uncompressedSize returns the extracted size of the image, summing its
+// layers for images recorded before the size was stored
+func (img *imageMetadata) uncompressedSize() int64 {
+	if img.UncompressedSize > 0 {
+		return img.UncompressedSize
+	}
+	return layersUncompressedSize(img.Layers)
+}
+
+// layersUncompressedSize returns the total extracted size of layers
+func layersUncompressedSize(layers []LayerMetadata) int64 {
+	var size int64
+	for _, layer := range layers {
+		size += layer.UncompressedSize
+	}
+	return size
+}
+
+// ready reports whether the image is fully pulled and usable
+func (img *imageMetadata) ready() bool {
+	return img.State == "" || img.State == imageStateReady
 }
 
 type ImageService struct {
 	client       *http.Client
+	registry     RegistryClient // Registry requests go over HTTP with client when nil
+	config       Config
 	imageRoot    string
 	images       map[string]*imageMetadata
 	mu           sync.RWMutex
 	metadataFile string
 	layerCache   *LayerCache
 	gc           *GarbageCollector
+	// stopDiskMonitor stops the layer cache disk pressure monitor
+	stopDiskMonitor func()
+	// stopFlusher stops the background metadata flusher. While it is set,
+	// saveMetadata only marks the metadata dirty for the flusher to write.
+	stopFlusher   func()
+	metadataDirty bool
+	// labels maps a manifest digest to user-assigned labels so that
+	// they survive removal and re-pull of the same content
+	labels     map[string]map[string]string
+	labelsFile string
+	// pulls records the start time of in-flight pulls by reference
+	pulls map[string]time.Time
+	// pullFlights maps the keys of pulls to the downloads they share
+	pullFlights map[string]*pullFlight
+	// layerCacheFile persists the layer cache index across restarts
+	layerCacheFile string
+	// layerRefs counts the images referencing each layer digest. It is
+	// built from images on first use when nil.
+	layerRefs     map[string]int
+	layerRefsFile string
+	// layerClaims counts the in-flight pulls that are downloading or
+	// reusing each layer digest
+	layerClaims map[string]int
+	// logger receives the structured logs of the service
+	logger *slog.Logger
+	// limiters throttle requests per registry host
+	limiters   map[string]*rate.Limiter
+	limitersMu sync.Mutex
+	// pullSem bounds the pulls downloading at once, nil when unlimited
+	pullSem     chan struct{}
+	pullSemOnce sync.Once
+	// prefetchSem bounds the background pulls of PrefetchImages
+	prefetchSem  chan struct{}
+	prefetchOnce sync.Once
+	// missing maps references the registry reported as missing to when
+	// that answer expires
+	missing   map[string]time.Time
+	missingMu sync.Mutex
+	// tokens caches the bearer tokens obtained from token endpoints until
+	// shortly before they expire
+	tokens   map[tokenKey]cachedToken
+	tokensMu sync.Mutex
+	// partialRemovals maps images whose removal failed part way to the
+	// layer files it left behind
+	partialRemovals map[string][]LayerMetadata
+	// wrapMetadataWriter, when set, wraps the writes of metadata files so
+	// that tests can inject write failures
+	wrapMetadataWriter func(io.Writer) io.Writer
+	// progressWatchers maps the keys of pulls to the callbacks following
+	// their progress
+	progressWatchers map[string][]*progressWatcher
+	progressMu       sync.Mutex
+
+	// ctx is cancelled by Close to abort in-flight pulls
+	ctx       context.Context
+	cancel    context.CancelFunc
+	pullWG    sync.WaitGroup
+	closed    bool
+	closeOnce sync.Once
 }
 
 func NewImageService() *ImageService {
+	return NewImageServiceWithConfig(DefaultConfig())
+}
+
+const (
+	// defaultMaxIdleConns bounds the idle registry connections kept across
+	// all hosts
+	defaultMaxIdleConns = 100
+	// idleConnTimeout is how long an idle registry connection is kept
+	idleConnTimeout = 90 * time.Second
+)
+
+// idleConnsPerHost returns how many idle connections to keep per registry
+// host: enough for every download config allows at once, the background
+// prefetches and a foreground pull each fetching their chunks in parallel
+func idleConnsPerHost(config Config) int {
+	pulls := config.PrefetchConcurrency
+	if pulls < 1 {
+		pulls = 1
+	}
+	chunks := 1
+	if config.BlobChunkSize > 0 {
+		chunks = config.BlobChunkConcurrency
+		if chunks < 1 {
+			chunks = defaultBlobChunkConcurrency
+		}
+	}
+	return (pulls + 1) * chunks
+}
+
+// newTransport builds the HTTP transport used to reach registries. Requests
+// go through config.ProxyURL when set, or else the proxy named by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. Idle
+// connections are pooled per host so that layer downloads reuse them, and
+// HTTP/2 is negotiated with registries that support it.
+func newTransport(config Config) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	perHost := idleConnsPerHost(config)
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        max(defaultMaxIdleConns, perHost),
+		MaxIdleConnsPerHost: perHost,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %v", config.ProxyURL, err)
+		}
+		if proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: scheme and host are required", config.ProxyURL)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.DNSCacheTTL > 0 {
+		tr.DialContext = newDNSCache(config.DNSCacheTTL).DialContext
+	}
+	return tr, nil
+}
+
+// NewImageServiceWithConfig creates an image service using the given config
+func NewImageServiceWithConfig(config Config) *ImageService {
 	// Create image storage directory
-	imageRoot := "/var/lib/image-service"
+	imageRoot := config.ImageRoot
 	if err := os.MkdirAll(imageRoot, 0755); err != nil {
 		panic(fmt.Sprintf("Failed to create image root directory: %v", err))
 	}
+	if config.StagingDir != "" && !config.ReadOnly {
+		if err := os.MkdirAll(config.StagingDir, 0755); err != nil {
+			panic(fmt.Sprintf("Failed to create staging directory: %v", err))
+		}
+	}
 
-	// Set default cache size limit to 10GB
-	const defaultMaxCacheSize = 10 * 1024 * 1024 * 1024
+	// Create HTTP client
+	tr, err := newTransport(config)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create HTTP transport: %v", err))
+	}
 
-	// Create HTTP client with insecure HTTPS support
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
 	}
 
 	service := &ImageService{
 		client:       &http.Client{Transport: tr},
+		registry:     config.RegistryClient,
+		config:       config,
 		imageRoot:    imageRoot,
 		images:       make(map[string]*imageMetadata),
 		metadataFile: filepath.Join(imageRoot, "metadata.json"),
-		layerCache:   NewLayerCache(defaultMaxCacheSize),
+		layerCache:   NewLayerCacheWithPolicy(config.MaxCacheSize, config.EvictionPolicy),
+		labels:       make(map[string]map[string]string),
+		labelsFile:   filepath.Join(imageRoot, "labels.json"),
+		pulls:        make(map[string]time.Time),
+
+		logger:         logger,
+		layerCacheFile: filepath.Join(imageRoot, "layers.json"),
+		layerRefsFile:  filepath.Join(imageRoot, "layer_refs.json"),
 	}
+	service.layerCache.logger = logger
+	service.layerCache.releaseEvicted = service.removeEvictedBlobs
+	service.layerCache.SetAdmissionFraction(config.CacheAdmissionFraction)
+	service.ctx, service.cancel = context.WithCancel(context.Background())
 
 	// Load existing metadata
 	if err := service.loadMetadata(); err != nil {
 		panic(fmt.Sprintf("Failed to load metadata: %v", err))
 	}
+	if err := service.loadLayerRefs(); err != nil {
+		panic(fmt.Sprintf("Failed to load layer references: %v", err))
+	}
+
+	// Move layers stored per image by older versions into the blob store
+	if !config.ReadOnly {
+		if _, err := service.migrateLayerPaths(); err != nil {
+			panic(fmt.Sprintf("Failed to migrate layer paths: %v", err))
+		}
+	}
+
+	// Drop images whose layers were deleted behind our back
+	if _, err := service.Reconcile(); err != nil {
+		panic(fmt.Sprintf("Failed to reconcile metadata: %v", err))
+	}
+
+	// Load image labels
+	if err := service.loadLabels(); err != nil {
+		panic(fmt.Sprintf("Failed to load labels: %v", err))
+	}
+
+	// Restore the layer cache index
+	if err := service.layerCache.Load(service.layerCacheFile); err != nil {
+		panic(fmt.Sprintf("Failed to load layer cache: %v", err))
+	}
+
+	// Shrink the layer cache when the disk runs low on space
+	if config.DiskPressureThreshold > 0 && config.DiskPressureInterval > 0 {
+		service.stopDiskMonitor = service.layerCache.StartDiskPressureMonitor(
+			imageRoot, config.DiskPressureThreshold, config.DiskPressureInterval)
+	}
+
+	// Batch metadata writes instead of writing on every change
+	if config.MetadataFlushInterval > 0 && !config.ReadOnly {
+		service.stopFlusher = service.startMetadataFlusher(config.MetadataFlushInterval)
+	}
 
-	// Initialize and start garbage collector
-	service.gc = NewGarbageCollector(service, 1*time.Hour)
-	service.gc.Start()
+	// Initialize and start garbage collector, which would modify the
+	// store of a read-only service
+	if !config.ReadOnly {
+		service.gc = NewGarbageCollector(service, config.GCInterval)
+		service.gc.Start()
+	}
 
 	return service
 }
 
 // PullImage implements image pulling functionality
 func (s *ImageService) PullImage(ctx context.Context, imageRef string, auth *runtime.AuthConfig) (string, error) {
+	ctx, done, err := s.trackPull(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
 	return s.pullImage(ctx, imageRef, auth)
 }
 
-// RemoveImage implements image removal functionality
+// PullImageResult describes a pulled image
+type PullImageResult struct {
+	ID         string
+	Size       int64
+	LayerCount int
+	// RepoDigest is the reference of the image pinned to its digest
+	RepoDigest string
+	// Platform is os/architecture[/variant] as declared by the image
+	// config, empty when unknown
+	Platform string
+}
+
+// PullImageWithResult pulls imageRef like PullImage and describes what was
+// pulled
+func (s *ImageService) PullImageWithResult(ctx context.Context, imageRef string, auth *runtime.AuthConfig) (*PullImageResult, error) {
+	ctx, done, err := s.trackPull(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if _, err := s.pullImage(ctx, imageRef, auth); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	if !ok || !img.ready() {
+		// Removed again before the result could be read
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	result := &PullImageResult{
+		ID:         img.ID,
+		Size:       img.Size,
+		LayerCount: len(img.Layers),
+		Platform:   configPlatform(img.Config),
+	}
+	if len(img.RepoDigests) > 0 {
+		result.RepoDigest = img.RepoDigests[0]
+	}
+	return result, nil
+}
+
+// trackPull ties ctx to the service lifetime so that Close aborts the pull,
+// and registers the pull so that Close can wait for it
+func (s *ImageService) trackPull(ctx context.Context) (context.Context, func(), error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, nil, fmt.Errorf("image service is closed")
+	}
+	if err := s.checkWritable(); err != nil {
+		s.mu.Unlock()
+		return nil, nil, err
+	}
+	s.pullWG.Add(1)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := func() bool { return true }
+	if s.ctx != nil {
+		stop = context.AfterFunc(s.ctx, cancel)
+	}
+
+	return ctx, func() {
+		stop()
+		cancel()
+		s.pullWG.Done()
+	}, nil
+}
+
+// RemoveImage implements image removal functionality. imageRef may be a
+// reference, a repo digest or an image ID, in which case every reference
+// of the image is removed.
 func (s *ImageService) RemoveImage(ctx context.Context, imageRef string) error {
-	return s.removeImage(ctx, imageRef)
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Removing an absent image succeeds, so that callers can retry a
+	// removal that failed part way
+	refs := s.resolveImageRefsLocked(imageRef)
+	if len(refs) == 0 {
+		return s.finishRemovalLocked(s.imageKeyLocked(imageRef))
+	}
+	var firstErr error
+	for _, ref := range refs {
+		if _, err := s.removeImageLocked(ref); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // ImageStatus implements image status retrieval functionality
 func (s *ImageService) ImageStatus(ctx context.Context, imageRef string) (*runtime.Image, error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	key := s.imageKeyLocked(imageRef)
+	img, ok := s.images[key]
+	if !ok || !img.ready() {
+		s.mu.RUnlock()
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	status := runtimeImage(s.sameImageLocked(img))
+	stale := time.Since(img.LastUsedAt) >= lastUsedResolution
+	s.mu.RUnlock()
 
-	// Check if image exists in our metadata
-	if img, ok := s.images[imageRef]; ok {
-		return &runtime.Image{
-			Id:          img.ID,
-			RepoTags:    img.RepoTags,
-			RepoDigests: img.RepoDigests,
-			Size_:       uint64(img.Size),
-		}, nil
+	if stale {
+		s.markUsed(key)
 	}
+	return status, nil
+}
 
-	// Image not found
-	return nil, fmt.Errorf("image not found: %s", imageRef)
+// markUsed records the image stored under key as used now and saves the
+// metadata
+func (s *ImageService) markUsed(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	img, ok := s.images[key]
+	if !ok {
+		return
+	}
+	img.LastUsedAt = time.Now()
+	if err := s.saveMetadata(); err != nil {
+		s.log().Warn("failed to save last use of image", "image", key, "error", err)
+	}
 }
 
-// ListImages implements image listing functionality
+// ListImages implements image listing functionality, returning every
+// matching image ordered by ID
 func (s *ImageService) ListImages(ctx context.Context, filter *runtime.ImageFilter) ([]*runtime.Image, error) {
-	var images []*runtime.Image
+	images, _, err := s.ListImagesPage(ctx, filter, "", 0)
+	return images, err
+}
 
-	for _, img := range s.images {
-		images = append(images, &runtime.Image{
-			Id:          img.ID,
-			RepoTags:    img.RepoTags,
-			RepoDigests: img.RepoDigests,
-			Size_:       uint64(img.Size),
-		})
+// matchesFilter reports whether img satisfies filter. Annotations on the
+// filter image spec are treated as label selectors that must all match.
+func matchesFilter(img *imageMetadata, filter *runtime.ImageFilter) bool {
+	for key, value := range filter.GetImage().GetAnnotations() {
+		if label, ok := img.Labels[key]; !ok || label != value {
+			return false
+		}
 	}
+	return true
+}
 
-	return images, nil
+// registryClient returns the client performing registry requests
+func (s *ImageService) registryClient() RegistryClient {
+	if s.registry != nil {
+		return s.registry
+	}
+	return &httpRegistryClient{
+		client:          s.client,
+		userAgent:       s.config.UserAgent,
+		maxManifestSize: s.config.MaxManifestSize,
+	}
+}
+
+// log returns the logger of the service, falling back to the default
+// logger for services built without one
+func (s *ImageService) log() *slog.Logger {
+	if s.logger == nil {
+		return slog.Default()
+	}
+	return s.logger
+}
+
+// HasImage reports whether imageRef is present and fully pulled
+func (s *ImageService) HasImage(imageRef string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	return ok && img.ready()
+}
+
+// ImageLayers returns the layer chain of imageRef in manifest order,
+// including whether each layer was reused from cache when it was pulled
+func (s *ImageService) ImageLayers(imageRef string) ([]LayerMetadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	if !ok || !img.ready() {
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	return append([]LayerMetadata(nil), img.Layers...), nil
 }
 
 // GetImageRoot returns the root path of image storage
@@ -136,17 +544,86 @@ func (s *ImageService) GetImageRoot() string {
 
 // AddImage safely adds an image to the service
 func (s *ImageService) AddImage(imageRef string, img *imageMetadata) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.images[imageRef] = img
+	s.setImage(imageRef, img)
 	return s.saveMetadata()
 }
 
-// Close stops the image service and its components
-func (s *ImageService) Close() error {
-	if s.gc != nil {
-		s.gc.Stop()
+// checkWritable returns ErrReadOnly when the service may not modify its
+// image store
+func (s *ImageService) checkWritable() error {
+	if s.config.ReadOnly {
+		return ErrReadOnly
 	}
 	return nil
 }
+
+// Ready reports whether the service can serve requests: its metadata is
+// loaded, it is not shutting down and the image root is writable, unless
+// the service is read-only
+func (s *ImageService) Ready() error {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return fmt.Errorf("image service is closed")
+	}
+	if s.config.ReadOnly {
+		if _, err := os.Stat(s.imageRoot); err != nil {
+			return fmt.Errorf("image root is not accessible: %v", err)
+		}
+		return nil
+	}
+
+	f, err := os.CreateTemp(s.imageRoot, ".ready-*")
+	if err != nil {
+		return fmt.Errorf("image root is not writable: %v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// Close aborts in-flight pulls and waits for them, stops the garbage
+// collector and flushes metadata and the layer cache index to disk
+func (s *ImageService) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.pullWG.Wait()
+
+		if s.gc != nil {
+			s.gc.Stop()
+		}
+		if s.stopDiskMonitor != nil {
+			s.stopDiskMonitor()
+		}
+		if s.stopFlusher != nil {
+			s.stopFlusher()
+		}
+
+		s.mu.Lock()
+		s.stopFlusher = nil
+		err = s.writeMetadata()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		if s.layerCacheFile != "" && !s.config.ReadOnly {
+			err = s.layerCache.Save(s.layerCacheFile)
+		}
+	})
+	return err
+}
@@ -21,12 +21,18 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	goruntime "runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -39,6 +45,22 @@ func TestImageService_PullImage(t *testing.T) {
 	// Use fixed content that matches the expected digest
 	fixedContent := []byte("fixed layer content for testing")
 	expectedDigest := "sha256:86c354b41b3e24f565001dea1f4f9b460dfb08de45baea0f4b111afeed87d9dc"
+	manifestContent := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size": 1000,
+			"digest": "sha256:test"
+		},
+		"layers": [
+			{
+				"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				"size": 31,
+				"digest": "` + expectedDigest + `"
+			}
+		]
+	}`)
 
 	// Setup mock registry server
 	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -59,22 +81,6 @@ func TestImageService_PullImage(t *testing.T) {
 		case "/v2/library/test/manifests/latest":
 			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
 			w.Header().Set("Docker-Content-Digest", expectedDigest)
-			manifestContent := []byte(`{
-				"schemaVersion": 2,
-				"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-				"config": {
-					"mediaType": "application/vnd.docker.container.image.v1+json",
-					"size": 1000,
-					"digest": "sha256:test"
-				},
-				"layers": [
-					{
-						"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
-						"size": 1000,
-						"digest": "` + expectedDigest + `"
-					}
-				]
-			}`)
 			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifestContent)))
 			w.WriteHeader(http.StatusOK)
 			w.Write(manifestContent)
@@ -116,7 +122,8 @@ func TestImageService_PullImage(t *testing.T) {
 			imageRef: server.URL[8:] + "/library/test:latest", // Remove https:// prefix
 			auth:     nil,
 			wantErr:  false,
-			wantID:   fmt.Sprintf("sha256:%x", digest.FromString(server.URL[8:]+"/library/test:latest").Hex()),
+			// The config digest is invalid, so the manifest names the image
+			wantID: digest.FromBytes(manifestContent).String(),
 		},
 		{
 			name:     "invalid image reference",
@@ -141,6 +148,50 @@ func TestImageService_PullImage(t *testing.T) {
 	}
 }
 
+func TestImageService_PullImageWithResult(t *testing.T) {
+	config := []byte(`{"architecture": "arm64", "os": "linux", "variant": "v8"}`)
+	layers := [][]byte{[]byte("first layer content"), []byte("second layer content")}
+
+	registry := newTestRegistry(t)
+	registry.addImageWithConfig(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", config, layers...)
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	result, err := service.PullImageWithResult(context.Background(), imageRef, nil)
+	if err != nil {
+		t.Fatalf("PullImageWithResult() error = %v", err)
+	}
+
+	status, err := service.ImageStatus(context.Background(), imageRef)
+	if err != nil {
+		t.Fatalf("ImageStatus() error = %v", err)
+	}
+	if result.ID != status.Id {
+		t.Errorf("result ID = %s, want %s", result.ID, status.Id)
+	}
+	if result.Size != int64(status.Size_) || result.Size != int64(len(layers[0])+len(layers[1])) {
+		t.Errorf("result size = %d, want %d", result.Size, status.Size_)
+	}
+	if result.LayerCount != len(layers) {
+		t.Errorf("result layer count = %d, want %d", result.LayerCount, len(layers))
+	}
+	if len(status.RepoDigests) == 0 || result.RepoDigest != status.RepoDigests[0] {
+		t.Errorf("result repo digest = %s, want %v", result.RepoDigest, status.RepoDigests)
+	}
+	if result.Platform != "linux/arm64/v8" {
+		t.Errorf("result platform = %q, want linux/arm64/v8", result.Platform)
+	}
+
+	// Pulling again describes the image already present
+	again, err := service.PullImageWithResult(context.Background(), imageRef, nil)
+	if err != nil {
+		t.Fatalf("PullImageWithResult() of present image error = %v", err)
+	}
+	if *again != *result {
+		t.Errorf("result of repeated pull = %+v, want %+v", again, result)
+	}
+}
+
 func TestImageService_RemoveImage(t *testing.T) {
 	// Create temp directory for test
 	tmpDir, err := os.MkdirTemp("", "image-service-test")
@@ -195,7 +246,7 @@ func TestImageService_RemoveImage(t *testing.T) {
 		{
 			name:     "remove non-existent image",
 			imageRef: "nonexistent:latest",
-			wantErr:  true,
+			wantErr:  false,
 		},
 	}
 
@@ -337,11 +388,22 @@ func TestImageService_downloadLayer(t *testing.T) {
 	expectedDigest := digester.Digest().String()
 
 	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/octet-stream")
+		contentType := "application/octet-stream"
+		if r.URL.Query().Has("type") {
+			contentType = r.URL.Query().Get("type")
+		}
+		w.Header().Set("Content-Type", contentType)
 		w.Write(fixedContent)
 	}))
 	defer server.Close()
 
+	// A misconfigured proxy answering with an error page and status 200
+	errorPage := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>Service Unavailable</body></html>"))
+	}))
+	defer errorPage.Close()
+
 	tmpDir, err := os.MkdirTemp("", "layer-test")
 	if err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
@@ -360,7 +422,9 @@ func TestImageService_downloadLayer(t *testing.T) {
 		name           string
 		url            string
 		expectedDigest string
+		expectedSize   int64
 		wantErr        bool
+		wantErrText    string
 	}{
 		{
 			name:           "valid layer download",
@@ -368,12 +432,53 @@ func TestImageService_downloadLayer(t *testing.T) {
 			expectedDigest: expectedDigest,
 			wantErr:        false,
 		},
+		{
+			name:           "valid layer download with declared size",
+			url:            server.URL,
+			expectedDigest: expectedDigest,
+			expectedSize:   int64(len(fixedContent)),
+			wantErr:        false,
+		},
+		{
+			name:           "fewer bytes than declared",
+			url:            server.URL,
+			expectedDigest: expectedDigest,
+			expectedSize:   int64(len(fixedContent)) + 10,
+			wantErr:        true,
+			wantErrText:    "size mismatch",
+		},
 		{
 			name:           "digest mismatch",
 			url:            server.URL,
 			expectedDigest: "sha256:invalid",
 			wantErr:        true,
 		},
+		{
+			name:           "layer media type",
+			url:            server.URL + "?type=application/vnd.oci.image.layer.v1.tar%2Bgzip",
+			expectedDigest: expectedDigest,
+			wantErr:        false,
+		},
+		{
+			name:           "no content type",
+			url:            server.URL + "?type=",
+			expectedDigest: expectedDigest,
+			wantErr:        false,
+		},
+		{
+			name:           "html error page",
+			url:            errorPage.URL,
+			expectedDigest: expectedDigest,
+			wantErr:        true,
+			wantErrText:    "registry returned text/html content instead of a layer blob",
+		},
+		{
+			name:           "json content type",
+			url:            server.URL + "?type=application/json",
+			expectedDigest: expectedDigest,
+			wantErr:        true,
+			wantErrText:    "application/json content",
+		},
 		{
 			name:           "invalid url",
 			url:            "https://invalid.url",
@@ -384,14 +489,60 @@ func TestImageService_downloadLayer(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := service.downloadLayer(context.Background(), tt.url, tmpDir, tt.expectedDigest, nil)
+			err := service.downloadLayer(context.Background(), tt.url, filepath.Join(tmpDir, "layer.tar"), tt.expectedDigest, tt.expectedSize, nil, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("downloadLayer() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErrText) {
+				t.Errorf("downloadLayer() error = %v, want it to mention %q", err, tt.wantErrText)
+			}
 		})
 	}
 }
 
+func TestImageService_ListImagesConcurrentWrites(t *testing.T) {
+	service := newTestService(t, nil)
+
+	// Run under -race: listing must not race with images being added and
+	// removed
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ref := fmt.Sprintf("test%d-%d:latest", i, j)
+				if err := service.AddImage(ref, &imageMetadata{
+					ID:       "sha256:" + ref,
+					RepoTags: []string{ref},
+				}); err != nil {
+					t.Errorf("AddImage() error = %v", err)
+					return
+				}
+				if err := service.RemoveImage(ctx, ref); err != nil {
+					t.Errorf("RemoveImage() error = %v", err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := service.ListImages(ctx, nil); err != nil {
+					t.Errorf("ListImages() error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if images, _ := service.ListImages(ctx, nil); len(images) != 0 {
+		t.Errorf("ListImages() returned %d images after all were removed", len(images))
+	}
+}
+
 // Test concurrent operations
 func TestImageService_ConcurrentOperations(t *testing.T) {
 	service := &ImageService{
@@ -464,7 +615,7 @@ func TestImageService_AuthHandling(t *testing.T) {
 				"layers": [
 					{
 						"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
-						"size": 19,
+						"size": 18,
 						"digest": "sha256:2189176b26e9f608c27104f31fbbaa3e8342b2230d804a21568afea057689391"
 					}
 				]
@@ -583,10 +734,10 @@ func TestImageService_MetadataPersistence(t *testing.T) {
 		t.Errorf("loadMetadata() error = %v", err)
 	}
 
-	// Verify loaded data
-	loadedImage, ok := newService.images["test:latest"]
+	// Verify loaded data, recorded under the normalized reference
+	loadedImage, ok := newService.images["docker.io/library/test:latest"]
 	if !ok {
-		t.Error("Failed to load image metadata")
+		t.Fatal("Failed to load image metadata")
 	}
 	if loadedImage.ID != testImage.ID {
 		t.Errorf("Loaded image ID = %v, want %v", loadedImage.ID, testImage.ID)
@@ -645,6 +796,77 @@ func TestImageService_MetadataConsistency(t *testing.T) {
 	}
 }
 
+func TestImageService_ConcurrentMetadataWrites(t *testing.T) {
+	const n = 20
+	registry := newTestRegistry(t)
+	for i := 0; i < n; i++ {
+		registry.addImage(t, fmt.Sprintf("library/app%d", i), "latest", []byte(fmt.Sprintf("concurrently pulled layer %d", i)))
+	}
+	service := newTestService(t, registry)
+	service.layerRefsFile = filepath.Join(service.imageRoot, "layer-refs.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		imageRef := fmt.Sprintf("test%d:latest", i)
+		pulled := fmt.Sprintf("%s/library/app%d:latest", registry.host(), i)
+		go func() {
+			defer wg.Done()
+			err := service.AddImage(imageRef, &imageMetadata{
+				ID:       "sha256:" + digest.FromString(imageRef).Hex(),
+				RepoTags: []string{imageRef},
+				State:    imageStateReady,
+			})
+			if err != nil {
+				t.Errorf("AddImage(%s) error = %v", imageRef, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// The image may not have been added yet
+			if err := service.removeImage(context.Background(), imageRef); err != nil && !errors.Is(err, ErrImageNotFound) {
+				t.Errorf("removeImage(%s) error = %v", imageRef, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := service.PullImage(context.Background(), pulled, nil); err != nil {
+				t.Errorf("PullImage(%s) error = %v", pulled, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(service.metadataFile)
+	if err != nil {
+		t.Fatalf("failed to read metadata: %v", err)
+	}
+	var saved map[string]*imageMetadata
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("metadata file does not parse: %v", err)
+	}
+	service.mu.RLock()
+	want := len(service.images)
+	service.mu.RUnlock()
+	if len(saved) != want {
+		t.Errorf("metadata file holds %d images, want %d", len(saved), want)
+	}
+	for i := 0; i < n; i++ {
+		if pulled := fmt.Sprintf("%s/library/app%d:latest", registry.host(), i); saved[pulled] == nil {
+			t.Errorf("metadata file is missing %s", pulled)
+		}
+	}
+
+	data, err = os.ReadFile(service.layerRefsFile)
+	if err != nil {
+		t.Fatalf("failed to read layer references: %v", err)
+	}
+	var refs map[string]int
+	if err := json.Unmarshal(data, &refs); err != nil {
+		t.Errorf("layer references file does not parse: %v", err)
+	}
+}
+
 func TestImageService_LayerReuse(t *testing.T) {
 	// Create temporary directory
 	tmpDir, err := os.MkdirTemp("", "layer-reuse-test")
@@ -814,3 +1036,1302 @@ func TestImageService_LayerCache(t *testing.T) {
 		}
 	}
 }
+
+func TestImageService_LayerDownloadOrder(t *testing.T) {
+	small := []byte("s")
+	medium := []byte("medium layer")
+	large := []byte("a considerably larger layer blob")
+
+	tests := []struct {
+		name  string
+		order LayerOrder
+		want  [][]byte
+	}{
+		{"manifest order", LayerOrderManifest, [][]byte{medium, large, small}},
+		{"smallest first", LayerOrderSmallestFirst, [][]byte{small, medium, large}},
+		{"largest first", LayerOrderLargestFirst, [][]byte{large, medium, small}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+			registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", medium, large, small)
+			service := newTestService(t, registry)
+			service.config.LayerOrder = tt.order
+
+			imageRef := registry.host() + "/library/app:latest"
+			if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+
+			// The config blob is fetched ahead of the layers
+			var manifest DockerManifest
+			if err := json.Unmarshal(registry.manifests["library/app:latest"], &manifest); err != nil {
+				t.Fatalf("Failed to parse manifest: %v", err)
+			}
+			want := []string{"/v2/library/app/blobs/" + manifest.Config.Digest}
+			for _, layer := range tt.want {
+				want = append(want, "/v2/library/app/blobs/"+digest.FromBytes(layer).String())
+			}
+			if got := registry.blobRequests(); !reflect.DeepEqual(got, want) {
+				t.Errorf("blob requests = %v, want %v", got, want)
+			}
+
+			// Stored layers keep manifest order regardless of dispatch order
+			layers := service.images[imageRef].Layers
+			for i, layer := range [][]byte{medium, large, small} {
+				if layers[i].Digest != digest.FromBytes(layer).String() {
+					t.Errorf("layer %d digest = %s, want manifest order", i, layers[i].Digest)
+				}
+			}
+		})
+	}
+}
+
+func TestImageService_RequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Send part of the body, then stall
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	service.config.RequestTimeout = 100 * time.Millisecond
+
+	destDir := filepath.Join(service.imageRoot, "layer-0")
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		t.Fatalf("Failed to create layer dir: %v", err)
+	}
+
+	start := time.Now()
+	err := service.downloadLayer(context.Background(), server.URL, filepath.Join(destDir, "layer.tar"), "sha256:stalled", 0, nil, nil)
+	if err == nil {
+		t.Fatal("downloadLayer() should fail on a stalled registry")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("downloadLayer() took %v, want abort near the 100ms timeout", elapsed)
+	}
+
+	_, _, err = service.getManifest(context.Background(), server.URL, nil)
+	if err == nil {
+		t.Fatal("getManifest() should fail on a stalled registry")
+	}
+
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		t.Fatalf("Failed to read layer dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("partial files left behind after timeout: %v", entries)
+	}
+}
+
+func TestImageService_RequestTimeoutSlowDownload(t *testing.T) {
+	layer := bytes.Repeat([]byte("slow layer "), 100)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep sending data, taking several timeouts in total
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for i := 0; i < len(layer); i += 100 {
+			w.Write(layer[i : i+100])
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	service.config.RequestTimeout = 100 * time.Millisecond
+
+	layerPath := filepath.Join(service.imageRoot, "layer.tar")
+	if err := service.downloadLayer(context.Background(), server.URL, layerPath, digest.FromBytes(layer).String(), int64(len(layer)), nil, nil); err != nil {
+		t.Fatalf("downloadLayer() error = %v, want a slow but steady download to complete", err)
+	}
+}
+
+func TestImageService_saveLayerDigestFormats(t *testing.T) {
+	content := []byte("layer content with a known digest")
+	canonical := digest.FromBytes(content)
+	hex := canonical.Encoded()
+
+	tests := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{"canonical", canonical.String(), false},
+		{"unprefixed", hex, false},
+		{"upper-case hex", "sha256:" + strings.ToUpper(hex), false},
+		{"mixed-case algorithm and hex", "SHA256:" + strings.ToUpper(hex[:32]) + hex[32:], false},
+		{"unprefixed upper-case", strings.ToUpper(hex), false},
+		{"sha512", digest.SHA512.FromBytes(content).String(), false},
+		{"sha512 upper-case hex", "sha512:" + strings.ToUpper(digest.SHA512.FromBytes(content).Encoded()), false},
+		{"sha512 of other content", digest.SHA512.FromString("other").String(), true},
+		{"unsupported algorithm", "sha384:" + hex, true},
+		{"wrong content", digest.FromString("other").String(), true},
+		{"malformed", "sha256:xyz", true},
+	}
+
+	service := newTestService(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destDir := t.TempDir()
+			_, err := service.saveLayer(filepath.Join(destDir, "layer.tar"), bytes.NewReader(content), tt.expected, 0)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("saveLayer(%q) error = %v, wantErr %v", tt.expected, err, tt.wantErr)
+			}
+			if _, statErr := os.Stat(filepath.Join(destDir, "layer.tar")); (statErr == nil) == tt.wantErr {
+				t.Errorf("layer.tar presence does not match verification result")
+			}
+		})
+	}
+}
+
+func TestImageService_PullSHA512Layer(t *testing.T) {
+	layer := []byte("layer content addressed by its sha512 digest")
+	sha512Digest := digest.SHA512.FromBytes(layer)
+
+	// Rewrite the manifest to address the layer by its sha512 digest
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", layer)
+	var manifest DockerManifest
+	if err := json.Unmarshal(registry.manifests["library/app:latest"], &manifest); err != nil {
+		t.Fatalf("Failed to decode manifest: %v", err)
+	}
+	manifest.Layers[0].Digest = sha512Digest.String()
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	registry.manifests["library/app:latest"] = data
+	registry.blobs[sha512Digest.String()] = layer
+
+	service := newTestService(t, registry)
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	layerPath := filepath.Join(service.imageRoot, blobsDir, "sha512", sha512Digest.Encoded())
+	if content, err := os.ReadFile(layerPath); err != nil || !bytes.Equal(content, layer) {
+		t.Errorf("layer stored at %s = %q, %v", layerPath, content, err)
+	}
+}
+
+func TestImageService_InsecureRegistry(t *testing.T) {
+	registry := newPlainTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("plain http layer"))
+	imageRef := registry.host() + "/library/app:latest"
+
+	// Without configuration the service insists on HTTPS
+	service := newTestService(t, registry)
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err == nil {
+		t.Fatal("PullImage() over HTTPS from a plain HTTP registry should fail")
+	}
+
+	service = newTestService(t, registry)
+	service.config.InsecureRegistries = []string{registry.host()}
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() from insecure registry error = %v", err)
+	}
+	if !service.HasImage(imageRef) {
+		t.Error("image pulled from insecure registry is not present")
+	}
+	if registry.hitCount("/v2/library/app/manifests/latest") != 1 {
+		t.Error("manifest was not fetched over plain HTTP")
+	}
+}
+
+func TestImageService_Proxy(t *testing.T) {
+	registry := newPlainTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("proxied layer"))
+
+	// The proxy forwards everything to the registry and records the hosts
+	// that were requested through it
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.Host)
+		mu.Unlock()
+		registry.serveHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	tr, err := newTransport(Config{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("newTransport() error = %v", err)
+	}
+
+	// The registry host does not resolve, so the pull only succeeds when
+	// it goes through the proxy
+	const host = "registry.invalid"
+	service := newTestService(t, nil)
+	service.client = &http.Client{Transport: tr}
+	service.config.InsecureRegistries = []string{host}
+
+	imageRef := host + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() through proxy error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) == 0 {
+		t.Fatal("no request went through the proxy")
+	}
+	for _, h := range proxied {
+		if h != host {
+			t.Errorf("proxied request for host %q, want %q", h, host)
+		}
+	}
+}
+
+func TestNewTransport_InvalidProxy(t *testing.T) {
+	for _, proxyURL := range []string{"://bad", "proxy.example.com"} {
+		if _, err := newTransport(Config{ProxyURL: proxyURL}); err == nil {
+			t.Errorf("newTransport(%q) should fail", proxyURL)
+		}
+	}
+}
+
+func TestNewTransport_ConnectionPool(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		wantPerHost int
+	}{
+		{name: "defaults", config: Config{}, wantPerHost: 2},
+		{name: "prefetching", config: Config{PrefetchConcurrency: 3}, wantPerHost: 4},
+		{name: "chunked downloads", config: Config{BlobChunkSize: 1024}, wantPerHost: 2 * defaultBlobChunkConcurrency},
+		{name: "chunked prefetching", config: Config{PrefetchConcurrency: 2, BlobChunkSize: 1024, BlobChunkConcurrency: 8}, wantPerHost: 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newTransport(tt.config)
+			if err != nil {
+				t.Fatalf("newTransport() error = %v", err)
+			}
+			if tr.MaxIdleConnsPerHost != tt.wantPerHost {
+				t.Errorf("MaxIdleConnsPerHost = %d, want %d", tr.MaxIdleConnsPerHost, tt.wantPerHost)
+			}
+			if tr.MaxIdleConns < tr.MaxIdleConnsPerHost {
+				t.Errorf("MaxIdleConns = %d, below the %d per host", tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+			}
+			if !tr.ForceAttemptHTTP2 || tr.IdleConnTimeout <= 0 {
+				t.Errorf("ForceAttemptHTTP2 = %v, IdleConnTimeout = %v, want HTTP/2 and an idle timeout", tr.ForceAttemptHTTP2, tr.IdleConnTimeout)
+			}
+		})
+	}
+}
+
+func TestImageService_ReusesConnections(t *testing.T) {
+	registry := newTestRegistry(t)
+	repos := []string{"library/a", "library/b", "library/c"}
+	for _, repo := range repos {
+		registry.addImage(t, repo, "latest", []byte("layer of "+repo))
+	}
+
+	tr, err := newTransport(Config{TLSCAData: serverCAPEM(registry.server)})
+	if err != nil {
+		t.Fatalf("newTransport() error = %v", err)
+	}
+	var mu sync.Mutex
+	var dials int
+	dialer := &net.Dialer{}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		return dialer.DialContext(ctx, network, addr)
+	}
+	service := newTestService(t, nil)
+	service.client = &http.Client{Transport: tr}
+
+	// Sequential pulls from one registry share a single connection
+	for _, repo := range repos {
+		imageRef := registry.host() + "/" + repo + ":latest"
+		if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", imageRef, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if dials != 1 {
+		t.Errorf("pulls opened %d connections, want 1", dials)
+	}
+}
+
+func TestImageService_RegistryMirrors(t *testing.T) {
+	broken := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	mirror := newTestRegistry(t)
+	mirror.addImage(t, "library/app", "latest", []byte("mirrored layer"))
+
+	// The canonical registry is never reachable in this test
+	const canonical = "registry.invalid"
+	service := newTestService(t, mirror)
+	service.config.Mirrors = map[string][]string{
+		canonical: {broken.URL, mirror.host()},
+	}
+
+	imageRef := canonical + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() through mirror error = %v", err)
+	}
+	if !service.HasImage(imageRef) {
+		t.Error("image pulled through mirror is not present")
+	}
+	if mirror.hitCount("/v2/library/app/manifests/latest") != 1 {
+		t.Error("manifest was not fetched from the working mirror with the original repository path")
+	}
+}
+
+func TestImageService_RegistryMirrorsFallback(t *testing.T) {
+	broken := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer broken.Close()
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("canonical layer"))
+
+	service := newTestService(t, registry)
+	service.config.Mirrors = map[string][]string{
+		registry.host(): {broken.URL},
+	}
+
+	imageRef := registry.host() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() with failing mirror error = %v", err)
+	}
+	if registry.hitCount("/v2/library/app/manifests/latest") != 1 {
+		t.Error("manifest was not fetched from the canonical registry after mirrors failed")
+	}
+}
+
+func TestImageService_LayerReuseProvenance(t *testing.T) {
+	shared := []byte("shared base layer")
+	uniqueA := []byte("layer only in a")
+	uniqueB := []byte("layer only in b")
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/a", "latest", shared, uniqueA)
+	registry.addImage(t, "library/b", "latest", shared, uniqueB)
+	service := newTestService(t, registry)
+
+	refA := registry.host() + "/library/a:latest"
+	refB := registry.host() + "/library/b:latest"
+	for _, ref := range []string{refA, refB} {
+		if _, err := service.PullImage(context.Background(), ref, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+	}
+
+	layersA, err := service.ImageLayers(refA)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	for i, layer := range layersA {
+		if layer.Reused {
+			t.Errorf("first image layer %d marked as reused", i)
+		}
+	}
+
+	layersB, err := service.ImageLayers(refB)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	if len(layersB) != 2 {
+		t.Fatalf("Expected 2 layers, got %d", len(layersB))
+	}
+	if !layersB[0].Reused {
+		t.Error("shared layer of the second image should be marked as reused")
+	}
+	if layersB[1].Reused {
+		t.Error("unique layer of the second image should be marked as freshly downloaded")
+	}
+}
+
+func TestImageService_SizeFromDisk(t *testing.T) {
+	layer := []byte("layer whose manifest size lies")
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/a", "latest", layer)
+	registry.addImage(t, "library/b", "latest", layer)
+
+	// Declare a bogus size for the layer in the manifest of the image that
+	// reuses it, as a downloaded layer must match its declared size
+	var manifest DockerManifest
+	if err := json.Unmarshal(registry.manifests["library/b:latest"], &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	manifest.Layers[0].Size = 4096
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	registry.manifests["library/b:latest"] = data
+
+	service := newTestService(t, registry)
+	// The first pull downloads the layer, the second reuses it from cache
+	for _, repo := range []string{"library/a", "library/b"} {
+		ref := registry.host() + "/" + repo + ":latest"
+		if _, err := service.PullImage(context.Background(), ref, nil); err != nil {
+			t.Fatalf("PullImage(%s) error = %v", ref, err)
+		}
+
+		status, err := service.ImageStatus(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("ImageStatus(%s) error = %v", ref, err)
+		}
+		if status.Size_ != uint64(len(layer)) {
+			t.Errorf("%s size = %d, want %d bytes on disk", repo, status.Size_, len(layer))
+		}
+	}
+}
+
+// cancelingRegistryClient cancels a pull once the first layer blob has been
+// served, ignoring the cancellation itself like a slow registry would
+type cancelingRegistryClient struct {
+	*fakeRegistryClient
+	layers map[string]bool
+	cancel context.CancelFunc
+}
+
+func (c *cancelingRegistryClient) GetBlob(ctx context.Context, rawURL string, auth *runtime.AuthConfig, byteRange string) (*Blob, error) {
+	blob, err := c.fakeRegistryClient.GetBlob(context.Background(), rawURL, auth, byteRange)
+	if c.layers[rawURL[strings.LastIndex(rawURL, "/")+1:]] {
+		c.cancel()
+		// The cancellation reaches the shared download asynchronously
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return blob, err
+}
+
+func TestImageService_CancelStopsLayerDownloads(t *testing.T) {
+	layers := [][]byte{
+		[]byte("first layer, served before the cancel"),
+		[]byte("second layer, never to be fetched"),
+		[]byte("third layer, never to be fetched"),
+	}
+
+	fake, registry := newFakeRegistryClient()
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", layers...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &cancelingRegistryClient{
+		fakeRegistryClient: fake,
+		layers:             map[string]bool{digest.FromBytes(layers[0]).String(): true},
+		cancel:             cancel,
+	}
+
+	service := newTestService(t, nil)
+	service.registry = client
+	imageRef := "registry.invalid/library/app:latest"
+
+	_, err := service.PullImage(ctx, imageRef, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("PullImage() error = %v, want %v", err, context.Canceled)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, layer := range layers[1:] {
+		blob := "GetBlob /v2/library/app/blobs/" + digest.FromBytes(layer).String()
+		for _, request := range fake.requests {
+			if request == blob {
+				t.Errorf("layer %s fetched after the pull was cancelled", digest.FromBytes(layer))
+			}
+		}
+	}
+	if service.HasImage(imageRef) {
+		t.Error("cancelled pull recorded the image")
+	}
+	if _, err := os.Stat(filepath.Join(service.imageRoot, digest.FromString(imageRef).Hex())); !os.IsNotExist(err) {
+		t.Errorf("cancelled pull left its image directory: %v", err)
+	}
+}
+
+func TestImageService_Ready(t *testing.T) {
+	service := newTestService(t, nil)
+	if err := service.Ready(); err != nil {
+		t.Fatalf("Ready() error = %v", err)
+	}
+	entries, err := os.ReadDir(service.imageRoot)
+	if err != nil {
+		t.Fatalf("Failed to read image root: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Ready() left %d entries in the image root", len(entries))
+	}
+
+	// A missing image root cannot be written to
+	root := service.imageRoot
+	service.imageRoot = filepath.Join(root, "missing")
+	if err := service.Ready(); err == nil {
+		t.Error("Ready() succeeded without an image root")
+	}
+	service.imageRoot = root
+
+	if err := service.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := service.Ready(); err == nil {
+		t.Error("Ready() succeeded after Close")
+	}
+}
+
+func TestImageService_ReadOnly(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/served", "latest", []byte("layer of the served image"))
+	registry.addImage(t, "library/new", "latest", []byte("layer of a new image"))
+	served := registry.host() + "/library/served:latest"
+
+	// Populate the store with a writable service
+	config := DefaultConfig()
+	config.ImageRoot = t.TempDir()
+	writer := NewImageServiceWithConfig(config)
+	writer.client = registry.server.Client()
+	if _, err := writer.PullImage(context.Background(), served, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	saved, err := os.ReadFile(writer.metadataFile)
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+
+	config.ReadOnly = true
+	service := NewImageServiceWithConfig(config)
+	service.client = registry.server.Client()
+	if service.gc != nil {
+		t.Error("garbage collector created for a read-only service")
+	}
+
+	// Reads are served from the loaded metadata
+	ctx := context.Background()
+	if _, err := service.ImageStatus(ctx, served); err != nil {
+		t.Errorf("ImageStatus() error = %v", err)
+	}
+	images, err := service.ListImages(ctx, nil)
+	if err != nil || len(images) != 1 {
+		t.Errorf("ListImages() = %d images, %v, want 1", len(images), err)
+	}
+	if err := service.Ready(); err != nil {
+		t.Errorf("Ready() error = %v", err)
+	}
+
+	// Mutations are rejected
+	if _, err := service.PullImage(ctx, registry.host()+"/library/new:latest", nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("PullImage() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := service.RemoveImage(ctx, served); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("RemoveImage() error = %v, want %v", err, ErrReadOnly)
+	}
+	if !service.HasImage(served) {
+		t.Error("image removed from a read-only service")
+	}
+
+	// Metadata is never written, even on Close
+	if err := service.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	after, err := os.ReadFile(service.metadataFile)
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if !bytes.Equal(after, saved) {
+		t.Error("read-only service rewrote the metadata")
+	}
+}
+
+func TestImageService_CloseAbortsPulls(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("slow layer"))
+	stalled := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer stalled.Close()
+
+	service := newTestService(t, registry)
+	service.layerCacheFile = filepath.Join(service.imageRoot, "layers.json")
+	service.ctx, service.cancel = context.WithCancel(context.Background())
+	service.gc = NewGarbageCollector(service, time.Hour)
+	service.gc.Start()
+
+	baseline := goruntime.NumGoroutine()
+
+	imageRef := strings.TrimPrefix(stalled.URL, "https://") + "/library/app:latest"
+	pullErr := make(chan error, 1)
+	go func() {
+		_, err := service.PullImage(context.Background(), imageRef, nil)
+		pullErr <- err
+	}()
+
+	// Wait until the pull is in flight
+	deadline := time.Now().Add(5 * time.Second)
+	for len(service.Snapshot().Pulls) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := service.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Close waits for in-flight pulls, so the result is already available
+	select {
+	case err := <-pullErr:
+		if err == nil {
+			t.Error("PullImage() should fail when the service is closed")
+		}
+	default:
+		t.Fatal("Close() returned before the in-flight pull finished")
+	}
+
+	if _, err := os.Stat(service.metadataFile); err != nil {
+		t.Errorf("metadata was not flushed on Close: %v", err)
+	}
+	if _, err := os.Stat(service.layerCacheFile); err != nil {
+		t.Errorf("layer cache index was not persisted on Close: %v", err)
+	}
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err == nil {
+		t.Error("PullImage() should be rejected after Close")
+	}
+
+	// All goroutines started for the pull and the GC must exit
+	registry.server.Client().Transport.(*http.Transport).CloseIdleConnections()
+	deadline = time.Now().Add(5 * time.Second)
+	for goruntime.NumGoroutine() > baseline-1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := goruntime.NumGoroutine(); n > baseline-1 {
+		t.Errorf("goroutine leak: %d goroutines running, want at most %d", n, baseline-1)
+	}
+}
+
+func TestImageService_ConcurrentPullsShareDownload(t *testing.T) {
+	layer := []byte("layer downloaded once")
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", layer)
+
+	// Slow down blob responses so that every pull joins the first one
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer slow.Close()
+
+	service := newTestService(t, registry)
+	imageRef := strings.TrimPrefix(slow.URL, "https://") + "/library/app:latest"
+
+	const pulls = 10
+	ids := make([]string, pulls)
+	errs := make([]error, pulls)
+	var wg sync.WaitGroup
+	for i := 0; i < pulls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = service.PullImage(context.Background(), imageRef, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < pulls; i++ {
+		if errs[i] != nil {
+			t.Fatalf("PullImage() #%d error = %v", i, errs[i])
+		}
+		if ids[i] != ids[0] {
+			t.Errorf("PullImage() #%d returned %s, want %s", i, ids[i], ids[0])
+		}
+	}
+
+	blobPath := "/v2/library/app/blobs/" + digest.FromBytes(layer).String()
+	if hits := registry.hitCount(blobPath); hits != 1 {
+		t.Errorf("layer endpoint hit %d times, want 1", hits)
+	}
+}
+
+func TestImageService_MaxConcurrentPulls(t *testing.T) {
+	const (
+		limit = 2
+		pulls = 6
+	)
+	registry := newTestRegistry(t)
+	for i := 0; i < pulls; i++ {
+		registry.addImage(t, fmt.Sprintf("library/app%d", i), "latest", gzipBytes(t, []byte(fmt.Sprintf("layer %d", i))))
+	}
+
+	// Each pull makes its requests one after another, so the requests in
+	// flight bound the pulls in flight
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer slow.Close()
+
+	service := newTestService(t, registry)
+	service.config.MaxConcurrentPulls = limit
+	host := strings.TrimPrefix(slow.URL, "https://")
+
+	errs := make([]error, pulls)
+	var wg sync.WaitGroup
+	for i := 0; i < pulls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = service.PullImage(context.Background(), fmt.Sprintf("%s/library/app%d:latest", host, i), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("PullImage() #%d error = %v", i, err)
+		}
+	}
+	if peak > limit {
+		t.Errorf("%d pulls in flight, want at most %d", peak, limit)
+	}
+
+	// Pulls waiting for a slot give up when their context ends
+	release, err := service.acquirePullSlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquirePullSlot() error = %v", err)
+	}
+	release2, err := service.acquirePullSlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquirePullSlot() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	registry.addImage(t, "library/waiting", "latest", gzipBytes(t, []byte("waiting layer")))
+	if _, err := service.PullImage(ctx, host+"/library/waiting:latest", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PullImage() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	release()
+	release2()
+
+	// Images already present do not need a slot
+	if _, err := service.PullImage(context.Background(), host+"/library/app0:latest", nil); err != nil {
+		t.Errorf("PullImage() of a present image error = %v", err)
+	}
+}
+
+func TestImageService_ConcurrentPullsShareErrors(t *testing.T) {
+	var mu sync.Mutex
+	manifestHits := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			mu.Lock()
+			manifestHits++
+			mu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+
+	var wg sync.WaitGroup
+	var failures int
+	var failuresMu sync.Mutex
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+				failuresMu.Lock()
+				failures++
+				failuresMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failures != 5 {
+		t.Errorf("%d of 5 pulls failed, want all waiters to receive the error", failures)
+	}
+
+	// The key is released, so a later pull hits the registry again
+	before := manifestHits
+	service.PullImage(context.Background(), imageRef, nil)
+	if manifestHits == before {
+		t.Error("failed pull was not retried after the shared pull completed")
+	}
+}
+
+func TestImageService_SharedPullOutlivesCaller(t *testing.T) {
+	layer := gzipBytes(t, []byte("layer of a shared pull"))
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", layer)
+	blobPath := "/v2/library/app/blobs/" + digest.FromBytes(layer).String()
+
+	// Hold the layer until both callers wait for the download
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == blobPath {
+			<-release
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	defer cancelLeader()
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := service.PullImage(leaderCtx, imageRef, nil)
+		leaderErr <- err
+	}()
+	followerErr := make(chan error, 1)
+	go func() {
+		_, err := service.PullImage(context.Background(), imageRef, nil)
+		followerErr <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		service.mu.Lock()
+		var waiters int
+		for _, f := range service.pullFlights {
+			waiters = f.waiters
+		}
+		service.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers waiting for the shared pull, want 2", waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The cancelled caller stops waiting right away
+	cancelLeader()
+	select {
+	case err := <-leaderErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled PullImage() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled caller still waiting for the shared pull")
+	}
+
+	// The other caller still gets the image
+	close(release)
+	if err := <-followerErr; err != nil {
+		t.Fatalf("PullImage() error = %v after another caller gave up", err)
+	}
+	if !service.HasImage(imageRef) {
+		t.Error("shared pull did not record the image")
+	}
+	if n := registry.hitCount("/v2/library/app/manifests/latest"); n != 1 {
+		t.Errorf("manifest fetched %d times, want a single shared pull", n)
+	}
+}
+
+func TestImageService_ChunkedResponses(t *testing.T) {
+	layer := buildTar(t, map[string]string{"etc/hostname": "chunked"})
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", gzipBytes(t, layer))
+
+	// Stream every response in small flushed pieces without Content-Length,
+	// which makes the server fall back to chunked transfer encoding
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		registry.serveHTTP(rec, r)
+		for key, values := range rec.Header() {
+			if key != "Content-Length" {
+				w.Header()[key] = values
+			}
+		}
+		w.WriteHeader(rec.Code)
+		body := rec.Body.Bytes()
+		for len(body) > 0 {
+			n := min(len(body), 16)
+			w.Write(body[:n])
+			w.(http.Flusher).Flush()
+			body = body[n:]
+		}
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	layers, err := service.ImageLayers(imageRef)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	if len(layers) != 1 || layers[0].DiffID != digest.FromBytes(layer).String() {
+		t.Errorf("layers = %+v, want one layer with the diffID of the tar", layers)
+	}
+}
+
+func TestDescribeSize(t *testing.T) {
+	if got := describeSize(-1); got != "unknown size" {
+		t.Errorf("describeSize(-1) = %q, want unknown size", got)
+	}
+	if got := describeSize(42); got != "42 bytes" {
+		t.Errorf("describeSize(42) = %q, want 42 bytes", got)
+	}
+}
+
+// recordingHandler collects the log records it handles
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+// find returns the attributes of the first record with the given message
+func (h *recordingHandler) find(msg string) (map[string]slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		return attrs, true
+	}
+	return nil, false
+}
+
+func TestImageService_StructuredPullLog(t *testing.T) {
+	layer := []byte("layer logged on pull")
+	registry := newTestRegistry(t)
+	manifestDigest := registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", layer)
+
+	handler := &recordingHandler{}
+	service := newTestService(t, registry)
+	service.logger = slog.New(handler)
+
+	imageRef := registry.host() + "/library/app:latest"
+	imageID, err := service.PullImage(context.Background(), imageRef, nil)
+	if err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	attrs, ok := handler.find("image pulled")
+	if !ok {
+		t.Fatal("no \"image pulled\" record emitted")
+	}
+	if got := attrs["image"].String(); got != imageRef {
+		t.Errorf("image = %q, want %q", got, imageRef)
+	}
+	if got := attrs["id"].String(); got != imageID {
+		t.Errorf("id = %q, want %q", got, imageID)
+	}
+	if got := attrs["digest"].String(); got != manifestDigest.String() {
+		t.Errorf("digest = %q, want %q", got, manifestDigest)
+	}
+	if got := attrs["bytes"].Int64(); got != int64(len(layer)) {
+		t.Errorf("bytes = %d, want %d", got, len(layer))
+	}
+	if attrs["duration"].Kind() != slog.KindDuration {
+		t.Errorf("duration has kind %v, want a duration", attrs["duration"].Kind())
+	}
+}
+
+func TestImageService_DefaultRegistry(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "myapp", "latest", []byte("layer of the short named image"))
+	service := newTestService(t, registry)
+	service.config.DefaultRegistry = registry.host()
+
+	if _, err := service.PullImage(context.Background(), "myapp:latest", nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if got := registry.hitCount("/v2/myapp/manifests/latest"); got != 1 {
+		t.Errorf("default registry served the manifest %d times, want 1", got)
+	}
+	if !service.HasImage("myapp:latest") {
+		t.Error("image not recorded under the reference it was pulled by")
+	}
+
+	// Names that are invalid as written stay invalid
+	for _, ref := range []string{"scratch", "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"} {
+		if _, err := service.PullImage(context.Background(), ref, nil); !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("PullImage(%q) error = %v, want %v", ref, err, ErrInvalidReference)
+		}
+	}
+}
+
+func TestHasRegistry(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{"myapp:latest", false},
+		{"team/myapp:latest", false},
+		{"registry.example.com/myapp", true},
+		{"registry:5000/myapp", true},
+		{"localhost/myapp", true},
+		{"Registry/myapp", true},
+	}
+
+	for _, tt := range tests {
+		if got := hasRegistry(tt.ref); got != tt.want {
+			t.Errorf("hasRegistry(%q) = %v, want %v", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeReference(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{ref: "nginx", want: "docker.io/library/nginx:latest"},
+		{ref: "nginx:latest", want: "docker.io/library/nginx:latest"},
+		{ref: "docker.io/library/nginx:latest", want: "docker.io/library/nginx:latest"},
+		{ref: "team/app:1.0", want: "docker.io/team/app:1.0"},
+		{ref: "registry:5000/app", want: "registry:5000/app:latest"},
+		{
+			ref:  "nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			want: "docker.io/library/nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		},
+		{ref: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", wantErr: true},
+		{ref: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizeReference(tt.ref)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidReference) {
+				t.Errorf("NormalizeReference(%q) error = %v, want %v", tt.ref, err, ErrInvalidReference)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NormalizeReference(%q) error = %v", tt.ref, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("NormalizeReference(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestImageService_NormalizedReferences(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", gzipBytes(t, []byte("layer")))
+	service := newTestService(t, registry)
+
+	short := registry.host() + "/library/app"
+	full := short + ":latest"
+	if _, err := service.PullImage(context.Background(), short, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	// The image is stored under its normalized reference only
+	if _, ok := service.images[full]; !ok || len(service.images) != 1 {
+		t.Errorf("%d images stored, want only %s", len(service.images), full)
+	}
+	for _, ref := range []string{short, full} {
+		if _, err := service.ImageStatus(context.Background(), ref); err != nil {
+			t.Errorf("ImageStatus(%q) error = %v", ref, err)
+		}
+	}
+
+	// Pulling under another spelling reuses the stored image
+	requests := registry.hitCount("/v2/library/app/manifests/latest")
+	if _, err := service.PullImage(context.Background(), full, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if got := registry.hitCount("/v2/library/app/manifests/latest"); got != requests {
+		t.Errorf("second pull fetched the manifest again")
+	}
+
+	if err := service.RemoveImage(context.Background(), short); err != nil {
+		t.Fatalf("RemoveImage() error = %v", err)
+	}
+	if service.HasImage(full) {
+		t.Error("image still present after removal by its short reference")
+	}
+}
+
+func TestImageService_StatusAcrossReferenceForms(t *testing.T) {
+	tests := []struct {
+		name   string
+		pull   string
+		status string
+	}{
+		{"short pull, qualified status", "library/test:latest", "docker.io/library/test:latest"},
+		{"qualified pull, short status", "docker.io/library/test:latest", "library/test:latest"},
+		{"untagged pull, tagged status", "test", "test:latest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, registry := newFakeRegistryClient()
+			registry.addImage(t, "library/test", "latest", []byte("test layer"))
+			service := newTestService(t, nil)
+			service.registry = client
+
+			imageID, err := service.PullImage(context.Background(), tt.pull, nil)
+			if err != nil {
+				t.Fatalf("PullImage(%q) error = %v", tt.pull, err)
+			}
+			img, err := service.ImageStatus(context.Background(), tt.status)
+			if err != nil {
+				t.Fatalf("ImageStatus(%q) error = %v", tt.status, err)
+			}
+			if img.Id != imageID {
+				t.Errorf("ImageStatus(%q) ID = %s, want %s", tt.status, img.Id, imageID)
+			}
+
+			if err := service.RemoveImage(context.Background(), tt.status); err != nil {
+				t.Fatalf("RemoveImage(%q) error = %v", tt.status, err)
+			}
+			if service.HasImage(tt.pull) {
+				t.Errorf("%s still present after removal by %s", tt.pull, tt.status)
+			}
+		})
+	}
+}
+
+func TestImageService_LoadNormalizesReferences(t *testing.T) {
+	service := newTestService(t, nil)
+	service.images["test:latest"] = &imageMetadata{ID: "sha256:legacy"}
+	service.images["other"] = &imageMetadata{ID: "sha256:other"}
+	// An image already stored under the normalized reference wins
+	service.images["docker.io/library/other:latest"] = &imageMetadata{ID: "sha256:current"}
+	if err := service.saveMetadata(); err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+
+	service.images = make(map[string]*imageMetadata)
+	if err := service.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+
+	want := map[string]string{
+		"docker.io/library/test:latest":  "sha256:legacy",
+		"docker.io/library/other:latest": "sha256:current",
+		"other":                          "sha256:other",
+	}
+	if len(service.images) != len(want) {
+		t.Errorf("loaded %d images, want %d", len(service.images), len(want))
+	}
+	for ref, id := range want {
+		if img, ok := service.images[ref]; !ok || img.ID != id {
+			t.Errorf("images[%q] = %v, want ID %s", ref, img, id)
+		}
+	}
+}
+
+func TestImageService_InvalidReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		wantErr bool
+	}{
+		{name: "bare digest", ref: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", wantErr: true},
+		{name: "empty string", ref: "", wantErr: true},
+		{name: "empty path", ref: "registry.example.com/", wantErr: true},
+		{name: "scratch", ref: "scratch", wantErr: true},
+		{name: "digest without repository", ref: "@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", wantErr: true},
+		{name: "valid reference", ref: "registry.invalid/library/app:latest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, registry := newFakeRegistryClient()
+			registry.addImage(t, "library/app", "latest", []byte("valid reference layer"))
+			service := newTestService(t, nil)
+			service.registry = client
+
+			_, err := service.PullImage(context.Background(), tt.ref, nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("PullImage(%q) error = %v", tt.ref, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidReference) {
+				t.Errorf("PullImage(%q) error = %v, want %v", tt.ref, err, ErrInvalidReference)
+			}
+			if len(client.requests) != 0 {
+				t.Errorf("PullImage(%q) contacted the registry: %v", tt.ref, client.requests)
+			}
+		})
+	}
+}
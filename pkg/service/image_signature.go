@@ -0,0 +1,179 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// cosignPayloadMediaType is the media type of cosign signature payloads
+	cosignPayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// cosignSignatureAnnotation holds the base64 signature of a payload
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// errSignatureNotFound is returned when no signature is published for an image
+var errSignatureNotFound = errors.New("no signature found")
+
+// signatureManifest is the manifest cosign stores under the signature tag
+type signatureManifest struct {
+	Layers []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// signaturePayload is the simple signing payload cosign signs
+type signaturePayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// signatureTag returns the tag cosign publishes the signature of
+// manifestDigest under
+func signatureTag(manifestDigest digest.Digest) string {
+	return fmt.Sprintf("%s-%s.sig", manifestDigest.Algorithm(), manifestDigest.Encoded())
+}
+
+// parseSignatureKey decodes a PEM encoded ECDSA public key
+func parseSignatureKey(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in signature public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signature public key: %v", err)
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signature public key is %T, want ECDSA", key)
+	}
+	return ecdsaKey, nil
+}
+
+// verifySignature checks the cosign signature of manifestDigest against the
+// configured public key. It is a no-op when no key is configured.
+func (s *ImageService) verifySignature(ctx context.Context, endpoints []string, repository string, manifestDigest digest.Digest, auth *runtime.AuthConfig) error {
+	if len(s.config.SignaturePublicKey) == 0 {
+		if s.config.RequireSignature {
+			return fmt.Errorf("signatures are required but no public key is configured")
+		}
+		return nil
+	}
+
+	key, err := parseSignatureKey(s.config.SignaturePublicKey)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		err = s.verifySignatureAt(ctx, endpoint, repository, manifestDigest, key, auth)
+		if err == nil || !errors.Is(err, errSignatureNotFound) {
+			break
+		}
+	}
+	if errors.Is(err, errSignatureNotFound) && !s.config.RequireSignature {
+		s.log().Warn("image has no signature", "repository", repository, "digest", manifestDigest)
+		return nil
+	}
+	return err
+}
+
+// verifySignatureAt verifies the signature of manifestDigest published on a
+// single registry endpoint
+func (s *ImageService) verifySignatureAt(ctx context.Context, endpoint, repository string, manifestDigest digest.Digest, key *ecdsa.PublicKey, auth *runtime.AuthConfig) error {
+	manifestURL := s.endpointURL(endpoint, fmt.Sprintf("/v2/%s/manifests/%s", repository, signatureTag(manifestDigest)))
+	manifest, err := s.getSignatureManifest(ctx, manifestURL, auth)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != cosignPayloadMediaType {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+
+		payloadURL := s.endpointURL(endpoint, fmt.Sprintf("/v2/%s/blobs/%s", repository, layer.Digest))
+		payload, err := s.getJSONBlob(ctx, payloadURL, layer.Digest, auth)
+		if err != nil {
+			return fmt.Errorf("failed to get signature payload: %v", err)
+		}
+
+		hash := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			continue
+		}
+
+		// The payload must vouch for the manifest being pulled
+		var signed signaturePayload
+		if err := json.Unmarshal(payload, &signed); err != nil {
+			return fmt.Errorf("failed to decode signature payload: %v", err)
+		}
+		if signed.Critical.Image.DockerManifestDigest != manifestDigest.String() {
+			return fmt.Errorf("signature is for %s, not %s", signed.Critical.Image.DockerManifestDigest, manifestDigest)
+		}
+		return nil
+	}
+	return fmt.Errorf("no signature of %s verifies against the configured key", manifestDigest)
+}
+
+// getSignatureManifest fetches a cosign signature manifest, returning
+// errSignatureNotFound when the registry has none
+func (s *ImageService) getSignatureManifest(ctx context.Context, url string, auth *runtime.AuthConfig) (*signatureManifest, error) {
+	ctx, cancel := s.withRequestTimeout(ctx)
+	defer cancel()
+
+	if err := s.waitForRegistry(ctx, url); err != nil {
+		return nil, fmt.Errorf("failed to get signature: %v", err)
+	}
+	data, err := s.registryClient().GetManifest(ctx, url, auth, nil)
+	if err != nil {
+		if registryStatus(err) == http.StatusNotFound {
+			return nil, errSignatureNotFound
+		}
+		return nil, fmt.Errorf("failed to get signature: %v", err)
+	}
+
+	var manifest signatureManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode signature manifest: %v", err)
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// newSignatureKey returns a fresh ECDSA key and its PEM encoded public key
+func newSignatureKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// signImage publishes a cosign signature of signedDigest, signed with key,
+// under the signature tag of manifestDigest
+func (r *testRegistry) signImage(t *testing.T, repo string, manifestDigest, signedDigest digest.Digest, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+		repo, signedDigest))
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("Failed to sign payload: %v", err)
+	}
+
+	var manifest signatureManifest
+	manifest.Layers = append(manifest.Layers, struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	}{
+		MediaType:   cosignPayloadMediaType,
+		Digest:      digest.FromBytes(payload).String(),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+	})
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to marshal signature manifest: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[digest.FromBytes(payload).String()] = payload
+	r.manifests[repo+":"+signatureTag(manifestDigest)] = data
+}
+
+func TestImageService_SignatureVerification(t *testing.T) {
+	trusted, trustedPEM := newSignatureKey(t)
+	untrusted, _ := newSignatureKey(t)
+
+	tests := []struct {
+		name    string
+		require bool
+		sign    func(r *testRegistry, manifestDigest digest.Digest)
+		wantErr bool
+	}{
+		{
+			name: "valid signature",
+			sign: func(r *testRegistry, d digest.Digest) {
+				r.signImage(t, "library/app", d, d, trusted)
+			},
+		},
+		{
+			name: "signed by another key",
+			sign: func(r *testRegistry, d digest.Digest) {
+				r.signImage(t, "library/app", d, d, untrusted)
+			},
+			wantErr: true,
+		},
+		{
+			name: "signature for another image",
+			sign: func(r *testRegistry, d digest.Digest) {
+				r.signImage(t, "library/app", d, digest.FromString("other"), trusted)
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsigned without enforcement",
+			sign: func(*testRegistry, digest.Digest) {},
+		},
+		{
+			name:    "unsigned with enforcement",
+			require: true,
+			sign:    func(*testRegistry, digest.Digest) {},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+			manifestDigest := registry.addImage(t, "library/app", "latest", []byte("signed layer content"))
+			tt.sign(registry, manifestDigest)
+
+			service := newTestService(t, registry)
+			service.config.SignaturePublicKey = trustedPEM
+			service.config.RequireSignature = tt.require
+
+			imageRef := registry.host() + "/library/app:latest"
+			_, err := service.PullImage(context.Background(), imageRef, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PullImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if service.HasImage(imageRef) == tt.wantErr {
+				t.Errorf("HasImage() = %v after a pull with error %v", !tt.wantErr, err)
+			}
+		})
+	}
+}
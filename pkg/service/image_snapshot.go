@@ -0,0 +1,117 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ImageSnapshot is a point-in-time copy of an image's metadata
+type ImageSnapshot struct {
+	Ref         string
+	ID          string
+	RepoTags    []string
+	RepoDigests []string
+	Size        int64
+	Digest      string
+	Layers      []LayerMetadata
+	// Ready is false while the image is still being pulled
+	Ready      bool
+	PulledAt   time.Time
+	LastUsedAt time.Time
+}
+
+// PullSnapshot describes a pull that was in flight when a snapshot was taken
+type PullSnapshot struct {
+	Ref       string
+	StartedAt time.Time
+}
+
+// Snapshot is an immutable, internally consistent view of the service state
+// meant for admin and listing consumers that must not hold service locks
+type Snapshot struct {
+	TakenAt        time.Time
+	Images         []ImageSnapshot
+	Pulls          []PullSnapshot
+	CachedLayers   []LayerMetadata
+	CacheTotalSize int64
+	GCStats        GCStats
+}
+
+// snapshotImage copies the metadata of the image recorded under ref
+func snapshotImage(ref string, img *imageMetadata) ImageSnapshot {
+	return ImageSnapshot{
+		Ref:         ref,
+		ID:          img.ID,
+		RepoTags:    append([]string(nil), img.RepoTags...),
+		RepoDigests: append([]string(nil), img.RepoDigests...),
+		Size:        img.Size,
+		Digest:      img.Digest,
+		Layers:      append([]LayerMetadata(nil), img.Layers...),
+		Ready:       img.ready(),
+		PulledAt:    img.PulledAt,
+		LastUsedAt:  img.LastUsedAt,
+	}
+}
+
+// GetImageInfo returns a copy of the metadata of imageRef, including when
+// it was pulled and last used
+func (s *ImageService) GetImageInfo(imageRef string) (*ImageSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	img, ok := s.images[s.imageKeyLocked(imageRef)]
+	if !ok || !img.ready() {
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, imageRef)
+	}
+	info := snapshotImage(imageRef, img)
+	return &info, nil
+}
+
+// Snapshot returns a consistent copy of images, in-flight pulls, cached
+// layers and GC statistics. Locks are only held while copying.
+func (s *ImageService) Snapshot() *Snapshot {
+	snap := &Snapshot{TakenAt: time.Now()}
+
+	s.mu.RLock()
+	for ref, img := range s.images {
+		snap.Images = append(snap.Images, snapshotImage(ref, img))
+	}
+	for ref, started := range s.pulls {
+		snap.Pulls = append(snap.Pulls, PullSnapshot{Ref: ref, StartedAt: started})
+	}
+	// Copy the cache while still holding the image lock so that the
+	// composite view reflects a single moment
+	if s.layerCache != nil {
+		snap.CachedLayers, snap.CacheTotalSize = s.layerCache.snapshot()
+	}
+	s.mu.RUnlock()
+
+	if s.gc != nil {
+		snap.GCStats = s.gc.GetStats()
+	}
+
+	sort.Slice(snap.Images, func(i, j int) bool {
+		return snap.Images[i].Ref < snap.Images[j].Ref
+	})
+	sort.Slice(snap.Pulls, func(i, j int) bool {
+		return snap.Pulls[i].Ref < snap.Pulls[j].Ref
+	})
+	return snap
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImageService_SnapshotConsistency(t *testing.T) {
+	registry := newTestRegistry(t)
+	service := newTestService(t, registry)
+
+	var refs []string
+	for i := 0; i < 5; i++ {
+		repo := fmt.Sprintf("library/app%d", i)
+		registry.addImage(t, repo, "latest", []byte(fmt.Sprintf("layer of app%d", i)))
+		refs = append(refs, registry.host()+"/"+repo+":latest")
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, ref := range refs {
+		wg.Add(1)
+		go func(ref string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := service.PullImage(context.Background(), ref, nil); err != nil {
+					t.Errorf("PullImage(%s) error = %v", ref, err)
+					return
+				}
+				_ = service.RemoveImage(context.Background(), ref)
+			}
+		}(ref)
+	}
+
+	for i := 0; i < 200; i++ {
+		snap := service.Snapshot()
+
+		ready := make(map[string]bool)
+		for _, img := range snap.Images {
+			ready[img.Ref] = img.Ready
+		}
+		for _, pull := range snap.Pulls {
+			if ready[pull.Ref] {
+				t.Errorf("snapshot lists %s both as a ready image and as an in-flight pull", pull.Ref)
+			}
+		}
+
+		var cached int64
+		for _, layer := range snap.CachedLayers {
+			cached += layer.Size
+		}
+		if cached != snap.CacheTotalSize {
+			t.Errorf("snapshot cache total = %d, sum of cached layers = %d", snap.CacheTotalSize, cached)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestImageService_SnapshotIsImmutable(t *testing.T) {
+	service := newTestService(t, nil)
+	service.images["test:latest"] = &imageMetadata{
+		ID:       "sha256:test",
+		RepoTags: []string{"test:latest"},
+		Layers:   []LayerMetadata{{Digest: "sha256:layer"}},
+	}
+
+	snap := service.Snapshot()
+	if len(snap.Images) != 1 {
+		t.Fatalf("Expected 1 image in snapshot, got %d", len(snap.Images))
+	}
+	snap.Images[0].RepoTags[0] = "mutated"
+	snap.Images[0].Layers[0].Digest = "mutated"
+
+	img := service.images["test:latest"]
+	if img.RepoTags[0] != "test:latest" || img.Layers[0].Digest != "sha256:layer" {
+		t.Error("mutating a snapshot changed the service state")
+	}
+}
+
+func TestImageService_GetImageInfoTimestamps(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("timestamped layer"))
+	service := newTestService(t, registry)
+	ctx := context.Background()
+	imageRef := registry.host() + "/library/app:latest"
+
+	before := time.Now()
+	if _, err := service.PullImage(ctx, imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	info, err := service.GetImageInfo(imageRef)
+	if err != nil {
+		t.Fatalf("GetImageInfo() error = %v", err)
+	}
+	if info.PulledAt.Before(before) || info.PulledAt.After(time.Now()) {
+		t.Errorf("PulledAt = %v, want a time during the pull", info.PulledAt)
+	}
+	if !info.LastUsedAt.Equal(info.PulledAt) {
+		t.Errorf("LastUsedAt = %v, want the pull time %v", info.LastUsedAt, info.PulledAt)
+	}
+
+	// A status query records a use once the last one is stale
+	service.mu.Lock()
+	for _, img := range service.images {
+		img.LastUsedAt = info.PulledAt.Add(-lastUsedResolution)
+	}
+	service.mu.Unlock()
+	info.LastUsedAt = info.PulledAt.Add(-lastUsedResolution)
+	if _, err := service.ImageStatus(ctx, imageRef); err != nil {
+		t.Fatalf("ImageStatus() error = %v", err)
+	}
+
+	updated, err := service.GetImageInfo(imageRef)
+	if err != nil {
+		t.Fatalf("GetImageInfo() error = %v", err)
+	}
+	if !updated.LastUsedAt.After(info.LastUsedAt) {
+		t.Errorf("LastUsedAt = %v did not advance past %v on status query", updated.LastUsedAt, info.LastUsedAt)
+	}
+	if !updated.PulledAt.Equal(info.PulledAt) {
+		t.Errorf("PulledAt changed from %v to %v on status query", info.PulledAt, updated.PulledAt)
+	}
+
+	// The timestamps survive a metadata round trip
+	if err := service.saveMetadata(); err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+	if err := service.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	reloaded, err := service.GetImageInfo(imageRef)
+	if err != nil {
+		t.Fatalf("GetImageInfo() after reload error = %v", err)
+	}
+	if !reloaded.PulledAt.Equal(updated.PulledAt) || !reloaded.LastUsedAt.Equal(updated.LastUsedAt) {
+		t.Errorf("reloaded timestamps = %v, %v, want %v, %v",
+			reloaded.PulledAt, reloaded.LastUsedAt, updated.PulledAt, updated.LastUsedAt)
+	}
+
+	if _, err := service.GetImageInfo("missing:latest"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("GetImageInfo() of missing image error = %v, want %v", err, ErrImageNotFound)
+	}
+}
+
+func TestImageService_ImageStatusSavesLastUse(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("used layer"))
+	service := newTestService(t, registry)
+	ctx := context.Background()
+	imageRef := registry.host() + "/library/app:latest"
+
+	if _, err := service.PullImage(ctx, imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	stale := time.Now().Add(-time.Hour)
+	service.mu.Lock()
+	for _, img := range service.images {
+		img.LastUsedAt = stale
+	}
+	err := service.saveMetadata()
+	service.mu.Unlock()
+	if err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+
+	if _, err := service.ImageStatus(ctx, imageRef); err != nil {
+		t.Fatalf("ImageStatus() error = %v", err)
+	}
+	used, err := os.ReadFile(service.metadataFile)
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+
+	// Queries within lastUsedResolution leave the saved metadata alone
+	for i := 0; i < 3; i++ {
+		if _, err := service.ImageStatus(ctx, imageRef); err != nil {
+			t.Fatalf("ImageStatus() error = %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(service.metadataFile); !bytes.Equal(data, used) {
+		t.Error("metadata rewritten by a status query within the resolution")
+	}
+
+	// The recorded use survives a restart
+	if err := service.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	info, err := service.GetImageInfo(imageRef)
+	if err != nil {
+		t.Fatalf("GetImageInfo() error = %v", err)
+	}
+	if !info.LastUsedAt.After(stale) {
+		t.Errorf("saved LastUsedAt = %v, want the status query time", info.LastUsedAt)
+	}
+}
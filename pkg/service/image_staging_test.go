@@ -0,0 +1,90 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageService_PullWithStagingDir(t *testing.T) {
+	layers := [][]byte{
+		[]byte("first layer staged outside the image root"),
+		[]byte("second layer staged outside the image root"),
+	}
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/staged", "latest", "application/vnd.oci.image.layer.v1.tar", layers...)
+
+	service := newTestService(t, registry)
+	service.config.StagingDir = t.TempDir()
+	imageRef := registry.host() + "/library/staged:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	stored, err := service.ImageLayers(imageRef)
+	if err != nil {
+		t.Fatalf("ImageLayers() error = %v", err)
+	}
+	for i, layer := range stored {
+		data, err := os.ReadFile(layer.Path)
+		if err != nil {
+			t.Fatalf("Failed to read layer %d: %v", i, err)
+		}
+		if string(data) != string(layers[i]) {
+			t.Errorf("layer %d = %q, want %q", i, data, layers[i])
+		}
+	}
+
+	// Nothing is left behind in the staging directory
+	entries, err := os.ReadDir(service.config.StagingDir)
+	if err != nil {
+		t.Fatalf("Failed to read staging directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("staging directory has %d entries, want none", len(entries))
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "layer.tmp")
+	dst := filepath.Join(t.TempDir(), "layer")
+	content := []byte("layer copied across filesystems")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		t.Fatalf("copyFile() error = %v", err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("Failed to read destination: %v", err)
+	}
+	if string(data) != string(content) {
+		t.Errorf("destination = %q, want %q", data, content)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still exists: %v", err)
+	}
+	matches, _ := filepath.Glob(dst + ".*.tmp")
+	if len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/reference"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// maxTagPages bounds the pages followed when listing tags, guarding against
+// registries whose next links loop
+const maxTagPages = 1000
+
+// ListTags returns every tag of repository, such as
+// "registry.example.com/library/app", following the pagination of the
+// registry tag list
+func (s *ImageService) ListTags(ctx context.Context, repository string, auth *runtime.AuthConfig) ([]string, error) {
+	named, err := s.parseReference(repository)
+	if err != nil {
+		return nil, err
+	}
+	if !reference.IsNameOnly(named) {
+		return nil, fmt.Errorf("%w: %q is not a repository", ErrInvalidReference, repository)
+	}
+
+	// Credentials are resolved as for pulls
+	auth, err = s.getRegistryClient(ctx, named, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("/v2/%s/tags/list", reference.Path(named))
+	for _, endpoint := range s.registryEndpoints(reference.Domain(named)) {
+		var tags []string
+		tags, err = s.listTagsAt(ctx, s.endpointURL(endpoint, path), auth)
+		if err == nil {
+			return tags, nil
+		}
+	}
+	return nil, err
+}
+
+// listTagsAt aggregates the pages of the tag list starting at url
+func (s *ImageService) listTagsAt(ctx context.Context, url string, auth *runtime.AuthConfig) ([]string, error) {
+	tags := []string{}
+	for page := 0; url != ""; page++ {
+		if page == maxTagPages {
+			return nil, fmt.Errorf("tag list exceeds %d pages", maxTagPages)
+		}
+
+		var pageTags []string
+		var err error
+		pageTags, url, err = s.getTagsPage(ctx, url, auth)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, pageTags...)
+	}
+	return tags, nil
+}
+
+// getTagsPage fetches a single page of a tag list
+func (s *ImageService) getTagsPage(ctx context.Context, url string, auth *runtime.AuthConfig) ([]string, string, error) {
+	ctx, cancel := s.withRequestTimeout(ctx)
+	defer cancel()
+
+	if err := s.waitForRegistry(ctx, url); err != nil {
+		return nil, "", fmt.Errorf("failed to list tags: %v", err)
+	}
+	tags, next, err := s.registryClient().GetTags(ctx, url, auth)
+	if err != nil {
+		return nil, "", registryRequestError("failed to list tags", err, auth)
+	}
+	return tags, next, nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImageService_ListTags(t *testing.T) {
+	const token = "tag-list-token"
+
+	// The tag list is served in two pages behind a bearer token
+	var pages int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.URL.Query().Get("scope") != "repository:library/app:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"token": %q}`, token)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/v2/library/app/tags/list" && r.URL.Query().Get("last") == "":
+			pages++
+			w.Header().Set("Link", `</v2/library/app/tags/list?n=2&last=v2>; rel="next"`)
+			fmt.Fprint(w, `{"name": "library/app", "tags": ["v1", "v2"]}`)
+		case r.URL.Path == "/v2/library/app/tags/list" && r.URL.Query().Get("last") == "v2":
+			pages++
+			fmt.Fprint(w, `{"name": "library/app", "tags": ["latest"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	tags, err := service.ListTags(context.Background(), host+"/library/app", nil)
+	if err != nil {
+		t.Fatalf("ListTags() error = %v", err)
+	}
+	if want := []string{"v1", "v2", "latest"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("ListTags() = %v, want %v", tags, want)
+	}
+	if pages != 2 {
+		t.Errorf("fetched %d pages, want 2", pages)
+	}
+
+	if _, err := service.ListTags(context.Background(), host+"/library/app:v1", nil); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("ListTags() of tagged reference error = %v, want %v", err, ErrInvalidReference)
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	base, _ := url.Parse("https://registry.example.com/v2/app/tags/list?n=2")
+
+	tests := []struct {
+		name  string
+		links []string
+		want  string
+	}{
+		{
+			name: "no link",
+			want: "",
+		},
+		{
+			name:  "relative next",
+			links: []string{`</v2/app/tags/list?n=2&last=b>; rel="next"`},
+			want:  "https://registry.example.com/v2/app/tags/list?n=2&last=b",
+		},
+		{
+			name:  "absolute next",
+			links: []string{`<https://other.example.com/v2/app/tags/list?last=b>; rel=next`},
+			want:  "https://other.example.com/v2/app/tags/list?last=b",
+		},
+		{
+			name:  "next among other relations",
+			links: []string{`</first>; rel="first", </second>; type="json"; rel="next"`},
+			want:  "https://registry.example.com/second",
+		},
+		{
+			name:  "no next relation",
+			links: []string{`</prev>; rel="prev"`},
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextLink(base, tt.links)
+			if err != nil {
+				t.Fatalf("nextLink() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("nextLink() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// whiteoutPrefix marks a file deleted by an upper layer
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose lower contents are hidden
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// UnpackImage applies the layers of the image identified by imageID (or by
+// reference) in order into destDir, producing its root filesystem
+func (s *ImageService) UnpackImage(imageID, destDir string) error {
+	s.mu.RLock()
+	var layers []LayerMetadata
+	found := false
+	for ref, img := range s.images {
+		if img.ID == imageID || ref == imageID {
+			layers = append([]LayerMetadata(nil), img.Layers...)
+			found = true
+			break
+		}
+	}
+	s.mu.RUnlock()
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrImageNotFound, imageID)
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create rootfs directory: %v", err)
+	}
+	root, err := filepath.Abs(destDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve rootfs directory: %v", err)
+	}
+
+	// Under LazyExtract the layers are extracted once and later unpacks
+	// copy the cached result
+	if s.config.LazyExtract && !s.config.ReadOnly {
+		if chain := chainID(layers); chain != "" {
+			cached, err := s.extractedRootfs(chain, layers)
+			if err != nil {
+				return err
+			}
+			if err := copyTree(cached, root, s.log()); err != nil {
+				return fmt.Errorf("failed to copy cached rootfs: %v", err)
+			}
+			return nil
+		}
+	}
+
+	for i, layer := range layers {
+		if err := applyLayerFile(layer.Path, root, s.log()); err != nil {
+			return fmt.Errorf("failed to apply layer %d (%s): %v", i, layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// openLayer opens a stored layer blob and transparently decompresses it
+// based on its magic bytes
+func openLayer(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer: %v", err)
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzReader, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open gzip stream: %v", err)
+		}
+		return &layerReader{Reader: gzReader, closers: []io.Closer{gzReader, f}}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open zstd stream: %v", err)
+		}
+		return &layerReader{Reader: zstdReader, closers: []io.Closer{zstdReader.IOReadCloser(), f}}, nil
+	default:
+		return &layerReader{Reader: br, closers: []io.Closer{f}}, nil
+	}
+}
+
+// layerReader closes the decompressor and the underlying file together
+type layerReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *layerReader) Close() error {
+	var firstErr error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// applyLayerFile applies the layer stored at path on top of root
+func applyLayerFile(path, root string, logger *slog.Logger) error {
+	reader, err := openLayer(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return applyLayer(reader, root, logger)
+}
+
+// applyLayer extracts a layer tar stream on top of root, honoring
+// whiteout files. Skipped entries are reported to logger.
+func applyLayer(r io.Reader, root string, logger *slog.Logger) error {
+	tr := tar.NewReader(r)
+	// Entries created by this layer must survive opaque whiteouts
+	created := make(map[string]bool)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %v", err)
+		}
+
+		target, err := sanitizeTarEntry(root, hdr)
+		if err != nil {
+			return err
+		}
+
+		dir, base := filepath.Split(target)
+		if base == whiteoutOpaque {
+			if err := removeLowerEntries(dir, created); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			victim, err := whiteoutVictim(root, dir, base)
+			if err != nil {
+				return fmt.Errorf("tar entry %q: %v", hdr.Name, err)
+			}
+			if err := os.RemoveAll(victim); err != nil {
+				return fmt.Errorf("failed to apply whiteout %s: %v", hdr.Name, err)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create parent of %s: %v", hdr.Name, err)
+		}
+		if err := extractEntry(tr, hdr, root, target, logger); err != nil {
+			return err
+		}
+		created[target] = true
+	}
+}
+
+// whiteoutVictim returns the path the whiteout named base in dir deletes.
+// Names that do not name an entry of dir, such as ".wh.." and ".wh...",
+// which would delete dir itself or its parent, are rejected.
+func whiteoutVictim(root, dir, base string) (string, error) {
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid whiteout %q", base)
+	}
+	victim := filepath.Join(dir, name)
+	if victim == root || !withinRoot(root, victim) {
+		return "", fmt.Errorf("whiteout %q escapes the destination directory", base)
+	}
+	return victim, nil
+}
+
+// sanitizeTarEntry validates a tar header against root and returns the path
+// it should be extracted to. Absolute names, names escaping root through
+// ".." components or through symlinks extracted earlier, and link targets
+// pointing outside root are rejected.
+func sanitizeTarEntry(root string, hdr *tar.Header) (string, error) {
+	target, err := resolveInRoot(root, hdr.Name)
+	if err != nil {
+		return "", err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		if filepath.IsAbs(hdr.Linkname) {
+			return "", fmt.Errorf("symlink %q has absolute target %q", hdr.Name, hdr.Linkname)
+		}
+		// The target is resolved on disk, as it would be when followed
+		dir, err := filepath.Rel(root, filepath.Dir(target))
+		if err != nil {
+			return "", err
+		}
+		if _, err := followInRoot(root, dir+string(filepath.Separator)+hdr.Linkname); err != nil {
+			return "", fmt.Errorf("symlink %q target %q escapes the destination directory", hdr.Name, hdr.Linkname)
+		}
+	case tar.TypeLink:
+		if _, err := resolveInRoot(root, hdr.Linkname); err != nil {
+			return "", fmt.Errorf("hardlink %q: %v", hdr.Name, err)
+		}
+	}
+	return target, nil
+}
+
+// maxSymlinkHops bounds the symlinks followed while resolving a single path
+const maxSymlinkHops = 255
+
+// resolveInRoot joins a relative tar name onto root, rejecting absolute
+// names and names that escape root. The parent directories of the name are
+// resolved on disk, following the symlinks earlier entries created, so the
+// returned path has no symlinks but possibly its last component.
+func resolveInRoot(root, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("tar entry %q has an absolute path", name)
+	}
+	if !withinRoot(root, filepath.Join(root, name)) {
+		return "", fmt.Errorf("tar entry %q escapes the destination directory", name)
+	}
+
+	dir, base := filepath.Split(filepath.Clean(name))
+	parent, err := followInRoot(root, dir)
+	if err != nil {
+		return "", fmt.Errorf("tar entry %q: %v", name, err)
+	}
+	return filepath.Join(parent, base), nil
+}
+
+// followInRoot resolves the relative path rel below root one component at a
+// time, following symlinks found on disk, and fails as soon as a ".."
+// component or a symlink would leave root. Components that do not exist
+// yet are taken as they are.
+func followInRoot(root, rel string) (string, error) {
+	current := root
+	pending := strings.Split(rel, string(filepath.Separator))
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if current == root {
+				return "", fmt.Errorf("path %q escapes the destination directory", rel)
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		fi, err := os.Lstat(next)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to resolve %s: %v", next, err)
+		}
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many symlinks resolving %q", rel)
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", fmt.Errorf("failed to read symlink %s: %v", next, err)
+		}
+		if filepath.IsAbs(link) {
+			return "", fmt.Errorf("path %q crosses absolute symlink %s", rel, next)
+		}
+		// The link target is resolved relative to the directory holding it
+		pending = append(strings.Split(link, string(filepath.Separator)), pending...)
+	}
+	return current, nil
+}
+
+// withinRoot reports whether the cleaned path is root or below it
+func withinRoot(root, path string) bool {
+	path = filepath.Clean(path)
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// removeLowerEntries removes the children of dir that were not created by
+// the layer currently being applied
+func removeLowerEntries(dir string, created map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read opaque directory %s: %v", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if created[path] {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to apply opaque whiteout in %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// extractEntry materializes a single tar entry at target
+func extractEntry(tr *tar.Reader, hdr *tar.Header, root, target string, logger *slog.Logger) error {
+	mode := hdr.FileInfo().Mode()
+
+	// Replace whatever a lower layer left at this path, except directories
+	// which are merged
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to replace %s: %v", hdr.Name, err)
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", hdr.Name, err)
+			}
+		}
+		if err := os.MkdirAll(target, mode.Perm()); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", hdr.Name, err)
+		}
+		if err := os.Chmod(target, mode.Perm()); err != nil {
+			return fmt.Errorf("failed to chmod %s: %v", hdr.Name, err)
+		}
+
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %v", hdr.Name, err)
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write file %s: %v", hdr.Name, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to close file %s: %v", hdr.Name, err)
+		}
+		if err := os.Chmod(target, mode.Perm()); err != nil {
+			return fmt.Errorf("failed to chmod %s: %v", hdr.Name, err)
+		}
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %v", hdr.Name, err)
+		}
+
+	case tar.TypeLink:
+		source, err := resolveInRoot(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			return fmt.Errorf("failed to create hardlink %s: %v", hdr.Name, err)
+		}
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := mknod(target, hdr); err != nil {
+			if os.IsPermission(err) {
+				// Device nodes need privileges, skip them when unprivileged
+				logger.Warn("skipping device node", "path", hdr.Name, "error", err)
+				return nil
+			}
+			return fmt.Errorf("failed to create device node %s: %v", hdr.Name, err)
+		}
+
+	default:
+		logger.Warn("skipping unsupported tar entry", "path", hdr.Name, "type", string(hdr.Typeflag))
+		return nil
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chtimes(target, hdr.AccessTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("failed to set times on %s: %v", hdr.Name, err)
+		}
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %v", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// mknod creates a device node or fifo described by hdr
+func mknod(target string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	dev := int((hdr.Devmajor&0xfff)<<8 | (hdr.Devminor & 0xff) | (hdr.Devminor&0xfff00)<<12)
+	if err := syscall.Mknod(target, mode, dev); err != nil {
+		return &os.PathError{Op: "mknod", Path: target, Err: err}
+	}
+	return nil
+}
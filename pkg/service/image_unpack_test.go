@@ -0,0 +1,255 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageService_UnpackImage(t *testing.T) {
+	lower := buildTar(t, map[string]string{
+		"etc/config":     "lower config",
+		"etc/obsolete":   "to be deleted",
+		"var/cache/a":    "cached a",
+		"var/cache/b":    "cached b",
+		"usr/bin/shared": "lower binary",
+	})
+	upper := buildTar(t, map[string]string{
+		"etc/.wh.obsolete":       "",
+		"var/cache/.wh..wh..opq": "",
+		"var/cache/c":            "cached c",
+		"usr/bin/shared":         "upper binary",
+	})
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", gzipBytes(t, lower), gzipBytes(t, upper))
+	service := newTestService(t, registry)
+
+	imageID, err := service.PullImage(context.Background(), registry.host()+"/library/app:latest", nil)
+	if err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	rootfs := filepath.Join(t.TempDir(), "rootfs")
+	if err := service.UnpackImage(imageID, rootfs); err != nil {
+		t.Fatalf("UnpackImage() error = %v", err)
+	}
+
+	wantFiles := map[string]string{
+		"etc/config":     "lower config",
+		"var/cache/c":    "cached c",
+		"usr/bin/shared": "upper binary",
+	}
+	for name, want := range wantFiles {
+		got, err := os.ReadFile(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, name := range []string{"etc/obsolete", "etc/.wh.obsolete", "var/cache/a", "var/cache/b", "var/cache/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist in the rootfs", name)
+		}
+	}
+}
+
+func TestApplyLayer_Links(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755, Size: 4},
+		{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox"},
+		{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("bbox"))
+		}
+	}
+	tw.Close()
+
+	root := t.TempDir()
+	if err := applyLayer(&buf, root, slog.Default()); err != nil {
+		t.Fatalf("applyLayer() error = %v", err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(root, "bin/sh")); err != nil || target != "busybox" {
+		t.Errorf("bin/sh -> %q (err %v), want busybox", target, err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "bin/ls"))
+	if err != nil || string(got) != "bbox" {
+		t.Errorf("bin/ls = %q (err %v), want hardlinked content", got, err)
+	}
+}
+
+func TestApplyLayer_RejectsTraversal(t *testing.T) {
+	// Symlinks created by earlier entries of the same layer resolve x/y to
+	// y and y to the parent of the destination
+	chain := []*tar.Header{
+		{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "x/y", Typeflag: tar.TypeSymlink, Linkname: ".."},
+	}
+
+	tests := []struct {
+		name string
+		hdrs []*tar.Header
+	}{
+		{"absolute path", []*tar.Header{{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{"parent components", []*tar.Header{{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{"nested parent components", []*tar.Header{{Name: "usr/../../escape", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{"absolute symlink", []*tar.Header{{Name: "etc/shadow", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"}}},
+		{"escaping symlink", []*tar.Header{{Name: "usr/lib", Typeflag: tar.TypeSymlink, Linkname: "../../../lib"}}},
+		{"escaping hardlink", []*tar.Header{{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}}},
+		{"absolute whiteout", []*tar.Header{{Name: "/etc/.wh.passwd", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{"empty whiteout", []*tar.Header{{Name: ".wh.", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{"whiteout of the destination", []*tar.Header{{Name: ".wh..", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{"whiteout of the parent", []*tar.Header{{Name: ".wh...", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{"nested whiteout of the parent", []*tar.Header{
+			{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/.wh...", Typeflag: tar.TypeReg, Mode: 0644},
+		}},
+		{"chained symlinks", append(chain, &tar.Header{Name: "y/escaped", Typeflag: tar.TypeReg, Mode: 0644})},
+		{"symlink through symlink", []*tar.Header{
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "y", Typeflag: tar.TypeSymlink, Linkname: "x/.."},
+		}},
+		{"whiteout through symlinks", append(chain, &tar.Header{Name: "y/.wh.outside", Typeflag: tar.TypeReg, Mode: 0644})},
+		{"hardlink through symlinks", append(chain, &tar.Header{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "y/outside"})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range tt.hdrs {
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatalf("Failed to write header: %v", err)
+				}
+			}
+			tw.Close()
+
+			parent := t.TempDir()
+			root := filepath.Join(parent, "rootfs")
+			if err := os.MkdirAll(root, 0755); err != nil {
+				t.Fatalf("Failed to create root: %v", err)
+			}
+			outside := filepath.Join(parent, "outside")
+			if err := os.WriteFile(outside, []byte("outside"), 0644); err != nil {
+				t.Fatalf("Failed to create outside file: %v", err)
+			}
+
+			if err := applyLayer(&buf, root, slog.Default()); err == nil {
+				t.Errorf("applyLayer() accepted malicious entry %q", tt.hdrs[len(tt.hdrs)-1].Name)
+			}
+
+			entries, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatalf("Failed to read parent: %v", err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("applyLayer() wrote outside the destination: %v", entries)
+			}
+			if _, err := os.Stat(outside); err != nil {
+				t.Errorf("applyLayer() removed a file outside the destination: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyLayer_DoesNotFollowEscapingSymlinks(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  *tar.Header
+	}{
+		{"regular file", &tar.Header{Name: "link/escaped", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"directory", &tar.Header{Name: "link/escaped/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{"whiteout", &tar.Header{Name: "link/.wh.outside", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"opaque whiteout", &tar.Header{Name: "link/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"hardlink source", &tar.Header{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "link/outside"}},
+		{"fifo", &tar.Header{Name: "link/fifo", Typeflag: tar.TypeFifo, Mode: 0644}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "rootfs")
+			if err := os.MkdirAll(root, 0755); err != nil {
+				t.Fatalf("Failed to create root: %v", err)
+			}
+			outside := filepath.Join(parent, "outside")
+			if err := os.WriteFile(outside, []byte("outside"), 0644); err != nil {
+				t.Fatalf("Failed to create outside file: %v", err)
+			}
+			// A symlink already on disk, as left by a lower layer
+			if err := os.Symlink("..", filepath.Join(root, "link")); err != nil {
+				t.Fatalf("Failed to create symlink: %v", err)
+			}
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := tw.WriteHeader(tt.hdr); err != nil {
+				t.Fatalf("Failed to write header: %v", err)
+			}
+			tw.Close()
+
+			if err := applyLayer(&buf, root, slog.Default()); err == nil {
+				t.Errorf("applyLayer() followed an escaping symlink for %q", tt.hdr.Name)
+			}
+
+			entries, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatalf("Failed to read parent: %v", err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("applyLayer() wrote outside the destination: %v", entries)
+			}
+			if _, err := os.Stat(outside); err != nil {
+				t.Errorf("applyLayer() removed a file outside the destination: %v", err)
+			}
+		})
+	}
+}
+
+func TestSanitizeTarEntry_AllowsRelativeLinks(t *testing.T) {
+	root := t.TempDir()
+	hdrs := []*tar.Header{
+		{Name: "./etc/hosts", Typeflag: tar.TypeReg},
+		{Name: "usr/lib64", Typeflag: tar.TypeSymlink, Linkname: "lib"},
+		{Name: "usr/bin/python", Typeflag: tar.TypeSymlink, Linkname: "../../opt/python/bin/python3"},
+		{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+	}
+	for _, hdr := range hdrs {
+		if _, err := sanitizeTarEntry(root, hdr); err != nil {
+			t.Errorf("sanitizeTarEntry(%q) error = %v", hdr.Name, err)
+		}
+	}
+}
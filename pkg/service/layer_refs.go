@@ -0,0 +1,213 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+)
+
+// layerRefKey returns the key a layer digest is counted under, so that
+// differently formatted spellings of one digest share a count
+func layerRefKey(layerDigest string) string {
+	if dgst, err := normalizeDigest(layerDigest); err == nil {
+		return dgst.String()
+	}
+	return layerDigest
+}
+
+// ensureLayerRefs builds the layer reference counts from the image store
+// if they have not been loaded. Caller must hold the lock.
+func (s *ImageService) ensureLayerRefs() {
+	if s.layerRefs != nil {
+		return
+	}
+	s.layerRefs = countLayerRefs(s.images)
+}
+
+// countLayerRefs counts the images referencing each layer digest
+func countLayerRefs(images map[string]*imageMetadata) map[string]int {
+	refs := make(map[string]int)
+	for _, img := range images {
+		for _, layer := range img.Layers {
+			refs[layerRefKey(layer.Digest)]++
+		}
+	}
+	return refs
+}
+
+// layerRefCount returns how many images reference a layer. Caller must hold
+// the lock.
+func (s *ImageService) layerRefCount(layerDigest string) int {
+	s.ensureLayerRefs()
+	return s.layerRefs[layerRefKey(layerDigest)]
+}
+
+// claimLayers marks the layers a pull or import is about to store or reuse
+// as in use, so that garbage collection, purges, evictions and removals keep
+// their blobs until an image referencing them is recorded. The returned func drops
+// the claims and may be called more than once.
+func (s *ImageService) claimLayers(layerDigests []string) func() {
+	s.mu.Lock()
+	if s.layerClaims == nil {
+		s.layerClaims = make(map[string]int)
+	}
+	for _, layerDigest := range layerDigests {
+		s.layerClaims[layerRefKey(layerDigest)]++
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, layerDigest := range layerDigests {
+				key := layerRefKey(layerDigest)
+				s.layerClaims[key]--
+				if s.layerClaims[key] <= 0 {
+					delete(s.layerClaims, key)
+				}
+			}
+		})
+	}
+}
+
+// layerInUse reports whether an image references a layer or an in-flight
+// pull has claimed it. Caller must hold the lock.
+func (s *ImageService) layerInUse(layerDigest string) bool {
+	return s.layerRefCount(layerDigest) > 0 || s.layerClaims[layerRefKey(layerDigest)] > 0
+}
+
+// setImage records img under imageRef, moving layer references from the
+// image it replaces. Caller must hold the lock.
+func (s *ImageService) setImage(imageRef string, img *imageMetadata) {
+	s.ensureLayerRefs()
+	if old, ok := s.images[imageRef]; ok {
+		s.releaseLayers(old.Layers)
+	}
+	for _, layer := range img.Layers {
+		s.layerRefs[layerRefKey(layer.Digest)]++
+	}
+	s.images[imageRef] = img
+}
+
+// deleteImage forgets imageRef and returns its layers that no image
+// references anymore. Caller must hold the lock.
+func (s *ImageService) deleteImage(imageRef string) []LayerMetadata {
+	s.ensureLayerRefs()
+	img, ok := s.images[imageRef]
+	if !ok {
+		return nil
+	}
+	delete(s.images, imageRef)
+	return s.releaseLayers(img.Layers)
+}
+
+// releaseLayers drops one reference to each layer and returns those left
+// unreferenced. Caller must hold the lock.
+func (s *ImageService) releaseLayers(layers []LayerMetadata) []LayerMetadata {
+	return releaseLayerRefs(s.layerRefs, layers)
+}
+
+// unreferencedLayers returns the layers releaseLayers would leave
+// unreferenced, without changing any reference count. Caller must hold the
+// lock.
+func (s *ImageService) unreferencedLayers(layers []LayerMetadata) []LayerMetadata {
+	s.ensureLayerRefs()
+	refs := make(map[string]int)
+	for _, layer := range layers {
+		key := layerRefKey(layer.Digest)
+		if count, ok := s.layerRefs[key]; ok {
+			refs[key] = count
+		}
+	}
+	return releaseLayerRefs(refs, layers)
+}
+
+// releaseLayerRefs drops one reference in refs to each layer and returns
+// those left unreferenced
+func releaseLayerRefs(refs map[string]int, layers []LayerMetadata) []LayerMetadata {
+	var unreferenced []LayerMetadata
+	for _, layer := range layers {
+		key := layerRefKey(layer.Digest)
+		if refs[key] <= 1 {
+			if _, ok := refs[key]; ok {
+				unreferenced = append(unreferenced, layer)
+			}
+			delete(refs, key)
+			continue
+		}
+		refs[key]--
+	}
+	return unreferenced
+}
+
+// saveLayerRefs persists the layer reference counts next to the metadata
+func (s *ImageService) saveLayerRefs() error {
+	if s.layerRefsFile == "" || s.layerRefs == nil {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.layerRefs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal layer references: %v", err)
+	}
+
+	if err := s.writeFileAtomic(s.layerRefsFile, data); err != nil {
+		return fmt.Errorf("failed to save layer references: %v", err)
+	}
+	return nil
+}
+
+// loadLayerRefs restores persisted layer reference counts. The metadata and
+// the counts are written one after the other, so saved counts that do not
+// match the loaded images, such as those left by a crash between the two
+// writes, are discarded and the counts rebuilt from the images instead.
+// Without a saved file the counts are rebuilt on first use.
+func (s *ImageService) loadLayerRefs() error {
+	if s.layerRefsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.layerRefsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read layer references: %v", err)
+	}
+
+	var refs map[string]int
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return fmt.Errorf("failed to unmarshal layer references: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counted := countLayerRefs(s.images)
+	if !maps.Equal(refs, counted) {
+		s.log().Warn("saved layer references do not match the images, rebuilding them",
+			"path", s.layerRefsFile)
+		refs = counted
+	}
+	s.layerRefs = refs
+	return nil
+}
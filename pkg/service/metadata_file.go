@@ -0,0 +1,72 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at path with data. The data is written
+// to a temporary file and synced to disk before it is renamed over path,
+// so a failed or interrupted write, such as on a full disk, leaves the
+// previous file intact.
+func (s *ImageService) writeFileAtomic(path string, data []byte) error {
+	tempFile := path + ".tmp"
+	f, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = f
+	if s.wrapMetadataWriter != nil {
+		w = s.wrapMetadataWriter(f)
+	}
+	n, err := w.Write(data)
+	if err == nil && n != len(data) {
+		err = fmt.Errorf("short write: wrote %d of %d bytes", n, len(data))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	// Persist the rename itself
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of the directory at path to disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// shortWriter writes only half of each buffer, as a write to a full disk
+// may, optionally failing like one
+type shortWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, sw.err
+}
+
+func TestImageService_SaveMetadataShortWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "short write"},
+		{name: "disk full", err: errors.New("no space left on device")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, nil)
+			service.layerRefsFile = filepath.Join(service.imageRoot, "layer_refs.json")
+			if err := service.AddImage("kept:latest", &imageMetadata{ID: "sha256:kept", State: imageStateReady}); err != nil {
+				t.Fatalf("AddImage() error = %v", err)
+			}
+			original, err := os.ReadFile(service.metadataFile)
+			if err != nil {
+				t.Fatalf("Failed to read metadata: %v", err)
+			}
+
+			service.wrapMetadataWriter = func(w io.Writer) io.Writer { return &shortWriter{w: w, err: tt.err} }
+			if err := service.AddImage("lost:latest", &imageMetadata{ID: "sha256:lost", State: imageStateReady}); err == nil {
+				t.Fatal("AddImage() succeeded despite a failed write")
+			}
+
+			// The previous metadata is left in place, without temporary files
+			data, err := os.ReadFile(service.metadataFile)
+			if err != nil {
+				t.Fatalf("Failed to read metadata: %v", err)
+			}
+			if string(data) != string(original) {
+				t.Errorf("metadata = %s, want the original %s", data, original)
+			}
+			var images map[string]*imageMetadata
+			if err := json.Unmarshal(data, &images); err != nil {
+				t.Errorf("metadata does not parse: %v", err)
+			}
+			if _, err := os.Stat(service.metadataFile + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temporary metadata file left behind: %v", err)
+			}
+
+			// Writes succeed again once the disk recovers
+			service.wrapMetadataWriter = nil
+			if err := service.AddImage("lost:latest", &imageMetadata{ID: "sha256:lost", State: imageStateReady}); err != nil {
+				t.Errorf("AddImage() error after recovery = %v", err)
+			}
+		})
+	}
+}
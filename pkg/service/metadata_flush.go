@@ -0,0 +1,61 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import "time"
+
+// SyncMetadata writes metadata changes not yet flushed to disk. It only has
+// work to do when MetadataFlushInterval batches writes.
+func (s *ImageService) SyncMetadata() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.metadataDirty {
+		return nil
+	}
+	if err := s.writeMetadata(); err != nil {
+		return err
+	}
+	s.metadataDirty = false
+	return nil
+}
+
+// startMetadataFlusher writes changed metadata every interval. The returned
+// function stops the flusher.
+func (s *ImageService) startMetadataFlusher(interval time.Duration) func() {
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if err := s.SyncMetadata(); err != nil {
+					s.log().Error("failed to flush metadata", "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-done
+	}
+}
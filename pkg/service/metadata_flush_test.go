@@ -0,0 +1,108 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlushingService creates a service batching metadata writes every
+// interval, counting the metadata files it writes in writes
+func newFlushingService(t *testing.T, root string, interval time.Duration, writes *atomic.Int32) *ImageService {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.ImageRoot = root
+	config.MetadataFlushInterval = interval
+	service := NewImageServiceWithConfig(config)
+	service.mu.Lock()
+	service.wrapMetadataWriter = func(w io.Writer) io.Writer {
+		writes.Add(1)
+		return w
+	}
+	service.mu.Unlock()
+	return service
+}
+
+func TestImageService_MetadataFlushBatchesWrites(t *testing.T) {
+	const mutations = 50
+	root := t.TempDir()
+	var writes atomic.Int32
+	service := newFlushingService(t, root, time.Hour, &writes)
+
+	for i := 0; i < mutations; i++ {
+		ref := fmt.Sprintf("docker.io/library/app:%d", i)
+		if err := service.AddImage(ref, &imageMetadata{ID: fmt.Sprintf("sha256:%064d", i), RepoTags: []string{ref}}); err != nil {
+			t.Fatalf("AddImage() error = %v", err)
+		}
+	}
+	if got := writes.Load(); got != 0 {
+		t.Errorf("metadata written %d times before a flush, want 0", got)
+	}
+
+	// A sync writes the metadata and the layer references once
+	if err := service.SyncMetadata(); err != nil {
+		t.Fatalf("SyncMetadata() error = %v", err)
+	}
+	if got := writes.Load(); got == 0 || got >= mutations {
+		t.Errorf("metadata written %d times for %d changes, want far fewer", got, mutations)
+	}
+	synced := writes.Load()
+	if err := service.SyncMetadata(); err != nil {
+		t.Fatalf("SyncMetadata() error = %v", err)
+	}
+	if got := writes.Load(); got != synced {
+		t.Error("SyncMetadata() wrote unchanged metadata")
+	}
+
+	// Close flushes the changes made since
+	if err := service.AddImage("docker.io/library/app:last", &imageMetadata{ID: "sha256:last"}); err != nil {
+		t.Fatalf("AddImage() error = %v", err)
+	}
+	if err := service.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	reloaded := newTestService(t, nil)
+	reloaded.metadataFile = service.metadataFile
+	if err := reloaded.loadMetadata(); err != nil {
+		t.Fatalf("loadMetadata() error = %v", err)
+	}
+	if got := len(reloaded.images); got != mutations+1 {
+		t.Errorf("reloaded %d images, want %d", got, mutations+1)
+	}
+}
+
+func TestImageService_MetadataFlushInBackground(t *testing.T) {
+	var writes atomic.Int32
+	service := newFlushingService(t, t.TempDir(), 10*time.Millisecond, &writes)
+	defer service.Close()
+
+	if err := service.AddImage("docker.io/library/app:latest", &imageMetadata{ID: "sha256:app"}); err != nil {
+		t.Fatalf("AddImage() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for writes.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("metadata was not flushed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import "time"
+
+// knownMissing reports whether the registry reported the image named by key
+// as missing within the last NegativeCacheTTL
+func (s *ImageService) knownMissing(key string) bool {
+	if s.config.NegativeCacheTTL <= 0 {
+		return false
+	}
+
+	s.missingMu.Lock()
+	defer s.missingMu.Unlock()
+
+	expiry, ok := s.missing[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(s.missing, key)
+		return false
+	}
+	return true
+}
+
+// recordMissing remembers that the registry reported the image named by key
+// as missing
+func (s *ImageService) recordMissing(key string) {
+	if s.config.NegativeCacheTTL <= 0 {
+		return
+	}
+
+	s.missingMu.Lock()
+	defer s.missingMu.Unlock()
+
+	now := time.Now()
+	if s.missing == nil {
+		s.missing = make(map[string]time.Time)
+	}
+	// Drop expired entries so that the cache does not grow without bound
+	for k, expiry := range s.missing {
+		if now.After(expiry) {
+			delete(s.missing, k)
+		}
+	}
+	s.missing[key] = now.Add(s.config.NegativeCacheTTL)
+}
+
+// forgetMissing drops the negative cache entry of key once the image it
+// names has been pulled
+func (s *ImageService) forgetMissing(key string) {
+	s.missingMu.Lock()
+	defer s.missingMu.Unlock()
+	delete(s.missing, key)
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestImageService_NegativeCache(t *testing.T) {
+	registry := newTestRegistry(t)
+	service := newTestService(t, registry)
+	service.config.NegativeCacheTTL = time.Hour
+
+	imageRef := registry.host() + "/library/app:latest"
+	manifestPath := "/v2/library/app/manifests/latest"
+
+	if _, err := service.PullImage(context.Background(), imageRef, nil); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("PullImage() of missing image error = %v, want %v", err, ErrImageNotFound)
+	}
+	if got := registry.hitCount(manifestPath); got != 1 {
+		t.Fatalf("manifest requested %d times, want 1", got)
+	}
+
+	// The second attempt within the TTL fails without asking the registry,
+	// also when the reference is spelled differently
+	if _, err := service.PullImage(context.Background(), registry.host()+"/library/app", nil); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("cached PullImage() error = %v, want %v", err, ErrImageNotFound)
+	}
+	if got := registry.hitCount(manifestPath); got != 1 {
+		t.Errorf("manifest requested %d times within the TTL, want 1", got)
+	}
+
+	// Once the entry expires the image is pulled and the entry is dropped
+	registry.addImage(t, "library/app", "latest", []byte("layer pushed after the first pull"))
+	service.missingMu.Lock()
+	service.missing[registry.host()+"/library/app:latest"] = time.Now().Add(-time.Second)
+	service.missingMu.Unlock()
+
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() after expiry error = %v", err)
+	}
+	service.missingMu.Lock()
+	defer service.missingMu.Unlock()
+	if len(service.missing) != 0 {
+		t.Errorf("negative cache = %v after a successful pull, want empty", service.missing)
+	}
+}
+
+func TestImageService_NegativeCacheDisabled(t *testing.T) {
+	registry := newTestRegistry(t)
+	service := newTestService(t, registry)
+
+	imageRef := registry.host() + "/library/app:latest"
+	for i := 0; i < 2; i++ {
+		if _, err := service.PullImage(context.Background(), imageRef, nil); err == nil {
+			t.Fatal("PullImage() of missing image succeeded")
+		}
+	}
+	if got := registry.hitCount("/v2/library/app/manifests/latest"); got != 2 {
+		t.Errorf("manifest requested %d times, want 2", got)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+
+	"github.com/distribution/reference"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// pullFlight is the download shared by concurrent pulls of one reference.
+// It runs detached from the callers waiting for it, so that one caller
+// giving up does not fail the others, and is cancelled by Close or once
+// every waiter has given up.
+type pullFlight struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// waiters counts the callers waiting for the flight. Guarded by the
+	// service lock.
+	waiters int
+	// done is closed once imageID and err are set
+	done    chan struct{}
+	imageID string
+	err     error
+}
+
+// joinPull returns the flight pulling the image stored under key, starting
+// one unless it is already in flight, and counts the caller as a waiter.
+// A flight abandoned by all its waiters is left to wind down before a new
+// one starts.
+func (s *ImageService) joinPull(ctx context.Context, named reference.Named, key string, auth *runtime.AuthConfig) (*pullFlight, error) {
+	for {
+		s.mu.Lock()
+		f, ok := s.pullFlights[key]
+		if !ok {
+			f = s.startFlightLocked(ctx, named, key, auth)
+		}
+		if f.ctx.Err() == nil {
+			f.waiters++
+			s.mu.Unlock()
+			return f, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// startFlightLocked starts pulling the image stored under key on a context
+// that keeps the values of ctx but not its cancellation. Caller must hold
+// the lock.
+func (s *ImageService) startFlightLocked(ctx context.Context, named reference.Named, key string, auth *runtime.AuthConfig) *pullFlight {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := func() bool { return true }
+	if s.ctx != nil {
+		stop = context.AfterFunc(s.ctx, cancel)
+	}
+	f := &pullFlight{
+		ctx: ctx,
+		cancel: func() {
+			stop()
+			cancel()
+		},
+		done: make(chan struct{}),
+	}
+	if s.pullFlights == nil {
+		s.pullFlights = make(map[string]*pullFlight)
+	}
+	s.pullFlights[key] = f
+
+	// Close waits for the flight as well as for its waiters
+	s.pullWG.Add(1)
+	go func() {
+		defer s.pullWG.Done()
+		f.imageID, f.err = s.fetchImage(ctx, named, key, auth)
+
+		s.mu.Lock()
+		delete(s.pullFlights, key)
+		s.mu.Unlock()
+		f.cancel()
+		close(f.done)
+	}()
+	return f
+}
+
+// leavePull stops counting the caller as a waiter of f, cancelling f when
+// no waiter is left. It reports whether the caller was the last waiter.
+func (s *ImageService) leavePull(f *pullFlight) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f.waiters--
+	if f.waiters > 0 {
+		return false
+	}
+	f.cancel()
+	return true
+}
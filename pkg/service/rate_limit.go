@@ -0,0 +1,66 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"golang.org/x/time/rate"
+)
+
+// registryLimiter returns the rate limiter of a registry host, or nil when
+// rate limiting is disabled
+func (s *ImageService) registryLimiter(host string) *rate.Limiter {
+	if s.config.RegistryRateLimit <= 0 {
+		return nil
+	}
+
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+
+	if s.limiters == nil {
+		s.limiters = make(map[string]*rate.Limiter)
+	}
+	limiter, ok := s.limiters[host]
+	if !ok {
+		burst := s.config.RegistryRateBurst
+		if burst < 1 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(s.config.RegistryRateLimit), burst)
+		s.limiters[host] = limiter
+	}
+	return limiter
+}
+
+// waitForRegistry blocks a manifest or blob request for rawURL until the
+// rate limiter of its registry host allows it, waiting rather than failing
+// when the limit is reached
+func (s *ImageService) waitForRegistry(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid registry URL %q: %v", rawURL, err)
+	}
+	if limiter := s.registryLimiter(u.Host); limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return fmt.Errorf("rate limit wait for %s: %v", u.Host, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImageService_RegistryRateLimit(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImageWithMediaType(t, "library/app", "latest", "application/vnd.oci.image.layer.v1.tar", []byte("layer one"), []byte("layer two"), []byte("layer three"))
+
+	var mu sync.Mutex
+	var arrivals []time.Time
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			mu.Lock()
+			arrivals = append(arrivals, time.Now())
+			mu.Unlock()
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	service.config.RegistryRateLimit = 20
+	service.config.RegistryRateBurst = 1
+
+	imageRef := server.Listener.Addr().String() + "/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	// Manifest, config and three layers at 20 requests/sec with no burst
+	// are spaced by about 50ms each
+	mu.Lock()
+	defer mu.Unlock()
+	if len(arrivals) != 5 {
+		t.Fatalf("got %d manifest and blob requests, want 5", len(arrivals))
+	}
+	for i := 1; i < len(arrivals); i++ {
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < 40*time.Millisecond {
+			t.Errorf("request %d arrived %v after the previous one, want at least 40ms", i, gap)
+		}
+	}
+}
+
+func TestImageService_RegistryRateLimitHonorsCancel(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("layer"))
+
+	service := newTestService(t, registry)
+	service.config.RegistryRateLimit = 0.01
+	service.config.RegistryRateBurst = 1
+
+	// Exhaust the burst so the next request must wait for minutes
+	service.registryLimiter(registry.host()).Allow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := service.PullImage(ctx, registry.host()+"/library/app:latest", nil)
+	if err == nil {
+		t.Fatal("PullImage() succeeded while rate limited past the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("PullImage() returned after %v, want it to stop at the deadline", elapsed)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// setRequestAuth attaches the credentials in auth to req, preferring a
+// registry token over basic credentials
+func setRequestAuth(req *http.Request, auth *runtime.AuthConfig) {
+	switch {
+	case auth == nil:
+	case auth.RegistryToken != "":
+		req.Header.Set("Authorization", "Bearer "+auth.RegistryToken)
+	case auth.Username != "" || auth.Password != "":
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+}
+
+// hasCredentials reports whether auth carries anything to authenticate with
+func hasCredentials(auth *runtime.AuthConfig) bool {
+	return auth != nil && (auth.Username != "" || auth.Password != "" || auth.RegistryToken != "")
+}
+
+// parseBearerChallenge extracts the parameters of a Bearer
+// WWW-Authenticate challenge, returning false for any other scheme
+func parseBearerChallenge(header string) (map[string]string, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			params[key] = value[1 : end+1]
+			rest = strings.TrimPrefix(value[end+2:], ",")
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+	return params, params["realm"] != ""
+}
+
+const (
+	// defaultTokenLifetime is how long a token without expires_in is
+	// valid, as in the distribution token specification
+	defaultTokenLifetime = 60 * time.Second
+	// tokenExpiryMargin is how long before it expires a cached token stops
+	// being used, so that it does not expire during a request
+	tokenExpiryMargin = 10 * time.Second
+)
+
+// tokenKey identifies the tokens a token endpoint issues for a scope to
+// an identity
+type tokenKey struct {
+	realm         string
+	service       string
+	scope         string
+	identityToken string
+}
+
+// cachedToken is a bearer token and when it stops being reused
+type cachedToken struct {
+	token  string
+	expiry time.Time
+}
+
+// fetchToken requests a pull token for repository from the token endpoint
+// named in a Bearer challenge. An identity token in auth is exchanged
+// through an OAuth2 refresh token grant; otherwise the token is requested
+// anonymously. Tokens are reused across requests until they expire.
+func (s *ImageService) fetchToken(ctx context.Context, challenge map[string]string, repository string, auth *runtime.AuthConfig) (string, error) {
+	req := TokenRequest{
+		Realm:         challenge["realm"],
+		Service:       challenge["service"],
+		Scope:         fmt.Sprintf("repository:%s:pull", repository),
+		IdentityToken: auth.GetIdentityToken(),
+	}
+	key := tokenKey{realm: req.Realm, service: req.Service, scope: req.Scope, identityToken: req.IdentityToken}
+	if token, ok := s.cachedToken(key); ok {
+		return token, nil
+	}
+
+	ctx, cancel := s.withRequestTimeout(ctx)
+	defer cancel()
+
+	token, err := s.registryClient().GetToken(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	s.cacheToken(key, token)
+	return token.Token, nil
+}
+
+// cachedToken returns the unexpired token cached under key
+func (s *ImageService) cachedToken(key tokenKey) (string, bool) {
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+
+	cached, ok := s.tokens[key]
+	if !ok {
+		return "", false
+	}
+	if !time.Now().Before(cached.expiry) {
+		delete(s.tokens, key)
+		return "", false
+	}
+	return cached.token, true
+}
+
+// cacheToken remembers token under key, unless it expires too soon to be
+// reused
+func (s *ImageService) cacheToken(key tokenKey, token *Token) {
+	lifetime := token.ExpiresIn
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	if lifetime <= tokenExpiryMargin {
+		return
+	}
+
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+
+	now := time.Now()
+	if s.tokens == nil {
+		s.tokens = make(map[tokenKey]cachedToken)
+	}
+	// Drop expired tokens so that the cache does not grow without bound
+	for k, cached := range s.tokens {
+		if !now.Before(cached.expiry) {
+			delete(s.tokens, k)
+		}
+	}
+	s.tokens[key] = cachedToken{token: token.Token, expiry: now.Add(lifetime - tokenExpiryMargin)}
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]string
+		ok     bool
+	}{
+		{
+			name:   "quoted parameters",
+			header: `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:library/app:pull"`,
+			want: map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "registry.example.com",
+				"scope":   "repository:library/app:pull",
+			},
+			ok: true,
+		},
+		{
+			name:   "unquoted parameters",
+			header: `bearer realm=https://auth.example.com/token, service=registry`,
+			want:   map[string]string{"realm": "https://auth.example.com/token", "service": "registry"},
+			ok:     true,
+		},
+		{name: "basic scheme", header: `Basic realm="registry"`},
+		{name: "missing realm", header: `Bearer service="registry"`, want: map[string]string{"service": "registry"}},
+		{name: "empty", header: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseBearerChallenge(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("parseBearerChallenge() ok = %v, want %v", ok, tt.ok)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBearerChallenge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageService_AnonymousTokenPull(t *testing.T) {
+	const token = "anonymous-pull-token"
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/public", "latest", []byte("public layer"))
+	registry.addImage(t, "library/private", "latest", []byte("private layer"))
+
+	// Every registry request needs a bearer token; the token endpoint only
+	// hands out anonymous tokens for public repositories
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.Header.Get("Authorization") != "" {
+				t.Errorf("token request carries credentials: %s", r.Header.Get("Authorization"))
+			}
+			if r.URL.Query().Get("scope") != "repository:library/public:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"token": %q}`, token)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	if _, err := service.PullImage(context.Background(), host+"/library/public:latest", nil); err != nil {
+		t.Fatalf("PullImage() of public image error = %v", err)
+	}
+	if !service.HasImage(host + "/library/public:latest") {
+		t.Error("public image not recorded")
+	}
+
+	if _, err := service.PullImage(context.Background(), host+"/library/private:latest", nil); err == nil {
+		t.Error("PullImage() of private image succeeded without credentials")
+	}
+}
+
+func TestImageService_IdentityTokenPull(t *testing.T) {
+	const (
+		identityToken = "refresh-token"
+		accessToken   = "exchanged-access-token"
+	)
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/private", "latest", []byte("private layer"))
+
+	// The token endpoint only exchanges the known refresh token
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.Method != http.MethodPost {
+				t.Errorf("token request method = %s, want POST", r.Method)
+			}
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("failed to parse token request: %v", err)
+			}
+			if r.PostForm.Get("grant_type") != "refresh_token" ||
+				r.PostForm.Get("refresh_token") != identityToken ||
+				r.PostForm.Get("scope") != "repository:library/private:pull" ||
+				r.PostForm.Get("service") != "test-registry" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token": %q}`, accessToken)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+accessToken {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	imageRef := host + "/library/private:latest"
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "valid identity token", token: identityToken},
+		{name: "rejected identity token", token: "stale-token", wantErr: ErrAuthFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(t, nil)
+			service.client = server.Client()
+
+			_, err := service.PullImage(context.Background(), imageRef, &runtime.AuthConfig{IdentityToken: tt.token})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("PullImage() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+			if !service.HasImage(imageRef) {
+				t.Error("image pulled with identity token not recorded")
+			}
+		})
+	}
+}
+
+func TestImageService_RegistryTokenPull(t *testing.T) {
+	const token = "pre-issued-token"
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/private", "latest", []byte("private layer"))
+
+	// Only the pre-issued token is accepted and the token endpoint must not
+	// be consulted
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			t.Error("token endpoint called despite a registry token")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/private:latest"
+
+	if _, err := service.PullImage(context.Background(), imageRef, &runtime.AuthConfig{RegistryToken: token}); err != nil {
+		t.Fatalf("PullImage() with registry token error = %v", err)
+	}
+	if !service.HasImage(imageRef) {
+		t.Error("image pulled with registry token not recorded")
+	}
+}
+
+func TestImageService_TokenCache(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("layer behind a token"))
+	registry.addImage(t, "library/app", "v2", []byte("next layer behind a token"))
+	registry.addImage(t, "library/other", "latest", []byte("layer of another repository"))
+
+	tests := []struct {
+		name      string
+		expiresIn int
+		// wantTokens is the token requests made by pulls of two tags of one
+		// repository followed by a pull of another
+		wantTokens int
+	}{
+		{name: "reused within lifetime", expiresIn: 300, wantTokens: 2},
+		{name: "default lifetime", wantTokens: 2},
+		{name: "too short to reuse", expiresIn: 5, wantTokens: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var scopes []string
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/token" {
+					scope := r.URL.Query().Get("scope")
+					mu.Lock()
+					scopes = append(scopes, scope)
+					mu.Unlock()
+					if tt.expiresIn > 0 {
+						fmt.Fprintf(w, `{"token": %q, "expires_in": %d}`, scope, tt.expiresIn)
+					} else {
+						fmt.Fprintf(w, `{"token": %q}`, scope)
+					}
+					return
+				}
+				if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer repository:") {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, r.Host))
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				registry.serveHTTP(w, r)
+			}))
+			defer server.Close()
+
+			service := newTestService(t, nil)
+			service.client = server.Client()
+			host := strings.TrimPrefix(server.URL, "https://")
+
+			for _, ref := range []string{"library/app:latest", "library/app:v2", "library/other:latest"} {
+				if _, err := service.PullImage(context.Background(), host+"/"+ref, nil); err != nil {
+					t.Fatalf("PullImage(%s) error = %v", ref, err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(scopes) != tt.wantTokens {
+				t.Errorf("token requests = %q, want %d", scopes, tt.wantTokens)
+			}
+			if last := scopes[len(scopes)-1]; last != "repository:library/other:pull" {
+				t.Errorf("last token scope = %q, want a token for the other repository", last)
+			}
+		})
+	}
+}
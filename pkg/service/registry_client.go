@@ -0,0 +1,442 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// tokenClientID identifies the service to token endpoints in OAuth2
+// refresh token grants
+const tokenClientID = "cri-image-service"
+
+// manifestMediaTypes are the manifest media types accepted from registries
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// manifestFallbackMediaTypes are requested one at a time, in order, from
+// registries that reject the manifestMediaTypes request or answer it with
+// a manifest that cannot be pulled
+var manifestFallbackMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// RegistryClient performs the requests the image service makes to
+// registries. URLs are absolute and auth may be nil.
+type RegistryClient interface {
+	// CheckV2 probes the registry API base at url, returning the response
+	// status code and WWW-Authenticate challenge
+	CheckV2(ctx context.Context, url string, auth *runtime.AuthConfig) (int, string, error)
+	// GetManifest fetches the raw manifest at url, accepting the given
+	// media types, or manifestMediaTypes when none are given
+	GetManifest(ctx context.Context, url string, auth *runtime.AuthConfig, mediaTypes []string) ([]byte, error)
+	// GetBlob opens the blob at url. A non-empty byteRange is sent as a
+	// Range header, which registries are free to ignore.
+	GetBlob(ctx context.Context, url string, auth *runtime.AuthConfig, byteRange string) (*Blob, error)
+	// GetToken requests a bearer token from a token endpoint
+	GetToken(ctx context.Context, req TokenRequest) (*Token, error)
+	// HeadManifest resolves the manifest at url to its digest without
+	// fetching its body
+	HeadManifest(ctx context.Context, url string, auth *runtime.AuthConfig) (string, error)
+	// GetTags fetches one page of the tag list at url, returning the URL of
+	// the next page or an empty string on the last one
+	GetTags(ctx context.Context, url string, auth *runtime.AuthConfig) ([]string, string, error)
+}
+
+// Blob is an open blob returned by RegistryClient.GetBlob
+type Blob struct {
+	Body io.ReadCloser
+	// Size is the length of Body, -1 when unknown
+	Size int64
+	// ContentRange is set in the form of a Content-Range header when Body
+	// holds only part of the blob
+	ContentRange string
+	// ContentType is the media type the registry declared for Body, empty
+	// when it declared none
+	ContentType string
+}
+
+// TokenRequest describes a token request answering a Bearer challenge
+type TokenRequest struct {
+	Realm   string
+	Service string
+	Scope   string
+	// IdentityToken, when set, is exchanged through an OAuth2 refresh token
+	// grant. Otherwise the token is requested anonymously.
+	IdentityToken string
+}
+
+// Token is a bearer token returned by RegistryClient.GetToken
+type Token struct {
+	Token string
+	// ExpiresIn is how long the token is valid for, zero when the token
+	// endpoint did not say
+	ExpiresIn time.Duration
+}
+
+// RegistryError reports a registry response with an unexpected status
+type RegistryError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *RegistryError) Error() string {
+	return e.Status
+}
+
+// registryStatus returns the status code carried by err, or 0 if it is not
+// a RegistryError
+func registryStatus(err error) int {
+	var registryErr *RegistryError
+	if errors.As(err, &registryErr) {
+		return registryErr.StatusCode
+	}
+	return 0
+}
+
+const (
+	// defaultMaxManifestSize bounds manifests when no limit is configured
+	defaultMaxManifestSize = 4 * 1024 * 1024
+	// maxTokenResponseSize bounds the responses of token endpoints
+	maxTokenResponseSize = 1024 * 1024
+)
+
+// httpRegistryClient is the RegistryClient speaking HTTP(S) to registries
+type httpRegistryClient struct {
+	client *http.Client
+	// userAgent is sent with every request, defaultUserAgent when empty
+	userAgent string
+	// maxManifestSize bounds decoded manifests in bytes,
+	// defaultMaxManifestSize when zero
+	maxManifestSize int64
+}
+
+// NewHTTPRegistryClient returns a RegistryClient sending its requests with
+// client
+func NewHTTPRegistryClient(client *http.Client) RegistryClient {
+	return &httpRegistryClient{client: client}
+}
+
+// do sends req, falling back to the default HTTP client. Redirects are
+// followed without the credentials of the registry unless they stay on its
+// host.
+func (c *httpRegistryClient) do(req *http.Request) (*http.Response, error) {
+	userAgent := c.userAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent()
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	redirecting := *client
+	redirecting.CheckRedirect = stripAuthOnRedirect(client.CheckRedirect)
+	return redirecting.Do(req)
+}
+
+// maxRedirects is how many redirects a request follows, as with the
+// default HTTP client
+const maxRedirects = 10
+
+// stripAuthOnRedirect returns a redirect policy dropping the Authorization
+// header when a redirect leaves the host first requested, such as a blob
+// redirected to a signed storage URL. The HTTP client keeps it for subdomains
+// of the registry, which need not be trusted with its credentials. next, if
+// set, is applied afterwards.
+func stripAuthOnRedirect(next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			req.Header.Del("Authorization")
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+}
+
+// get sends an authenticated GET request for url
+func (c *httpRegistryClient) get(ctx context.Context, url string, auth *runtime.AuthConfig, header http.Header) (*http.Response, error) {
+	return c.send(ctx, "GET", url, auth, header)
+}
+
+// send sends an authenticated request without body for url
+func (c *httpRegistryClient) send(ctx context.Context, method, url string, auth *runtime.AuthConfig, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	setRequestAuth(req, auth)
+	return c.do(req)
+}
+
+func (c *httpRegistryClient) CheckV2(ctx context.Context, url string, auth *runtime.AuthConfig) (int, string, error) {
+	resp, err := c.get(ctx, url, auth, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("WWW-Authenticate"), nil
+}
+
+// GetManifest allows registries to gzip the manifest in transit. Setting
+// Accept-Encoding keeps the transport from decoding it, so the encoding is
+// undone here and the manifest digest is computed over the decoded bytes.
+func (c *httpRegistryClient) GetManifest(ctx context.Context, url string, auth *runtime.AuthConfig, mediaTypes []string) ([]byte, error) {
+	if len(mediaTypes) == 0 {
+		mediaTypes = manifestMediaTypes
+	}
+	resp, err := c.get(ctx, url, auth, http.Header{
+		"Accept":          {strings.Join(mediaTypes, ", ")},
+		"Accept-Encoding": {"gzip"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RegistryError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var body io.Reader = resp.Body
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode manifest: %v", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported manifest content encoding %q", encoding)
+	}
+
+	// The limit applies after decoding, so compression cannot hide a
+	// huge manifest
+	limit := c.maxManifestSize
+	if limit <= 0 {
+		limit = defaultMaxManifestSize
+	}
+	data, err := readLimited(body, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return data, nil
+}
+
+// readLimited reads r to EOF, failing once more than limit bytes arrive
+// rather than buffering an unbounded response
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("response exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+func (c *httpRegistryClient) HeadManifest(ctx context.Context, url string, auth *runtime.AuthConfig) (string, error) {
+	resp, err := c.send(ctx, "HEAD", url, auth, http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &RegistryError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	dgst := resp.Header.Get("Docker-Content-Digest")
+	if dgst == "" {
+		return "", fmt.Errorf("registry returned no Docker-Content-Digest header")
+	}
+	return dgst, nil
+}
+
+// GetBlob asks for blobs without transfer encoding so that their bytes,
+// and byte ranges into them, match the digest. A registry that encodes
+// them anyway is served as is and fails digest verification.
+func (c *httpRegistryClient) GetBlob(ctx context.Context, url string, auth *runtime.AuthConfig, byteRange string) (*Blob, error) {
+	header := http.Header{"Accept-Encoding": {"identity"}}
+	if byteRange != "" {
+		header.Set("Range", byteRange)
+	}
+	resp, err := c.get(ctx, url, auth, header)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := &Blob{Body: resp.Body, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		blob.ContentRange = resp.Header.Get("Content-Range")
+	default:
+		resp.Body.Close()
+		return nil, &RegistryError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return blob, nil
+}
+
+func (c *httpRegistryClient) GetTags(ctx context.Context, rawURL string, auth *runtime.AuthConfig) ([]string, string, error) {
+	resp, err := c.get(ctx, rawURL, auth, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &RegistryError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, "", fmt.Errorf("failed to decode tag list: %v", err)
+	}
+
+	next, err := nextLink(resp.Request.URL, resp.Header.Values("Link"))
+	if err != nil {
+		return nil, "", err
+	}
+	return body.Tags, next, nil
+}
+
+// nextLink returns the absolute URL of the RFC 5988 rel="next" link among
+// the Link header values, resolved against base, or an empty string
+func nextLink(base *url.URL, links []string) (string, error) {
+	for _, header := range links {
+		for _, link := range strings.Split(header, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			isNext := false
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && strings.Trim(value, `"`) == "next" {
+					isNext = true
+				}
+			}
+			if !isNext {
+				continue
+			}
+			ref, err := url.Parse(target[1 : len(target)-1])
+			if err != nil {
+				return "", fmt.Errorf("invalid next link %q: %v", target, err)
+			}
+			return base.ResolveReference(ref).String(), nil
+		}
+	}
+	return "", nil
+}
+
+func (c *httpRegistryClient) GetToken(ctx context.Context, tr TokenRequest) (*Token, error) {
+	tokenURL, err := url.Parse(tr.Realm)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token realm %q: %v", tr.Realm, err)
+	}
+
+	var req *http.Request
+	if tr.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", tr.IdentityToken)
+		form.Set("client_id", tokenClientID)
+		form.Set("scope", tr.Scope)
+		if tr.Service != "" {
+			form.Set("service", tr.Service)
+		}
+		req, err = http.NewRequestWithContext(ctx, "POST", tokenURL.String(), strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		query := tokenURL.Query()
+		if tr.Service != "" {
+			query.Set("service", tr.Service)
+		}
+		query.Set("scope", tr.Scope)
+		tokenURL.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, "GET", tokenURL.String(), nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %v", err)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request rejected: %s", resp.Status)
+	}
+
+	data, err := readLimited(resp.Body, maxTokenResponseSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %v", err)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.Token == "" {
+		return nil, fmt.Errorf("token response carries no token")
+	}
+	token := &Token{Token: body.Token}
+	if body.ExpiresIn > 0 {
+		token.ExpiresIn = time.Duration(body.ExpiresIn) * time.Second
+	}
+	return token, nil
+}
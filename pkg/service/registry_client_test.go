@@ -0,0 +1,499 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeRegistryClient is an in-memory RegistryClient serving the content of
+// a testRegistry without any network traffic
+type fakeRegistryClient struct {
+	registry *testRegistry
+
+	mu       sync.Mutex
+	requests []string // "<method> <path>" in arrival order
+}
+
+// newFakeRegistryClient returns a fake client and the registry whose images
+// it serves
+func newFakeRegistryClient() (*fakeRegistryClient, *testRegistry) {
+	registry := &testRegistry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[string][]byte),
+		hits:      make(map[string]int),
+	}
+	return &fakeRegistryClient{registry: registry}, registry
+}
+
+func (c *fakeRegistryClient) record(method, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, method+" "+u.Path)
+	c.mu.Unlock()
+	return u.Path
+}
+
+func (c *fakeRegistryClient) CheckV2(ctx context.Context, rawURL string, auth *runtime.AuthConfig) (int, string, error) {
+	c.record("CheckV2", rawURL)
+	return http.StatusOK, "", nil
+}
+
+func (c *fakeRegistryClient) GetManifest(ctx context.Context, rawURL string, auth *runtime.AuthConfig, mediaTypes []string) ([]byte, error) {
+	if manifest, found := c.manifest(c.record("GetManifest", rawURL)); found {
+		return manifest, nil
+	}
+	return nil, &RegistryError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+}
+
+// manifest looks up the manifest served at path
+func (c *fakeRegistryClient) manifest(path string) ([]byte, bool) {
+	repo, tag, ok := strings.Cut(strings.TrimPrefix(path, "/v2/"), "/manifests/")
+	if !ok {
+		return nil, false
+	}
+	c.registry.mu.Lock()
+	defer c.registry.mu.Unlock()
+	manifest, found := c.registry.manifests[repo+":"+tag]
+	return manifest, found
+}
+
+func (c *fakeRegistryClient) GetBlob(ctx context.Context, rawURL string, auth *runtime.AuthConfig, byteRange string) (*Blob, error) {
+	path := c.record("GetBlob", rawURL)
+	if i := strings.Index(path, "/blobs/"); i > 0 {
+		c.registry.mu.Lock()
+		blob, found := c.registry.blobs[path[i+len("/blobs/"):]]
+		c.registry.mu.Unlock()
+		if found {
+			return &Blob{Body: io.NopCloser(bytes.NewReader(blob)), Size: int64(len(blob))}, nil
+		}
+	}
+	return nil, &RegistryError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+}
+
+func (c *fakeRegistryClient) HeadManifest(ctx context.Context, rawURL string, auth *runtime.AuthConfig) (string, error) {
+	if manifest, found := c.manifest(c.record("HeadManifest", rawURL)); found {
+		return digest.FromBytes(manifest).String(), nil
+	}
+	return "", &RegistryError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+}
+
+func (c *fakeRegistryClient) GetTags(ctx context.Context, rawURL string, auth *runtime.AuthConfig) ([]string, string, error) {
+	c.record("GetTags", rawURL)
+	return nil, "", &RegistryError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+}
+
+func (c *fakeRegistryClient) GetToken(ctx context.Context, req TokenRequest) (*Token, error) {
+	c.record("GetToken", req.Realm)
+	return &Token{Token: "fake-token"}, nil
+}
+
+func TestImageService_PullWithFakeRegistryClient(t *testing.T) {
+	client, registry := newFakeRegistryClient()
+	registry.addImage(t, "library/app", "latest", []byte("layer served from memory"))
+	registry.manifests["library/broken:latest"] = []byte("not json")
+
+	service := newTestService(t, nil)
+	service.registry = client
+
+	// The host is never resolved, every request goes through the fake
+	imageRef := "registry.invalid/library/app:latest"
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	if !service.HasImage(imageRef) {
+		t.Error("image pulled through the fake client is not present")
+	}
+
+	client.mu.Lock()
+	requests := append([]string(nil), client.requests...)
+	client.mu.Unlock()
+	want := []string{
+		"CheckV2 /v2/",
+		"GetManifest /v2/library/app/manifests/latest",
+	}
+	if len(requests) < len(want)+2 {
+		t.Fatalf("requests = %v, want a check, the manifest, the config and the layer", requests)
+	}
+	for i, request := range want {
+		if requests[i] != request {
+			t.Errorf("request %d = %q, want %q", i, requests[i], request)
+		}
+	}
+	for _, request := range requests[len(want):] {
+		if !strings.HasPrefix(request, "GetBlob /v2/library/app/blobs/") {
+			t.Errorf("unexpected request %q", request)
+		}
+	}
+
+	// Registry errors surface like HTTP ones
+	if _, err := service.PullImage(context.Background(), "registry.invalid/library/missing:latest", nil); err == nil {
+		t.Error("PullImage() of a missing image succeeded")
+	}
+	if _, err := service.PullImage(context.Background(), "registry.invalid/library/broken:latest", nil); err == nil {
+		t.Error("PullImage() of an invalid manifest succeeded")
+	}
+}
+
+func TestImageService_PullGzipEncodedManifest(t *testing.T) {
+	registry := newTestRegistry(t)
+	want := registry.addImage(t, "library/app", "latest", []byte("layer behind a compressing registry"))
+
+	// Compress manifests in transit and record how blobs are asked for
+	var mu sync.Mutex
+	var manifestEncodings, blobEncodings []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/manifests/"):
+			mu.Lock()
+			manifestEncodings = append(manifestEncodings, r.Header.Get("Accept-Encoding"))
+			mu.Unlock()
+			rec := httptest.NewRecorder()
+			registry.serveHTTP(rec, r)
+			for key, values := range rec.Header() {
+				w.Header()[key] = values
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(rec.Code)
+			zw := gzip.NewWriter(w)
+			zw.Write(rec.Body.Bytes())
+			zw.Close()
+			return
+		case strings.Contains(r.URL.Path, "/blobs/"):
+			mu.Lock()
+			blobEncodings = append(blobEncodings, r.Header.Get("Accept-Encoding"))
+			mu.Unlock()
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service := newTestService(t, nil)
+	service.client = server.Client()
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+
+	if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+	service.mu.RLock()
+	got := service.images[imageRef].Digest
+	service.mu.RUnlock()
+	if got != want.String() {
+		t.Errorf("image digest = %s, want the digest of the decoded manifest %s", got, want)
+	}
+
+	if len(manifestEncodings) == 0 || manifestEncodings[0] != "gzip" {
+		t.Errorf("manifest Accept-Encoding = %v, want gzip", manifestEncodings)
+	}
+	if len(blobEncodings) == 0 {
+		t.Fatal("no blobs were requested")
+	}
+	for _, encoding := range blobEncodings {
+		if encoding != "identity" {
+			t.Errorf("blob Accept-Encoding = %q, want identity", encoding)
+		}
+	}
+}
+
+func TestImageService_UserAgent(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("layer fetched with a user agent"))
+
+	// Require a bearer token so the token endpoint is exercised too
+	var mu sync.Mutex
+	userAgents := make(map[string][]string)
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := "other"
+		switch {
+		case r.URL.Path == "/token":
+			kind = "token"
+		case strings.Contains(r.URL.Path, "/manifests/"):
+			kind = "manifest"
+		case strings.Contains(r.URL.Path, "/blobs/"):
+			kind = "blob"
+		}
+		mu.Lock()
+		userAgents[kind] = append(userAgents[kind], r.Header.Get("User-Agent"))
+		mu.Unlock()
+
+		if kind == "token" {
+			w.Write([]byte(`{"token": "secret"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{name: "configured", userAgent: "kubelet-helper/1.2", want: "kubelet-helper/1.2"},
+		{name: "default", want: "cri-image-service/" + Version},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			clear(userAgents)
+			mu.Unlock()
+
+			service := newTestService(t, nil)
+			service.client = server.Client()
+			service.config.UserAgent = tt.userAgent
+			imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+			if _, err := service.PullImage(context.Background(), imageRef, nil); err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, kind := range []string{"manifest", "blob", "token"} {
+				if len(userAgents[kind]) == 0 {
+					t.Errorf("no %s requests were made", kind)
+				}
+				for _, got := range userAgents[kind] {
+					if got != tt.want {
+						t.Errorf("%s request User-Agent = %q, want %q", kind, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestImageService_ManifestSizeLimit(t *testing.T) {
+	const limit = 1024
+
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/small", "latest", []byte("layer of a small manifest"))
+	registry.addImage(t, "library/huge", "latest", []byte("layer of a huge manifest"))
+	// Whitespace keeps the padded manifest valid JSON
+	registry.manifests["library/huge:latest"] = append(registry.manifests["library/huge:latest"], bytes.Repeat([]byte(" "), 2*limit)...)
+
+	tests := []struct {
+		name    string
+		repo    string
+		gzip    bool
+		wantErr bool
+	}{
+		{name: "within limit", repo: "library/small"},
+		{name: "oversized", repo: "library/huge", wantErr: true},
+		{name: "oversized once decompressed", repo: "library/huge", gzip: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.gzip || !strings.Contains(r.URL.Path, "/manifests/") {
+					registry.serveHTTP(w, r)
+					return
+				}
+				rec := httptest.NewRecorder()
+				registry.serveHTTP(rec, r)
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(gzipBytes(t, rec.Body.Bytes()))
+			}))
+			defer server.Close()
+
+			service := newTestService(t, nil)
+			service.client = server.Client()
+			service.config.MaxManifestSize = limit
+			imageRef := strings.TrimPrefix(server.URL, "https://") + "/" + tt.repo + ":latest"
+
+			_, err := service.PullImage(context.Background(), imageRef, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PullImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "exceeds") {
+				t.Errorf("PullImage() error = %v, want it to report the size limit", err)
+			}
+		})
+	}
+}
+
+func TestHTTPRegistryClient_TokenSizeLimit(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"token": %q}`, strings.Repeat("t", maxTokenResponseSize))
+	}))
+	defer server.Close()
+
+	client := NewHTTPRegistryClient(server.Client())
+	_, err := client.GetToken(context.Background(), TokenRequest{Realm: server.URL + "/token"})
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("GetToken() error = %v, want the oversized response rejected", err)
+	}
+}
+
+func TestImageService_ManifestMediaTypeFallback(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("layer behind a picky registry"))
+
+	combined := strings.Join(manifestMediaTypes, ", ")
+	ociIndex := manifestFallbackMediaTypes[0]
+	ociManifest := manifestFallbackMediaTypes[1]
+
+	tests := []struct {
+		name        string
+		accepted    string // the only Accept header answered, "" for none
+		repo        string
+		wantErr     string
+		wantAccepts []string
+	}{
+		{
+			name:        "second media type succeeds",
+			accepted:    ociManifest,
+			repo:        "library/app",
+			wantAccepts: []string{combined, ociIndex, ociManifest},
+		},
+		{
+			name:        "combined request succeeds",
+			accepted:    combined,
+			repo:        "library/app",
+			wantAccepts: []string{combined},
+		},
+		{
+			name:        "no media type succeeds",
+			repo:        "library/app",
+			wantErr:     "no usable manifest",
+			wantAccepts: append([]string{combined}, manifestFallbackMediaTypes...),
+		},
+		{
+			name:        "missing manifest is not retried",
+			accepted:    combined,
+			repo:        "library/missing",
+			wantErr:     "not found",
+			wantAccepts: []string{combined},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var accepts []string
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.Path, "/manifests/") {
+					mu.Lock()
+					accepts = append(accepts, r.Header.Get("Accept"))
+					mu.Unlock()
+					if r.Header.Get("Accept") != tt.accepted {
+						w.WriteHeader(http.StatusNotAcceptable)
+						return
+					}
+				}
+				registry.serveHTTP(w, r)
+			}))
+			defer server.Close()
+
+			service := newTestService(t, nil)
+			service.client = server.Client()
+			imageRef := strings.TrimPrefix(server.URL, "https://") + "/" + tt.repo + ":latest"
+
+			_, err := service.PullImage(context.Background(), imageRef, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("PullImage() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("PullImage() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(accepts, tt.wantAccepts) {
+				t.Errorf("manifest Accept headers = %q, want %q", accepts, tt.wantAccepts)
+			}
+		})
+	}
+}
+
+func TestImageService_BlobRedirectDropsAuthorization(t *testing.T) {
+	registry := newPlainTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("layer in signed storage"))
+
+	// The registry sends blobs to a storage host below its own domain,
+	// which the HTTP client would otherwise trust with its credentials
+	const registryHost, storageHost = "registry.test", "storage.registry.test"
+	var mu sync.Mutex
+	authByHost := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			mu.Lock()
+			authByHost[r.Host] = append(authByHost[r.Host], r.Header.Get("Authorization"))
+			mu.Unlock()
+			if r.Host == registryHost {
+				http.Redirect(w, r, "http://"+storageHost+r.URL.Path, http.StatusTemporaryRedirect)
+				return
+			}
+		}
+		registry.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// Every host resolves to the test server
+	service := newTestService(t, nil)
+	service.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+	service.config.InsecureRegistries = []string{registryHost}
+
+	auth := &runtime.AuthConfig{Username: "user", Password: "secret"}
+	if _, err := service.PullImage(context.Background(), registryHost+"/library/app:latest", auth); err != nil {
+		t.Fatalf("PullImage() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(authByHost[registryHost]) == 0 || len(authByHost[storageHost]) == 0 {
+		t.Fatalf("blob requests by host = %v, want requests to both hosts", authByHost)
+	}
+	for _, got := range authByHost[registryHost] {
+		if got == "" {
+			t.Error("blob request to the registry was not authenticated")
+		}
+	}
+	for _, got := range authByHost[storageHost] {
+		if got != "" {
+			t.Errorf("redirected blob request carried Authorization %q", got)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2025 ChengyuZhu6 <hudson@cyzhu.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTLSService returns a test service reaching registries with a transport
+// built from config
+func newTLSService(t *testing.T, config Config) *ImageService {
+	t.Helper()
+
+	tr, err := newTransport(config)
+	if err != nil {
+		t.Fatalf("newTransport() error = %v", err)
+	}
+	service := newTestService(t, nil)
+	service.client = &http.Client{Transport: tr}
+	return service
+}
+
+// serverCAPEM returns the PEM encoded certificate of a TLS test server
+func serverCAPEM(server *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+}
+
+func TestImageService_TLSCustomCA(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.addImage(t, "library/app", "latest", []byte("layer served over verified TLS"))
+	imageRef := registry.host() + "/library/app:latest"
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, serverCAPEM(registry.server), 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:    "unknown CA",
+			config:  Config{},
+			wantErr: true,
+		},
+		{
+			name:   "CA data",
+			config: Config{TLSCAData: serverCAPEM(registry.server)},
+		},
+		{
+			name:   "CA file",
+			config: Config{TLSCAFile: caFile},
+		},
+		{
+			name:   "insecure skip verify",
+			config: Config{InsecureSkipVerify: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTLSService(t, tt.config)
+			_, err := service.PullImage(context.Background(), imageRef, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("PullImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageService_TLSClientCertificate(t *testing.T) {
+	// Self-signed client certificate, trusted by the registry as its own CA
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "image-service"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	_, registry := newFakeRegistryClient()
+	registry.addImage(t, "library/app", "latest", []byte("layer served over mutual TLS"))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(registry.serveHTTP))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	imageRef := strings.TrimPrefix(server.URL, "https://") + "/library/app:latest"
+
+	withoutCert := newTLSService(t, Config{TLSCAData: serverCAPEM(server)})
+	if _, err := withoutCert.PullImage(context.Background(), imageRef, nil); err == nil {
+		t.Error("PullImage() without client certificate succeeded")
+	}
+
+	withCert := newTLSService(t, Config{
+		TLSCAData:         serverCAPEM(server),
+		TLSClientCertFile: certFile,
+		TLSClientKeyFile:  keyFile,
+	})
+	if _, err := withCert.PullImage(context.Background(), imageRef, nil); err != nil {
+		t.Errorf("PullImage() with client certificate error = %v", err)
+	}
+}
+
+func TestNewTLSConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{
+			name:   "missing CA file",
+			config: Config{TLSCAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		},
+		{
+			name:   "CA data without certificates",
+			config: Config{TLSCAData: []byte("not a certificate")},
+		},
+		{
+			name:   "client certificate without key",
+			config: Config{TLSClientCertFile: "client.pem"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTLSConfig(tt.config); err == nil {
+				t.Error("newTLSConfig() should fail")
+			}
+		})
+	}
+}